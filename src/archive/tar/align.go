@@ -0,0 +1,63 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"fmt"
+	"strings"
+)
+
+// paxPadding is the key of the PAX record that pads the extended header of
+// an entry such that its data is aligned as requested by DataAlignment.
+// Its value is meaningless.
+const paxPadding = "GO.padding"
+
+// alignHeader returns hdr, or a copy of it with a padding record such
+// that the data of the entry, to be written at the current offset, begins
+// at a multiple of tw.DataAlignment.
+func (tw *Writer) alignHeader(hdr *Header, sp []SparseEntry) (*Header, error) {
+	align := tw.DataAlignment
+	if align%blockSize != 0 {
+		return nil, fmt.Errorf("archive/tar: DataAlignment %d is not a multiple of %d", align, blockSize)
+	}
+	if hdr.Size <= 0 || isHeaderOnlyType(hdr.Typeflag) {
+		return hdr, nil
+	}
+
+	// dataOffset returns the offset at which the data of h would begin.
+	dataOffset := func(h *Header) (int64, bool) {
+		ew := tw.encoder()
+		ew.off, ew.raw = tw.off, true
+		if err := ew.writeHeader(h, sp); err != nil {
+			return 0, false
+		}
+		return ew.off - (ew.size - ew.nb), true // Before any sparse map
+	}
+	off, ok := dataOffset(hdr)
+	if !ok || off%align == 0 {
+		return hdr, nil // Any error is reported when the header is written
+	}
+
+	// Growing the padding record by a multiple of 512 bytes grows the
+	// extended header by as many blocks, unless the length of the record
+	// gains a digit, in which case another attempt is needed.
+	h := *hdr
+	h.PAXRecords = copyRecords(hdr.PAXRecords)
+	if h.PAXRecords == nil {
+		h.PAXRecords = make(map[string]string)
+	}
+	n := 1
+	for i := 0; i < 4; i++ {
+		h.PAXRecords[paxPadding] = strings.Repeat("0", n)
+		if off, ok = dataOffset(&h); !ok {
+			return hdr, nil // Cannot be written in the PAX format
+		}
+		if off%align == 0 {
+			return &h, nil
+		}
+		n += int(align - off%align)
+	}
+	return hdr, nil // Should never happen
+}
@@ -0,0 +1,132 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// APKSignaturePrefix is the prefix of the names of the entries of the
+// signature segment of an Alpine APK package, such as
+// ".SIGN.RSA.builder.rsa.pub".
+const APKSignaturePrefix = ".SIGN."
+
+// An APKSignature is an entry of the signature segment of an APK package,
+// which holds a signature of the control segment that follows it.
+type APKSignature struct {
+	Name string // Name of the entry, which begins with APKSignaturePrefix
+	Data []byte // Signature
+}
+
+// SplitAPK splits off the signature segment at the start of the APK
+// package read from r. An APK package is a concatenation of gzip streams:
+// the signature segment, if the package is signed, the control segment,
+// and the data segment. The first two each hold a tar archive without
+// the end-of-archive trailer, such that the tar streams join up when the
+// gzip streams are decompressed together.
+//
+// If the first gzip stream holds only entries whose names begin with
+// APKSignaturePrefix, SplitAPK returns them along with a reader for the
+// remaining gzip streams. Otherwise, the package is not signed, and
+// SplitAPK returns no signatures and a reader for the whole package.
+func SplitAPK(r io.Reader) (sigs []APKSignature, rest io.Reader, err error) {
+	br, ok := r.(*bufio.Reader)
+	if !ok {
+		br = bufio.NewReader(r)
+	}
+
+	// Decompress the first gzip stream, keeping its compressed bytes.
+	// The gzip.Reader reads no further than the stream, since it reads
+	// from an io.ByteReader.
+	tee := &byteTeeReader{r: br}
+	zr, err := gzip.NewReader(tee)
+	if err != nil {
+		return nil, nil, err
+	}
+	zr.Multistream(false)
+	segment, err := ioutil.ReadAll(zr)
+	if err != nil {
+		return nil, nil, err
+	}
+	whole := io.MultiReader(bytes.NewReader(tee.buf.Bytes()), br)
+
+	tr := NewReader(bytes.NewReader(segment))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil || !strings.HasPrefix(hdr.Name, APKSignaturePrefix) ||
+			(hdr.Typeflag != TypeReg && hdr.Typeflag != TypeRegA) {
+			return nil, whole, nil
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			return nil, whole, nil
+		}
+		sigs = append(sigs, APKSignature{Name: hdr.Name, Data: data})
+	}
+	if len(sigs) == 0 {
+		return nil, whole, nil
+	}
+	return sigs, br, nil
+}
+
+// WriteAPKSignatures writes to w the signature segment of an APK package
+// holding sigs, as a gzip stream holding a tar archive without the
+// end-of-archive trailer, as abuild-sign does. The control segment and
+// the data segment must then follow it.
+func WriteAPKSignatures(w io.Writer, sigs []APKSignature) error {
+	zw, err := gzip.NewWriterLevel(w, gzip.BestCompression)
+	if err != nil {
+		return err
+	}
+	tw := NewWriter(zw)
+	tw.OmitTrailer = true
+	for _, sig := range sigs {
+		hdr := &Header{
+			Typeflag: TypeReg,
+			Name:     sig.Name,
+			Mode:     0644,
+			Uname:    "root",
+			Gname:    "root",
+			Size:     int64(len(sig.Data)),
+			ModTime:  time.Unix(0, 0),
+		}
+		if err := tw.WriteFile(hdr, bytes.NewReader(sig.Data)); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// A byteTeeReader is an io.ByteReader that records what is read from r.
+type byteTeeReader struct {
+	r   *bufio.Reader
+	buf bytes.Buffer
+}
+
+func (t *byteTeeReader) Read(b []byte) (int, error) {
+	n, err := t.r.Read(b)
+	t.buf.Write(b[:n])
+	return n, err
+}
+
+func (t *byteTeeReader) ReadByte() (byte, error) {
+	c, err := t.r.ReadByte()
+	if err == nil {
+		t.buf.WriteByte(c)
+	}
+	return c, err
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"path"
+	"strings"
+)
+
+// AppleDoublePrefix is the prefix of the base names of the companion
+// entries in which the tar of macOS stores the resource fork and Finder
+// information of a file, in the AppleDouble format, such that "dir/._file"
+// holds those of "dir/file" and precedes it in the archive.
+const AppleDoublePrefix = "._"
+
+// IDs of the entries of an AppleDouble file, as defined by RFC 1740.
+const (
+	appleDoubleResourceFork = 2
+	appleDoubleFinderInfo   = 9
+)
+
+const (
+	appleDoubleMagic   = 0x00051607
+	appleDoubleVersion = 0x00020000
+	appleDoubleHeader  = 26 // Size of the header before the entry descriptors
+	finderInfoSize     = 32
+)
+
+var errAppleDouble = errors.New("archive/tar: invalid AppleDouble data")
+
+// appleDoubleName returns the name of the AppleDouble entry of the entry
+// named name.
+func appleDoubleName(name string) string {
+	dir, base := path.Split(strings.TrimSuffix(name, "/"))
+	return dir + AppleDoublePrefix + base
+}
+
+// encodeAppleDouble returns an AppleDouble file holding the given Finder
+// information and resource fork, either of which may be empty.
+func encodeAppleDouble(finderInfo, rsrc []byte) []byte {
+	type entry struct {
+		id   uint32
+		data []byte
+	}
+	var entries []entry
+	if len(finderInfo) > 0 {
+		entries = append(entries, entry{appleDoubleFinderInfo, finderInfo})
+	}
+	if len(rsrc) > 0 {
+		entries = append(entries, entry{appleDoubleResourceFork, rsrc})
+	}
+	off := appleDoubleHeader + 12*len(entries)
+	b := make([]byte, off, off+len(finderInfo)+len(rsrc))
+	binary.BigEndian.PutUint32(b[0:], appleDoubleMagic)
+	binary.BigEndian.PutUint32(b[4:], appleDoubleVersion)
+	copy(b[8:24], "Mac OS X        ")
+	binary.BigEndian.PutUint16(b[24:], uint16(len(entries)))
+	for i, e := range entries {
+		d := b[appleDoubleHeader+12*i:]
+		binary.BigEndian.PutUint32(d[0:], e.id)
+		binary.BigEndian.PutUint32(d[4:], uint32(len(b)))
+		binary.BigEndian.PutUint32(d[8:], uint32(len(e.data)))
+		b = append(b, e.data...)
+	}
+	return b
+}
+
+// decodeAppleDouble returns the Finder information and resource fork held
+// by the AppleDouble file b. Entries of other types are ignored.
+func decodeAppleDouble(b []byte) (finderInfo, rsrc []byte, err error) {
+	if len(b) < appleDoubleHeader || binary.BigEndian.Uint32(b[0:]) != appleDoubleMagic ||
+		binary.BigEndian.Uint32(b[4:]) != appleDoubleVersion {
+		return nil, nil, errAppleDouble
+	}
+	n := int(binary.BigEndian.Uint16(b[24:]))
+	if len(b) < appleDoubleHeader+12*n {
+		return nil, nil, errAppleDouble
+	}
+	for i := 0; i < n; i++ {
+		d := b[appleDoubleHeader+12*i:]
+		off, size := uint64(binary.BigEndian.Uint32(d[4:])), uint64(binary.BigEndian.Uint32(d[8:]))
+		if off+size > uint64(len(b)) {
+			return nil, nil, errAppleDouble
+		}
+		data := b[off : off+size]
+		switch binary.BigEndian.Uint32(d[0:]) {
+		case appleDoubleFinderInfo:
+			// The tar of macOS stores extended attributes after the
+			// Finder information in the same entry.
+			if len(data) > finderInfoSize {
+				data = data[:finderInfoSize]
+			}
+			finderInfo = data
+		case appleDoubleResourceFork:
+			rsrc = data
+		}
+	}
+	return finderInfo, rsrc, nil
+}
+
+// ApplyAppleDouble sets the Finder information and resource fork stored in
+// the AppleDouble file read from r, which is typically the contents of the
+// entry preceding that of the file at name and named as its companion with
+// AppleDoublePrefix, on the file at name. It reports an error if r does not
+// hold an AppleDouble file. On systems other than macOS, the data is only
+// checked.
+func ApplyAppleDouble(name string, r io.Reader) error {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	finderInfo, rsrc, err := decodeAppleDouble(b)
+	if err != nil {
+		return err
+	}
+	return writeAppleMetadata(name, finderInfo, rsrc)
+}
@@ -0,0 +1,102 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Names of the extended attributes holding the Finder information and
+// resource fork of a file on macOS.
+const (
+	xattrFinderInfo   = "com.apple.FinderInfo"
+	xattrResourceFork = "com.apple.ResourceFork"
+)
+
+const xattrNoFollow = 0x0001 // XATTR_NOFOLLOW
+
+// readAppleMetadata returns the Finder information and resource fork of
+// the file at name, either of which is empty if the file has none.
+// It is a variable so that tests may replace it.
+var readAppleMetadata = func(name string) (finderInfo, rsrc []byte, err error) {
+	if finderInfo, err = getxattr(name, xattrFinderInfo); err != nil {
+		return nil, nil, err
+	}
+	if rsrc, err = getxattr(name, xattrResourceFork); err != nil {
+		return nil, nil, err
+	}
+	return finderInfo, rsrc, nil
+}
+
+// writeAppleMetadata sets the Finder information and resource fork of the
+// file at name, unless they are empty.
+func writeAppleMetadata(name string, finderInfo, rsrc []byte) error {
+	if len(finderInfo) > 0 {
+		if err := setxattr(name, xattrFinderInfo, finderInfo); err != nil {
+			return err
+		}
+	}
+	if len(rsrc) > 0 {
+		return setxattr(name, xattrResourceFork, rsrc)
+	}
+	return nil
+}
+
+// getxattr returns the value of the extended attribute attr of the file at
+// name, or nil if it has none or the file system does not support them.
+func getxattr(name, attr string) ([]byte, error) {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return nil, err
+	}
+	var buf []byte
+	for {
+		var bp unsafe.Pointer
+		if len(buf) > 0 {
+			bp = unsafe.Pointer(&buf[0])
+		}
+		n, _, errno := syscall.Syscall6(syscall.SYS_GETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)),
+			uintptr(bp), uintptr(len(buf)), 0, xattrNoFollow)
+		switch {
+		case errno == syscall.ENOATTR || errno == syscall.ENOTSUP:
+			return nil, nil
+		case errno == syscall.ERANGE:
+			buf = nil // The attribute grew; query its size again
+		case errno != 0:
+			return nil, &os.PathError{Op: "getxattr", Path: name, Err: errno}
+		case buf == nil:
+			if n == 0 {
+				return nil, nil
+			}
+			buf = make([]byte, n)
+		default:
+			return buf[:n], nil
+		}
+	}
+}
+
+// setxattr sets the extended attribute attr of the file at name to value.
+func setxattr(name, attr string, value []byte) error {
+	p, err := syscall.BytePtrFromString(name)
+	if err != nil {
+		return err
+	}
+	a, err := syscall.BytePtrFromString(attr)
+	if err != nil {
+		return err
+	}
+	_, _, errno := syscall.Syscall6(syscall.SYS_SETXATTR, uintptr(unsafe.Pointer(p)), uintptr(unsafe.Pointer(a)),
+		uintptr(unsafe.Pointer(&value[0])), uintptr(len(value)), 0, xattrNoFollow)
+	if errno != 0 {
+		return &os.PathError{Op: "setxattr", Path: name, Err: errno}
+	}
+	return nil
+}
@@ -0,0 +1,13 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !darwin
+
+package tar
+
+// readAppleMetadata returns no Finder information or resource fork, which
+// only files on macOS have. It is a variable so that tests may replace it.
+var readAppleMetadata = func(name string) (finderInfo, rsrc []byte, err error) { return nil, nil, nil }
+
+func writeAppleMetadata(name string, finderInfo, rsrc []byte) error { return nil }
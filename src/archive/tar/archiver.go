@@ -0,0 +1,211 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// maxArchiverBuffer is the size of the largest file that a worker of an
+// Archiver reads into memory. Larger files are read again when written.
+const maxArchiverBuffer = 1 << 20
+
+// An Archiver writes files to an archive, reading and hashing them with a
+// pool of goroutines while the entries are written to the Writer, in order,
+// by the calling goroutine. The output is the same as if each file was
+// read and written in turn.
+type Archiver struct {
+	// Workers is the number of files that are read concurrently.
+	// If zero, runtime.NumCPU is used.
+	Workers int
+
+	// Digest, if not empty, names a digest algorithm, as for
+	// Header.SetDigest, with which the digest of each regular file is
+	// recorded in its header.
+	Digest string
+
+	// ModifiedAfter, if not zero, causes only the files and symbolic links
+	// that were last modified after it to be written, as for an incremental
+	// backup. Directories are written regardless, so that their metadata
+	// may be restored along with any of their contents.
+	ModifiedAfter time.Time
+
+	// AppleDouble causes the resource fork and Finder information of each
+	// file that has them to be written, as by the tar of macOS, in an
+	// AppleDouble entry named with AppleDoublePrefix before the entry of
+	// the file, from which ApplyAppleDouble restores them. Only files on
+	// macOS have them.
+	AppleDouble bool
+}
+
+// An archiverFile is a file prepared by a worker of an Archiver.
+type archiverFile struct {
+	hdr  *Header
+	data []byte // Contents of a regular file, unless it is too large
+	ad   []byte // AppleDouble file, if there is one
+	path string
+	skip bool // Not modified after ModifiedAfter
+	err  error
+}
+
+// WriteFiles writes to tw the files, directories, and symbolic links at the
+// given slash-separated names, relative to the directory root, as done by
+// FileInfoHeader with the names as the names of the entries. The contents of
+// directories are not written unless they are named. It does not close tw.
+//
+// At most a few files per worker are held in memory at any time, and only
+// those of up to 1 MiB; larger files are read a second time when written.
+func (a *Archiver) WriteFiles(tw *Writer, root string, names []string) error {
+	if a.Digest != "" && newDigest(a.Digest) == nil {
+		return ErrDigestUnavailable
+	}
+	workers := a.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	// The files are prepared in order, with at most 2*workers of them
+	// prepared but not yet written.
+	results := make([]chan archiverFile, len(names))
+	for i := range results {
+		results[i] = make(chan archiverFile, 1)
+	}
+	next := make(chan int)
+	window := make(chan struct{}, 2*workers)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		defer close(next)
+		for i := range names {
+			select {
+			case window <- struct{}{}:
+			case <-done:
+				return
+			}
+			select {
+			case next <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+	for w := 0; w < workers; w++ {
+		go func() {
+			for i := range next {
+				results[i] <- a.prepareFile(root, names[i])
+			}
+		}()
+	}
+
+	for i := range names {
+		f := <-results[i]
+		<-window
+		if f.err != nil {
+			return f.err
+		}
+		if f.skip {
+			continue
+		}
+		if f.ad != nil {
+			hdr := &Header{
+				Name:     appleDoubleName(f.hdr.Name),
+				Typeflag: TypeReg,
+				Mode:     0644,
+				Uid:      f.hdr.Uid,
+				Gid:      f.hdr.Gid,
+				Uname:    f.hdr.Uname,
+				Gname:    f.hdr.Gname,
+				Size:     int64(len(f.ad)),
+				ModTime:  f.hdr.ModTime,
+			}
+			if err := tw.WriteFile(hdr, bytes.NewReader(f.ad)); err != nil {
+				return err
+			}
+		}
+		if err := tw.WriteHeader(f.hdr); err != nil {
+			return err
+		}
+		if f.hdr.Typeflag != TypeReg {
+			continue
+		}
+		if f.data != nil {
+			if _, err := tw.Write(f.data); err != nil {
+				return err
+			}
+		} else if err := copyFile(tw, f.path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// prepareFile returns the header and, if it is small enough, the contents
+// of the file at name relative to root.
+func (a *Archiver) prepareFile(root, name string) archiverFile {
+	f := archiverFile{path: filepath.Join(root, filepath.FromSlash(name))}
+	fi, err := os.Lstat(f.path)
+	if err != nil {
+		f.err = err
+		return f
+	}
+	if !a.ModifiedAfter.IsZero() && !fi.IsDir() && !fi.ModTime().After(a.ModifiedAfter) {
+		f.skip = true
+		return f
+	}
+	if f.hdr, f.err = layerHeader(fi, f.path); f.err != nil {
+		return f
+	}
+	f.hdr.Name = name
+	if fi.IsDir() && !strings.HasSuffix(name, "/") {
+		f.hdr.Name += "/"
+	}
+	if a.AppleDouble {
+		finderInfo, rsrc, err := readAppleMetadata(f.path)
+		if err != nil {
+			f.err = err
+			return f
+		}
+		if len(finderInfo) > 0 || len(rsrc) > 0 {
+			f.ad = encodeAppleDouble(finderInfo, rsrc)
+		}
+	}
+	if f.hdr.Typeflag != TypeReg {
+		return f
+	}
+
+	var r io.Reader
+	if f.hdr.Size <= maxArchiverBuffer {
+		if f.data, f.err = ioutil.ReadFile(f.path); f.err != nil {
+			return f
+		}
+		if int64(len(f.data)) != f.hdr.Size {
+			f.err = fmt.Errorf("archive/tar: file %q changed size while being read", f.path)
+			return f
+		}
+		r = bytes.NewReader(f.data)
+	}
+	if a.Digest == "" {
+		return f
+	}
+	if r == nil {
+		file, err := os.Open(f.path)
+		if err != nil {
+			f.err = err
+			return f
+		}
+		defer file.Close()
+		r = file
+	}
+	f.err = f.hdr.SetDigest(a.Digest, r)
+	return f
+}
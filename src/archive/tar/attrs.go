@@ -0,0 +1,66 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import "strings"
+
+// paxProjectID is the key of the PAX record holding the project quota ID
+// of a file on Linux.
+const paxProjectID = "GO.projid"
+
+// paxAltStream is the prefix of the keys of the PAX records holding the
+// alternate data streams of a file on Windows, which follow it by name.
+const paxAltStream = "GO.ads."
+
+// ReadFileAttrs adds to h the attributes of the regular file or directory
+// at name that os.Lstat does not report, and thus FileInfoHeader cannot
+// populate. On Linux, these are the inode attributes (such as immutable,
+// append-only, and nodump), which are stored in h.FileFlags with the names
+// used by bsdtar, and the project quota ID, which is stored as a GO.projid
+// record in h.PAXRecords. On Windows, these are the alternate data streams,
+// such as Zone.Identifier, whose contents are each stored in base64 as a
+// GO.ads. record in h.PAXRecords followed by the name of the stream, such
+// that the streams should be small. Attributes that the file system does
+// not support are ignored. On other systems, ReadFileAttrs does nothing.
+func ReadFileAttrs(name string, h *Header) error {
+	if h.Typeflag != TypeReg && h.Typeflag != TypeDir {
+		return nil
+	}
+	return readFileAttrs(name, h)
+}
+
+// ApplyFileAttrs sets the file flags of h, on Linux its project quota ID,
+// and on Windows its alternate data streams, on the regular file or
+// directory at name, which is typically one that has been extracted from
+// an archive. Flags that are unknown to the
+// system are ignored; flags are only ever added, not cleared.
+//
+// Setting some of the flags, such as schg, requires privileges, and an
+// immutable or append-only file cannot be modified afterwards,
+// so ApplyFileAttrs should be called once the contents and all other
+// metadata of the file have been restored.
+func ApplyFileAttrs(name string, h *Header) error {
+	if h.Typeflag != TypeReg && h.Typeflag != TypeDir {
+		return nil
+	}
+	return applyFileAttrs(name, h)
+}
+
+// altStreamName returns the name of the alternate data stream described by
+// s, as reported by FindFirstStreamW, such as "Zone.Identifier" for
+// ":Zone.Identifier:$DATA", or the empty string if s is the unnamed stream
+// that holds the contents of the file or a stream of another type.
+func altStreamName(s string) string {
+	if !strings.HasPrefix(s, ":") || !strings.HasSuffix(s, ":$DATA") {
+		return ""
+	}
+	return s[1 : len(s)-len(":$DATA")]
+}
+
+// validAltStream reports whether name may be used as the name of an
+// alternate data stream, which cannot refer to another file.
+func validAltStream(name string) bool {
+	return name != "" && !strings.ContainsAny(name, `:/\`+"\x00")
+}
@@ -0,0 +1,35 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package tar
+
+import (
+	"os"
+	"strings"
+	"syscall"
+)
+
+// readFileAttrs does nothing, since the file flags are reported by
+// os.Lstat and set by FileInfoHeader.
+func readFileAttrs(name string, h *Header) error { return nil }
+
+func applyFileAttrs(name string, h *Header) error {
+	var flags uint32
+	for _, s := range strings.Split(h.FileFlags, ",") {
+		for _, f := range fileFlags {
+			if s == f.name {
+				flags |= f.bit
+			}
+		}
+	}
+	if flags == 0 {
+		return nil
+	}
+	if err := syscall.Chflags(name, int(flags)); err != nil {
+		return &os.PathError{Op: "chflags", Path: name, Err: err}
+	}
+	return nil
+}
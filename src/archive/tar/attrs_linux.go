@@ -0,0 +1,152 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,386 linux,amd64 linux,arm linux,arm64 linux,s390x
+
+package tar
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Requests of ioctl(2) for the inode attributes of Linux file systems,
+// as defined in linux/fs.h for architectures with the generic encoding.
+const (
+	fsIOCGetFlags   = 0x80006601 | unsafe.Sizeof(uintptr(0))<<16 // FS_IOC_GETFLAGS
+	fsIOCSetFlags   = 0x40006602 | unsafe.Sizeof(uintptr(0))<<16 // FS_IOC_SETFLAGS
+	fsIOCFSGetXattr = 0x801c581f                                 // FS_IOC_FSGETXATTR
+	fsIOCFSSetXattr = 0x401c5820                                 // FS_IOC_FSSETXATTR
+)
+
+// linuxFlags are the inode attributes of Linux file systems that are
+// archived, with the names that bsdtar uses for them.
+var linuxFlags = []struct {
+	name string
+	bit  uint32
+}{
+	{"sync", 0x00000008},    // FS_SYNC_FL
+	{"schg", 0x00000010},    // FS_IMMUTABLE_FL
+	{"sappnd", 0x00000020},  // FS_APPEND_FL
+	{"nodump", 0x00000040},  // FS_NODUMP_FL
+	{"noatime", 0x00000080}, // FS_NOATIME_FL
+	{"dirsync", 0x00010000}, // FS_DIRSYNC_FL
+}
+
+// fsxattr is the argument of FS_IOC_FSGETXATTR and FS_IOC_FSSETXATTR.
+type fsxattr struct {
+	xflags     uint32
+	extsize    uint32
+	nextents   uint32
+	projid     uint32
+	cowextsize uint32
+	pad        [8]byte
+}
+
+func ioctl(f *os.File, req uintptr, arg unsafe.Pointer) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, f.Fd(), req, uintptr(arg))
+	if errno != 0 {
+		return &os.PathError{Op: "ioctl", Path: f.Name(), Err: errno}
+	}
+	return nil
+}
+
+// unsupportedAttrs reports whether err is the result of using ioctl(2)
+// on a file system or file that does not support inode attributes.
+func unsupportedAttrs(err error) bool {
+	if pe, ok := err.(*os.PathError); ok {
+		err = pe.Err
+	}
+	return err == syscall.ENOTTY || err == syscall.EOPNOTSUPP || err == syscall.EINVAL
+}
+
+func readFileAttrs(name string, h *Header) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var flags uint32
+	if err := ioctl(f, fsIOCGetFlags, unsafe.Pointer(&flags)); err != nil {
+		if unsupportedAttrs(err) {
+			return nil
+		}
+		return err
+	}
+	var names []string
+	for _, lf := range linuxFlags {
+		if flags&lf.bit != 0 {
+			names = append(names, lf.name)
+		}
+	}
+	h.FileFlags = strings.Join(names, ",")
+
+	var fsx fsxattr
+	if err := ioctl(f, fsIOCFSGetXattr, unsafe.Pointer(&fsx)); err != nil {
+		if unsupportedAttrs(err) {
+			return nil
+		}
+		return err
+	}
+	if fsx.projid != 0 {
+		if h.PAXRecords == nil {
+			h.PAXRecords = make(map[string]string)
+		}
+		h.PAXRecords[paxProjectID] = strconv.FormatUint(uint64(fsx.projid), 10)
+	}
+	return nil
+}
+
+func applyFileAttrs(name string, h *Header) error {
+	var set uint32
+	for _, s := range strings.Split(h.FileFlags, ",") {
+		for _, lf := range linuxFlags {
+			if s == lf.name {
+				set |= lf.bit
+			}
+		}
+	}
+	projid, hasProjID := h.PAXRecords[paxProjectID]
+	if set == 0 && !hasProjID {
+		return nil
+	}
+
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The project ID must be set first, since an immutable file cannot
+	// be changed further.
+	if hasProjID {
+		id, err := strconv.ParseUint(projid, 10, 32)
+		if err != nil {
+			return ErrHeader
+		}
+		var fsx fsxattr
+		if err := ioctl(f, fsIOCFSGetXattr, unsafe.Pointer(&fsx)); err != nil {
+			return err
+		}
+		fsx.projid = uint32(id)
+		if err := ioctl(f, fsIOCFSSetXattr, unsafe.Pointer(&fsx)); err != nil {
+			return err
+		}
+	}
+	if set != 0 {
+		var flags uint32
+		if err := ioctl(f, fsIOCGetFlags, unsafe.Pointer(&flags)); err != nil {
+			return err
+		}
+		flags |= set
+		if err := ioctl(f, fsIOCSetFlags, unsafe.Pointer(&flags)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
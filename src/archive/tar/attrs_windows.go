@@ -0,0 +1,97 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+var (
+	modkernel32          = syscall.NewLazyDLL("kernel32.dll")
+	procFindFirstStreamW = modkernel32.NewProc("FindFirstStreamW")
+	procFindNextStreamW  = modkernel32.NewProc("FindNextStreamW")
+)
+
+// win32FindStreamData is the WIN32_FIND_STREAM_DATA structure.
+type win32FindStreamData struct {
+	size int64
+	name [syscall.MAX_PATH + 36]uint16
+}
+
+// unsupportedStreams reports whether err is the result of enumerating the
+// streams of a file on a file system that has none, such as FAT.
+func unsupportedStreams(err error) bool {
+	return err == syscall.ERROR_HANDLE_EOF || err == syscall.Errno(1) || // ERROR_INVALID_FUNCTION
+		err == syscall.Errno(87) // ERROR_INVALID_PARAMETER
+}
+
+func readFileAttrs(name string, h *Header) error {
+	if procFindFirstStreamW.Find() != nil {
+		return nil // Windows XP and earlier
+	}
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	var data win32FindStreamData
+	r, _, err := procFindFirstStreamW.Call(uintptr(unsafe.Pointer(p)), 0, uintptr(unsafe.Pointer(&data)), 0)
+	fh := syscall.Handle(r)
+	if fh == syscall.InvalidHandle {
+		if unsupportedStreams(err) {
+			return nil
+		}
+		return &os.PathError{Op: "FindFirstStreamW", Path: name, Err: err}
+	}
+	defer syscall.FindClose(fh)
+	for {
+		if s := altStreamName(syscall.UTF16ToString(data.name[:])); s != "" {
+			b, err := ioutil.ReadFile(name + ":" + s)
+			if err != nil {
+				return err
+			}
+			if h.PAXRecords == nil {
+				h.PAXRecords = make(map[string]string)
+			}
+			h.PAXRecords[paxAltStream+s] = base64.StdEncoding.EncodeToString(b)
+		}
+		if r, _, err := procFindNextStreamW.Call(uintptr(fh), uintptr(unsafe.Pointer(&data))); r == 0 {
+			if err == syscall.ERROR_HANDLE_EOF {
+				return nil
+			}
+			return &os.PathError{Op: "FindNextStreamW", Path: name, Err: err}
+		}
+	}
+}
+
+func applyFileAttrs(name string, h *Header) error {
+	var keys []string
+	for k := range h.PAXRecords {
+		if strings.HasPrefix(k, paxAltStream) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s := k[len(paxAltStream):]
+		if !validAltStream(s) {
+			return fmt.Errorf("archive/tar: invalid alternate data stream name %q", s)
+		}
+		b, err := base64.StdEncoding.DecodeString(h.PAXRecords[k])
+		if err != nil {
+			return fmt.Errorf("archive/tar: alternate data stream %q: %v", s, err)
+		}
+		if err := ioutil.WriteFile(name+":"+s, b, 0666); err != nil {
+			return err
+		}
+	}
+	return nil
+}
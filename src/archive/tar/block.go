@@ -0,0 +1,125 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"io"
+	"io/ioutil"
+)
+
+// BlockSize is the size of the blocks of which a tar archive consists.
+// Headers occupy whole blocks, and the data of entries is padded to a
+// multiple of the block size.
+const BlockSize = blockSize
+
+// A Block is a single block of a tar archive. Together with BlockReader,
+// BlockWriter, ParseNumeric, and FormatNumeric, it allows tools such as
+// recovery and tape utilities to parse and produce archives themselves,
+// with the same encodings that Reader and Writer use.
+type Block [BlockSize]byte
+
+// Checksum returns the checksum of b as a header block, computed with
+// the checksum field treated as spaces. POSIX specifies a sum of the
+// unsigned byte values, but some historic implementations, such as Sun
+// tar, used signed byte values; both sums are returned.
+func (b *Block) Checksum() (unsigned, signed int64) {
+	return (*block)(b).ComputeChecksum()
+}
+
+// SetChecksum stores the unsigned checksum of b in its checksum field,
+// which must be done after all other fields of a header block are set.
+func (b *Block) SetChecksum() {
+	var f formatter
+	field := (*block)(b).V7().Chksum()
+	chksum, _ := b.Checksum()
+	f.formatOctal(field[:7], chksum)
+	field[7] = ' '
+}
+
+// IsZero reports whether b consists entirely of zeros, as do the blocks
+// that mark the end of an archive.
+func (b *Block) IsZero() bool {
+	return (*block)(b).IsZero()
+}
+
+// ParseNumeric parses a numeric field of a header block, such as the size
+// at bytes 124 through 135, which is encoded in octal or, for values that do
+// not fit, in the GNU base-256 encoding. It reports ErrHeader if the field
+// is malformed.
+func ParseNumeric(field []byte) (int64, error) {
+	var p parser
+	x := p.parseNumeric(field)
+	return x, p.err
+}
+
+// FormatNumeric encodes x into a numeric field of a header block, in octal
+// if it fits, and otherwise in the GNU base-256 encoding. It reports
+// ErrFieldTooLong, and stores zero, if x fits in neither.
+func FormatNumeric(field []byte, x int64) error {
+	var f formatter
+	f.formatNumeric(field, x)
+	return f.err
+}
+
+// A BlockReader reads a tar archive as a sequence of blocks, keeping
+// track of its position within the archive.
+type BlockReader struct {
+	r   io.Reader
+	off int64
+}
+
+// NewBlockReader returns a BlockReader that reads from r.
+func NewBlockReader(r io.Reader) *BlockReader {
+	return &BlockReader{r: r}
+}
+
+// Offset returns the offset within the archive of the next block to be read.
+func (br *BlockReader) Offset() int64 {
+	return br.off
+}
+
+// ReadBlock reads the next block into b. It reports io.EOF if the input
+// ends before the block, and io.ErrUnexpectedEOF if it ends within it.
+func (br *BlockReader) ReadBlock(b *Block) error {
+	n, err := io.ReadFull(br.r, b[:])
+	br.off += int64(n)
+	return err
+}
+
+// Skip discards the next n blocks, such as those holding the data of
+// an entry. It reports io.ErrUnexpectedEOF if the input ends before them.
+func (br *BlockReader) Skip(n int64) error {
+	nr, err := io.CopyN(ioutil.Discard, br.r, n*BlockSize)
+	br.off += nr
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// A BlockWriter writes a tar archive as a sequence of blocks, keeping
+// track of its position within the archive.
+type BlockWriter struct {
+	w   io.Writer
+	off int64
+}
+
+// NewBlockWriter returns a BlockWriter that writes to w.
+func NewBlockWriter(w io.Writer) *BlockWriter {
+	return &BlockWriter{w: w}
+}
+
+// Offset returns the offset within the archive of the next block to be
+// written.
+func (bw *BlockWriter) Offset() int64 {
+	return bw.off
+}
+
+// WriteBlock writes b as the next block.
+func (bw *BlockWriter) WriteBlock(b *Block) error {
+	n, err := bw.w.Write(b[:])
+	bw.off += int64(n)
+	return err
+}
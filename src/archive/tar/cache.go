@@ -0,0 +1,155 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"errors"
+	"io"
+	"sync"
+)
+
+// A CachedReaderAt is an io.ReaderAt that reads from an underlying
+// io.ReaderAt in fixed-size blocks and retains the most recently used ones.
+// It is intended for archives stored where each read is expensive, such as
+// a remote file accessed with HTTP range requests, so that an Index of the
+// archive can be built and browsed without transferring all of it.
+//
+// The fields must not be changed after the first call to ReadAt.
+// The methods of a CachedReaderAt are safe for concurrent use by multiple
+// goroutines if those of the underlying io.ReaderAt are.
+type CachedReaderAt struct {
+	// BlockSize is the size of the blocks that are read. If zero,
+	// 64 KiB is used.
+	BlockSize int
+
+	// Blocks is the maximum number of blocks that are retained. If zero,
+	// 64 blocks are retained.
+	Blocks int
+
+	// Prefetch is the number of blocks following a block that is not
+	// cached that are read along with it, in the same call to ReadAt
+	// of the underlying io.ReaderAt.
+	Prefetch int
+
+	r    io.ReaderAt
+	size int64
+
+	mu     sync.Mutex
+	blocks map[int64]*cachedBlock // Keyed by block number
+	uses   int64
+}
+
+type cachedBlock struct {
+	b    []byte
+	used int64 // Value of uses when the block was last used
+}
+
+// NewCachedReaderAt returns a CachedReaderAt that reads from r,
+// which has the given size.
+func NewCachedReaderAt(r io.ReaderAt, size int64) *CachedReaderAt {
+	return &CachedReaderAt{r: r, size: size}
+}
+
+// Size returns the size of the underlying io.ReaderAt.
+func (c *CachedReaderAt) Size() int64 { return c.size }
+
+// ReadAt implements io.ReaderAt.
+func (c *CachedReaderAt) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("tar: negative offset")
+	}
+	bs := int64(c.blockSize())
+	for n < len(p) && off < c.size {
+		i := off / bs
+		b, err := c.block(i)
+		if err != nil {
+			return n, err
+		}
+		nc := copy(p[n:], b[off-i*bs:])
+		n += nc
+		off += int64(nc)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (c *CachedReaderAt) blockSize() int {
+	if c.BlockSize > 0 {
+		return c.BlockSize
+	}
+	return 64 << 10
+}
+
+// block returns the contents of the i-th block, reading it and the
+// blocks to be prefetched if it is not cached.
+func (c *CachedReaderAt) block(i int64) ([]byte, error) {
+	c.mu.Lock()
+	if c.blocks == nil {
+		c.blocks = make(map[int64]*cachedBlock)
+	}
+	c.uses++
+	if cb := c.blocks[i]; cb != nil {
+		cb.used = c.uses
+		c.mu.Unlock()
+		return cb.b, nil
+	}
+	c.mu.Unlock()
+
+	// The lock is not held while reading, so that other blocks may be
+	// read concurrently. The same block may thus be read more than once,
+	// which is harmless.
+	bs := int64(c.blockSize())
+	start := i * bs
+	end := start + bs*int64(1+c.Prefetch)
+	if end > c.size || end < start {
+		end = c.size
+	}
+	buf := make([]byte, end-start)
+	if nr, err := c.r.ReadAt(buf, start); nr < len(buf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for j := int64(0); len(buf) > 0; j++ {
+		nb := bs
+		if nb > int64(len(buf)) {
+			nb = int64(len(buf))
+		}
+		if c.blocks[i+j] == nil {
+			c.blocks[i+j] = &cachedBlock{b: buf[:nb:nb], used: c.uses}
+		}
+		buf = buf[nb:]
+	}
+	cb := c.blocks[i]
+	c.evict(i)
+	return cb.b, nil
+}
+
+// evict removes the least recently used blocks, other than the i-th block,
+// until no more than the maximum number of blocks are retained.
+func (c *CachedReaderAt) evict(i int64) {
+	max := c.Blocks
+	if max <= 0 {
+		max = 64
+	}
+	for len(c.blocks) > max {
+		lru, used := int64(-1), int64(0)
+		for j, cb := range c.blocks {
+			if j != i && (lru < 0 || cb.used < used) {
+				lru, used = j, cb.used
+			}
+		}
+		if lru < 0 {
+			return
+		}
+		delete(c.blocks, lru)
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux,386 linux,amd64 linux,arm linux,arm64 linux,s390x
+
+package tar
+
+import (
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+const ficloneRange = 0x4020940d // FICLONERANGE
+
+// fileCloneRange is the argument of FICLONERANGE.
+type fileCloneRange struct {
+	srcFD     int64
+	srcOffset uint64
+	srcLength uint64
+	dstOffset uint64
+}
+
+// cloneRange shares the n bytes of src at offset srcOff with dst at
+// offset dstOff, rounded down to a multiple of the block size of the file
+// system, and returns the number of bytes that it shares. It returns zero
+// if the file system does not support sharing them, such as because the
+// files are on different file systems or the offsets are not aligned.
+// It is a variable so that tests may replace it.
+var cloneRange = func(dst, src *os.File, dstOff, srcOff, n int64) int64 {
+	var st syscall.Statfs_t
+	if err := syscall.Fstatfs(int(dst.Fd()), &st); err != nil || st.Bsize <= 0 {
+		return 0
+	}
+	bs := int64(st.Bsize)
+	if srcOff%bs != 0 || dstOff%bs != 0 {
+		return 0
+	}
+	n -= n % bs
+	if n == 0 {
+		return 0
+	}
+	arg := fileCloneRange{
+		srcFD:     int64(src.Fd()),
+		srcOffset: uint64(srcOff),
+		srcLength: uint64(n),
+		dstOffset: uint64(dstOff),
+	}
+	if err := ioctl(dst, ficloneRange, unsafe.Pointer(&arg)); err != nil {
+		return 0
+	}
+	return n
+}
+
+// copyRange copies the n bytes of src at offset srcOff to dst at offset
+// dstOff with copy_file_range(2), which copies them within the kernel
+// without passing them through user space, and returns the number of bytes
+// that it copies. It stops early, possibly returning zero, if the kernel
+// cannot copy between the files, such as because it predates the system
+// call or the files are on different file systems.
+func copyRange(dst, src *os.File, dstOff, srcOff, n int64) int64 {
+	var copied int64
+	for copied < n {
+		soff, doff := srcOff+copied, dstOff+copied
+		m := n - copied
+		if m > 1<<30 {
+			m = 1 << 30
+		}
+		r, _, errno := syscall.Syscall6(copyFileRangeTrap,
+			src.Fd(), uintptr(unsafe.Pointer(&soff)),
+			dst.Fd(), uintptr(unsafe.Pointer(&doff)),
+			uintptr(m), 0)
+		if errno == syscall.EINTR {
+			continue
+		}
+		if errno != 0 || r == 0 {
+			break
+		}
+		copied += int64(r)
+	}
+	return copied
+}
@@ -0,0 +1,123 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// A CollisionError records two entries whose names differ, but which refer
+// to the same file on a file system that ignores case or the Unicode
+// normalization of names, such as those usually used on Windows and macOS.
+// Extracting the later entry there silently overwrites the earlier one.
+type CollisionError struct {
+	Name  string // Name of the later entry
+	Other string // Name of the earlier entry
+}
+
+func (e *CollisionError) Error() string {
+	return fmt.Sprintf("tar: entry %q collides with %q on case-insensitive file systems", e.Name, e.Other)
+}
+
+// A CollisionChecker detects entries whose names collide on file systems
+// that ignore case. Names are compared after cleaning them as ReadMap does,
+// folding case as by strings.EqualFold, and removing the trailing periods
+// and spaces of each element, which Windows ignores. Entries with the same
+// name do not collide, as they overwrite each other on any file system.
+//
+// The zero value is ready to use.
+type CollisionChecker struct {
+	// Normalize, if non-nil, is applied to names before they are compared,
+	// such that names differing only in their Unicode normalization can be
+	// detected, such as with the String method of norm.NFD from the
+	// golang.org/x/text/unicode/norm package.
+	Normalize func(string) string
+
+	names map[string]string // Cleaned names, by key
+}
+
+// Check records name as that of the next entry, and reports a
+// *CollisionError if it collides with that of a preceding entry.
+func (c *CollisionChecker) Check(name string) error {
+	clean := mapName(name)
+	key := clean
+	if c.Normalize != nil {
+		key = c.Normalize(key)
+	}
+	key = foldName(key)
+	if c.names == nil {
+		c.names = make(map[string]string)
+	}
+	other, ok := c.names[key]
+	if ok && other != clean {
+		return &CollisionError{Name: name, Other: other}
+	}
+	c.names[key] = clean
+	return nil
+}
+
+// Audit checks the name of hdr, other than for global headers.
+// It may be used as Reader.Audit, such that Next reports a *CollisionError
+// along with the header of each colliding entry.
+func (c *CollisionChecker) Audit(hdr *Header, info *EntryInfo) error {
+	if hdr.Typeflag == TypeXGlobalHeader {
+		return nil
+	}
+	return c.Check(hdr.Name)
+}
+
+// CheckCollisions reads the tar archive from r in a single pass and returns
+// a *CollisionError for every entry whose name collides with that of
+// a preceding one, as a CollisionChecker using normalize would.
+func CheckCollisions(r io.Reader, normalize func(string) string) ([]*CollisionError, error) {
+	var errs []*CollisionError
+	c := &CollisionChecker{Normalize: normalize}
+	tr := NewReader(r)
+	tr.AllowInsecurePaths = true // Names are only reported
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errs, nil
+		}
+		if err != nil {
+			return errs, err
+		}
+		if err := c.Audit(hdr, nil); err != nil {
+			errs = append(errs, err.(*CollisionError))
+		}
+	}
+}
+
+// foldName returns a key for name that is the same for all names that
+// are equal under simple case folding, once the trailing periods and
+// spaces of each of their elements are removed.
+func foldName(name string) string {
+	elems := strings.Split(name, "/")
+	for i, e := range elems {
+		if t := strings.TrimRight(e, ". "); t != "" {
+			elems[i] = t
+		}
+	}
+	name = strings.Join(elems, "/")
+
+	b := make([]byte, 0, len(name))
+	for _, r := range name {
+		// Map each rune to the smallest rune of its folding orbit.
+		min := r
+		for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+			if f < min {
+				min = f
+			}
+		}
+		var buf [utf8.UTFMax]byte
+		n := utf8.EncodeRune(buf[:], min)
+		b = append(b, buf[:n]...)
+	}
+	return string(b)
+}
@@ -13,23 +13,36 @@
 package tar
 
 import (
+	"encoding/base64"
 	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // BUG: Use of the Uid and Gid fields in Header could overflow on 32-bit
 // architectures. If a large value is encountered when decoding, the result
-// stored in Header will be the truncated version.
+// stored in Header will be the truncated version. The Uid64 and Gid64
+// methods report the full value.
 
 var (
 	ErrHeader          = errors.New("tar: invalid tar header")
 	ErrWriteTooLong    = errors.New("tar: write too long")
 	ErrFieldTooLong    = errors.New("tar: header field too long")
 	ErrWriteAfterClose = errors.New("tar: write after close")
+	ErrUnreadData      = errors.New("tar: unread data in current entry")
+	ErrInsecurePath    = errors.New("tar: insecure file path")
+	ErrWindowsName     = errors.New("tar: file name not valid on Windows")
+	ErrSpecialMode     = errors.New("tar: setuid, setgid, or sticky bit set")
+
+	ErrDigestMismatch    = errors.New("tar: digest mismatch")
+	ErrDigestUnavailable = errors.New("tar: digest algorithm not available")
+
+	ErrSnapshot = errors.New("tar: invalid incremental snapshot")
 )
 
 // Header type flags.
@@ -48,8 +61,30 @@ const (
 	TypeGNULongName   = 'L'    // Next file has a long name
 	TypeGNULongLink   = 'K'    // Next file symlinks to a file w/ a long name
 	TypeGNUSparse     = 'S'    // sparse file
+
+	// GNU volume headers and old rename records are returned by
+	// Reader.Next like any other entry. For a volume header, the
+	// Name field holds the volume label.
+	TypeGNUVolumeHeader = 'V' // volume label
+	TypeGNUNames        = 'N' // names of renamed files (obsolete)
+
+	// A multi-volume continuation entry holds the remainder of a file that
+	// was split at the end of the previous volume; see Header.VolumeOffset.
+	// It can only be written in the GNU format.
+	TypeGNUMultiVolume = 'M' // continuation of a file from the previous volume
+
+	// A dumpdir entry records the contents of a directory in an incremental
+	// backup; its data is parsed by ParseDumpDir. It can only be written in
+	// the GNU format.
+	TypeGNUDumpDir = 'D' // directory contents for incremental backups
 )
 
+// typeXHeaderOld is the type of the extended header written by the tar of
+// some System V derived systems, such as Solaris and AIX, which predates
+// TypeXHeader and holds records in the same format. It is read as a local
+// extended header.
+const typeXHeaderOld = 'X'
+
 // A Header represents a single header in a tar archive.
 // Some fields may not be populated.
 type Header struct {
@@ -68,6 +103,92 @@ type Header struct {
 	AccessTime time.Time // access time
 	ChangeTime time.Time // status change time
 	Xattrs     map[string]string
+
+	// FileFlags holds the BSD file flags of the entry, as a comma-separated
+	// list of the names used by chflags(1), such as "uchg,nodump".
+	// It is stored in a SCHILY.fflags record, as done by bsdtar and star,
+	// which forces the use of the PAX format. FileInfoHeader populates it
+	// from the st_flags field on BSD systems and macOS, and ReadFileAttrs
+	// from the inode attributes on Linux.
+	FileFlags string
+
+	// VolumeOffset is the offset within the original file of the data
+	// held by a TypeGNUMultiVolume entry. The Size field is the length
+	// of that data. It is ignored for all other entries.
+	VolumeOffset int64
+
+	// PAXRecords is a map of PAX extended header records.
+	//
+	// On read, it holds all of the records that apply to the entry,
+	// including those inherited from preceding global headers.
+	// For a TypeXGlobalHeader entry, it holds the records of that header.
+	//
+	// On write, the records are written in the entry's extended header,
+	// which forces the use of the PAX format. Records for keys that
+	// correspond to other Header fields (such as "path" and "size") and
+	// the sparse records of GNU and Solaris tar are ignored; the Header
+	// fields take precedence.
+	PAXRecords map[string]string
+
+	// Extensions holds structured values translated from the PAX records
+	// of vendor namespaces by the extensions registered with
+	// RegisterPAXExtension, keyed by namespace prefix.
+	//
+	// On read, it holds a value for every registered namespace with records
+	// that apply to the entry. The records also remain in PAXRecords.
+	//
+	// On write, each value is encoded by the extension for its namespace,
+	// which must be registered, and its records take precedence over those
+	// of the namespace in PAXRecords. This forces the use of the PAX format.
+	Extensions map[string]interface{}
+
+	// uid64 and gid64 hold the full values of Uid and Gid when they
+	// cannot be represented by an int. They are only valid so long as
+	// Uid and Gid hold the truncated versions of them.
+	uid64, gid64 int64
+}
+
+// A SparseEntry represents a single data fragment of a sparse file,
+// as passed to Writer.WriteSparseHeader.
+type SparseEntry struct {
+	Offset int64 // Starting position of the fragment
+	Length int64 // Length of the fragment
+}
+
+// Uid64 returns the user id of the owner.
+// Unlike the Uid field, the result does not overflow on 32-bit architectures.
+func (h *Header) Uid64() int64 {
+	if h.uid64 != 0 && int(h.uid64) == h.Uid {
+		return h.uid64
+	}
+	return int64(h.Uid)
+}
+
+// Gid64 returns the group id of the owner.
+// Unlike the Gid field, the result does not overflow on 32-bit architectures.
+func (h *Header) Gid64() int64 {
+	if h.gid64 != 0 && int(h.gid64) == h.Gid {
+		return h.gid64
+	}
+	return int64(h.Gid)
+}
+
+// SetUid64 sets the user id of the owner.
+// The Uid field is set to the (possibly truncated) value of id.
+func (h *Header) SetUid64(id int64) {
+	h.Uid, h.uid64 = int(id), 0
+	if int64(h.Uid) != id {
+		h.uid64 = id
+	}
+}
+
+// SetGid64 sets the group id of the owner.
+// The Gid field is set to the (possibly truncated) value of id.
+func (h *Header) SetGid64(id int64) {
+	h.Gid, h.gid64 = int(id), 0
+	if int64(h.Gid) != id {
+		h.gid64 = id
+	}
 }
 
 // FileInfo returns an os.FileInfo for the Header.
@@ -147,8 +268,8 @@ func (h *Header) allowedFormats() (format int, paxHdrs map[string]string) {
 	verifyString(h.Uname, len(ustar.UserName()), paxUname)
 	verifyString(h.Gname, len(ustar.GroupName()), paxGname)
 	verifyNumeric(h.Mode, len(v7.Mode()), paxNone)
-	verifyNumeric(int64(h.Uid), len(v7.UID()), paxUid)
-	verifyNumeric(int64(h.Gid), len(v7.GID()), paxGid)
+	verifyNumeric(h.Uid64(), len(v7.UID()), paxUid)
+	verifyNumeric(h.Gid64(), len(v7.GID()), paxGid)
 	verifyNumeric(h.Size, len(v7.Size()), paxSize)
 	verifyNumeric(h.Devmajor, len(ustar.DevMajor()), paxNone)
 	verifyNumeric(h.Devminor, len(ustar.DevMinor()), paxNone)
@@ -156,15 +277,57 @@ func (h *Header) allowedFormats() (format int, paxHdrs map[string]string) {
 	verifyTime(h.AccessTime, len(gnu.AccessTime()), paxAtime)
 	verifyTime(h.ChangeTime, len(gnu.ChangeTime()), paxCtime)
 
+	if h.Typeflag == TypeGNUMultiVolume {
+		verifyNumeric(h.VolumeOffset, len(gnu.Offset()), paxNone)
+		format &= formatGNU // GNU only
+	}
+	if h.Typeflag == TypeGNUDumpDir {
+		format &= formatGNU // GNU only
+	}
+
 	if !isHeaderOnlyType(h.Typeflag) && h.Size < 0 {
 		return formatUnknown, nil
 	}
 	if len(h.Xattrs) > 0 {
 		for k, v := range h.Xattrs {
-			paxHdrs[paxXattr+k] = v
+			// As done by bsdtar, attributes with names that cannot be
+			// used in a PAX key or with binary values are also stored
+			// with a URL-encoded name and a base64-encoded value.
+			validKey := validPAXRecord(paxXattr+k, v)
+			if validKey {
+				paxHdrs[paxXattr+k] = v
+			}
+			if !validKey || !utf8.ValidString(v) {
+				paxHdrs[paxLibXattr+urlEncode(k)] = base64.RawStdEncoding.EncodeToString([]byte(v))
+			}
 		}
 		format &= formatPAX // PAX only
 	}
+	if h.FileFlags != "" {
+		paxHdrs[paxFflags] = h.FileFlags
+		format &= formatPAX // PAX only
+	}
+	if len(h.Extensions) > 0 {
+		if !encodePAXExtensions(h, paxHdrs) {
+			return formatUnknown, nil
+		}
+		format &= formatPAX // PAX only
+	}
+	for _, k := range []string{paxPath, paxLinkpath, paxUname, paxGname} {
+		// PAX records are UTF-8 unless marked otherwise, but names from
+		// legacy file systems are not necessarily valid UTF-8.
+		if v, ok := paxHdrs[k]; ok && !utf8.ValidString(v) {
+			paxHdrs[paxHdrCharset] = "BINARY"
+			break
+		}
+	}
+	for k, v := range h.PAXRecords {
+		if _, ok := paxHdrs[k]; ok || basicKeys[k] || isSparseRecord(k) || strings.HasPrefix(k, paxLibXattr) {
+			continue // Header fields take precedence
+		}
+		paxHdrs[k] = v
+		format &= formatPAX // PAX only
+	}
 	for k, v := range paxHdrs {
 		// Forbid empty values (which represent deletion) since usage of
 		// them are non-sensible without global PAX record support.
@@ -286,28 +449,49 @@ const (
 
 // Keywords for the PAX Extended Header
 const (
-	paxAtime    = "atime"
-	paxCharset  = "charset"
-	paxComment  = "comment"
-	paxCtime    = "ctime" // please note that ctime is not a valid pax header.
-	paxGid      = "gid"
-	paxGname    = "gname"
-	paxLinkpath = "linkpath"
-	paxMtime    = "mtime"
-	paxPath     = "path"
-	paxSize     = "size"
-	paxUid      = "uid"
-	paxUname    = "uname"
-	paxXattr    = "SCHILY.xattr."
-	paxNone     = ""
+	paxAtime      = "atime"
+	paxCharset    = "charset"
+	paxComment    = "comment"
+	paxCtime      = "ctime" // please note that ctime is not a valid pax header.
+	paxGid        = "gid"
+	paxGname      = "gname"
+	paxHdrCharset = "hdrcharset"
+	paxLinkpath   = "linkpath"
+	paxMtime      = "mtime"
+	paxPath       = "path"
+	paxSize       = "size"
+	paxUid        = "uid"
+	paxUname      = "uname"
+	paxXattr      = "SCHILY.xattr."
+	paxLibXattr   = "LIBARCHIVE.xattr."
+	paxFflags     = "SCHILY.fflags"
+	paxNone       = ""
+
+	paxGNUSparse = "GNU.sparse."
 )
 
+// basicKeys is a set of the PAX keys that correspond to Header fields.
+var basicKeys = map[string]bool{
+	paxPath: true, paxLinkpath: true, paxSize: true, paxUid: true, paxGid: true,
+	paxUname: true, paxGname: true, paxMtime: true, paxAtime: true, paxCtime: true,
+	paxFflags: true,
+}
+
+// isSparseRecord reports whether k is the key of a PAX record that holds
+// the sparse map of a file, which only the Reader interprets.
+func isSparseRecord(k string) bool {
+	return strings.HasPrefix(k, paxGNUSparse) || k == paxSunHolesData
+}
+
 // FileInfoHeader creates a partially-populated Header from fi.
 // If fi describes a symlink, FileInfoHeader records link as the link target.
 // If fi describes a directory, a slash is appended to the name.
 // Because os.FileInfo's Name method returns only the base name of
 // the file it describes, it may be necessary to modify the Name field
 // of the returned header to provide the full path name of the file.
+//
+// If fi implements FileInfoNames, the Uname and Gname fields of the
+// returned header are populated by its methods.
 func FileInfoHeader(fi os.FileInfo, link string) (*Header, error) {
 	if fi == nil {
 		return nil, errors.New("tar: FileInfo is nil")
@@ -355,8 +539,8 @@ func FileInfoHeader(fi os.FileInfo, link string) (*Header, error) {
 	if sys, ok := fi.Sys().(*Header); ok {
 		// This FileInfo came from a Header (not the OS). Use the
 		// original Header to populate all remaining fields.
-		h.Uid = sys.Uid
-		h.Gid = sys.Gid
+		h.SetUid64(sys.Uid64())
+		h.SetGid64(sys.Gid64())
 		h.Uname = sys.Uname
 		h.Gname = sys.Gname
 		h.AccessTime = sys.AccessTime
@@ -367,6 +551,12 @@ func FileInfoHeader(fi os.FileInfo, link string) (*Header, error) {
 				h.Xattrs[k] = v
 			}
 		}
+		if sys.PAXRecords != nil {
+			h.PAXRecords = make(map[string]string)
+			for k, v := range sys.PAXRecords {
+				h.PAXRecords[k] = v
+			}
+		}
 		if sys.Typeflag == TypeLink {
 			// hard link
 			h.Typeflag = TypeLink
@@ -375,11 +565,53 @@ func FileInfoHeader(fi os.FileInfo, link string) (*Header, error) {
 		}
 	}
 	if sysStat != nil {
-		return h, sysStat(fi, h)
+		if err := sysStat(fi, h); err != nil {
+			return h, err
+		}
+	}
+	if fn, ok := fi.(FileInfoNames); ok {
+		var err error
+		if h.Uname, err = fn.Uname(); err != nil {
+			return h, err
+		}
+		if h.Gname, err = fn.Gname(); err != nil {
+			return h, err
+		}
 	}
 	return h, nil
 }
 
+// DirHeader returns a header for a directory with the given name, to which
+// a slash is appended if it lacks one, and a mode of 0755.
+func DirHeader(name string) *Header {
+	if !strings.HasSuffix(name, "/") {
+		name += "/"
+	}
+	return &Header{Name: name, Typeflag: TypeDir, Mode: 0755}
+}
+
+// SymlinkHeader returns a header for a symbolic link with the given name
+// and target, and a mode of 0777.
+func SymlinkHeader(name, target string) *Header {
+	return &Header{Name: name, Typeflag: TypeSymlink, Linkname: target, Mode: 0777}
+}
+
+// DeviceHeader returns a header for a device with the given name, type flag,
+// which is TypeChar or TypeBlock, and device numbers, and a mode of 0600.
+func DeviceHeader(name string, typeflag byte, major, minor int64) *Header {
+	return &Header{Name: name, Typeflag: typeflag, Devmajor: major, Devminor: minor, Mode: 0600}
+}
+
+// FileInfoNames extends os.FileInfo to supply the user and group names
+// of the owner of a file, which FileInfoHeader uses in preference to any
+// other source. It allows implementations, such as virtual file systems,
+// to provide the names without consulting the system user database.
+type FileInfoNames interface {
+	os.FileInfo
+	Uname() (string, error) // User name of the owner
+	Gname() (string, error) // Group name of the owner
+}
+
 // isHeaderOnlyType checks if the given type flag is of the type that has no
 // data section even if a size is specified.
 func isHeaderOnlyType(flag byte) bool {
@@ -0,0 +1,314 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"archive/zip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"time"
+)
+
+// A Loss describes information about an entry that could not be represented
+// in the format that an archive was converted to.
+type Loss struct {
+	Name   string // Name of the affected entry, or empty for the archive
+	Reason string // Description of the information that was lost
+}
+
+func (l Loss) String() string {
+	if l.Name == "" {
+		return l.Reason
+	}
+	return l.Name + ": " + l.Reason
+}
+
+// Extra fields of zip files that are used to store Unix metadata, as defined
+// by Info-ZIP. See https://www.pkware.com/appnote and the Info-ZIP
+// extrafld.txt.
+const (
+	zipExtTimeID = 0x5455 // Extended timestamp
+	zipUnixID    = 0x7875 // Unix UID/GID of any size
+)
+
+// ToZip converts the tar archive read from tr into the zip archive written
+// to zw, in a single pass, and returns a description of every loss of
+// information, in archive order. It does not close zw.
+//
+// The modes of entries are stored as Unix attributes, their modification
+// and access times in an extended timestamp, and their numeric user and
+// group IDs in a Unix extra field, which are the conventions of Info-ZIP.
+// Symbolic links are stored with their target as their data. Regular files
+// are compressed with zip.Deflate.
+//
+// Hard links, user and group names, change times, fractional seconds,
+// device numbers, extended attributes, file flags, and other PAX records
+// cannot be represented, and are reported as losses. Entries that are hard
+// links or of an unknown type are omitted.
+func ToZip(zw *zip.Writer, tr *Reader) ([]Loss, error) {
+	var losses []Loss
+	lose := func(name, format string, args ...interface{}) {
+		losses = append(losses, Loss{name, fmt.Sprintf(format, args...)})
+	}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return losses, nil
+		}
+		if err != nil {
+			return losses, err
+		}
+
+		switch hdr.Typeflag {
+		case TypeXGlobalHeader:
+			continue // Records have been merged into the following headers
+		case TypeLink:
+			lose(hdr.Name, "omitted hard link to %s", hdr.Linkname)
+			continue
+		case TypeReg, TypeRegA, TypeCont, TypeSymlink, TypeChar, TypeBlock, TypeDir, TypeFifo:
+		default:
+			lose(hdr.Name, "omitted entry of unknown type %q", hdr.Typeflag)
+			continue
+		}
+
+		fh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return losses, err
+		}
+		fh.Name = hdr.Name
+		if hdr.Typeflag == TypeDir && !strings.HasSuffix(fh.Name, "/") {
+			fh.Name += "/"
+		}
+		fh.Extra = zipExtra(hdr)
+		if !isHeaderOnlyType(hdr.Typeflag) {
+			fh.Method = zip.Deflate
+		}
+		if hdr.Typeflag == TypeSymlink {
+			fh.UncompressedSize64 = uint64(len(hdr.Linkname))
+			fh.UncompressedSize = uint32(len(hdr.Linkname))
+		}
+
+		for _, reason := range headerLosses(hdr, true) {
+			lose(hdr.Name, reason)
+		}
+		if !fitsZipTime(hdr.ModTime) || (!hdr.AccessTime.IsZero() && !fitsZipTime(hdr.AccessTime)) {
+			lose(hdr.Name, "dropped times that are out of range")
+		}
+		if (hdr.Typeflag == TypeChar || hdr.Typeflag == TypeBlock) && (hdr.Devmajor != 0 || hdr.Devminor != 0) {
+			lose(hdr.Name, "dropped device numbers")
+		}
+
+		w, err := zw.CreateHeader(fh)
+		if err != nil {
+			return losses, err
+		}
+		switch {
+		case hdr.Typeflag == TypeSymlink:
+			_, err = io.WriteString(w, hdr.Linkname)
+		case !isHeaderOnlyType(hdr.Typeflag):
+			_, err = io.Copy(w, tr)
+		}
+		if err != nil {
+			return losses, err
+		}
+	}
+}
+
+// FromZip converts the zip archive zr into the tar archive written to tw,
+// and returns a description of every loss of information, in archive order.
+// It does not close tw.
+//
+// The Unix attributes, extended timestamps, and Unix extra fields used by
+// ToZip are recognized, so that converting an archive created by ToZip
+// reproduces the entries that were retained. Files with MS-DOS attributes
+// become regular files or directories, with a mode derived as done by
+// zip.FileHeader.Mode. The comments of the archive and of files are
+// reported as losses.
+func FromZip(tw *Writer, zr *zip.Reader) ([]Loss, error) {
+	var losses []Loss
+	if zr.Comment != "" {
+		losses = append(losses, Loss{"", "dropped archive comment"})
+	}
+	for _, f := range zr.File {
+		if err := fromZipFile(tw, f); err != nil {
+			return losses, err
+		}
+		if f.Comment != "" {
+			losses = append(losses, Loss{f.Name, "dropped comment"})
+		}
+	}
+	return losses, nil
+}
+
+func fromZipFile(tw *Writer, f *zip.File) error {
+	fi := f.FileInfo()
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		b, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		link = string(b)
+	}
+	hdr, err := FileInfoHeader(fi, link)
+	if err != nil {
+		return err
+	}
+	hdr.Name = f.Name
+	if fi.IsDir() && !strings.HasSuffix(hdr.Name, "/") {
+		hdr.Name += "/"
+	}
+	parseZipExtra(hdr, f.Extra)
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if hdr.Typeflag != TypeReg {
+		return nil
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	_, err = io.Copy(tw, rc)
+	return err
+}
+
+// headerLosses describes the fields of hdr that are lost when it is
+// converted to a format that only holds a numeric owner and a modification
+// time in whole seconds, and an access time if atime is set.
+func headerLosses(hdr *Header, atime bool) []string {
+	var reasons []string
+	if hdr.Uname != "" || hdr.Gname != "" {
+		reasons = append(reasons, "dropped user and group names")
+	}
+	if !atime && !hdr.AccessTime.IsZero() {
+		reasons = append(reasons, "dropped access time")
+	}
+	if !hdr.ChangeTime.IsZero() {
+		reasons = append(reasons, "dropped change time")
+	}
+	if hdr.ModTime.Nanosecond() != 0 || (atime && hdr.AccessTime.Nanosecond() != 0) {
+		reasons = append(reasons, "truncated times to whole seconds")
+	}
+	if len(hdr.Xattrs) > 0 {
+		reasons = append(reasons, "dropped extended attributes")
+	}
+	if hdr.FileFlags != "" {
+		reasons = append(reasons, "dropped file flags")
+	}
+	for k := range hdr.PAXRecords {
+		if !basicKeys[k] && !strings.HasPrefix(k, paxXattr) && !strings.HasPrefix(k, paxLibXattr) && !isSparseRecord(k) {
+			reasons = append(reasons, "dropped PAX records")
+			break
+		}
+	}
+	return reasons
+}
+
+// fitsZipTime reports whether t can be stored in an extended timestamp.
+func fitsZipTime(t time.Time) bool {
+	return t.Unix() >= -1<<31 && t.Unix() < 1<<31
+}
+
+// zipExtra returns the extra fields of a zip file that store the times
+// and numeric IDs of hdr.
+func zipExtra(hdr *Header) []byte {
+	le := binary.LittleEndian
+	var b []byte
+	field := func(id uint16, data []byte) {
+		var hdr [4]byte
+		le.PutUint16(hdr[:2], id)
+		le.PutUint16(hdr[2:], uint16(len(data)))
+		b = append(append(b, hdr[:]...), data...)
+	}
+
+	// Extended timestamp, in the format used in local headers.
+	var buf [9]byte
+	ts := buf[:1]
+	for bit, t := range []time.Time{hdr.ModTime, hdr.AccessTime} {
+		if !t.IsZero() && fitsZipTime(t) {
+			buf[0] |= 1 << uint(bit)
+			le.PutUint32(buf[len(ts):], uint32(t.Unix()))
+			ts = buf[:len(ts)+4]
+		}
+	}
+	if buf[0] != 0 {
+		field(zipExtTimeID, ts)
+	}
+
+	// Unix UID/GID, of version 1, with 8-byte IDs if they do not fit in 4.
+	uid, gid := hdr.Uid64(), hdr.Gid64()
+	if uid < 1<<32 && gid < 1<<32 {
+		var ids [11]byte
+		ids[0], ids[1], ids[6] = 1, 4, 4
+		le.PutUint32(ids[2:], uint32(uid))
+		le.PutUint32(ids[7:], uint32(gid))
+		field(zipUnixID, ids[:])
+	} else {
+		var ids [19]byte
+		ids[0], ids[1], ids[10] = 1, 8, 8
+		le.PutUint64(ids[2:], uint64(uid))
+		le.PutUint64(ids[11:], uint64(gid))
+		field(zipUnixID, ids[:])
+	}
+	return b
+}
+
+// parseZipExtra sets the times and numeric IDs of hdr from the extra fields
+// of a zip file, ignoring any that are malformed.
+func parseZipExtra(hdr *Header, extra []byte) {
+	le := binary.LittleEndian
+	for len(extra) >= 4 {
+		id, size := le.Uint16(extra), int(le.Uint16(extra[2:]))
+		extra = extra[4:]
+		if size > len(extra) {
+			return
+		}
+		field := extra[:size]
+		extra = extra[size:]
+
+		switch id {
+		case zipExtTimeID:
+			if len(field) < 1 {
+				continue
+			}
+			flags, times := field[0], field[1:]
+			for bit, t := range []*time.Time{&hdr.ModTime, &hdr.AccessTime} {
+				if flags&(1<<uint(bit)) == 0 || len(times) < 4 {
+					continue
+				}
+				*t = time.Unix(int64(int32(le.Uint32(times))), 0)
+				times = times[4:]
+			}
+		case zipUnixID:
+			if len(field) < 1 || field[0] != 1 {
+				continue
+			}
+			field = field[1:]
+			for _, set := range []func(int64){hdr.SetUid64, hdr.SetGid64} {
+				if len(field) < 1 || len(field) < 1+int(field[0]) {
+					break
+				}
+				n := int(field[0])
+				var id uint64
+				for i := n - 1; i >= 0; i-- {
+					id = id<<8 | uint64(field[1+i])
+				}
+				set(int64(id))
+				field = field[1+n:]
+			}
+		}
+	}
+}
@@ -0,0 +1,9 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+// Linux copy_file_range system call number.
+// See copyRange in clone_linux.go.
+const copyFileRangeTrap uintptr = 391
@@ -0,0 +1,422 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The "newc" cpio format, also known as the SVR4 format, is used by Linux
+// initramfs images and RPM payloads. Each entry has a header of 13
+// hexadecimal fields, followed by the NUL-terminated name and the data,
+// each padded to a multiple of 4 bytes. The archive ends with an entry
+// named "TRAILER!!!". The "crc" variant differs only in its magic number
+// and the checksum field.
+const (
+	cpioMagicNewc = "070701"
+	cpioMagicCRC  = "070702"
+	cpioTrailer   = "TRAILER!!!"
+
+	cpioHeaderSize  = 6 + 13*8
+	cpioMaxNameSize = 1 << 20
+	cpioMaxLinkSize = 1 << 20
+
+	c_ISFMT = 0170000 // Mask of the file type bits
+)
+
+// A cpioInode identifies a file by its device and inode numbers.
+type cpioInode struct{ major, minor, ino uint64 }
+
+// A CPIOReader provides sequential access to the contents of a cpio archive
+// in the "newc" or "crc" format. Entries are returned as a Header, as done
+// by Reader, with the type bits of the mode translated into a Typeflag.
+//
+// The checksums of the "crc" format are not verified.
+type CPIOReader struct {
+	r     io.Reader
+	nb    int64 // Number of unread bytes of the current entry
+	pad   int64 // Amount of padding after the current entry
+	err   error // Persistent error
+	links map[cpioInode]string
+}
+
+// NewCPIOReader creates a new CPIOReader reading from r.
+func NewCPIOReader(r io.Reader) *CPIOReader {
+	return &CPIOReader{r: r, links: make(map[cpioInode]string)}
+}
+
+// Next advances to the next entry in the cpio archive.
+// The Header.Size determines how many bytes can be read for the next file.
+// Any remaining data in the current file is automatically discarded.
+//
+// A regular file without data that shares its device and inode numbers
+// with an earlier entry is reported as a TypeLink to the name of the
+// earliest such entry. The data of symbolic links is returned as the
+// Linkname. io.EOF is returned at the end of the input, after the trailer
+// entry. An archive without a trailer entry reports io.ErrUnexpectedEOF.
+func (cr *CPIOReader) Next() (*Header, error) {
+	if cr.err != nil {
+		return nil, cr.err
+	}
+	hdr, err := cr.next()
+	cr.err = err
+	return hdr, err
+}
+
+func (cr *CPIOReader) next() (*Header, error) {
+	if err := cr.discard(cr.nb + cr.pad); err != nil {
+		return nil, err
+	}
+	cr.nb, cr.pad = 0, 0
+
+	var buf [cpioHeaderSize]byte
+	if _, err := io.ReadFull(cr.r, buf[:]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if magic := string(buf[:6]); magic != cpioMagicNewc && magic != cpioMagicCRC {
+		return nil, ErrHeader
+	}
+	var f [13]uint64
+	for i := range f {
+		v, err := strconv.ParseUint(string(buf[6+8*i:][:8]), 16, 32)
+		if err != nil {
+			return nil, ErrHeader
+		}
+		f[i] = v
+	}
+	ino, mode, uid, gid, nlink, mtime, size := f[0], f[1], f[2], f[3], f[4], f[5], int64(f[6])
+	major, minor, rmajor, rminor, namesize := f[7], f[8], f[9], f[10], f[11]
+
+	if namesize == 0 || namesize > cpioMaxNameSize {
+		return nil, ErrHeader
+	}
+	name := make([]byte, namesize+uint64(-(cpioHeaderSize+namesize)&3))
+	if _, err := io.ReadFull(cr.r, name); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	if name[namesize-1] != 0 {
+		return nil, ErrHeader
+	}
+	hdr := &Header{
+		Name:     string(name[:namesize-1]),
+		Mode:     int64(mode),
+		Uid:      int(uid),
+		Gid:      int(gid),
+		Size:     size,
+		ModTime:  time.Unix(int64(mtime), 0),
+		Devmajor: int64(rmajor),
+		Devminor: int64(rminor),
+	}
+	cr.nb, cr.pad = size, -size&3
+	if hdr.Name == cpioTrailer {
+		return nil, io.EOF
+	}
+
+	switch mode & c_ISFMT {
+	case c_ISREG:
+		hdr.Typeflag = TypeReg
+		if nlink > 1 {
+			id := cpioInode{major, minor, ino}
+			if link, ok := cr.links[id]; ok && size == 0 {
+				hdr.Typeflag, hdr.Linkname = TypeLink, link
+			} else if !ok {
+				cr.links[id] = hdr.Name
+			}
+		}
+	case c_ISDIR:
+		hdr.Typeflag = TypeDir
+	case c_ISLNK:
+		hdr.Typeflag = TypeSymlink
+		if size > cpioMaxLinkSize {
+			return nil, ErrHeader
+		}
+		link, err := ioutil.ReadAll(cr)
+		if err != nil {
+			return nil, err
+		}
+		hdr.Linkname = string(link)
+	case c_ISCHR:
+		hdr.Typeflag = TypeChar
+	case c_ISBLK:
+		hdr.Typeflag = TypeBlock
+	case c_ISFIFO:
+		hdr.Typeflag = TypeFifo
+	case c_ISSOCK:
+		return nil, fmt.Errorf("tar: cpio entry %q: sockets not supported", hdr.Name)
+	default:
+		return nil, ErrHeader
+	}
+	if isHeaderOnlyType(hdr.Typeflag) {
+		hdr.Size = 0
+		cr.nb, cr.pad = 0, cr.nb+cr.pad
+	}
+	return hdr, nil
+}
+
+// discard skips n bytes of the input.
+func (cr *CPIOReader) discard(n int64) error {
+	if n == 0 {
+		return nil
+	}
+	nd, err := io.CopyN(ioutil.Discard, cr.r, n)
+	if nd < n && (err == nil || err == io.EOF) {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Read reads from the current entry in the cpio archive.
+// It returns (0, io.EOF) when it reaches the end of that entry,
+// until Next is called to advance to the next entry.
+func (cr *CPIOReader) Read(b []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.nb == 0 {
+		return 0, io.EOF
+	}
+	if int64(len(b)) > cr.nb {
+		b = b[:cr.nb]
+	}
+	n, err := cr.r.Read(b)
+	cr.nb -= int64(n)
+	switch {
+	case err == io.EOF && cr.nb > 0:
+		err = io.ErrUnexpectedEOF
+		cr.err = err
+	case err != nil && err != io.EOF:
+		cr.err = err
+	}
+	return n, err
+}
+
+// A CPIOWriter provides sequential writing of a cpio archive in the "newc"
+// format. Call WriteHeader to begin a new file, and then call Write to
+// supply that file's data, writing exactly hdr.Size bytes in total.
+// Call Close to complete the archive.
+//
+// Entries are assigned consecutive inode numbers, and trailing slashes are
+// removed from the names of directories. Hard links cannot be written,
+// since the links to a file must share its inode number, which is not
+// known when the file is written.
+type CPIOWriter struct {
+	w    io.Writer
+	ino  uint64
+	name string // Name of the current entry
+	size int64  // Size of the current entry
+	nb   int64  // Number of unwritten bytes of the current entry
+	pad  int64  // Amount of padding to write after the current entry
+	err  error  // Persistent error
+}
+
+// NewCPIOWriter creates a new CPIOWriter writing to w.
+func NewCPIOWriter(w io.Writer) *CPIOWriter { return &CPIOWriter{w: w} }
+
+// WriteHeader writes hdr and prepares to accept the file's contents.
+// The Typeflag must be TypeReg, TypeDir, TypeSymlink, TypeChar, TypeBlock,
+// or TypeFifo; otherwise ErrHeader is returned. ErrFieldTooLong is
+// returned if a numeric field does not fit in 32 bits, including the size
+// and a modification time before 1970 or after 2106.
+func (cw *CPIOWriter) WriteHeader(hdr *Header) error {
+	if err := cw.flush(); err != nil {
+		return err
+	}
+	var mode uint64
+	size, link := hdr.Size, ""
+	switch hdr.Typeflag {
+	case TypeReg, TypeRegA:
+		mode = c_ISREG
+	case TypeDir:
+		mode = c_ISDIR
+		size = 0
+	case TypeSymlink:
+		mode = c_ISLNK
+		size, link = int64(len(hdr.Linkname)), hdr.Linkname
+	case TypeChar:
+		mode = c_ISCHR
+		size = 0
+	case TypeBlock:
+		mode = c_ISBLK
+		size = 0
+	case TypeFifo:
+		mode = c_ISFIFO
+		size = 0
+	default:
+		return ErrHeader
+	}
+	mode |= uint64(hdr.Mode) & 07777
+	name := hdr.Name
+	if hdr.Typeflag == TypeDir {
+		name = strings.TrimRight(name, "/")
+	}
+	if name == "" {
+		return ErrHeader
+	}
+
+	nlink := uint64(1)
+	if hdr.Typeflag == TypeDir {
+		nlink = 2
+	}
+	cw.ino++
+	f := []int64{int64(cw.ino), int64(mode), hdr.Uid64(), hdr.Gid64(), int64(nlink), hdr.ModTime.Unix(), size, 0, 0, hdr.Devmajor, hdr.Devminor}
+	for _, v := range f {
+		if v < 0 || v >= 1<<32 {
+			return ErrFieldTooLong
+		}
+	}
+	if err := cw.writeHeader(f, name); err != nil {
+		return err
+	}
+	cw.name, cw.size, cw.nb, cw.pad = name, size, size, -size&3
+	if link != "" {
+		if _, err := io.WriteString(cw, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeHeader writes a header with the fields in f, which exclude the size
+// of the name and the checksum, followed by name.
+func (cw *CPIOWriter) writeHeader(f []int64, name string) error {
+	b := make([]byte, 0, cpioHeaderSize+len(name)+4)
+	b = append(b, cpioMagicNewc...)
+	for _, v := range append(f, int64(len(name)+1), 0) {
+		b = append(b, fmt.Sprintf("%08X", v)...)
+	}
+	b = append(b, name...)
+	b = append(b, 0)
+	b = append(b, zeroBlock[:-len(b)&3]...)
+	_, err := cw.w.Write(b)
+	cw.err = err
+	return err
+}
+
+// flush finishes the data of the current entry and writes its padding.
+func (cw *CPIOWriter) flush() error {
+	if cw.err != nil {
+		return cw.err
+	}
+	if cw.nb > 0 {
+		return fmt.Errorf("archive/tar: cpio entry %q: wrote %d of %d bytes", cw.name, cw.size-cw.nb, cw.size)
+	}
+	if cw.pad > 0 {
+		_, cw.err = cw.w.Write(zeroBlock[:cw.pad])
+		cw.pad = 0
+	}
+	return cw.err
+}
+
+// Write writes to the current entry in the cpio archive.
+// Write returns the error ErrWriteTooLong if more than
+// Header.Size bytes are written after WriteHeader.
+func (cw *CPIOWriter) Write(b []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	overwrite := int64(len(b)) > cw.nb
+	if overwrite {
+		b = b[:cw.nb]
+	}
+	n, err := cw.w.Write(b)
+	cw.nb -= int64(n)
+	if err == nil && overwrite {
+		return n, ErrWriteTooLong // Non-fatal error
+	}
+	cw.err = err
+	return n, err
+}
+
+// Close closes the cpio archive by writing the trailer entry.
+// It reports an error if the current file was not fully written.
+// It does not close the underlying writer.
+func (cw *CPIOWriter) Close() error {
+	if cw.err == ErrWriteAfterClose {
+		return nil
+	}
+	err := cw.flush()
+	if err == nil {
+		err = cw.writeHeader([]int64{0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0}, cpioTrailer)
+	}
+	if err == nil {
+		cw.err = ErrWriteAfterClose
+	}
+	return err
+}
+
+// CPIOToTar copies the entries of the cpio archive read from cr to tw.
+// Slashes are appended to the names of directories. It does not close tw.
+func CPIOToTar(tw *Writer, cr *CPIOReader) error {
+	for {
+		hdr, err := cr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == TypeDir && !strings.HasSuffix(hdr.Name, "/") {
+			hdr.Name += "/"
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, cr); err != nil {
+			return err
+		}
+	}
+}
+
+// TarToCPIO converts the tar archive read from tr into the cpio archive
+// written to cw, and returns a description of every loss of information,
+// in archive order, as done by ToZip. It does not close cw.
+//
+// User and group names, access and change times, fractional seconds,
+// extended attributes, file flags, and PAX records cannot be represented,
+// and are reported as losses. Entries that are hard links or of an unsupported
+// type are omitted.
+func TarToCPIO(cw *CPIOWriter, tr *Reader) ([]Loss, error) {
+	var losses []Loss
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return losses, nil
+		}
+		if err != nil {
+			return losses, err
+		}
+		switch hdr.Typeflag {
+		case TypeXGlobalHeader:
+			continue // Records have been merged into the following headers
+		case TypeLink:
+			losses = append(losses, Loss{hdr.Name, "omitted hard link to " + hdr.Linkname})
+			continue
+		case TypeReg, TypeRegA, TypeSymlink, TypeChar, TypeBlock, TypeDir, TypeFifo:
+		default:
+			losses = append(losses, Loss{hdr.Name, fmt.Sprintf("omitted entry of unsupported type %q", hdr.Typeflag)})
+			continue
+		}
+		for _, reason := range headerLosses(hdr, false) {
+			losses = append(losses, Loss{hdr.Name, reason})
+		}
+		if err := cw.WriteHeader(hdr); err != nil {
+			return losses, err
+		}
+		if _, err := io.Copy(cw, tr); err != nil {
+			return losses, err
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bytes"
+	"crypto"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// paxDigest is the prefix of PAX records holding the digest of the data of
+// an entry, which is followed by the name of the digest algorithm.
+// The value is the hex-encoded digest.
+const paxDigest = "GO.digest."
+
+var (
+	digestMu sync.RWMutex
+	digests  = make(map[string]func() hash.Hash)
+
+	// digestHashes maps the names of digest algorithms to their
+	// implementations in the crypto registry, which are only available
+	// if the implementing package is linked into the binary.
+	digestHashes = map[string]crypto.Hash{
+		"sha256":      crypto.SHA256,
+		"sha384":      crypto.SHA384,
+		"sha512":      crypto.SHA512,
+		"sha512-256":  crypto.SHA512_256,
+		"blake2s-256": crypto.BLAKE2s_256,
+		"blake2b-256": crypto.BLAKE2b_256,
+		"blake2b-384": crypto.BLAKE2b_384,
+		"blake2b-512": crypto.BLAKE2b_512,
+	}
+)
+
+// RegisterDigest registers a digest algorithm under the given name for use
+// by Header.SetDigest and Reader.VerifyDigests, replacing any previous
+// registration of that name.
+//
+// The algorithms "sha256", "sha384", "sha512", "sha512-256", "blake2s-256",
+// "blake2b-256", "blake2b-384", and "blake2b-512" are provided through the
+// crypto registry, so that they need not be registered, but are only
+// available if the package implementing them is imported.
+// Other algorithms, such as BLAKE3, may be added with RegisterDigest.
+func RegisterDigest(name string, new func() hash.Hash) {
+	digestMu.Lock()
+	digests[name] = new
+	digestMu.Unlock()
+}
+
+// newDigest returns a new hash.Hash for the named algorithm,
+// or nil if it is not available.
+func newDigest(name string) hash.Hash {
+	digestMu.RLock()
+	new := digests[name]
+	digestMu.RUnlock()
+	if new != nil {
+		return new()
+	}
+	if h, ok := digestHashes[name]; ok && h.Available() {
+		return h.New()
+	}
+	return nil
+}
+
+// SetDigest computes the digest of the data read from r, which must be the
+// data of the entry, using the named algorithm and records it in the
+// PAXRecords of the header, where it may later be checked by a Reader with
+// VerifyDigests set. Headers with digests can only be encoded in the PAX
+// format.
+//
+// It reports ErrDigestUnavailable if the algorithm is not available.
+func (h *Header) SetDigest(name string, r io.Reader) error {
+	d := newDigest(name)
+	if d == nil {
+		return ErrDigestUnavailable
+	}
+	if _, err := io.Copy(d, r); err != nil {
+		return err
+	}
+	if h.PAXRecords == nil {
+		h.PAXRecords = make(map[string]string)
+	}
+	h.PAXRecords[paxDigest+name] = hex.EncodeToString(d.Sum(nil))
+	return nil
+}
+
+// A DigestError is reported by a Reader with both VerifyDigests and
+// DetailedErrors set for an entry whose data does not match a digest
+// recorded by Header.SetDigest.
+type DigestError struct {
+	Name      string // Name of the entry
+	Algorithm string // Name of the digest algorithm
+	Want      []byte // Recorded digest, or nil if the record is malformed
+	Got       []byte // Digest of the data that was read
+}
+
+func (e *DigestError) Error() string {
+	return fmt.Sprintf("tar: entry %q: %s digest mismatch", e.Name, e.Algorithm)
+}
+
+// digestCheck is a digest being computed over the data of an entry,
+// along with the name of its algorithm and the expected value.
+type digestCheck struct {
+	hash.Hash
+	name string
+	want string
+}
+
+// newDigestChecks returns the checks for the digest records in paxHdrs that
+// use an available algorithm, in order of the algorithm names.
+func newDigestChecks(paxHdrs map[string]string) []digestCheck {
+	var names []string
+	for k := range paxHdrs {
+		if strings.HasPrefix(k, paxDigest) {
+			names = append(names, strings.TrimPrefix(k, paxDigest))
+		}
+	}
+	sort.Strings(names)
+
+	var checks []digestCheck
+	for _, name := range names {
+		if d := newDigest(name); d != nil {
+			checks = append(checks, digestCheck{d, name, paxHdrs[paxDigest+name]})
+		}
+	}
+	return checks
+}
+
+// verifyDigests returns a *DigestError for the first digest in checks that
+// does not match, or nil if all of them match.
+func verifyDigests(name string, checks []digestCheck) *DigestError {
+	for _, c := range checks {
+		want, err := hex.DecodeString(c.want)
+		if got := c.Sum(nil); err != nil || !bytes.Equal(got, want) {
+			if err != nil {
+				want = nil
+			}
+			return &DigestError{Name: name, Algorithm: c.name, Want: want, Got: got}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// EditHeader rewrites in place the header of the i-th entry of the
+// uncompressed archive in f, counting from zero as Index does, such as to
+// fix its timestamps or ownership without rewriting the archive. The header
+// is read, passed to edit, and then encoded as by a Writer. The headers of
+// the other entries are skipped over by seeking, so that only the headers
+// of the entries up to the i-th one are read.
+//
+// The encoded header, including any extended header or GNU long name
+// entries, must occupy the same number of blocks as before, so that the
+// data of the entry stays in place; otherwise, an error naming the entry
+// is reported and f is not modified. The size of the entry cannot be
+// changed, and the headers of sparse files and global headers cannot be
+// edited. Records of preceding global headers that the entry inherits are
+// not written in its header.
+func EditHeader(f *os.File, i int, edit func(hdr *Header) error) error {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	tr := NewReader(f)
+	tr.AllowInsecurePaths = true
+	var start int64
+	var hdr *Header
+	for n := 0; n <= i; n++ {
+		start = tr.nextOff
+		var err error
+		if hdr, err = tr.Next(); err == io.EOF {
+			return fmt.Errorf("archive/tar: archive has only %d entries", n)
+		} else if err != nil {
+			return err
+		}
+	}
+	if _, ok := tr.curr.(*sparseFileReader); ok || hdr.Typeflag == TypeXGlobalHeader {
+		return fmt.Errorf("archive/tar: entry %q: header cannot be edited", hdr.Name)
+	}
+	dataOff := tr.nextOff - tr.pad - tr.numBytes()
+
+	// Inherited records are not part of the entry's own header.
+	for k, v := range tr.GlobalPAXRecords() {
+		if hdr.PAXRecords[k] == v {
+			delete(hdr.PAXRecords, k)
+		}
+	}
+	name, size := hdr.Name, hdr.Size
+	if err := edit(hdr); err != nil {
+		return err
+	}
+	if hdr.Size != size {
+		return fmt.Errorf("archive/tar: entry %q: size cannot be changed", name)
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if tr.format&formatGNU != 0 {
+		tw.NumericEncoding = NumericBase256
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if int64(b.Len()) != dataOff-start {
+		return fmt.Errorf("archive/tar: entry %q: edited header takes %d bytes instead of %d", name, b.Len(), dataOff-start)
+	}
+	if _, err := f.WriteAt(b.Bytes(), start); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"strings"
+	"sync"
+)
+
+// A PAXExtension translates the PAX records of a vendor namespace, such as
+// "SCHILY.", "LIBARCHIVE.", "GNU.", or "SUN.", to and from a structured
+// value held in Header.Extensions.
+//
+// The records passed to and returned by its methods have their keys
+// stripped of the namespace prefix.
+type PAXExtension interface {
+	// DecodePAX returns the value represented by the records of the
+	// namespace that apply to an entry. It is only called if there is
+	// at least one such record.
+	DecodePAX(records map[string]string) (interface{}, error)
+
+	// EncodePAX returns the records that represent v, which is
+	// a value held in Header.Extensions for the namespace.
+	EncodePAX(v interface{}) (map[string]string, error)
+}
+
+var (
+	paxExtMu sync.RWMutex
+	paxExts  map[string]PAXExtension // Keyed by namespace prefix
+)
+
+// RegisterPAXExtension registers ext for the PAX records whose keys begin
+// with prefix, which must end with a period. It panics if an extension
+// is already registered for prefix.
+//
+// A registered extension is used by every Reader and Writer. Records of the
+// namespace that are used by the package itself, such as the extended
+// attributes of "SCHILY.xattr." and the sparse maps of "GNU.sparse.",
+// are passed to it as well, but the corresponding Header fields take
+// precedence over the records it encodes.
+func RegisterPAXExtension(prefix string, ext PAXExtension) {
+	if !strings.HasSuffix(prefix, ".") || strings.ContainsAny(prefix, "=\x00") {
+		panic("tar: invalid PAX extension prefix " + prefix)
+	}
+	paxExtMu.Lock()
+	defer paxExtMu.Unlock()
+	if _, dup := paxExts[prefix]; dup {
+		panic("tar: PAX extension already registered for " + prefix)
+	}
+	if paxExts == nil {
+		paxExts = make(map[string]PAXExtension)
+	}
+	paxExts[prefix] = ext
+}
+
+// paxExtension returns the extension registered for prefix, if any.
+func paxExtension(prefix string) PAXExtension {
+	paxExtMu.RLock()
+	defer paxExtMu.RUnlock()
+	return paxExts[prefix]
+}
+
+// decodePAXExtensions sets hdr.Extensions from the non-empty records in
+// headers that belong to the namespace of a registered extension.
+func decodePAXExtensions(hdr *Header, headers map[string]string) error {
+	paxExtMu.RLock()
+	defer paxExtMu.RUnlock()
+	for prefix, ext := range paxExts {
+		var records map[string]string
+		for k, v := range headers {
+			if v != "" && strings.HasPrefix(k, prefix) {
+				if records == nil {
+					records = make(map[string]string)
+				}
+				records[k[len(prefix):]] = v
+			}
+		}
+		if records == nil {
+			continue
+		}
+		v, err := ext.DecodePAX(records)
+		if err != nil {
+			return ErrHeader
+		}
+		if hdr.Extensions == nil {
+			hdr.Extensions = make(map[string]interface{})
+		}
+		hdr.Extensions[prefix] = v
+	}
+	return nil
+}
+
+// encodePAXExtensions adds the records that represent h.Extensions to
+// paxHdrs, other than those already present and sparse records, which
+// are only written by Writer.WriteSparseHeader. It reports whether every
+// extension is registered and could be encoded.
+func encodePAXExtensions(h *Header, paxHdrs map[string]string) bool {
+	for prefix, v := range h.Extensions {
+		ext := paxExtension(prefix)
+		if ext == nil {
+			return false
+		}
+		records, err := ext.EncodePAX(v)
+		if err != nil {
+			return false
+		}
+		for k, v := range records {
+			k = prefix + k
+			if _, ok := paxHdrs[k]; ok || isSparseRecord(k) {
+				continue // Header fields take precedence
+			}
+			paxHdrs[k] = v
+		}
+	}
+	return true
+}
+
+// copyExtensions returns a shallow copy of m.
+func copyExtensions(m map[string]interface{}) map[string]interface{} {
+	if m == nil {
+		return nil
+	}
+	m2 := make(map[string]interface{}, len(m))
+	for k, v := range m {
+		m2[k] = v
+	}
+	return m2
+}
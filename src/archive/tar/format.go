@@ -65,15 +65,33 @@ func (b *block) Sparse() sparseArray { return (sparseArray)(b[:]) }
 // It then attempts to guess the specific format based on magic values.
 // If the checksum fails, then formatUnknown is returned.
 func (b *block) GetFormat() (format int) {
-	// Verify checksum.
+	if !b.validChecksum(ChecksumEither) {
+		return formatUnknown
+	}
+	return b.guessFormat()
+}
+
+// validChecksum reports whether the checksum field of the block holds
+// a checksum that is accepted by policy.
+func (b *block) validChecksum(policy ChecksumPolicy) bool {
 	var p parser
 	value := p.parseOctal(b.V7().Chksum())
 	chksum1, chksum2 := b.ComputeChecksum()
-	if p.err != nil || (value != chksum1 && value != chksum2) {
-		return formatUnknown
+	switch {
+	case p.err != nil:
+		return false
+	case policy == ChecksumUnsigned:
+		return value == chksum1
+	case policy == ChecksumSigned:
+		return value == chksum2
+	default:
+		return value == chksum1 || value == chksum2
 	}
+}
 
-	// Guess the magic values.
+// guessFormat guesses the specific format of the block, which is assumed
+// to be a valid tar header, based on magic values.
+func (b *block) guessFormat() (format int) {
 	magic := string(b.USTAR().Magic())
 	version := string(b.USTAR().Version())
 	trailer := string(b.STAR().Trailer())
@@ -134,6 +152,11 @@ func (b *block) ComputeChecksum() (unsigned, signed int64) {
 	return unsigned, signed
 }
 
+// IsZero reports whether the block consists entirely of zeros.
+func (b *block) IsZero() bool {
+	return *b == zeroBlock
+}
+
 // Reset clears the block with all zeros.
 func (b *block) Reset() {
 	*b = block{}
@@ -162,6 +185,7 @@ func (h *headerGNU) DevMajor() []byte    { return h[329:][:8] }
 func (h *headerGNU) DevMinor() []byte    { return h[337:][:8] }
 func (h *headerGNU) AccessTime() []byte  { return h[345:][:12] }
 func (h *headerGNU) ChangeTime() []byte  { return h[357:][:12] }
+func (h *headerGNU) Offset() []byte      { return h[369:][:12] }
 func (h *headerGNU) Sparse() sparseArray { return (sparseArray)(h[386:][:24*4+1]) }
 func (h *headerGNU) RealSize() []byte    { return h[483:][:12] }
 
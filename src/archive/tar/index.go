@@ -0,0 +1,296 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"sync"
+)
+
+// An Index provides random access to the entries of a tar archive
+// stored in an io.ReaderAt.
+//
+// The methods of an Index are safe for concurrent use by multiple goroutines,
+// and the readers returned by Open may be used concurrently with each other.
+type Index struct {
+	r       io.ReaderAt
+	b       []byte // Archive contents, if created by NewIndexBytes
+	entries []indexEntry
+	names   map[string]int // Index of the last entry with each name
+
+	// Set if the Index was read from a trailing index by OpenIndex,
+	// in which case headers are read as needed.
+	lazy bool
+	mu   sync.Mutex // Guards the headers of entries
+	size int64      // Size of the archive
+	alg  string     // Name of the digest algorithm of the index
+
+	// Set if the Index was created by NewIndexFile, in which case entries
+	// and names are unused.
+	file *indexFile
+
+	// The directory tree, built by the first call to ReadDir.
+	tree  sync.Once
+	files map[string]int      // Index of the last entry with each cleaned name
+	dirs  map[string][]string // Sorted cleaned names of the files in each directory
+}
+
+type indexEntry struct {
+	hdr    *Header
+	offset int64         // Offset of the encoded data in the archive
+	length int64         // Length of the encoded data
+	sp     []sparseEntry // Sparse map, if this is a sparse file
+
+	// Fields recorded by a trailing index.
+	hoff int64  // Offset of the first header block of the entry
+	typ  byte   // Type flag of the entry
+	name string // Name of the entry
+	sum  []byte // Digest of the encoded data, if any
+}
+
+// NewIndex reads the headers of the tar archive in r, which has the given
+// size, and returns an Index of its entries in archive order, as returned
+// by Reader.Next.
+//
+// If any entry has an insecure name (see Reader.AllowInsecurePaths),
+// the complete Index is returned along with ErrInsecurePath.
+func NewIndex(r io.ReaderAt, size int64) (*Index, error) {
+	ix := &Index{r: r, names: make(map[string]int)}
+	var insecure bool
+	tr := NewReader(io.NewSectionReader(r, 0, size))
+	for {
+		hdr, err := tr.Next()
+		if err == ErrInsecurePath {
+			insecure, err = true, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e := indexEntry{hdr: hdr, length: tr.numBytes()}
+		e.offset = tr.dataOffset()
+		if sfr, ok := tr.curr.(*sparseFileReader); ok {
+			e.sp = append([]sparseEntry{}, sfr.sp...)
+		}
+		if hdr.Typeflag != TypeXGlobalHeader {
+			ix.names[hdr.Name] = len(ix.entries)
+		}
+		ix.entries = append(ix.entries, e)
+	}
+	if insecure {
+		return ix, ErrInsecurePath
+	}
+	return ix, nil
+}
+
+// NewIndexBytes is like NewIndex, but reads the archive from b such that
+// the data of entries can be obtained without copying using Bytes.
+// The caller must not modify b while the Index is in use.
+//
+// This is useful for archives that are memory-mapped or otherwise already
+// reside in memory in their entirety.
+func NewIndexBytes(b []byte) (*Index, error) {
+	ix, err := NewIndex(bytes.NewReader(b), int64(len(b)))
+	if ix != nil {
+		ix.b = b
+	}
+	return ix, err
+}
+
+// Len reports the number of entries in the archive.
+func (ix *Index) Len() int {
+	if ix.file != nil {
+		return ix.file.n
+	}
+	return len(ix.entries)
+}
+
+// Lookup returns the index of the entry with the given name, compared
+// exactly with Header.Name, and reports whether there is one. If several
+// entries have the name, the last one is returned, which is the one that
+// takes effect when the archive is extracted. Global headers are never
+// returned.
+func (ix *Index) Lookup(name string) (int, bool) {
+	if ix.file != nil {
+		_, i, err := ix.file.find(name)
+		return i - 1, err == nil && i > 0
+	}
+	i, ok := ix.names[name]
+	return i, ok
+}
+
+// ReadDir returns the files in the directory with the given name, sorted by
+// name, as ioutil.ReadDir does, such that the archive can be walked as a
+// tree. Names are cleaned as ReadMap does, as are the names of entries, so
+// the root directory is ".", and where several entries have the same
+// name, the last one is listed. The Sys method of each os.FileInfo returns
+// the *Header of its entry.
+//
+// Directories that contain entries but have none of their own, as in
+// archives made by some build tools, are listed with a mode of 0555, as
+// for ReadMap, and with a *Header of type TypeDir that is not that of
+// any entry.
+func (ix *Index) ReadDir(name string) ([]os.FileInfo, error) {
+	ix.tree.Do(ix.buildTree)
+	name = mapName(name)
+	i, isEntry := ix.files[name]
+	if isEntry && !ix.Header(i).FileInfo().IsDir() {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	names, ok := ix.dirs[name]
+	if !ok && !isEntry && name != "." {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	fis := make([]os.FileInfo, 0, len(names))
+	for _, name := range names {
+		if i, ok := ix.files[name]; ok {
+			fis = append(fis, ix.Header(i).FileInfo())
+		} else {
+			fis = append(fis, headerFileInfo{&Header{Name: name + "/", Typeflag: TypeDir, Mode: 0555}})
+		}
+	}
+	return fis, nil
+}
+
+// buildTree builds the directory tree of ix from the names of its entries.
+func (ix *Index) buildTree() {
+	ix.files = make(map[string]int)
+	add := func(name string, i int) {
+		name = mapName(name)
+		if j, ok := ix.files[name]; !ok || i > j {
+			ix.files[name] = i
+		}
+	}
+	if ix.file != nil {
+		ix.file.records(func(i int, off int64, e *indexEntry) error {
+			if e.typ != TypeXGlobalHeader {
+				add(e.name, i)
+			}
+			return nil
+		})
+	}
+	for name, i := range ix.names {
+		add(name, i)
+	}
+	ix.dirs = make(map[string][]string)
+	added := make(map[string]bool)
+	for name := range ix.files {
+		for ; name != "." && !added[name]; name = path.Dir(name) {
+			added[name] = true
+			dir := path.Dir(name)
+			ix.dirs[dir] = append(ix.dirs[dir], name)
+		}
+	}
+	for _, names := range ix.dirs {
+		sort.Strings(names)
+	}
+}
+
+// Header returns a copy of the header of the i-th entry.
+func (ix *Index) Header(i int) *Header {
+	hdr := *ix.entry(i).hdr
+	hdr.Xattrs = copyRecords(hdr.Xattrs)
+	hdr.PAXRecords = copyRecords(hdr.PAXRecords)
+	hdr.Extensions = copyExtensions(hdr.Extensions)
+	return &hdr
+}
+
+// Open returns a reader for the data of the i-th entry, which is independent
+// of any other reader returned by Open. As with Reader.Read, special types
+// such as TypeDir have no data, regardless of what Header.Size claims.
+func (ix *Index) Open(i int) io.Reader {
+	e := ix.entry(i)
+	var r numBytesReader = &regFileReader{
+		r:  io.NewSectionReader(ix.r, e.offset, e.length),
+		nb: e.length,
+	}
+	if e.sp != nil {
+		// The sparse map was validated when the entry was read.
+		sp := append([]sparseEntry{}, e.sp...)
+		r, _ = newSparseFileReader(r, sp, e.hdr.Size)
+	}
+	return r
+}
+
+// Bytes returns the data of the i-th entry as a sub-slice of the slice
+// passed to NewIndexBytes, which must not be modified by the caller.
+// It reports false if the Index was not created by NewIndexBytes or if the
+// entry is a sparse file, whose data is not stored contiguously, in which
+// case Open must be used instead.
+func (ix *Index) Bytes(i int) ([]byte, bool) {
+	e := ix.entry(i)
+	if ix.b == nil || e.sp != nil {
+		return nil, false
+	}
+	return ix.b[e.offset:][:e.length:e.length], true
+}
+
+// DataRange returns the offset and length of the data of the i-th entry
+// as stored in the archive, such as to serve it with an HTTP range request
+// to the storage holding the archive. For a sparse file, this is the data
+// of its fragments, excluding its holes and any sparse map.
+func (ix *Index) DataRange(i int) (offset, length int64) {
+	e := ix.entry(i)
+	return e.offset, e.length
+}
+
+// Section returns an io.SectionReader for the data of the i-th entry,
+// which is independent of any other reader returned by Index, and which,
+// being an io.ReadSeeker, may be passed to http.ServeContent to serve a
+// single file out of a stored archive with support for range requests.
+// It reports false if the entry is a sparse file, whose data is not stored
+// contiguously, in which case Open must be used instead.
+func (ix *Index) Section(i int) (*io.SectionReader, bool) {
+	e := ix.entry(i)
+	if e.sp != nil {
+		return nil, false
+	}
+	return io.NewSectionReader(ix.r, e.offset, e.length), true
+}
+
+// CopyTo writes the data of the i-th entry to dst at its current offset,
+// and returns the number of bytes written. Unlike copying from the reader
+// returned by Open, it does not necessarily transfer the data: if the
+// io.ReaderAt passed to NewIndex is an *os.File on the same file system as
+// dst, which supports sharing data between files (such as XFS or Btrfs on
+// Linux), the blocks of the entry are cloned instead of copied, which makes
+// extracting large files nearly instantaneous.
+//
+// Blocks can only be cloned if the data of the entry, which is aligned to
+// 512 bytes in the archive, is aligned to the block size of the file system,
+// as is the offset of dst. Any remaining data is copied, within the kernel
+// with copy_file_range(2) on Linux if it is supported for the two files.
+// The data of sparse files is always copied.
+func (ix *Index) CopyTo(i int, dst *os.File) (int64, error) {
+	e := ix.entry(i)
+	var src io.Reader = ix.Open(i)
+	var n int64
+	if f, ok := ix.r.(*os.File); ok && e.sp == nil {
+		off, err := dst.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return 0, err
+		}
+		n = cloneRange(dst, f, off, e.offset, e.length)
+		if n < e.length {
+			n += copyRange(dst, f, off+n, e.offset+n, e.length-n)
+		}
+		if n > 0 {
+			if _, err := dst.Seek(n, io.SeekCurrent); err != nil {
+				return n, err
+			}
+			src = io.NewSectionReader(f, e.offset+n, e.length-n)
+		}
+	}
+	nc, err := io.Copy(dst, src)
+	return n + nc, err
+}
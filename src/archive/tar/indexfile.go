@@ -0,0 +1,274 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// NewIndexFile is like NewIndex, but keeps the entries of the Index in the
+// file f instead of in memory, so that the memory used by the Index does
+// not grow with the number of entries, as for archives with tens of
+// millions of them. Only the names and the offsets of the entries are
+// stored in f, which NewIndexFile overwrites, and the header of an entry
+// is read from r each time that it is needed, which any method other than
+// Len and Lookup does. The caller must not modify f while the Index is in
+// use, and should remove it afterward; f is typically created with
+// ioutil.TempFile.
+//
+// The directory tree used by ReadDir is still kept in memory.
+// If f cannot be read, Lookup reports that there is no entry, and the
+// Header method returns an empty header.
+func NewIndexFile(r io.ReaderAt, size int64, f *os.File) (*Index, error) {
+	ix := &Index{r: r, size: size, file: &indexFile{f: f}}
+	xf := ix.file
+	if err := f.Truncate(0); err != nil {
+		return nil, err
+	}
+	fw := &fileWriter{f: f}
+	w := bufio.NewWriter(fw)
+	var insecure bool
+	var hoff int64
+	tr := NewReader(io.NewSectionReader(r, 0, size))
+	for {
+		hdr, err := tr.Next()
+		if err == ErrInsecurePath {
+			insecure, err = true, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		e := indexEntry{hoff: hoff, offset: tr.dataOffset(), length: tr.numBytes(), typ: hdr.Typeflag, name: hdr.Name}
+		hoff = e.offset + e.length
+		hoff += -hoff & (blockSize - 1)
+		if err := writeIndexRecord(w, &e); err != nil {
+			return nil, err
+		}
+		if e.typ == TypeXGlobalHeader {
+			xf.globals = append(xf.globals, xf.n)
+		}
+		xf.n++
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	if err := xf.build(fw.off); err != nil {
+		return nil, err
+	}
+	if insecure {
+		return ix, ErrInsecurePath
+	}
+	return ix, nil
+}
+
+// An indexFile holds the entries of an Index created by NewIndexFile.
+//
+// The file starts with a record for each entry, in archive order, which
+// holds the offset of its first header block, the offset and length of its
+// data, its type flag, the length of its name, and its name. The records
+// are followed by a table of their offsets, and then by a hash table of
+// the names of the entries that are not global headers, with open
+// addressing. Each slot of the hash table holds the hash of a name and one
+// more than the index of the last entry with the name, or zero if the slot
+// is empty.
+type indexFile struct {
+	f       *os.File
+	n       int    // Number of entries
+	offsets int64  // Offset of the table of the offsets of the records
+	table   int64  // Offset of the hash table
+	slots   uint64 // Number of slots in the hash table, a power of two
+	globals []int  // Indexes of the global headers
+}
+
+const (
+	indexRecordLen = 8 + 8 + 8 + 1 + 4 // Length of a record, before the name
+	indexSlotLen   = 8 + 8             // Length of a slot of the hash table
+)
+
+// writeIndexRecord writes the record of e to w.
+func writeIndexRecord(w *bufio.Writer, e *indexEntry) error {
+	var b [indexRecordLen]byte
+	binary.LittleEndian.PutUint64(b[0:], uint64(e.hoff))
+	binary.LittleEndian.PutUint64(b[8:], uint64(e.offset))
+	binary.LittleEndian.PutUint64(b[16:], uint64(e.length))
+	b[24] = e.typ
+	binary.LittleEndian.PutUint32(b[25:], uint32(len(e.name)))
+	w.Write(b[:])
+	_, err := w.WriteString(e.name)
+	return err
+}
+
+// build writes the table of offsets and the hash table after the records
+// of the xf.n entries, which end at the offset end of the file.
+func (xf *indexFile) build(end int64) error {
+	xf.offsets = end
+	xf.table = xf.offsets + 8*int64(xf.n)
+	xf.slots = 1
+	for xf.slots < 2*uint64(xf.n) {
+		xf.slots <<= 1
+	}
+	if err := xf.f.Truncate(xf.table + int64(xf.slots)*indexSlotLen); err != nil {
+		return err
+	}
+
+	// Write the table of offsets, and then fill in the hash table,
+	// which requires it.
+	w := bufio.NewWriter(&fileWriter{f: xf.f, off: xf.offsets})
+	err := xf.records(func(i int, off int64, e *indexEntry) error {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], uint64(off))
+		_, err := w.Write(b[:])
+		return err
+	})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		return err
+	}
+	return xf.records(func(i int, off int64, e *indexEntry) error {
+		if e.typ == TypeXGlobalHeader {
+			return nil
+		}
+		s, _, err := xf.find(e.name)
+		if err != nil {
+			return err
+		}
+		var b [indexSlotLen]byte
+		binary.LittleEndian.PutUint64(b[0:], indexHash(e.name))
+		binary.LittleEndian.PutUint64(b[8:], uint64(i)+1)
+		_, err = xf.f.WriteAt(b[:], xf.table+int64(s)*indexSlotLen)
+		return err
+	})
+}
+
+// records calls fn with the index, the offset, and the decoded record of
+// each entry in turn.
+func (xf *indexFile) records(fn func(i int, off int64, e *indexEntry) error) error {
+	br := bufio.NewReader(io.NewSectionReader(xf.f, 0, xf.offsets))
+	var off int64
+	for i := 0; i < xf.n; i++ {
+		var b [indexRecordLen]byte
+		if _, err := io.ReadFull(br, b[:]); err != nil {
+			return err
+		}
+		e := decodeIndexRecord(b[:])
+		name := make([]byte, binary.LittleEndian.Uint32(b[25:]))
+		if _, err := io.ReadFull(br, name); err != nil {
+			return err
+		}
+		e.name = string(name)
+		if err := fn(i, off, &e); err != nil {
+			return err
+		}
+		off += indexRecordLen + int64(len(name))
+	}
+	return nil
+}
+
+// decodeIndexRecord decodes the fields of a record other than the name.
+func decodeIndexRecord(b []byte) indexEntry {
+	return indexEntry{
+		hoff:   int64(binary.LittleEndian.Uint64(b[0:])),
+		offset: int64(binary.LittleEndian.Uint64(b[8:])),
+		length: int64(binary.LittleEndian.Uint64(b[16:])),
+		typ:    b[24],
+	}
+}
+
+// record reads the record of the i-th entry.
+func (xf *indexFile) record(i int) (indexEntry, error) {
+	var b [indexRecordLen]byte
+	if _, err := xf.f.ReadAt(b[:8], xf.offsets+8*int64(i)); err != nil {
+		return indexEntry{}, err
+	}
+	off := int64(binary.LittleEndian.Uint64(b[:]))
+	if _, err := xf.f.ReadAt(b[:], off); err != nil {
+		return indexEntry{}, err
+	}
+	e := decodeIndexRecord(b[:])
+	name := make([]byte, binary.LittleEndian.Uint32(b[25:]))
+	if _, err := xf.f.ReadAt(name, off+indexRecordLen); err != nil {
+		return indexEntry{}, err
+	}
+	e.name = string(name)
+	return e, nil
+}
+
+// find returns the slot of the hash table that holds the given name,
+// or the empty slot where it would be added, and one more than the index
+// of its entry, or zero if there is none.
+func (xf *indexFile) find(name string) (uint64, int, error) {
+	h := indexHash(name)
+	for s := h & (xf.slots - 1); ; s = (s + 1) & (xf.slots - 1) {
+		var b [indexSlotLen]byte
+		if _, err := xf.f.ReadAt(b[:], xf.table+int64(s)*indexSlotLen); err != nil {
+			return 0, 0, err
+		}
+		i := int(binary.LittleEndian.Uint64(b[8:]))
+		if i == 0 {
+			return s, 0, nil
+		}
+		if binary.LittleEndian.Uint64(b[0:]) == h {
+			e, err := xf.record(i - 1)
+			if err != nil {
+				return 0, 0, err
+			}
+			if e.name == name {
+				return s, i, nil
+			}
+		}
+	}
+}
+
+// entry returns the i-th entry, with its header read from the archive
+// of ix.
+func (xf *indexFile) entry(ix *Index, i int) *indexEntry {
+	e, err := xf.record(i)
+	if err != nil {
+		return &indexEntry{hdr: new(Header)}
+	}
+	var globals map[string]string
+	if e.typ != TypeXGlobalHeader {
+		for _, j := range xf.globals {
+			if j >= i {
+				break
+			}
+			globals = mergePAXRecords(globals, xf.entry(ix, j).hdr.PAXRecords)
+		}
+	}
+	ix.readEntry(&e, globals)
+	return &e
+}
+
+// indexHash returns the 64-bit FNV-1a hash of name.
+func indexHash(name string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// A fileWriter writes sequentially to a file from the offset off,
+// regardless of the offset of the file.
+type fileWriter struct {
+	f   *os.File
+	off int64
+}
+
+func (w *fileWriter) Write(b []byte) (int, error) {
+	n, err := w.f.WriteAt(b, w.off)
+	w.off += int64(n)
+	return n, err
+}
@@ -0,0 +1,97 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A JournalRecord is a record of Writer.Journal, which describes the last
+// entry of an archive that was completely written.
+type JournalRecord struct {
+	Name   string // Name of the entry
+	Offset int64  // Offset in the archive at which the entry ends
+}
+
+// writeJournal appends the record for the entry that was just flushed to
+// tw.Journal, once any buffered output has been written out.
+// Each record is a line of the form "offset quoted-name".
+func (tw *Writer) writeJournal() error {
+	if tw.bw != nil {
+		if err := tw.bw.Flush(); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(tw.Journal, "%d %s\n", tw.off, strconv.Quote(tw.name))
+	return err
+}
+
+// ReadJournal returns the last record of a journal written by a Writer.
+// A final record that is incomplete, as left by a crash during a write to
+// the journal, is ignored in favor of the preceding one. If the journal
+// holds no complete record, ReadJournal returns the zero JournalRecord,
+// which stands for the empty archive.
+func ReadJournal(r io.Reader) (JournalRecord, error) {
+	var rec JournalRecord
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadString('\n')
+		if err == io.EOF {
+			return rec, nil // Ignore an incomplete record
+		}
+		if err != nil {
+			return rec, err
+		}
+		line = line[:len(line)-1]
+		i := strings.IndexByte(line, ' ')
+		if i < 0 {
+			return rec, fmt.Errorf("archive/tar: malformed journal record %q", line)
+		}
+		off, err := strconv.ParseInt(line[:i], 10, 64)
+		name, err2 := strconv.Unquote(line[i+1:])
+		if err != nil || err2 != nil || off < 0 || off%blockSize != 0 {
+			return rec, fmt.Errorf("archive/tar: malformed journal record %q", line)
+		}
+		rec = JournalRecord{Name: name, Offset: off}
+	}
+}
+
+// RecoverArchive finalizes f, an archive that was partially written from
+// its start by a Writer with a Journal, such as before a crash. It reads
+// the last record of the journal from journal, truncates f to the end of
+// the entry that it describes, and then writes the end-of-archive trailer
+// and syncs f, such that f holds the entries that were completely written.
+// It returns the record that was used.
+//
+// It reports an error without modifying f if f is shorter than the
+// record implies, as when its data was not synced before the journal.
+func RecoverArchive(f *os.File, journal io.Reader) (JournalRecord, error) {
+	rec, err := ReadJournal(journal)
+	if err != nil {
+		return rec, err
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		return rec, err
+	}
+	if fi.Size() < rec.Offset {
+		return rec, fmt.Errorf("archive/tar: archive is %d bytes, but the journal records %d", fi.Size(), rec.Offset)
+	}
+	if err := f.Truncate(rec.Offset); err != nil {
+		return rec, err
+	}
+	if _, err := f.WriteAt(zeroBlock[:], rec.Offset); err != nil {
+		return rec, err
+	}
+	if _, err := f.WriteAt(zeroBlock[:], rec.Offset+blockSize); err != nil {
+		return rec, err
+	}
+	return rec, f.Sync()
+}
@@ -0,0 +1,463 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Names used by OCI image layers to record deletions. A whiteout entry
+// named ".wh.name" deletes name from the lower layers, and an opaque
+// whiteout entry ".wh..wh..opq" in a directory deletes all of its contents
+// from the lower layers.
+const (
+	WhiteoutPrefix = ".wh."
+	WhiteoutOpaque = WhiteoutPrefix + WhiteoutPrefix + ".opq"
+)
+
+// WriteLayerDiff writes to tw the entries of an OCI image layer that
+// transforms the directory tree rooted at base into the one rooted at upper.
+// Files and directories of upper that are not in base, or that differ from
+// those in base, are written as done by FileInfoHeader, with names relative
+// to upper using forward slashes. Files and directories of base that are not
+// in upper are deleted with a whiteout entry. Directories are written before
+// their contents, and within each directory, the whiteout entries are
+// written first, followed by the other entries, each sorted by name.
+// It does not close tw.
+//
+// Files are compared by their metadata only: the type, mode, owner, size,
+// modification time, and link target or device numbers. Hard links are
+// written as separate copies of the file.
+func WriteLayerDiff(tw *Writer, base, upper string) error {
+	return writeLayerDiff(tw, base, upper, "")
+}
+
+// writeLayerDiff writes the differences between the directories base and
+// upper, whose names within the layer have the given prefix.
+func writeLayerDiff(tw *Writer, base, upper, prefix string) error {
+	lower, err := readDirNames(base)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	sort.Strings(lower)
+	fis, err := ioutil.ReadDir(upper)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool, len(fis))
+	for _, fi := range fis {
+		names[fi.Name()] = true
+	}
+	for _, name := range lower {
+		if !names[name] {
+			if err := tw.WriteHeader(&Header{Name: prefix + WhiteoutPrefix + name, Typeflag: TypeReg, Mode: 0600}); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, fi := range fis {
+		name := fi.Name()
+		upperPath := filepath.Join(upper, name)
+		hdr, err := layerHeader(fi, upperPath)
+		if err != nil {
+			return err
+		}
+		hdr.Name = prefix + hdr.Name
+
+		// Compare against the corresponding file in base, if any.
+		changed := true
+		var basePath string
+		if base != "" {
+			basePath = filepath.Join(base, name)
+			if bfi, err := os.Lstat(basePath); err == nil {
+				bhdr, err := layerHeader(bfi, basePath)
+				if err != nil {
+					return err
+				}
+				changed = !sameLayerHeader(hdr, bhdr)
+				if !bfi.IsDir() {
+					basePath = ""
+				}
+			} else if os.IsNotExist(err) {
+				basePath = ""
+			} else {
+				return err
+			}
+		}
+
+		if changed {
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			if hdr.Typeflag == TypeReg {
+				if err := copyFile(tw, upperPath); err != nil {
+					return err
+				}
+			}
+		}
+		if fi.IsDir() {
+			if err := writeLayerDiff(tw, basePath, upperPath, path.Join(prefix, name)+"/"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ApplyLayer extracts the entries of an OCI image layer read from tr onto
+// the existing directory tree rooted at dir, as the inverse of
+// WriteLayerDiff. Directories, regular files, symbolic links, and hard
+// links are created with the mode, modification and access times, and,
+// if the process runs as root, owner of their entries. An entry replaces
+// any file of the same name, except that an existing directory is kept
+// for a directory entry. A whiteout entry deletes the file that it names,
+// and an opaque whiteout entry deletes the contents of its directory,
+// except for those written by the layer itself. The metadata of
+// directories is applied after all entries have been extracted, so that
+// their contents can be created regardless of their modes.
+//
+// Each entry must lie within dir: ApplyLayer reports ErrInsecurePath for a
+// name that is absolute or that leaves dir through "..", regardless of the
+// AllowInsecurePaths field of tr, as well as for an entry whose parent
+// directory would be reached through a symbolic link, for a hard link
+// whose target would be, or for a whiteout entry that names no file. Missing parent directories are created with mode
+// 0755. Entries of other types, such as devices, cannot be extracted and
+// are reported as errors. Global headers are ignored.
+func ApplyLayer(tr *Reader, dir string) error {
+	return ApplyLayerSymlinks(tr, dir, SymlinkCreate)
+}
+
+// A SymlinkPolicy specifies what ApplyLayerSymlinks does with a symbolic
+// link that the process is not permitted to create, as on Windows without
+// the privilege to create symbolic links.
+type SymlinkPolicy int
+
+const (
+	// SymlinkCreate reports the error.
+	SymlinkCreate SymlinkPolicy = iota
+
+	// SymlinkJunction creates a junction point instead, if the link is to
+	// a directory of the layer. A target that is an absolute name is taken
+	// to be within dir. Links to files or to names outside of dir, and links
+	// on systems other than Windows, which have no junction points, are
+	// handled as for SymlinkCreate. Unlike a symbolic link, a junction
+	// point refers to the absolute name of its target, which changes if
+	// dir is moved.
+	SymlinkJunction
+
+	// SymlinkSkip skips the entry.
+	SymlinkSkip
+)
+
+// ApplyLayerSymlinks is like ApplyLayer, but handles symbolic links that
+// cannot be created according to policy.
+func ApplyLayerSymlinks(tr *Reader, dir string, policy SymlinkPolicy) error {
+	la := layerApplier{dir: dir, seen: make(map[string]bool), symlinks: policy}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		if err := la.apply(hdr, tr); err != nil {
+			return err
+		}
+	}
+
+	// Apply the metadata of directories after their contents, innermost
+	// first, so that their modification times are not changed afterward.
+	for i := len(la.dirs) - 1; i >= 0; i-- {
+		if err := applyLayerMetadata(la.dirs[i].path, la.dirs[i].hdr); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// A layerApplier extracts the entries of a layer for ApplyLayer.
+type layerApplier struct {
+	dir      string
+	seen     map[string]bool // Cleaned names of the entries of the layer
+	dirs     []layerDir      // Directories whose metadata is to be applied
+	symlinks SymlinkPolicy
+}
+
+// symlink creates a symbolic link for ApplyLayer.
+// It is a variable so that tests may replace it.
+var symlink = os.Symlink
+
+// A layerDir is a directory extracted by ApplyLayer.
+type layerDir struct {
+	path string
+	hdr  *Header
+}
+
+// apply extracts the entry hdr, whose data is read from r.
+func (la *layerApplier) apply(hdr *Header, r io.Reader) error {
+	if hdr.Typeflag == TypeXGlobalHeader {
+		return nil
+	}
+	name := path.Clean(hdr.Name)
+	if isInsecurePath(name) {
+		return ErrInsecurePath
+	}
+	if name == "." {
+		return nil
+	}
+	dir, base := path.Split(name)
+
+	// Whiteout entries delete files of the lower layers only.
+	if strings.HasPrefix(base, WhiteoutPrefix) {
+		parent, err := la.path(hdr, dir, false)
+		if err != nil || parent == "" {
+			return err
+		}
+		if base == WhiteoutOpaque {
+			names, err := readDirNames(parent)
+			if err != nil {
+				return err
+			}
+			for _, n := range names {
+				if !la.seen[path.Join(dir, n)] {
+					if err := la.remove(filepath.Join(parent, n)); err != nil {
+						return err
+					}
+				}
+			}
+			return nil
+		}
+		target := base[len(WhiteoutPrefix):]
+		if target == "" {
+			return ErrInsecurePath
+		}
+		if !la.seen[path.Join(dir, target)] {
+			return la.remove(filepath.Join(parent, target))
+		}
+		return nil
+	}
+
+	parent, err := la.path(hdr, dir, true)
+	if err != nil {
+		return err
+	}
+	p := filepath.Join(parent, base)
+	la.seen[name] = true
+	if fi, err := os.Lstat(p); err == nil {
+		if hdr.Typeflag == TypeDir && fi.IsDir() {
+			la.dirs = append(la.dirs, layerDir{p, hdr})
+			return nil
+		}
+		if err := la.remove(p); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	switch hdr.Typeflag {
+	case TypeDir:
+		if err := os.Mkdir(p, 0700); err != nil {
+			return err
+		}
+		la.dirs = append(la.dirs, layerDir{p, hdr})
+		return nil
+	case TypeReg, TypeRegA, TypeGNUSparse:
+		f, err := os.OpenFile(p, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(f, r)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	case TypeSymlink:
+		if err := symlink(hdr.Linkname, p); err != nil {
+			if !symlinkNotPermitted(err) {
+				return err
+			}
+			switch la.symlinks {
+			case SymlinkJunction:
+				if err := la.junction(hdr, name, p, err); err != nil {
+					return err
+				}
+			case SymlinkSkip:
+				return nil
+			default:
+				return err
+			}
+		}
+	case TypeLink:
+		link := path.Clean(hdr.Linkname)
+		if isInsecurePath(link) || link == "." {
+			return ErrInsecurePath
+		}
+		ldir, lbase := path.Split(link)
+		lparent, err := la.path(hdr, ldir, false)
+		if err != nil {
+			return err
+		}
+		if lparent == "" {
+			return fmt.Errorf("archive/tar: entry %q: link target %q does not exist", hdr.Name, hdr.Linkname)
+		}
+		return os.Link(filepath.Join(lparent, lbase), p)
+	default:
+		return fmt.Errorf("archive/tar: entry %q: cannot extract entries of type %q", hdr.Name, hdr.Typeflag)
+	}
+	return applyLayerMetadata(p, hdr)
+}
+
+// remove removes the file at p and any children it contains, and forgets
+// the directories among them whose metadata was to be applied, since
+// the name p may be reused for a symbolic link.
+func (la *layerApplier) remove(p string) error {
+	if err := os.RemoveAll(p); err != nil {
+		return err
+	}
+	dirs := la.dirs[:0]
+	for _, d := range la.dirs {
+		if d.path != p && !strings.HasPrefix(d.path, p+string(filepath.Separator)) {
+			dirs = append(dirs, d)
+		}
+	}
+	la.dirs = dirs
+	return nil
+}
+
+// junction creates a junction point at p, for the symbolic link entry hdr
+// named name, in place of the link that could not be created with the
+// error err. It returns err if the link is not to a directory within la.dir.
+func (la *layerApplier) junction(hdr *Header, name, p string, err error) error {
+	if runtime.GOOS != "windows" {
+		return err
+	}
+	target := hdr.Linkname
+	if path.IsAbs(target) {
+		target = path.Clean(target[1:])
+	} else {
+		target = path.Join(path.Dir(name), target)
+	}
+	if isInsecurePath(target) {
+		return err
+	}
+	tp, terr := la.path(hdr, target+"/", false)
+	if terr != nil || tp == "" {
+		return err
+	}
+	return createJunction(p, tp)
+}
+
+// path returns the path of the directory dir, a cleaned slash-separated
+// name ending in a slash or empty, within la.dir. It reports ErrInsecurePath
+// if one of the directories leading to it is a symbolic link. If create is
+// set, missing directories are created; otherwise, path returns the empty
+// string if one of them is missing.
+func (la *layerApplier) path(hdr *Header, dir string, create bool) (string, error) {
+	p := la.dir
+	for _, elem := range strings.Split(strings.TrimSuffix(dir, "/"), "/") {
+		if elem == "" {
+			continue
+		}
+		p = filepath.Join(p, elem)
+		fi, err := os.Lstat(p)
+		switch {
+		case os.IsNotExist(err) && create:
+			if err := os.Mkdir(p, 0755); err != nil {
+				return "", err
+			}
+		case os.IsNotExist(err):
+			return "", nil
+		case err != nil:
+			return "", err
+		case fi.Mode()&os.ModeSymlink != 0:
+			return "", ErrInsecurePath
+		case !fi.IsDir():
+			return "", fmt.Errorf("archive/tar: entry %q: %s is not a directory", hdr.Name, p)
+		}
+	}
+	return p, nil
+}
+
+// applyLayerMetadata applies the mode, owner, and times of hdr to the file
+// at p, other than the mode and times of a symbolic link, which cannot be
+// changed portably.
+func applyLayerMetadata(p string, hdr *Header) error {
+	if os.Geteuid() == 0 {
+		if err := os.Lchown(p, hdr.Uid, hdr.Gid); err != nil {
+			return err
+		}
+	}
+	if hdr.Typeflag == TypeSymlink {
+		return nil
+	}
+	if err := os.Chmod(p, hdr.FileInfo().Mode()); err != nil {
+		return err
+	}
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	return os.Chtimes(p, atime, hdr.ModTime)
+}
+
+// layerHeader returns the header for the file at name, described by fi.
+func layerHeader(fi os.FileInfo, name string) (*Header, error) {
+	var link string
+	if fi.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(name); err != nil {
+			return nil, err
+		}
+	}
+	return FileInfoHeader(fi, link)
+}
+
+// sameLayerHeader reports whether the headers of two files describe the
+// same file for the purposes of WriteLayerDiff.
+func sameLayerHeader(a, b *Header) bool {
+	return a.Typeflag == b.Typeflag && a.Mode == b.Mode &&
+		a.Uid64() == b.Uid64() && a.Gid64() == b.Gid64() &&
+		a.Size == b.Size && a.ModTime.Equal(b.ModTime) &&
+		a.Linkname == b.Linkname &&
+		a.Devmajor == b.Devmajor && a.Devminor == b.Devminor
+}
+
+// readDirNames returns the names of the entries of the directory dir,
+// or none if dir is empty.
+func readDirNames(dir string) ([]string, error) {
+	if dir == "" {
+		return nil, nil
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return f.Readdirnames(-1)
+}
+
+// copyFile copies the contents of the file at name to w.
+func copyFile(w io.Writer, name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,88 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// A Limiter limits the rate at which a Reader or Writer with it as its
+// Limiter transfers data, such as to cap the bandwidth of a backup.
+// A Limiter may be shared by several Readers and Writers if it is safe for
+// concurrent use, so that their combined rate is limited.
+type Limiter interface {
+	// WaitN blocks until the transfer of n more bytes is allowed.
+	// An error is returned by the Reader or Writer method that
+	// transferred them.
+	WaitN(n int) error
+}
+
+// NewRateLimiter returns a Limiter that allows an average of bytesPerSec
+// bytes per second, in bursts of up to one second's worth of bytes,
+// using a token bucket. It is safe for concurrent use.
+func NewRateLimiter(bytesPerSec int64) Limiter {
+	return &rateLimiter{rate: float64(bytesPerSec), avail: float64(bytesPerSec)}
+}
+
+type rateLimiter struct {
+	mu    sync.Mutex
+	rate  float64   // Bytes allowed per second
+	avail float64   // Bytes allowed at last, which is negative when in debt
+	last  time.Time // Time at which avail was last updated
+}
+
+func (l *rateLimiter) WaitN(n int) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if !l.last.IsZero() {
+		if l.avail += now.Sub(l.last).Seconds() * l.rate; l.avail > l.rate {
+			l.avail = l.rate
+		}
+	}
+	l.last = now
+	if l.avail -= float64(n); l.avail < 0 && l.rate > 0 {
+		// Pay off the debt before any other transfer is allowed.
+		time.Sleep(time.Duration(-l.avail / l.rate * float64(time.Second)))
+	}
+	return nil
+}
+
+// A limitedReader reads from r, waiting on l for the bytes that are read.
+type limitedReader struct {
+	r io.Reader
+	l Limiter
+}
+
+func (lr *limitedReader) Read(b []byte) (int, error) {
+	n, err := lr.r.Read(b)
+	if n > 0 {
+		if err2 := lr.l.WaitN(n); err2 != nil {
+			return n, err2
+		}
+	}
+	return n, err
+}
+
+// A limitedReadSeeker is a limitedReader that preserves the ability of r
+// to skip over data by seeking.
+type limitedReadSeeker struct {
+	limitedReader
+	s io.Seeker
+}
+
+func (lr *limitedReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return lr.s.Seek(offset, whence)
+}
+
+// newLimitedReader returns r reading from l.
+func newLimitedReader(r io.Reader, l Limiter) io.Reader {
+	if s, ok := r.(io.Seeker); ok {
+		return &limitedReadSeeker{limitedReader{r, l}, s}
+	}
+	return &limitedReader{r, l}
+}
@@ -0,0 +1,62 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"fmt"
+	"io"
+)
+
+// A LinkError records a hard link (TypeLink) whose target does not
+// precede it in an archive, which most implementations fail to extract.
+type LinkError struct {
+	Name     string // Name of the hard link
+	Linkname string // Name of its target
+	Forward  bool   // Whether the target follows the hard link
+}
+
+func (e *LinkError) Error() string {
+	if e.Forward {
+		return fmt.Sprintf("tar: hard link %q refers to %q, which follows it in the archive", e.Name, e.Linkname)
+	}
+	return fmt.Sprintf("tar: hard link %q refers to %q, which does not precede it in the archive", e.Name, e.Linkname)
+}
+
+// CheckLinks reads the tar archive from r in a single pass and returns a
+// *LinkError for every hard link whose target does not precede it, in the
+// order of the hard links. Those whose targets appear later in the archive
+// have Forward set. Names are compared after cleaning them as ReadMap does.
+func CheckLinks(r io.Reader) ([]*LinkError, error) {
+	var errs []*LinkError
+	seen := make(map[string]bool)
+	pending := make(map[string][]*LinkError) // Keyed by target
+	tr := NewReader(r)
+	tr.AllowInsecurePaths = true // Names are only reported
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errs, nil
+		}
+		if err != nil {
+			return errs, err
+		}
+		if hdr.Typeflag == TypeXGlobalHeader {
+			continue
+		}
+		if hdr.Typeflag == TypeLink {
+			if target := mapName(hdr.Linkname); !seen[target] {
+				e := &LinkError{Name: hdr.Name, Linkname: hdr.Linkname}
+				errs = append(errs, e)
+				pending[target] = append(pending[target], e)
+			}
+		}
+		name := mapName(hdr.Name)
+		seen[name] = true
+		for _, e := range pending[name] {
+			e.Forward = true
+		}
+		delete(pending, name)
+	}
+}
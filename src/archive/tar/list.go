@@ -0,0 +1,119 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+// listTypes maps the type flags of entries to the characters that
+// "tar tvf" shows for them in place of the file type of ls -l.
+var listTypes = map[byte]byte{
+	TypeReg:             '-',
+	TypeRegA:            '-',
+	TypeLink:            'h',
+	TypeSymlink:         'l',
+	TypeChar:            'c',
+	TypeBlock:           'b',
+	TypeDir:             'd',
+	TypeFifo:            'p',
+	TypeCont:            'C',
+	TypeGNUDumpDir:      'd',
+	TypeGNUMultiVolume:  'M',
+	TypeGNUSparse:       'S',
+	TypeGNUVolumeHeader: 'V',
+}
+
+// ListString returns a line describing h in the style of "tar tvf", such
+// as:
+//
+//	-rw-r--r-- gopher/staff   1234 2017-06-20 15:04 dir/file.txt
+//
+// The owner and group are shown by name, or by ID if the name is empty,
+// and the modification time is shown in its own location, such that the
+// output does not depend on the locale or time zone of the process.
+// Devices are shown by their major and minor numbers instead of the size,
+// and links along with their targets. Unprintable characters in names are
+// escaped as in Go string literals, so that the line is a single line.
+func (h *Header) ListString() string {
+	b := make([]byte, 0, 64+len(h.Name)+len(h.Linkname))
+
+	// Mode string.
+	c, ok := listTypes[h.Typeflag]
+	if !ok {
+		c = '?'
+	}
+	b = append(b, c)
+	const rwx = "rwxrwxrwx"
+	for i := uint(0); i < 9; i++ {
+		if h.Mode&(1<<(8-i)) != 0 {
+			b = append(b, rwx[i])
+		} else {
+			b = append(b, '-')
+		}
+	}
+	for i, bit := range []int64{c_ISUID, c_ISGID, c_ISVTX} {
+		if h.Mode&bit == 0 {
+			continue
+		}
+		c := byte("sst"[i])
+		if b[3*i+3] == '-' {
+			c = byte("SST"[i])
+		}
+		b[3*i+3] = c
+	}
+
+	// Owner, group, and size or device numbers, right-aligned to the same
+	// minimum width as by GNU tar.
+	b = append(b, ' ')
+	owner := h.Uname
+	if owner == "" {
+		owner = strconv.Itoa(h.Uid)
+	}
+	group := h.Gname
+	if group == "" {
+		group = strconv.Itoa(h.Gid)
+	}
+	size := strconv.FormatInt(h.Size, 10)
+	if h.Typeflag == TypeChar || h.Typeflag == TypeBlock {
+		size = strconv.FormatInt(h.Devmajor, 10) + "," + strconv.FormatInt(h.Devminor, 10)
+	}
+	b = append(b, owner...)
+	b = append(b, '/')
+	b = append(b, group...)
+	for n := len(owner) + len(group) + len(size) + 2; n < 19; n++ {
+		b = append(b, ' ')
+	}
+	b = append(b, ' ')
+	b = append(b, size...)
+
+	b = append(b, ' ')
+	b = h.ModTime.AppendFormat(b, "2006-01-02 15:04")
+	b = append(b, ' ')
+	b = appendListName(b, h.Name)
+	switch h.Typeflag {
+	case TypeSymlink:
+		b = append(b, " -> "...)
+		b = appendListName(b, h.Linkname)
+	case TypeLink:
+		b = append(b, " link to "...)
+		b = appendListName(b, h.Linkname)
+	}
+	return string(b)
+}
+
+// appendListName appends name to b, escaping it as in a Go string literal
+// if it contains unprintable characters or backslashes.
+func appendListName(b []byte, name string) []byte {
+	for _, r := range name {
+		if r == '\\' || r == utf8.RuneError || !unicode.IsPrint(r) {
+			q := strconv.Quote(name)
+			return append(b, q[1:len(q)-1]...)
+		}
+	}
+	return append(b, name...)
+}
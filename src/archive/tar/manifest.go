@@ -0,0 +1,236 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// A Manifest lists the entries of a tar archive in order, along with the
+// size and digest of the data of each and a digest of its metadata.
+//
+// The encoding produced by MarshalText is canonical: it only depends on the
+// contents of the archive and not on how its headers were encoded, such as
+// whether PAX records or GNU extensions were used. It is suitable for
+// signing, such that a detached signature of the manifest vouches for any
+// archive that Verify accepts.
+type Manifest struct {
+	Algorithm string // Name of the digest algorithm, as for Header.SetDigest
+	Entries   []ManifestEntry
+}
+
+// A ManifestEntry describes an entry of a tar archive in a Manifest.
+//
+// The metadata digested in MetaDigest consists of the type flag, name,
+// link target, mode, owner, modification time, device numbers, file flags,
+// extended attributes, and any PAX records that do not correspond to Header
+// fields, other than those holding digests. Access and change times and
+// the records of global headers are not covered.
+type ManifestEntry struct {
+	Name       string
+	Size       int64  // Size of the data; the logical size for sparse files
+	Digest     []byte // Digest of the data
+	MetaDigest []byte // Digest of the metadata
+}
+
+// manifestMagic begins the first line of the text encoding of a Manifest,
+// which is followed by the name of the digest algorithm.
+const manifestMagic = "tar-manifest-v1 "
+
+// NewManifest reads the tar archive from r and returns its Manifest,
+// using the named digest algorithm. It reports ErrDigestUnavailable if the
+// algorithm is not available. Global headers are not listed as entries.
+func NewManifest(r io.Reader, algorithm string) (*Manifest, error) {
+	m := &Manifest{Algorithm: algorithm}
+	err := readManifest(r, algorithm, func(e ManifestEntry) error {
+		m.Entries = append(m.Entries, e)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// readManifest calls f for each entry of the tar archive read from r.
+func readManifest(r io.Reader, algorithm string, f func(ManifestEntry) error) error {
+	d := newDigest(algorithm)
+	if d == nil {
+		return ErrDigestUnavailable
+	}
+	tr := NewReader(r)
+	tr.AllowInsecurePaths = true // Names are only reported
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if hdr.Typeflag == TypeXGlobalHeader {
+			continue
+		}
+		d.Reset()
+		n, err := io.Copy(d, tr)
+		if err != nil {
+			return err
+		}
+		e := ManifestEntry{Name: hdr.Name, Size: n, Digest: d.Sum(nil)}
+		d.Reset()
+		writeMetadata(d, hdr)
+		e.MetaDigest = d.Sum(nil)
+		if err := f(e); err != nil {
+			return err
+		}
+	}
+}
+
+// writeMetadata writes the metadata of hdr that is covered by the
+// MetaDigest of a ManifestEntry to d, as a sequence of length-prefixed
+// keys and values in increasing order of key.
+func writeMetadata(d hash.Hash, hdr *Header) {
+	md := map[string]string{
+		"typeflag":  string([]byte{hdr.Typeflag}),
+		paxPath:     hdr.Name,
+		paxLinkpath: hdr.Linkname,
+		"mode":      strconv.FormatInt(hdr.Mode, 8),
+		paxUid:      strconv.Itoa(hdr.Uid),
+		paxGid:      strconv.Itoa(hdr.Gid),
+		paxUname:    hdr.Uname,
+		paxGname:    hdr.Gname,
+		paxMtime:    formatPAXTime(hdr.ModTime),
+		"devmajor":  strconv.FormatInt(hdr.Devmajor, 10),
+		"devminor":  strconv.FormatInt(hdr.Devminor, 10),
+		paxFflags:   hdr.FileFlags,
+	}
+	for k, v := range hdr.Xattrs {
+		md[paxXattr+k] = v
+	}
+	for k, v := range hdr.PAXRecords {
+		if basicKeys[k] || strings.HasPrefix(k, paxDigest) || strings.HasPrefix(k, paxXattr) || strings.HasPrefix(k, paxLibXattr) || isSparseRecord(k) {
+			continue
+		}
+		if _, ok := md[k]; !ok {
+			md[k] = v
+		}
+	}
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b []byte
+	for _, k := range keys {
+		b = strconv.AppendInt(b[:0], int64(len(k)), 10)
+		b = append(b, ':')
+		b = append(b, k...)
+		b = strconv.AppendInt(b, int64(len(md[k])), 10)
+		b = append(b, ':')
+		b = append(b, md[k]...)
+		d.Write(b)
+	}
+}
+
+// MarshalText encodes m in its canonical text form. The first line holds
+// the name of the digest algorithm, and each following line describes an
+// entry with its hex-encoded data digest, hex-encoded metadata digest,
+// size in decimal, and name quoted as by strconv.Quote, separated by
+// single spaces.
+func (m *Manifest) MarshalText() ([]byte, error) {
+	if m.Algorithm == "" || strings.ContainsAny(m.Algorithm, " \n") {
+		return nil, errors.New("tar: invalid manifest algorithm")
+	}
+	var b bytes.Buffer
+	b.WriteString(manifestMagic + m.Algorithm + "\n")
+	for _, e := range m.Entries {
+		fmt.Fprintf(&b, "%x %x %d %s\n", e.Digest, e.MetaDigest, e.Size, strconv.Quote(e.Name))
+	}
+	return b.Bytes(), nil
+}
+
+// UnmarshalText decodes the text form of a Manifest produced by MarshalText.
+func (m *Manifest) UnmarshalText(b []byte) error {
+	lines := strings.SplitAfter(string(b), "\n")
+	if len(lines) < 2 || lines[len(lines)-1] != "" || !strings.HasPrefix(lines[0], manifestMagic) {
+		return errors.New("tar: malformed manifest")
+	}
+	m2 := Manifest{Algorithm: strings.TrimSuffix(strings.TrimPrefix(lines[0], manifestMagic), "\n")}
+	for i, line := range lines[1 : len(lines)-1] {
+		f := strings.SplitN(strings.TrimSuffix(line, "\n"), " ", 4)
+		if len(f) != 4 {
+			return fmt.Errorf("tar: malformed manifest line %d", i+2)
+		}
+		var e ManifestEntry
+		var err1, err2, err3, err4 error
+		e.Digest, err1 = hex.DecodeString(f[0])
+		e.MetaDigest, err2 = hex.DecodeString(f[1])
+		e.Size, err3 = strconv.ParseInt(f[2], 10, 64)
+		e.Name, err4 = strconv.Unquote(f[3])
+		if err1 != nil || err2 != nil || err3 != nil || err4 != nil || e.Size < 0 {
+			return fmt.Errorf("tar: malformed manifest line %d", i+2)
+		}
+		m2.Entries = append(m2.Entries, e)
+	}
+	*m = m2
+	return nil
+}
+
+// A ManifestError is reported by Manifest.Verify for the first entry of an
+// archive that does not match the manifest.
+type ManifestError struct {
+	Index  int    // Index of the entry
+	Name   string // Name of the entry in the manifest, or in the archive if it is not listed
+	Reason string // What does not match
+}
+
+func (e *ManifestError) Error() string {
+	return fmt.Sprintf("tar: entry %d (%q): %s", e.Index, e.Name, e.Reason)
+}
+
+// Verify reads the tar archive from r and checks that its entries are
+// those listed in m, in the same order and with the same names, sizes,
+// data, and metadata. It reports a *ManifestError for the first entry
+// that does not match, and ErrDigestUnavailable if the digest algorithm
+// of m is not available.
+//
+// Verify does not check the authenticity of m itself, which is the purpose
+// of a detached signature over its text form.
+func (m *Manifest) Verify(r io.Reader) error {
+	i := 0
+	err := readManifest(r, m.Algorithm, func(got ManifestEntry) error {
+		if i >= len(m.Entries) {
+			return &ManifestError{Index: i, Name: got.Name, Reason: "entry not listed in manifest"}
+		}
+		want := m.Entries[i]
+		merr := &ManifestError{Index: i, Name: want.Name}
+		switch {
+		case got.Name != want.Name:
+			merr.Reason = fmt.Sprintf("name is %q", got.Name)
+		case got.Size != want.Size:
+			merr.Reason = fmt.Sprintf("size is %d, want %d", got.Size, want.Size)
+		case !bytes.Equal(got.Digest, want.Digest):
+			merr.Reason = m.Algorithm + " digest of data mismatch"
+		case !bytes.Equal(got.MetaDigest, want.MetaDigest):
+			merr.Reason = m.Algorithm + " digest of metadata mismatch"
+		default:
+			i++
+			return nil
+		}
+		return merr
+	})
+	if err == nil && i < len(m.Entries) {
+		err = &ManifestError{Index: i, Name: m.Entries[i].Name, Reason: "entry missing from archive"}
+	}
+	return err
+}
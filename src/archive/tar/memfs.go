@@ -0,0 +1,94 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// A MapFile describes a single file read into memory by ReadMap.
+// Its fields correspond to those of a file in a testing/fstest.MapFS.
+type MapFile struct {
+	Data    []byte      // File contents, or the target of a symbolic link
+	Mode    os.FileMode // FileInfo.Mode
+	ModTime time.Time   // FileInfo.ModTime
+	Sys     interface{} // FileInfo.Sys, the *Header of the entry
+}
+
+// ReadMap reads the entire archive from tr into memory and returns its
+// files keyed by name, so that small archives can be processed, such as
+// in tests, without extracting them to disk.
+//
+// Names are cleaned with path.Clean as if they were relative to the root
+// directory, whose name is ".", and so lack any leading "./", "../", or "/". Where several entries have
+// the same name, the last one takes effect, as when extracting. Hard links
+// are given the contents of their targets, which must precede them, and
+// global headers are omitted. Directories that contain entries but have
+// none of their own, as in archives made by some build tools, are added
+// with a mode of 0555 and no Sys, as testing/fstest.MapFS implies them.
+//
+// If any entry has an insecure name (see Reader.AllowInsecurePaths),
+// the complete map is returned along with ErrInsecurePath.
+func ReadMap(tr *Reader) (map[string]*MapFile, error) {
+	files := make(map[string]*MapFile)
+	var insecure bool
+	for {
+		hdr, err := tr.Next()
+		if err == ErrInsecurePath {
+			insecure, err = true, nil
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		f := &MapFile{Mode: hdr.FileInfo().Mode(), ModTime: hdr.ModTime, Sys: hdr}
+		switch hdr.Typeflag {
+		case TypeXGlobalHeader:
+			continue
+		case TypeSymlink:
+			f.Data = []byte(hdr.Linkname)
+		case TypeLink:
+			target, ok := files[mapName(hdr.Linkname)]
+			if !ok {
+				return nil, ErrHeader
+			}
+			f.Data = target.Data
+			f.Mode = target.Mode
+		default:
+			if isHeaderOnlyType(hdr.Typeflag) {
+				break
+			}
+			if f.Data, err = ioutil.ReadAll(tr); err != nil {
+				return nil, err
+			}
+		}
+		files[mapName(hdr.Name)] = f
+	}
+	for name := range files {
+		for dir := path.Dir(name); dir != "." && files[dir] == nil; dir = path.Dir(dir) {
+			files[dir] = &MapFile{Mode: os.ModeDir | 0555}
+		}
+	}
+	if insecure {
+		return files, ErrInsecurePath
+	}
+	return files, nil
+}
+
+// mapName returns the key of the file with the given name in ReadMap.
+func mapName(name string) string {
+	if name = strings.TrimPrefix(path.Clean("/"+name), "/"); name == "" {
+		return "."
+	}
+	return name
+}
@@ -0,0 +1,141 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"io"
+	"strconv"
+)
+
+// A Metrics receives events from the Readers and Writers that have it as
+// their Metrics, such as to maintain counters exported for monitoring.
+// A Metrics that is shared by several Readers and Writers must be safe for
+// concurrent use. Its methods are called synchronously and should not
+// block.
+type Metrics interface {
+	// Entry is called for each header returned by Reader.Next or written
+	// by Writer.WriteHeader, along with the name of the format in which it
+	// is encoded, as named in Summary.Formats. The header must not be
+	// modified or retained.
+	Entry(op MetricsOp, hdr *Header, format string)
+
+	// Bytes is called with the number of bytes of entry data returned by
+	// each call to Reader.Read or accepted by each call to Writer.Write.
+	Bytes(op MetricsOp, n int)
+
+	// Error is called with each error reported by Reader.Next,
+	// Reader.Read, Writer.WriteHeader, Writer.Write, Writer.Flush, and
+	// Writer.Close, other than io.EOF. A persistent error is only reported
+	// the first time it is returned.
+	Error(op MetricsOp, class ErrorClass, err error)
+}
+
+// A MetricsOp tells whether an event of a Metrics is from a Reader or
+// a Writer.
+type MetricsOp int
+
+const (
+	MetricsRead  MetricsOp = iota + 1 // Event from a Reader
+	MetricsWrite                      // Event from a Writer
+)
+
+func (op MetricsOp) String() string {
+	switch op {
+	case MetricsRead:
+		return "read"
+	case MetricsWrite:
+		return "write"
+	}
+	return "MetricsOp(" + strconv.Itoa(int(op)) + ")"
+}
+
+// An ErrorClass classifies an error reported to a Metrics.
+type ErrorClass int
+
+const (
+	ClassIO        ErrorClass = iota + 1 // Any other error, such as from the underlying io.Reader or io.Writer
+	ClassHeader                          // Invalid or unencodable header, such as ErrHeader
+	ClassTruncated                       // Input that ends prematurely, such as io.ErrUnexpectedEOF
+	ClassDigest                          // Data that does not match its digest, such as ErrDigestMismatch
+	ClassPolicy                          // Entry rejected by an option, such as ErrInsecurePath
+	ClassUsage                           // Misuse of a method, such as ErrWriteTooLong
+)
+
+var classNames = map[ErrorClass]string{
+	ClassIO:        "I/O",
+	ClassHeader:    "header",
+	ClassTruncated: "truncated",
+	ClassDigest:    "digest",
+	ClassPolicy:    "policy",
+	ClassUsage:     "usage",
+}
+
+func (c ErrorClass) String() string {
+	if s, ok := classNames[c]; ok {
+		return s
+	}
+	return "ErrorClass(" + strconv.Itoa(int(c)) + ")"
+}
+
+// errorClass returns the class of err.
+func errorClass(err error) ErrorClass {
+	switch err.(type) {
+	case *HeaderError:
+		return ClassHeader
+	case *TruncatedError:
+		return ClassTruncated
+	case *DigestError:
+		return ClassDigest
+	case *LinkError, *CollisionError:
+		return ClassPolicy
+	}
+	switch err {
+	case ErrHeader, ErrFieldTooLong:
+		return ClassHeader
+	case io.ErrUnexpectedEOF:
+		return ClassTruncated
+	case ErrDigestMismatch, ErrDigestUnavailable:
+		return ClassDigest
+	case ErrInsecurePath, ErrWindowsName, ErrSpecialMode:
+		return ClassPolicy
+	case ErrWriteTooLong, ErrWriteAfterClose, ErrUnreadData:
+		return ClassUsage
+	}
+	return ClassIO
+}
+
+// reportError reports err, if it is an error other than io.EOF, to
+// tr.Metrics, unless it is a persistent error that was already reported.
+func (tr *Reader) reportError(err error) {
+	if err != nil && err != io.EOF && (err != tr.merr || err != tr.err) {
+		tr.merr = err
+		tr.Metrics.Error(MetricsRead, errorClass(err), err)
+	}
+}
+
+// reportError reports err, if it is an error, to tw.Metrics, unless it is
+// a persistent error that was already reported.
+func (tw *Writer) reportError(err error) {
+	if err != nil && (err != tw.merr || err != tw.err) {
+		tw.merr = err
+		tw.Metrics.Error(MetricsWrite, errorClass(err), err)
+	}
+}
+
+// reportEntry reports the header of the current file entry, just written
+// in the given format, to tw.Metrics, unless there was an error.
+// It returns tw.err.
+func (tw *Writer) reportEntry(format int) error {
+	if tw.err == nil && tw.Metrics != nil {
+		tw.Metrics.Entry(MetricsWrite, &tw.hdr, formatName(format))
+	}
+	return tw.err
+}
+
+// A dataWriter writes the data of the current file entry of a Writer on
+// its behalf, without reporting it to its Metrics.
+type dataWriter struct{ tw *Writer }
+
+func (w dataWriter) Write(b []byte) (int, error) { return w.tw.writeData(b) }
@@ -0,0 +1,53 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"path"
+	"strings"
+)
+
+// writeParentDirs writes an entry for each parent directory of the current
+// header that has not been written, as described for ParentDirs. Each entry
+// is flushed at once. The current header is left as it was.
+func (tw *Writer) writeParentDirs() error {
+	if tw.hdr.Typeflag == TypeXGlobalHeader {
+		return nil
+	}
+	hdr := tw.hdr
+	defer func() { tw.hdr = hdr }()
+	name := strings.TrimRight(hdr.Name, "/")
+	for i := 1; i < len(name); i++ {
+		if name[i] != '/' || name[i-1] == '/' {
+			continue
+		}
+		dir := name[:i]
+		base := path.Base(dir)
+		if base == ".." {
+			break
+		}
+		if base == "." || strings.Trim(dir, "/") == "" || tw.dirs[mapName(dir)] {
+			continue
+		}
+		d := *tw.ParentDirs
+		d.Name, d.Typeflag, d.Size, d.Linkname = strings.TrimLeft(dir, "/")+"/", TypeDir, 0, ""
+		if d.Mode == 0 {
+			d.Mode = 0755
+		}
+		if d.ModTime.IsZero() {
+			d.ModTime = hdr.ModTime
+		}
+		tw.raw = true
+		err := tw.writeHeader(&d, nil)
+		tw.raw = false
+		if err == nil {
+			err = tw.flushEntry()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,178 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"fmt"
+	"io"
+)
+
+// A Profile describes the capabilities of a tar implementation that is
+// expected to extract an archive. It is used to check ahead of time whether
+// entries would fail to extract or lose metadata when consumed by that
+// implementation.
+//
+// The predefined profiles are approximations of the behavior of common
+// tools and err on the side of reporting problems.
+type Profile struct {
+	Name string // Human readable name of the implementation
+
+	PAX       bool // Understands PAX extended headers
+	GNU       bool // Understands GNU long names and base-256 numeric fields
+	Xattrs    bool // Restores extended attributes (SCHILY.xattr records)
+	Links     bool // Creates hard and symbolic links
+	Devices   bool // Creates character devices, block devices, and FIFOs
+	Ownership bool // Restores user and group ownership
+	SubSecond bool // Restores sub-second modification times
+	UTF8      bool // Handles non-ASCII names
+	Windows   bool // Extracts onto a Windows file system, which restricts names
+}
+
+// Predefined profiles.
+var (
+	// ProfileUSTAR is a strictly conforming POSIX.1-1988 USTAR reader.
+	ProfileUSTAR = &Profile{
+		Name:      "POSIX ustar",
+		Links:     true,
+		Devices:   true,
+		Ownership: true,
+	}
+
+	// ProfileBSDTar is the libarchive-based bsdtar shipped with macOS.
+	ProfileBSDTar = &Profile{
+		Name:      "macOS bsdtar",
+		PAX:       true,
+		GNU:       true,
+		Xattrs:    true,
+		Links:     true,
+		Devices:   true,
+		Ownership: true,
+		SubSecond: true,
+		UTF8:      true,
+	}
+
+	// ProfileBusyBox is the tar applet of BusyBox.
+	ProfileBusyBox = &Profile{
+		Name:      "busybox tar",
+		PAX:       true,
+		GNU:       true,
+		Links:     true,
+		Devices:   true,
+		Ownership: true,
+		UTF8:      true,
+	}
+
+	// Profile7Zip is 7-Zip extracting onto a Windows file system.
+	Profile7Zip = &Profile{
+		Name:    "Windows 7-Zip",
+		PAX:     true,
+		GNU:     true,
+		UTF8:    true,
+		Windows: true,
+	}
+)
+
+// A Problem describes how an entry is affected when extracted by the
+// implementation described by a Profile.
+type Problem struct {
+	Name   string // Name of the affected entry
+	Field  string // Name of the affected Header field
+	Fatal  bool   // Whether the entry fails to extract, rather than losing metadata
+	Reason string // Description of the problem
+}
+
+func (p Problem) String() string {
+	if p.Fatal {
+		return fmt.Sprintf("%s: %s: fails to extract: %s", p.Name, p.Field, p.Reason)
+	}
+	return fmt.Sprintf("%s: %s: metadata lost: %s", p.Name, p.Field, p.Reason)
+}
+
+// CheckHeader reports the problems that would occur if an entry with the
+// given header were extracted by the implementation described by p.
+// It returns nil if no problems are found.
+func (p *Profile) CheckHeader(hdr *Header) []Problem {
+	var probs []Problem
+	report := func(field string, fatal bool, reason string) {
+		probs = append(probs, Problem{hdr.Name, field, fatal, reason})
+	}
+
+	format, _ := hdr.allowedFormats()
+	switch {
+	case format == formatUnknown:
+		report("Header", true, "cannot be encoded in any format")
+	case format&formatUSTAR > 0:
+	case format&formatPAX > 0 && p.PAX:
+	case format&formatGNU > 0 && p.GNU:
+	case format&formatPAX > 0 && format&formatGNU > 0:
+		report("Header", true, "requires the PAX or GNU format")
+	case format&formatPAX > 0:
+		report("Header", true, "requires the PAX format")
+	default:
+		report("Header", true, "requires the GNU format")
+	}
+
+	switch hdr.Typeflag {
+	case TypeLink, TypeSymlink:
+		if !p.Links {
+			report("Typeflag", true, "links are not supported")
+		}
+	case TypeChar, TypeBlock, TypeFifo:
+		if !p.Devices {
+			report("Typeflag", true, "device and FIFO nodes are not supported")
+		}
+	case TypeGNUSparse:
+		if !p.GNU {
+			report("Typeflag", true, "GNU sparse files are not supported")
+		}
+	}
+
+	if isInsecurePath(hdr.Name) {
+		report("Name", true, "insecure path")
+	}
+	if p.Windows {
+		if reason := windowsNameProblem(hdr.Name); reason != "" {
+			report("Name", true, reason+" on Windows")
+		}
+	}
+	if !p.UTF8 && !isASCII(hdr.Name) {
+		report("Name", false, "non-ASCII names are not supported")
+	}
+	if !p.Ownership && (hdr.Uid64() != 0 || hdr.Gid64() != 0 || hdr.Uname != "" || hdr.Gname != "") {
+		report("Uid", false, "ownership is not restored")
+	}
+	if !p.SubSecond && hdr.ModTime.Nanosecond() != 0 {
+		report("ModTime", false, "sub-second times are not restored")
+	}
+	if !p.Xattrs && len(hdr.Xattrs) > 0 {
+		report("Xattrs", false, "extended attributes are not restored")
+	}
+	return probs
+}
+
+// CheckArchive reads the tar archive from r and reports the problems that
+// would occur if it were extracted by the implementation described by p.
+// Global headers are not themselves checked.
+func (p *Profile) CheckArchive(r io.Reader) ([]Problem, error) {
+	var probs []Problem
+	tr := NewReader(r)
+	tr.AllowInsecurePaths = true // Reported by CheckHeader
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return probs, nil
+		}
+		if err != nil {
+			return probs, err
+		}
+		if hdr.Typeflag == TypeXGlobalHeader {
+			if !p.PAX {
+				probs = append(probs, Problem{hdr.Name, "Typeflag", false, "global headers are not supported"})
+			}
+			continue
+		}
+		probs = append(probs, p.CheckHeader(hdr)...)
+	}
+}
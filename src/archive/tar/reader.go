@@ -8,13 +8,21 @@ package tar
 //   - pax extensions
 
 import (
+	"bufio"
 	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"math"
+	"os"
+	"path"
+	"runtime"
 	"strconv"
 	"strings"
 	"time"
+	"unicode/utf8"
 )
 
 // A Reader provides sequential access to the contents of a tar archive.
@@ -22,10 +30,227 @@ import (
 // The Next method advances to the next file in the archive (including the first),
 // and then it can be treated as an io.Reader to access the file's data.
 type Reader struct {
+	// AllowShortTrailer permits the end-of-archive trailer to be truncated.
+	//
+	// A stream that ends cleanly after the last entry's data and padding
+	// is always treated as the end of the archive. However, a stream that
+	// ends partway through one of the two trailing zero blocks ordinarily
+	// reports io.ErrUnexpectedEOF. If AllowShortTrailer is set, such a
+	// stream reports io.EOF so long as all of the trailing bytes are zero.
+	AllowShortTrailer bool
+
+	// DetailedErrors reports invalid headers using a *HeaderError that
+	// describes where and why the archive is malformed, and archives that
+	// end partway through an entry using a *TruncatedError that describes
+	// where the input ended and how much of the entry is missing.
+	// Otherwise, ErrHeader and io.ErrUnexpectedEOF are reported.
+	DetailedErrors bool
+
+	// DisallowSkip causes Next to report ErrUnreadData, instead of
+	// skipping the remainder, if the data of the current entry has not
+	// been completely read. The error is not persistent; the remaining
+	// data may still be read, after which Next succeeds.
+	DisallowSkip bool
+
+	// TrackSources records where the value of each Header field came from,
+	// which is reported by the Sources method.
+	TrackSources bool
+
+	// AllowInsecurePaths disables the check performed by Next on the names
+	// of entries. Unless set, Next reports ErrInsecurePath, along with the
+	// header, for an entry whose name is absolute, contains a ".." path
+	// element, or on Windows, contains a backslash or volume name.
+	// The error is not persistent; Next may be called again to continue.
+	AllowInsecurePaths bool
+
+	// AllowUnusualNames accepts names found in archives from some vendor
+	// tools that Next otherwise rejects: names that consist only of
+	// slashes, such as "/", which refer to the destination directory
+	// itself, are not reported as insecure paths, and trailing NULs in
+	// the values of PAX path, linkpath, uname, and gname records are
+	// removed instead of causing ErrHeader. Like entries with empty
+	// names, which are always returned, such entries need to be handled
+	// by the caller, such as by skipping them.
+	AllowUnusualNames bool
+
+	// LazyHeaders makes Next decode only the Name, Linkname, Size, and
+	// Typeflag fields of each header, leaving the others zero, such as to
+	// list the names in a large archive faster. The other fields, and the
+	// PAX records of the entry, may then be decoded with FullHeader.
+	// Since the modes of entries are not decoded by Next, SpecialModes and
+	// Umask are applied by FullHeader, and TrackSources has no effect.
+	LazyHeaders bool
+
+	// InternNames causes the Reader to reuse the strings for recurring
+	// values of the Uname and Gname fields, rather than allocating new
+	// ones for every entry. This reduces memory usage when many headers
+	// of a large archive are retained.
+	InternNames bool
+
+	// VerifyDigests causes the Reader to compute the digests of the data
+	// of each entry that has digests recorded by Header.SetDigest, and to
+	// report ErrDigestMismatch instead of io.EOF from Read once the end of
+	// the data is reached if any of them differ. If DetailedErrors is set,
+	// a *DigestError is reported instead. Digests using algorithms that are
+	// not available are ignored.
+	//
+	// Data that is not read before the next call to Next is read by Next,
+	// rather than skipped over, and a mismatch is reported by Next without
+	// advancing to the next entry. The error is not persistent; Next may be
+	// called again to continue.
+	VerifyDigests bool
+
+	// ReadAheadSize, if positive, is the size of a buffer through which
+	// the Reader reads from the underlying io.Reader, such that it is read
+	// in large chunks rather than a block or an entry at a time. This
+	// improves throughput for sources with a high latency per read.
+	// If the underlying io.Reader is already a *bufio.Reader, it is used
+	// as is. Buffered sources are never skipped over using io.Seeker.
+	// It only has an effect if set before the first call to Next.
+	ReadAheadSize int
+
+	// Limiter, if non-nil, limits the rate at which the Reader reads from
+	// the underlying io.Reader, after any buffering for ReadAheadSize.
+	// Data skipped over using io.Seeker is not counted. It only has an
+	// effect if set before the first call to Next.
+	Limiter Limiter
+
+	// Metrics, if non-nil, receives the entries that Next returns, the
+	// amount of data that Read returns, and the errors that either reports.
+	Metrics Metrics
+
+	// Include and Exclude select the entries that Next returns by name.
+	// If Include is non-empty, only entries whose names match one of its
+	// patterns are returned; entries whose names match one of the patterns
+	// in Exclude are never returned. Other entries are skipped over.
+	// Global headers are always returned.
+	//
+	// The patterns have the syntax of path.Match, and additionally, an
+	// element of "**" matches zero or more elements of a name. For example,
+	// "**/*.so" matches "a.so" and "lib/x/b.so". Names of directories are
+	// matched without their trailing slash. An invalid pattern causes Next
+	// to report path.ErrBadPattern.
+	Include, Exclude []string
+
+	// StripComponents, if positive, is the number of leading elements that
+	// Next removes from the names of entries, as with the --strip-components
+	// option of GNU tar. Afterwards, NamePrefix is prepended to each name.
+	// Both also apply to the targets of hard links, but not of symbolic
+	// links. Entries whose names have no more elements than are stripped
+	// are skipped over. The Include and Exclude patterns are matched against
+	// the original names, whereas ErrInsecurePath applies to the new ones.
+	StripComponents int
+	NamePrefix      string
+
+	// NormalizeNames, if non-nil, is applied by Next to the names and link
+	// targets of entries before any other option, such as to convert them
+	// to a Unicode normal form with the String method of norm.NFC from the
+	// golang.org/x/text/unicode/norm package, such that names written on
+	// macOS, which uses NFD, and on Linux, which usually uses NFC, compare
+	// equal. The names as stored in the archive are reported by
+	// OriginalNames.
+	NormalizeNames func(string) string
+
+	// WindowsNames selects how entries whose names cannot be created on
+	// Windows are handled, after the above options are applied. By default,
+	// their names are returned as they are.
+	WindowsNames WindowsNamePolicy
+
+	// SpecialModes selects how the setuid, setgid, and sticky bits of the
+	// modes of entries are handled, such that a service that unpacks
+	// untrusted archives does not create setuid executables. By default,
+	// the modes are returned as they are.
+	SpecialModes SpecialModePolicy
+
+	// Umask, if positive, holds permission bits that Next clears from the
+	// modes of entries, after SpecialModes is applied, as extracting files
+	// with the given creation mask would. If it is ProcessUmask, the mask of
+	// the process at the time of the first call to Next is used, matching
+	// GNU tar without the --same-permissions option. Otherwise, modes are
+	// returned as archived, matching GNU tar with it.
+	Umask int64
+
+	// MaxExtendedHeaderSize, if positive, limits the size of the data of
+	// PAX extended headers and of GNU long name and long link entries,
+	// which the Reader holds in memory in their entirety. Next reports
+	// ErrFieldTooLong for larger ones. Otherwise, they may be of any size,
+	// such that records with large values, such as extended attributes,
+	// can be read.
+	MaxExtendedHeaderSize int64
+
+	// DuplicateKeys selects how a key that occurs more than once in an
+	// extended header is handled. With DuplicateReject, Next reports
+	// ErrHeader, or a *HeaderError of KindPAXRecord if DetailedErrors is set.
+	// The records of the old GNU sparse format, which repeat by design,
+	// are exempt.
+	DuplicateKeys DuplicateKeyPolicy
+
+	// Checksums selects which interpretations of the checksum of a header
+	// block are accepted. By default, either is.
+	//
+	// Next normally reports ErrHeader, or a *HeaderError of KindChecksum if
+	// DetailedErrors is set, for a header block whose checksum does not
+	// match, after which the Reader is unusable. If ContinueOnBadChecksum
+	// is set, the header is decoded regardless, and Next reports the error
+	// along with the header of the entry, or with the header that follows
+	// if the block belonged to an extended header, unless the entry is
+	// skipped over. The error is not persistent; Next may be called again
+	// to continue.
+	Checksums             ChecksumPolicy
+	ContinueOnBadChecksum bool
+
+	// ContentTransform, if non-nil, is called by Next for each entry that
+	// has data, and Read returns the data read from the io.Reader that it
+	// returns, such as to decompress, decrypt, or scan the data of entries
+	// that were transformed by Writer.ContentTransform. The transform reads
+	// the data as stored in the archive from r, which reports errors, such
+	// as a truncated archive or a digest mismatch, as Read would. It may
+	// return r to leave the data of an entry as is. Header.Size remains
+	// the size of the data as stored.
+	ContentTransform func(hdr *Header, r io.Reader) io.Reader
+
+	// Audit, if non-nil, is called by Next with each header that is
+	// selected, after StripComponents and NamePrefix are applied and before
+	// any other check, along with details of how the entry is encoded, such
+	// that a security scanner can inspect every entry in one place. If it
+	// returns SkipEntry, the entry is skipped over. If it returns any other
+	// error, Next reports the error along with the header. The error is not
+	// persistent; Next may be called again to continue.
+	Audit func(hdr *Header, info *EntryInfo) error
+
 	r    io.Reader
+	ra   io.ReaderAt    // r, if it is an io.ReaderAt, before any buffering
 	pad  int64          // amount of padding (ignored) after current file entry
 	curr numBytesReader // reader for current file entry
 	blk  block          // buffer to use as temporary local storage
+	rfr  regFileReader  // reused as the reader for current file entry
+	buf  bytes.Buffer   // reused for the data of PAX and GNU headers
+
+	globals  map[string]string // records from preceding global headers
+	trailing map[string]string // records from an extended header at the end of the archive
+
+	name    string // name of the entry whose data is being read
+	hdrOff  int64  // offset of the most recently read header block
+	nextOff int64  // offset of the next header block
+	dataEnd int64  // offset of the end of the data of the current entry
+	index   int    // number of entries returned by Next
+
+	sources map[string]FieldSource // sources of the fields of the current header
+	raw     block                  // copy of the raw header block of the current entry
+	hasRaw  bool                   // whether raw is valid
+	names   map[string]string      // interned names if InternNames is set
+	started bool                   // whether Next has been called
+	format  int                    // format of the current entry
+	digests []digestCheck          // digests to verify if VerifyDigests is set
+	rawHdrs bytes.Buffer           // raw blocks and meta data preceding the current entry's data, if more than raw
+	rawNB   int64                  // unread bytes of the current entry when returned by Next
+	badSum  error                  // error for a bad checksum of the current entry
+	xr      io.Reader              // transformed data of the current entry, if any
+	orig    [2]string              // name and link target of the current entry as stored
+	umask   int64                  // permission bits to clear from modes
+	merr    error                  // error last reported to Metrics
+	listed  *Header                // copy of the current header if LazyHeaders is set
+	recs    map[string]string      // PAX records of the current entry if LazyHeaders is set
 
 	// err is a persistent error.
 	// It is only the responsibility of every exported method of Reader to
@@ -91,23 +316,738 @@ const (
 	paxGNUSparseRealSize  = "GNU.sparse.realsize"
 )
 
+// Keyword for Solaris sparse files in a PAX extended header
+const paxSunHolesData = "SUN.holesdata"
+
+// A DuplicateKeyPolicy selects how a Reader handles a key that occurs more
+// than once in a single extended header. Implementations disagree on which
+// of the records takes effect, and such headers are usually the result of
+// a bug or an attempt to confuse some of the readers of an archive.
+type DuplicateKeyPolicy int
+
+const (
+	// DuplicateLastWins uses the value of the last record with the key,
+	// as do GNU tar and bsdtar.
+	DuplicateLastWins DuplicateKeyPolicy = iota
+
+	// DuplicateFirstWins uses the value of the first record with the key.
+	DuplicateFirstWins
+
+	// DuplicateReject reports the extended header as invalid.
+	DuplicateReject
+)
+
+// A ChecksumPolicy selects which checksums of header blocks a Reader
+// accepts. POSIX specifies a sum of the unsigned byte values of a block,
+// but some historic implementations, such as Sun tar, used signed byte
+// values, which differ for blocks with bytes of 0x80 and above.
+type ChecksumPolicy int
+
+const (
+	ChecksumEither   ChecksumPolicy = iota // Accept either sum
+	ChecksumUnsigned                       // Only accept the sum of unsigned bytes
+	ChecksumSigned                         // Only accept the sum of signed bytes
+)
+
+// ProcessUmask is a value of Reader.Umask that selects the creation mask
+// of the process.
+const ProcessUmask = -1
+
+// A SpecialModePolicy selects how a Reader handles the setuid, setgid, and
+// sticky bits of the modes of entries.
+type SpecialModePolicy int
+
+const (
+	// SpecialModesPreserve returns the modes as they are.
+	SpecialModesPreserve SpecialModePolicy = iota
+
+	// SpecialModesPrivileged returns the modes as they are if the process
+	// has an effective user ID of 0, such that files extracted by root
+	// keep their modes, as with GNU tar, and strips the bits otherwise.
+	SpecialModesPrivileged
+
+	// SpecialModesStrip clears the bits in the modes of all entries.
+	SpecialModesStrip
+
+	// SpecialModesError causes Next to report ErrSpecialMode along with
+	// the header of an entry whose mode has any of the bits set. The error
+	// is not persistent; Next may be called again to continue.
+	SpecialModesError
+)
+
+// An ErrorKind classifies why a header is invalid.
+type ErrorKind int
+
+// Kinds of invalid headers reported in a HeaderError.
+const (
+	KindChecksum  ErrorKind = iota + 1 // Header block has an invalid checksum
+	KindNumeric                        // Numeric field is malformed or out of range
+	KindPAXRecord                      // PAX record is malformed or truncated
+	KindSparseMap                      // Sparse map is malformed
+	KindTrailer                        // Zero block is followed by a non-zero block
+)
+
+var kindNames = map[ErrorKind]string{
+	KindChecksum:  "bad checksum",
+	KindNumeric:   "bad numeric field",
+	KindPAXRecord: "bad PAX record",
+	KindSparseMap: "bad sparse map",
+	KindTrailer:   "bad trailer",
+}
+
+func (k ErrorKind) String() string {
+	if s, ok := kindNames[k]; ok {
+		return s
+	}
+	return "ErrorKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// A HeaderError records an invalid header found by a Reader
+// that has DetailedErrors set; it corresponds to ErrHeader.
+type HeaderError struct {
+	Offset int64     // Offset in the stream of the header block
+	Index  int       // Index of the entry, counting from zero
+	Kind   ErrorKind // Reason the header is invalid
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("tar: invalid tar header at offset %d (entry %d): %v", e.Offset, e.Index, e.Kind)
+}
+
+// A TruncatedError records that the input of a Reader that has
+// DetailedErrors set ended partway through an entry or a header block;
+// it corresponds to io.ErrUnexpectedEOF.
+type TruncatedError struct {
+	Name    string // Name of the entry, or "" if a header block was truncated
+	Offset  int64  // Offset in the stream at which the input ended
+	Missing int64  // Number of bytes of the entry or header block that are missing
+}
+
+func (e *TruncatedError) Error() string {
+	if e.Name == "" {
+		return fmt.Sprintf("tar: archive truncated at offset %d: header block is missing %d bytes", e.Offset, e.Missing)
+	}
+	return fmt.Sprintf("tar: archive truncated at offset %d: entry %q is missing %d bytes", e.Offset, e.Name, e.Missing)
+}
+
+// A SourceKind identifies the part of an archive that a Header field was
+// read from.
+type SourceKind int
+
+// Sources of Header fields.
+const (
+	SourceHeader    SourceKind = iota + 1 // Field of the V7, USTAR, or STAR header block
+	SourceGNU                             // GNU extension, such as a long name entry or GNU header field
+	SourcePAX                             // Record of the entry's extended header
+	SourceGlobalPAX                       // Record of a preceding global extended header
+)
+
+var sourceNames = map[SourceKind]string{
+	SourceHeader:    "header",
+	SourceGNU:       "GNU",
+	SourcePAX:       "PAX",
+	SourceGlobalPAX: "global PAX",
+}
+
+func (k SourceKind) String() string {
+	if s, ok := sourceNames[k]; ok {
+		return s
+	}
+	return "SourceKind(" + strconv.Itoa(int(k)) + ")"
+}
+
+// A FieldSource describes where the value of a Header field was read from.
+type FieldSource struct {
+	Kind SourceKind
+	Key  string // PAX record key, for SourcePAX and SourceGlobalPAX
+}
+
+// paxFields maps PAX record keys to the Header fields that they populate.
+var paxFields = map[string]string{
+	paxPath:              "Name",
+	paxLinkpath:          "Linkname",
+	paxUname:             "Uname",
+	paxGname:             "Gname",
+	paxUid:               "Uid",
+	paxGid:               "Gid",
+	paxAtime:             "AccessTime",
+	paxMtime:             "ModTime",
+	paxCtime:             "ChangeTime",
+	paxSize:              "Size",
+	paxGNUSparseName:     "Name",
+	paxGNUSparseSize:     "Size",
+	paxGNUSparseRealSize: "Size",
+	paxSunHolesData:      "Size",
+}
+
+// Sources reports where the value of each field of the Header most recently
+// returned by Next came from, keyed by the name of the field (such as "Name"
+// or "ModTime"). A field that was not present in the archive has no entry.
+// It returns nil unless TrackSources is set.
+func (tr *Reader) Sources() map[string]FieldSource {
+	return tr.sources
+}
+
+// GlobalPAXRecords returns a copy of the PAX records from all preceding
+// global extended headers, as currently applied to each subsequent entry.
+// Records deleted by a later global header are not included.
+func (tr *Reader) GlobalPAXRecords() map[string]string {
+	return mergePAXRecords(nil, tr.globals)
+}
+
+// ResetGlobalPAXRecords discards the records from all preceding global
+// extended headers, such that they no longer apply to subsequent entries.
+func (tr *Reader) ResetGlobalPAXRecords() {
+	tr.globals = nil
+}
+
+// TrailingPAXRecords returns the PAX records of a local extended header
+// that is not followed by any entry once Next has reported io.EOF, which
+// some producers use to store metadata about the archive as a whole. If
+// several such headers precede the end of the archive, only the last one
+// is reported, as only it would apply to a following entry. It returns nil
+// otherwise. Global headers at the end of the archive are returned by Next
+// as entries, as any other global headers are.
+func (tr *Reader) TrailingPAXRecords() map[string]string {
+	if tr.err != io.EOF || tr.trailing == nil {
+		return nil
+	}
+	recs := make(map[string]string, len(tr.trailing))
+	for k, v := range tr.trailing {
+		recs[k] = v
+	}
+	return recs
+}
+
+// TrailerSize reports the number of bytes that the Reader consumed after the
+// data of the last entry once Next has reported io.EOF, which comprises the
+// padding of that entry and the zero blocks marking the end of the archive.
+// It reports zero otherwise.
+//
+// The Reader never reads beyond the end of the archive from the underlying
+// io.Reader, unless ReadAheadSize is set. Thus, data that follows the archive
+// in the same stream may be read from it once Next has reported io.EOF.
+func (tr *Reader) TrailerSize() int64 {
+	if tr.err != io.EOF {
+		return 0
+	}
+	return tr.nextOff - tr.dataEnd
+}
+
+// RawHeader returns a copy of the raw header block of the entry most
+// recently returned by Next. For entries that are preceded by extended
+// headers or GNU long name entries, only the final header block is
+// returned. It returns nil if there is no current entry.
+//
+// Together with Writer.WriteRawHeader, this allows entries to be copied
+// verbatim, including those with vendor-specific type flags, which Next
+// treats as regular files. To copy an entry along with its extended
+// headers, use Writer.CopyEntry.
+func (tr *Reader) RawHeader() []byte {
+	if !tr.hasRaw {
+		return nil
+	}
+	return append([]byte(nil), tr.raw[:]...)
+}
+
+// Section returns an io.SectionReader for the data of the entry most
+// recently returned by Next, which provides random access to it with ReadAt
+// and Seek, independently of Read, such that part of a large entry can be
+// read without reading all of it. Digests are not verified for data read
+// from the io.SectionReader.
+//
+// It reports false if there is no current entry, if the entry is a sparse
+// file, whose data is not stored contiguously, or if the io.Reader passed to
+// NewReader is not also an io.ReaderAt, such as an *os.File or a
+// *bytes.Reader. Its offsets must correspond to those from which the
+// archive is read, as is the case for a file read from its beginning.
+func (tr *Reader) Section() (*io.SectionReader, bool) {
+	if tr.ra == nil || tr.curr != &tr.rfr || !tr.hasRaw {
+		return nil, false
+	}
+	return io.NewSectionReader(tr.ra, tr.dataOffset(), tr.rawNB), true
+}
+
+// OriginalNames returns the name and link target of the entry most recently
+// returned by Next as stored in the archive, before NormalizeNames,
+// StripComponents, and NamePrefix were applied.
+func (tr *Reader) OriginalNames() (name, linkname string) {
+	return tr.orig[0], tr.orig[1]
+}
+
 // NewReader creates a new Reader reading from r.
 func NewReader(r io.Reader) *Reader { return &Reader{r: r} }
 
 // Next advances to the next entry in the tar archive.
 //
+// Global extended headers (TypeXGlobalHeader) are returned as entries
+// with their records in Header.PAXRecords and no readable data.
+// Their records also apply to all subsequent entries, for which
+// records in a local extended header take precedence.
+//
 // io.EOF is returned at the end of the input.
 func (tr *Reader) Next() (*Header, error) {
+	hdr, err := tr.nextEntry()
+	if tr.LazyHeaders {
+		tr.listed = nil
+		if hdr != nil {
+			listed := *hdr
+			tr.listed = &listed
+		}
+	}
+	if tr.Metrics != nil {
+		if hdr != nil {
+			tr.Metrics.Entry(MetricsRead, hdr, formatName(tr.format))
+		}
+		tr.reportError(err)
+	}
+	return hdr, err
+}
+
+// nextEntry is Next without the reporting to tr.Metrics.
+func (tr *Reader) nextEntry() (*Header, error) {
 	if tr.err != nil {
 		return nil, tr.err
 	}
-	hdr, err := tr.next()
-	tr.err = err
-	return hdr, err
+	if tr.DisallowSkip && tr.numBytes() > 0 {
+		return nil, ErrUnreadData
+	}
+	for tr.digests != nil {
+		// Read the remaining data of the current entry to verify it.
+		if _, err := tr.readData(tr.blk[:]); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if !tr.started {
+		tr.start()
+	}
+	for _, patterns := range [][]string{tr.Include, tr.Exclude} {
+		for _, pattern := range patterns {
+			if err := checkPattern(pattern); err != nil {
+				return nil, err
+			}
+		}
+	}
+	for {
+		tr.sources, tr.hasRaw, tr.digests, tr.badSum, tr.xr = nil, false, nil, nil, nil
+		tr.rawHdrs.Reset()
+		hdr, err := tr.next()
+		tr.err = err
+		if err != nil {
+			return nil, err
+		}
+		tr.index++
+		tr.rawNB = tr.rfr.nb
+		tr.orig = [2]string{hdr.Name, hdr.Linkname}
+		if tr.NormalizeNames != nil && hdr.Typeflag != TypeXGlobalHeader {
+			hdr.Name = tr.NormalizeNames(hdr.Name)
+			if hdr.Linkname != "" {
+				hdr.Linkname = tr.NormalizeNames(hdr.Linkname)
+			}
+		}
+		if !tr.selected(hdr) || !tr.rename(hdr) {
+			continue
+		}
+		var policyErr error
+		if tr.WindowsNames != WindowsNamesAllow && hdr.Typeflag != TypeXGlobalHeader {
+			switch {
+			case tr.WindowsNames == WindowsNamesRename:
+				hdr.Name = windowsName(hdr.Name)
+				if hdr.Typeflag == TypeLink {
+					hdr.Linkname = windowsName(hdr.Linkname)
+				}
+			case windowsNameProblem(hdr.Name) == "":
+			case tr.WindowsNames == WindowsNamesSkip:
+				continue
+			default:
+				policyErr = ErrWindowsName
+			}
+		}
+		if err := tr.applyModes(hdr); policyErr == nil {
+			policyErr = err
+		}
+		if tr.Audit != nil {
+			if err := tr.Audit(hdr, tr.entryInfo()); err == SkipEntry {
+				continue
+			} else if err != nil {
+				return hdr, err
+			}
+		}
+		if tr.ContentTransform != nil && tr.numBytes() > 0 {
+			tr.xr = tr.ContentTransform(hdr, entryData{tr})
+		}
+		if tr.badSum != nil {
+			return hdr, tr.badSum
+		}
+		if !tr.AllowInsecurePaths && isInsecurePath(hdr.Name) && !(tr.AllowUnusualNames && strings.Trim(hdr.Name, "/") == "") {
+			return hdr, ErrInsecurePath
+		}
+		return hdr, policyErr
+	}
+}
+
+// applyModes applies SpecialModes and Umask to the mode of hdr. It returns
+// ErrSpecialMode if the mode is rejected by SpecialModes.
+func (tr *Reader) applyModes(hdr *Header) (err error) {
+	if mode := hdr.Mode & (c_ISUID | c_ISGID | c_ISVTX); mode != 0 {
+		switch tr.SpecialModes {
+		case SpecialModesPrivileged:
+			if os.Geteuid() != 0 {
+				hdr.Mode &^= mode
+			}
+		case SpecialModesStrip:
+			hdr.Mode &^= mode
+		case SpecialModesError:
+			err = ErrSpecialMode
+		}
+	}
+	if tr.umask > 0 && hdr.Typeflag != TypeXGlobalHeader {
+		hdr.Mode &^= tr.umask & 0777
+	}
+	return err
+}
+
+// FullHeader returns the header of the entry most recently returned by Next
+// with all of its fields decoded, when LazyHeaders is set. The fields that
+// Next decoded are as it returned them, such as after NormalizeNames, and
+// SpecialModes and Umask are applied to the mode, for which ErrSpecialMode
+// may be returned along with the header, as for Next.
+//
+// It reports an error if LazyHeaders is not set or there is no current
+// entry. Each call decodes the header anew.
+func (tr *Reader) FullHeader() (*Header, error) {
+	if !tr.LazyHeaders || tr.listed == nil {
+		return nil, errors.New("archive/tar: FullHeader called without a lazily decoded entry")
+	}
+	if tr.listed.Typeflag == TypeXGlobalHeader {
+		hdr := *tr.listed
+		return &hdr, nil // Global headers are always fully decoded
+	}
+	var p parser
+	hdr := new(Header)
+	tr.decodeFields(hdr, &tr.raw, tr.raw.guessFormat(), &p)
+	if p.err != nil {
+		return nil, tr.headerError(p.err, KindNumeric)
+	}
+	if err := mergePAX(hdr, tr.recs); err != nil {
+		return nil, tr.headerError(err, KindPAXRecord)
+	}
+	if tr.InternNames {
+		hdr.Uname = tr.internName(hdr.Uname)
+		hdr.Gname = tr.internName(hdr.Gname)
+	}
+	hdr.Name, hdr.Linkname = tr.listed.Name, tr.listed.Linkname
+	hdr.Size, hdr.Typeflag = tr.listed.Size, tr.listed.Typeflag
+	return hdr, tr.applyModes(hdr)
+}
+
+// SkipEntry is used as a return value from Reader.Audit to indicate that
+// the entry is to be skipped over. It is not returned as an error by any
+// function.
+var SkipEntry = errors.New("skip this entry")
+
+// An EntryInfo describes how the entry most recently decoded by a Reader is
+// encoded, as passed to Reader.Audit.
+type EntryInfo struct {
+	Index      int    // Number of entries that precede it, including skipped ones
+	Offset     int64  // Offset of its header block
+	DataOffset int64  // Offset of its data
+	Format     string // Format of its header, as named in Summary.Formats
+	Raw        []byte // Its header block, as returned by Reader.RawHeader
+
+	Extended    bool  // Whether it is preceded by extended headers or GNU long names
+	Sparse      bool  // Whether it is a sparse file
+	BadChecksum error // Error for a bad checksum, if ContinueOnBadChecksum is set
+}
+
+// entryInfo returns the EntryInfo of the current entry.
+func (tr *Reader) entryInfo() *EntryInfo {
+	_, sparse := tr.curr.(*sparseFileReader)
+	return &EntryInfo{
+		Index:       tr.index - 1,
+		Offset:      tr.hdrOff,
+		DataOffset:  tr.dataOffset(),
+		Format:      formatName(tr.format),
+		Raw:         tr.RawHeader(),
+		Extended:    tr.rawHdrs.Len() > 0,
+		Sparse:      sparse,
+		BadChecksum: tr.badSum,
+	}
+}
+
+// start applies the options of tr that take effect when it is first used.
+func (tr *Reader) start() {
+	tr.started = true
+	tr.umask = tr.Umask
+	if tr.Umask == ProcessUmask {
+		tr.umask = processUmask()
+	}
+	tr.ra, _ = tr.r.(io.ReaderAt)
+	if _, ok := tr.r.(*bufio.Reader); !ok && tr.ReadAheadSize > 0 {
+		tr.r = bufio.NewReaderSize(tr.r, tr.ReadAheadSize)
+	}
+	if tr.Limiter != nil {
+		tr.r = newLimitedReader(tr.r, tr.Limiter)
+	}
+}
+
+// selected reports whether hdr is selected by the Include and Exclude
+// patterns, which must be valid.
+func (tr *Reader) selected(hdr *Header) bool {
+	if hdr.Typeflag == TypeXGlobalHeader || (len(tr.Include) == 0 && len(tr.Exclude) == 0) {
+		return true
+	}
+	name := strings.TrimSuffix(hdr.Name, "/")
+	included := len(tr.Include) == 0
+	for _, pattern := range tr.Include {
+		if matchPath(pattern, name) {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+	for _, pattern := range tr.Exclude {
+		if matchPath(pattern, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// rename applies StripComponents and NamePrefix to hdr. It reports false
+// if the name has too few elements to be stripped.
+func (tr *Reader) rename(hdr *Header) bool {
+	if hdr.Typeflag == TypeXGlobalHeader || (tr.StripComponents <= 0 && tr.NamePrefix == "") {
+		return true
+	}
+	name, ok := stripComponents(hdr.Name, tr.StripComponents)
+	if !ok {
+		return false
+	}
+	hdr.Name = tr.NamePrefix + name
+	if hdr.Typeflag == TypeLink {
+		if link, ok := stripComponents(hdr.Linkname, tr.StripComponents); ok {
+			hdr.Linkname = tr.NamePrefix + link
+		}
+	}
+	return true
+}
+
+// stripComponents removes the first n elements of name. It reports false
+// if nothing remains.
+func stripComponents(name string, n int) (string, bool) {
+	for ; n > 0; n-- {
+		i := strings.IndexByte(name, '/')
+		if i < 0 {
+			return "", false
+		}
+		name = name[i+1:]
+	}
+	return name, name != ""
+}
+
+// matchPath reports whether name matches the valid pattern, as described
+// for Reader.Include.
+func matchPath(pattern, name string) bool {
+	return matchElems(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchElems(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchElems(pattern[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// checkPattern reports path.ErrBadPattern if pattern does not have the
+// syntax of path.Match, which reports it only upon reaching the malformed
+// part of a pattern while matching a name.
+func checkPattern(pattern string) error {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '\\':
+			if len(pattern) == 1 {
+				return path.ErrBadPattern
+			}
+			pattern = pattern[2:]
+		case '[':
+			pattern = pattern[1:]
+			if len(pattern) > 0 && pattern[0] == '^' {
+				pattern = pattern[1:]
+			}
+			for nrange := 0; ; nrange++ {
+				if len(pattern) > 0 && pattern[0] == ']' && nrange > 0 {
+					pattern = pattern[1:]
+					break
+				}
+				var err error
+				if pattern, err = checkClassChar(pattern); err != nil {
+					return err
+				}
+				if pattern[0] == '-' {
+					if pattern, err = checkClassChar(pattern[1:]); err != nil {
+						return err
+					}
+				}
+			}
+		default:
+			pattern = pattern[1:]
+		}
+	}
+	return nil
+}
+
+// checkClassChar checks the possibly escaped character that starts pattern
+// within a character class, which must not end there, and returns the rest
+// of pattern.
+func checkClassChar(pattern string) (string, error) {
+	if len(pattern) == 0 || pattern[0] == '-' || pattern[0] == ']' {
+		return "", path.ErrBadPattern
+	}
+	if pattern[0] == '\\' {
+		pattern = pattern[1:]
+		if len(pattern) == 0 {
+			return "", path.ErrBadPattern
+		}
+	}
+	r, n := utf8.DecodeRuneInString(pattern)
+	if (r == utf8.RuneError && n == 1) || len(pattern) == n {
+		return "", path.ErrBadPattern
+	}
+	return pattern[n:], nil
+}
+
+// Find advances to the next entry in the tar archive whose name is one of
+// names, skipping over all other entries as Next does, which uses io.Seeker
+// if the underlying io.Reader implements it. It reports io.EOF if there is
+// no such entry in the remainder of the archive. Successive calls find
+// successive matching entries in archive order.
+//
+// Names are compared exactly, as they appear in Header.Name. Errors are
+// reported as for Next, except that errors that Next reports along with
+// the header of an entry that does not match, such as ErrInsecurePath or
+// an error from Audit, are not reported. If DisallowSkip is set, the data
+// of the entries that do not match is read and discarded.
+func (tr *Reader) Find(names ...string) (*Header, error) {
+	return tr.find(func(hdr *Header) bool {
+		for _, name := range names {
+			if hdr.Name == name {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// NextType advances to the next entry in the tar archive whose Typeflag is
+// one of types, skipping over all other entries, including global headers,
+// as Find does. It reports io.EOF if there is no such entry in the
+// remainder of the archive. Errors are reported as for Find.
+func (tr *Reader) NextType(types ...byte) (*Header, error) {
+	return tr.find(func(hdr *Header) bool {
+		for _, flag := range types {
+			if hdr.Typeflag == flag {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// find advances to the next entry for which match reports true, for Find
+// and NextType.
+func (tr *Reader) find(match func(*Header) bool) (*Header, error) {
+	for {
+		hdr, err := tr.Next()
+		if hdr == nil {
+			return nil, err
+		}
+		if match(hdr) {
+			return hdr, err
+		}
+		if tr.DisallowSkip {
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				return nil, err
+			}
+		}
+	}
+}
+
+// NextRegular advances to the next regular file in the tar archive,
+// skipping over directories, links, global headers, and all other entries
+// that have no data of their own, as NextType does. Regular files are those
+// of types TypeReg, TypeRegA, TypeCont, and TypeGNUSparse.
+func (tr *Reader) NextRegular() (*Header, error) {
+	return tr.NextType(TypeReg, TypeRegA, TypeCont, TypeGNUSparse)
+}
+
+// isInsecurePath reports whether extracting a file with the given name could
+// write outside of the destination directory.
+func isInsecurePath(name string) bool {
+	if strings.HasPrefix(name, "/") {
+		return true
+	}
+	if runtime.GOOS == "windows" {
+		if strings.Contains(name, `\`) || (len(name) >= 2 && name[1] == ':') {
+			return true
+		}
+	}
+	for name != "" {
+		elem := name
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			elem, name = name[:i], name[i+1:]
+		} else {
+			name = ""
+		}
+		if elem == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// headerError converts ErrHeader into a *HeaderError of the given kind
+// for the current header if DetailedErrors is set.
+// All other errors are returned as is.
+func (tr *Reader) headerError(err error, kind ErrorKind) error {
+	if err != ErrHeader || !tr.DetailedErrors {
+		return err
+	}
+	return &HeaderError{Offset: tr.hdrOff, Index: tr.index, Kind: kind}
+}
+
+// truncatedError converts io.ErrUnexpectedEOF into a *TruncatedError for
+// the data of the current entry if DetailedErrors is set.
+// All other errors are returned as is.
+func (tr *Reader) truncatedError(err error) error {
+	if err != io.ErrUnexpectedEOF || !tr.DetailedErrors {
+		return err
+	}
+	nb := tr.numBytes()
+	return &TruncatedError{Name: tr.name, Offset: tr.nextOff - tr.pad - nb, Missing: nb}
 }
 
 func (tr *Reader) next() (*Header, error) {
 	var extHdrs map[string]string
+	var gnuLongName, gnuLongLink string
 
 	// Externally, Next iterates through the tar archive as if it is a series of
 	// files. Internally, the tar format often uses fake "files" to add meta
@@ -120,37 +1060,74 @@ loop:
 			return nil, err
 		}
 		hdr, rawHdr, err := tr.readHeader()
+		if err == io.EOF {
+			tr.trailing = extHdrs
+		}
 		if err != nil {
 			return nil, err
 		}
 		if err := tr.handleRegularFile(hdr); err != nil {
-			return nil, err
+			return nil, tr.headerError(err, KindNumeric)
 		}
 
 		// Check for PAX/GNU special headers and files.
+		// The raw blocks are only retained for entries that span more than
+		// a single header block, for use by Writer.CopyEntry.
+		switch hdr.Typeflag {
+		case TypeXHeader, typeXHeaderOld, TypeXGlobalHeader, TypeGNULongName, TypeGNULongLink, TypeGNUSparse:
+			tr.rawHdrs.Write(rawHdr[:])
+		default:
+			if tr.rawHdrs.Len() > 0 {
+				tr.rawHdrs.Write(rawHdr[:])
+			}
+		}
 		switch hdr.Typeflag {
-		case TypeXHeader:
-			extHdrs, err = parsePAX(tr)
+		case TypeXHeader, typeXHeaderOld:
+			buf, err := tr.readMetaData()
 			if err != nil {
 				return nil, err
 			}
+			extHdrs, err = parsePAX(buf, tr.DuplicateKeys, tr.AllowUnusualNames)
+			if err != nil {
+				return nil, tr.headerError(err, KindPAXRecord)
+			}
 			continue loop // This is a meta header affecting the next header
-		case TypeGNULongName, TypeGNULongLink:
-			realname, err := ioutil.ReadAll(tr)
+		case TypeXGlobalHeader:
+			buf, err := tr.readMetaData()
 			if err != nil {
 				return nil, err
 			}
+			globHdrs, err := parsePAX(buf, tr.DuplicateKeys, tr.AllowUnusualNames)
+			if err != nil {
+				return nil, tr.headerError(err, KindPAXRecord)
+			}
+			tr.globals = mergePAXRecords(tr.globals, globHdrs)
+			tr.raw, tr.hasRaw = *rawHdr, true
+			tr.format = formatPAX
+			if tr.TrackSources {
+				src := FieldSource{Kind: SourceHeader}
+				tr.sources = map[string]FieldSource{"Name": src, "Typeflag": src}
+			}
 
-			// Convert GNU extensions to use PAX headers.
-			if extHdrs == nil {
-				extHdrs = make(map[string]string)
+			// The global header is surfaced to the caller since it is
+			// meta data that pertains to the archive as a whole.
+			return &Header{
+				Name:       hdr.Name,
+				Typeflag:   hdr.Typeflag,
+				PAXRecords: globHdrs,
+			}, nil
+		case TypeGNULongName, TypeGNULongLink:
+			realname, err := tr.readMetaData()
+			if err != nil {
+				return nil, err
 			}
+
 			var p parser
 			switch hdr.Typeflag {
 			case TypeGNULongName:
-				extHdrs[paxPath] = p.parseString(realname)
+				gnuLongName = p.parseString(realname)
 			case TypeGNULongLink:
-				extHdrs[paxLinkpath] = p.parseString(realname)
+				gnuLongLink = p.parseString(realname)
 			}
 			if p.err != nil {
 				return nil, p.err
@@ -160,26 +1137,126 @@ loop:
 			// The old GNU sparse format is handled here since it is technically
 			// just a regular file with additional attributes.
 
-			if err := mergePAX(hdr, extHdrs); err != nil {
-				return nil, err
+			format, localHdrs := rawHdr.guessFormat(), extHdrs
+			tr.raw, tr.hasRaw = *rawHdr, true
+			tr.format = format
+			if len(localHdrs) > 0 {
+				tr.format |= formatPAX
+			}
+
+			// Records from the local extended header take precedence over
+			// those from any preceding global headers.
+			extHdrs = mergePAXRecords(mergePAXRecords(nil, tr.globals), extHdrs)
+			mergeRecs := mergePAX
+			if tr.LazyHeaders {
+				tr.recs, mergeRecs = extHdrs, mergePAXNames
+			}
+			if err := mergeRecs(hdr, extHdrs); err != nil {
+				return nil, tr.headerError(err, KindPAXRecord)
+			}
+			if tr.InternNames {
+				hdr.Uname = tr.internName(hdr.Uname)
+				hdr.Gname = tr.internName(hdr.Gname)
+			}
+			if gnuLongName != "" {
+				hdr.Name = gnuLongName
+			}
+			if gnuLongLink != "" {
+				hdr.Linkname = gnuLongLink
 			}
 
 			// The extended headers may have updated the size.
 			// Thus, setup the regFileReader again after merging PAX headers.
 			if err := tr.handleRegularFile(hdr); err != nil {
-				return nil, err
+				return nil, tr.headerError(err, KindNumeric)
 			}
 
 			// Sparse formats rely on being able to read from the logical data
 			// section; there must be a preceding call to handleRegularFile.
 			if err := tr.handleSparseFile(hdr, rawHdr, extHdrs); err != nil {
-				return nil, err
+				return nil, tr.headerError(tr.truncatedError(err), KindSparseMap)
+			}
+			if tr.TrackSources && !tr.LazyHeaders {
+				tr.trackSources(hdr, format, localHdrs, gnuLongName, gnuLongLink)
+			}
+			if tr.VerifyDigests {
+				tr.digests = newDigestChecks(mergePAXRecords(nil, extHdrs))
 			}
 			return hdr, nil // This is a file, so stop
 		}
 	}
 }
 
+// trackSources records the sources of the fields of hdr, as parsed from a
+// header block of the given format and then updated by the global records
+// in tr.globals, the local records in localHdrs, the GNU long name and link,
+// and any sparse file headers.
+func (tr *Reader) trackSources(hdr *Header, format int, localHdrs map[string]string, gnuLongName, gnuLongLink string) {
+	tr.sources = make(map[string]FieldSource)
+	set := func(kind SourceKind, fields ...string) {
+		for _, f := range fields {
+			tr.sources[f] = FieldSource{Kind: kind}
+		}
+	}
+
+	set(SourceHeader, "Name", "Mode", "Uid", "Gid", "Size", "ModTime", "Typeflag", "Linkname")
+	if format > formatV7 {
+		set(SourceHeader, "Uname", "Gname", "Devmajor", "Devminor")
+	}
+	if format == formatSTAR {
+		set(SourceHeader, "AccessTime", "ChangeTime")
+	}
+	if format == formatGNU && !hdr.AccessTime.IsZero() {
+		set(SourceGNU, "AccessTime")
+	}
+	if format == formatGNU && !hdr.ChangeTime.IsZero() {
+		set(SourceGNU, "ChangeTime")
+	}
+	if format == formatGNU && hdr.Typeflag == TypeGNUMultiVolume {
+		set(SourceGNU, "VolumeOffset")
+	}
+
+	// Local records take precedence over global ones, and the GNU sparse
+	// records take precedence over all others, in the given order.
+	allRecs := []struct {
+		kind SourceKind
+		m    map[string]string
+	}{{SourceGlobalPAX, tr.globals}, {SourcePAX, localHdrs}}
+	for _, recs := range allRecs {
+		for k, v := range recs.m {
+			field, ok := paxFields[k]
+			if strings.HasPrefix(k, paxXattr) {
+				field, k, ok = "Xattrs", paxXattr, true
+			}
+			if strings.HasPrefix(k, paxLibXattr) {
+				field, k, ok = "Xattrs", paxLibXattr, true
+			}
+			if ok && v != "" && !isSparseRecord(k) {
+				tr.sources[field] = FieldSource{Kind: recs.kind, Key: k}
+			}
+		}
+	}
+	if _, ok := tr.curr.(*sparseFileReader); ok {
+		for _, k := range []string{paxSunHolesData, paxGNUSparseRealSize, paxGNUSparseSize, paxGNUSparseName} {
+			for _, recs := range allRecs {
+				if v := recs.m[k]; v != "" {
+					tr.sources[paxFields[k]] = FieldSource{Kind: recs.kind, Key: k}
+				}
+			}
+		}
+	}
+
+	if gnuLongName != "" {
+		set(SourceGNU, "Name")
+	}
+	if gnuLongLink != "" {
+		set(SourceGNU, "Linkname")
+	}
+	if hdr.Typeflag == TypeGNUSparse {
+		set(SourceGNU, "Size")
+	}
+}
+
 // handleRegularFile sets up the current file reader and padding such that it
 // can only read the following logical data section. It will properly handle
 // special headers that contain no data section.
@@ -192,8 +1269,12 @@ func (tr *Reader) handleRegularFile(hdr *Header) error {
 		return ErrHeader
 	}
 
+	tr.name = hdr.Name
 	tr.pad = -nb & (blockSize - 1) // blockSize is a power of two
-	tr.curr = &regFileReader{r: tr.r, nb: nb}
+	tr.rfr = regFileReader{r: tr.r, nb: nb}
+	tr.curr = &tr.rfr
+	tr.dataEnd = tr.hdrOff + blockSize + nb
+	tr.nextOff = tr.dataEnd + tr.pad
 	return nil
 }
 
@@ -212,6 +1293,12 @@ func (tr *Reader) handleSparseFile(hdr *Header, rawHdr *block, extHdrs map[strin
 		if err != nil {
 			return err
 		}
+		if v := extHdrs[paxSunHolesData]; sp == nil && v != "" {
+			sp, hdr.Size, err = readSunHolesData(v, hdr.Size)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	// If sp is non-nil, then this is a sparse file.
@@ -278,19 +1365,60 @@ func (tr *Reader) checkForGNUSparsePAXHeaders(hdr *Header, headers map[string]st
 	case "0.0", "0.1":
 		sp, err = readGNUSparseMap0x1(headers)
 	case "1.0":
-		sp, err = readGNUSparseMap1x0(tr.curr)
+		sp, err = readGNUSparseMap1x0(io.TeeReader(tr.curr, &tr.rawHdrs))
 	}
 	return sp, err
 }
 
+// mergePAXRecords applies the records in src to dst and returns dst.
+// Records with an empty value delete the corresponding key in dst.
+// If dst is nil, a new map is allocated, if necessary.
+func mergePAXRecords(dst, src map[string]string) map[string]string {
+	for k, v := range src {
+		if v == "" {
+			delete(dst, k)
+			continue
+		}
+		if dst == nil {
+			dst = make(map[string]string)
+		}
+		dst[k] = v
+	}
+	return dst
+}
+
+// mergePAXNames merges only the records for the Name, Linkname, and Size
+// fields of hdr, as decoded by Next if LazyHeaders is set.
+func mergePAXNames(hdr *Header, headers map[string]string) (err error) {
+	if v := headers[paxPath]; v != "" {
+		hdr.Name = v
+	}
+	if v := headers[paxLinkpath]; v != "" {
+		hdr.Linkname = v
+	}
+	if v := headers[paxSize]; v != "" {
+		if hdr.Size, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return ErrHeader
+		}
+	}
+	return nil
+}
+
 // mergePAX merges well known headers according to PAX standard.
 // In general headers with the same name as those found
 // in the header struct overwrite those found in the header
 // struct with higher precision or longer values. Esp. useful
 // for name and linkname fields.
+//
+// All non-empty records are stored in hdr.PAXRecords, and those of the
+// namespaces of registered extensions are decoded into hdr.Extensions.
 func mergePAX(hdr *Header, headers map[string]string) (err error) {
 	var id64 int64
+	var libXattrs map[string]string
 	for k, v := range headers {
+		if v == "" {
+			continue // An empty value only serves to delete a record
+		}
 		switch k {
 		case paxPath:
 			hdr.Name = v
@@ -302,10 +1430,10 @@ func mergePAX(hdr *Header, headers map[string]string) (err error) {
 			hdr.Gname = v
 		case paxUid:
 			id64, err = strconv.ParseInt(v, 10, 64)
-			hdr.Uid = int(id64) // Integer overflow possible
+			hdr.SetUid64(id64)
 		case paxGid:
 			id64, err = strconv.ParseInt(v, 10, 64)
-			hdr.Gid = int(id64) // Integer overflow possible
+			hdr.SetGid64(id64)
 		case paxAtime:
 			hdr.AccessTime, err = parsePAXTime(v)
 		case paxMtime:
@@ -314,6 +1442,8 @@ func mergePAX(hdr *Header, headers map[string]string) (err error) {
 			hdr.ChangeTime, err = parsePAXTime(v)
 		case paxSize:
 			hdr.Size, err = strconv.ParseInt(v, 10, 64)
+		case paxFflags:
+			hdr.FileFlags = v
 		default:
 			if strings.HasPrefix(k, paxXattr) {
 				if hdr.Xattrs == nil {
@@ -321,21 +1451,39 @@ func mergePAX(hdr *Header, headers map[string]string) (err error) {
 				}
 				hdr.Xattrs[k[len(paxXattr):]] = v
 			}
+			if strings.HasPrefix(k, paxLibXattr) {
+				name, ok := urlDecode(k[len(paxLibXattr):])
+				value, err2 := base64.RawStdEncoding.DecodeString(strings.TrimRight(v, "="))
+				if !ok || name == "" || err2 != nil {
+					return ErrHeader
+				}
+				if libXattrs == nil {
+					libXattrs = make(map[string]string)
+				}
+				libXattrs[name] = string(value)
+			}
 		}
 		if err != nil {
 			return ErrHeader
 		}
 	}
+	// The encoded LIBARCHIVE records are more faithful where both exist.
+	for k, v := range libXattrs {
+		if hdr.Xattrs == nil {
+			hdr.Xattrs = make(map[string]string)
+		}
+		hdr.Xattrs[k] = v
+	}
+	if len(headers) > 0 {
+		hdr.PAXRecords = mergePAXRecords(nil, headers)
+		return decodePAXExtensions(hdr, headers)
+	}
 	return nil
 }
 
-// parsePAX parses PAX headers.
-// If an extended header (type 'x') is invalid, ErrHeader is returned
-func parsePAX(r io.Reader) (map[string]string, error) {
-	buf, err := ioutil.ReadAll(r)
-	if err != nil {
-		return nil, err
-	}
+// parsePAX parses PAX headers, removing trailing NULs from names if trimNUL
+// is set. If an extended header (type 'x') is invalid, ErrHeader is returned
+func parsePAX(buf []byte, dup DuplicateKeyPolicy, trimNUL bool) (map[string]string, error) {
 	sbuf := string(buf)
 
 	// For GNU PAX sparse format 0.0 support.
@@ -345,7 +1493,7 @@ func parsePAX(r io.Reader) (map[string]string, error) {
 
 	extHdrs := make(map[string]string)
 	for len(sbuf) > 0 {
-		key, value, residual, err := parsePAXRecord(sbuf)
+		key, value, residual, err := parsePAXRecord(sbuf, trimNUL)
 		if err != nil {
 			return nil, ErrHeader
 		}
@@ -361,13 +1509,18 @@ func parsePAX(r io.Reader) (map[string]string, error) {
 			}
 			sparseMap = append(sparseMap, value)
 		default:
-			// According to PAX specification, a value is stored only if it is
-			// non-empty. Otherwise, the key is deleted.
-			if len(value) > 0 {
-				extHdrs[key] = value
-			} else {
-				delete(extHdrs, key)
+			if _, ok := extHdrs[key]; ok {
+				switch dup {
+				case DuplicateFirstWins:
+					continue
+				case DuplicateReject:
+					return nil, ErrHeader
+				}
 			}
+			// According to PAX specification, a value is stored only if it is
+			// non-empty. Otherwise, the key is deleted. Empty values are
+			// retained here since they also delete any global record.
+			extHdrs[key] = value
 		}
 	}
 	if len(sparseMap) > 0 {
@@ -376,6 +1529,21 @@ func parsePAX(r io.Reader) (map[string]string, error) {
 	return extHdrs, nil
 }
 
+// readMetaData reads the data of the current entry, which holds meta data
+// that affects the next entry, such as PAX records or a GNU long name.
+// The returned buffer is only valid until the next call to readMetaData.
+func (tr *Reader) readMetaData() ([]byte, error) {
+	if tr.MaxExtendedHeaderSize > 0 && tr.numBytes() > tr.MaxExtendedHeaderSize {
+		return nil, ErrFieldTooLong
+	}
+	tr.buf.Reset()
+	if _, err := tr.buf.ReadFrom(entryData{tr}); err != nil {
+		return nil, err
+	}
+	tr.rawHdrs.Write(tr.buf.Bytes())
+	return tr.buf.Bytes(), nil
+}
+
 // skipUnread skips any unread bytes in the existing file entry, as well as any
 // alignment padding. It returns io.ErrUnexpectedEOF if any io.EOF is
 // encountered in the data portion; it is okay to hit io.EOF in the padding.
@@ -392,7 +1560,9 @@ func (tr *Reader) skipUnread() error {
 	// the fact that the tar stream may be truncated. We can rely on the
 	// io.CopyN done shortly afterwards to trigger any IO errors.
 	var seekSkipped int64 // Number of bytes skipped via Seek
-	if sr, ok := tr.r.(io.Seeker); ok && dataSkip > 1 {
+	var seekStart int64   // Position of sr before seeking, if seekSkipped > 0
+	sr, ok := tr.r.(io.Seeker)
+	if ok && dataSkip > 1 {
 		// Not all io.Seeker can actually Seek. For example, os.Stdin implements
 		// io.Seeker, but calling Seek always returns an error and performs
 		// no action. Thus, we try an innocent seek to the current position
@@ -404,13 +1574,44 @@ func (tr *Reader) skipUnread() error {
 			if err != nil {
 				return err
 			}
-			seekSkipped = pos2 - pos1
+			seekSkipped, seekStart = pos2-pos1, pos1
 		}
 	}
 
-	copySkipped, err := io.CopyN(ioutil.Discard, tr.r, totalSkip-seekSkipped)
+	var copySkipped int64
+	var err error
+	if n := totalSkip - seekSkipped; n <= blockSize {
+		// Skip padding and short data sections without the allocations
+		// of io.CopyN. The header in tr.blk is no longer needed.
+		var nn int
+		nn, err = io.ReadFull(tr.r, tr.blk[:n])
+		if tr.rawHdrs.Len() > 0 {
+			tr.rawHdrs.Write(tr.blk[:nn]) // Padding of a meta data entry
+		}
+		if err == io.ErrUnexpectedEOF {
+			err = io.EOF
+		}
+		copySkipped = int64(nn)
+	} else {
+		copySkipped, err = io.CopyN(ioutil.Discard, tr.r, n)
+	}
 	if err == io.EOF && seekSkipped+copySkipped < dataSkip {
 		err = io.ErrUnexpectedEOF
+		if tr.DetailedErrors {
+			skipped := seekSkipped + copySkipped
+			if seekSkipped > 0 {
+				// Seeking past the end of the input is not an error,
+				// so determine where the input actually ended.
+				if end, err := sr.Seek(0, io.SeekEnd); err == nil && end-seekStart < skipped {
+					skipped = end - seekStart
+				}
+			}
+			start := tr.nextOff - totalSkip
+			err = &TruncatedError{Name: tr.name, Offset: start + skipped, Missing: dataSkip - skipped}
+		}
+	} else if err == io.EOF {
+		// The input ended within the padding, which is permitted.
+		tr.nextOff -= totalSkip - seekSkipped - copySkipped
 	}
 	return err
 }
@@ -425,24 +1626,29 @@ func (tr *Reader) skipUnread() error {
 //	* At least 2 blocks of zeros are read.
 func (tr *Reader) readHeader() (*Header, *block, error) {
 	// Two blocks of zero bytes marks the end of the archive.
-	if _, err := io.ReadFull(tr.r, tr.blk[:]); err != nil {
+	if err := tr.readTrailerBlock(); err != nil {
 		return nil, nil, err // EOF is okay here; exactly 0 bytes read
 	}
 	if bytes.Equal(tr.blk[:], zeroBlock[:]) {
-		if _, err := io.ReadFull(tr.r, tr.blk[:]); err != nil {
+		if err := tr.readTrailerBlock(); err != nil {
 			return nil, nil, err // EOF is okay here; exactly 1 block of zeros read
 		}
 		if bytes.Equal(tr.blk[:], zeroBlock[:]) {
 			return nil, nil, io.EOF // normal EOF; exactly 2 block of zeros read
 		}
-		return nil, nil, ErrHeader // Zero block and then non-zero block
+		return nil, nil, tr.headerError(ErrHeader, KindTrailer) // Zero block and then non-zero block
 	}
 
 	// Verify the header matches a known format.
-	format := tr.blk.GetFormat()
-	if format == formatUnknown {
-		return nil, nil, ErrHeader
+	if !tr.blk.validChecksum(tr.Checksums) {
+		if !tr.ContinueOnBadChecksum {
+			return nil, nil, tr.headerError(ErrHeader, KindChecksum)
+		}
+		if tr.badSum == nil {
+			tr.badSum = tr.headerError(ErrHeader, KindChecksum)
+		}
 	}
+	format := tr.blk.guessFormat()
 
 	var p parser
 	hdr := new(Header)
@@ -450,76 +1656,158 @@ func (tr *Reader) readHeader() (*Header, *block, error) {
 	// Unpack the V7 header.
 	v7 := tr.blk.V7()
 	hdr.Name = p.parseString(v7.Name())
-	hdr.Mode = p.parseNumeric(v7.Mode())
-	hdr.Uid = int(p.parseNumeric(v7.UID()))
-	hdr.Gid = int(p.parseNumeric(v7.GID()))
 	hdr.Size = p.parseNumeric(v7.Size())
-	hdr.ModTime = time.Unix(p.parseNumeric(v7.ModTime()), 0)
 	hdr.Typeflag = v7.TypeFlag()[0]
 	hdr.Linkname = p.parseString(v7.LinkName())
+	if !tr.LazyHeaders {
+		tr.decodeFields(hdr, &tr.blk, format, &p)
+	}
 
-	// Unpack format specific fields.
-	if format > formatV7 {
+	// Unpack the name prefix.
+	var prefix string
+	switch format {
+	case formatUSTAR:
 		ustar := tr.blk.USTAR()
-		hdr.Uname = p.parseString(ustar.UserName())
-		hdr.Gname = p.parseString(ustar.GroupName())
-		hdr.Devmajor = p.parseNumeric(ustar.DevMajor())
-		hdr.Devminor = p.parseNumeric(ustar.DevMinor())
-
-		var prefix string
-		switch format {
-		case formatUSTAR:
+		prefix = p.parseString(ustar.Prefix())
+	case formatSTAR:
+		star := tr.blk.STAR()
+		prefix = p.parseString(star.Prefix())
+	case formatGNU:
+		// Prior to Go1.8, the Writer had a bug where it would output
+		// an invalid tar file in certain rare situations because the logic
+		// incorrectly believed that the old GNU format had a prefix field.
+		// This is wrong and leads to an output file that mangles the
+		// atime and ctime fields, which are often left unused.
+		//
+		// In order to continue reading tar files created by former, buggy
+		// versions of Go, we skeptically parse the atime and ctime fields.
+		// If we are unable to parse them and the prefix field looks like
+		// an ASCII string, then we fallback on the pre-Go1.8 behavior
+		// of treating these fields as the USTAR prefix field.
+		//
+		// Note that this will not use the fallback logic for all possible
+		// files generated by a pre-Go1.8 toolchain. If the generated file
+		// happened to have a prefix field that parses as valid
+		// atime and ctime fields (e.g., when they are valid octal strings),
+		// then it is impossible to distinguish between an valid GNU file
+		// and an invalid pre-Go1.8 file.
+		//
+		// See https://golang.org/issues/12594
+		// See https://golang.org/issues/21005
+		if _, _, ok := gnuTimes(&tr.blk); !ok {
 			ustar := tr.blk.USTAR()
-			prefix = p.parseString(ustar.Prefix())
-		case formatSTAR:
-			star := tr.blk.STAR()
-			prefix = p.parseString(star.Prefix())
-			hdr.AccessTime = time.Unix(p.parseNumeric(star.AccessTime()), 0)
-			hdr.ChangeTime = time.Unix(p.parseNumeric(star.ChangeTime()), 0)
-		case formatGNU:
-			var p2 parser
-			gnu := tr.blk.GNU()
-			if b := gnu.AccessTime(); b[0] != 0 {
-				hdr.AccessTime = time.Unix(p2.parseNumeric(b), 0)
-			}
-			if b := gnu.ChangeTime(); b[0] != 0 {
-				hdr.ChangeTime = time.Unix(p2.parseNumeric(b), 0)
-			}
-
-			// Prior to Go1.8, the Writer had a bug where it would output
-			// an invalid tar file in certain rare situations because the logic
-			// incorrectly believed that the old GNU format had a prefix field.
-			// This is wrong and leads to an output file that mangles the
-			// atime and ctime fields, which are often left unused.
-			//
-			// In order to continue reading tar files created by former, buggy
-			// versions of Go, we skeptically parse the atime and ctime fields.
-			// If we are unable to parse them and the prefix field looks like
-			// an ASCII string, then we fallback on the pre-Go1.8 behavior
-			// of treating these fields as the USTAR prefix field.
-			//
-			// Note that this will not use the fallback logic for all possible
-			// files generated by a pre-Go1.8 toolchain. If the generated file
-			// happened to have a prefix field that parses as valid
-			// atime and ctime fields (e.g., when they are valid octal strings),
-			// then it is impossible to distinguish between an valid GNU file
-			// and an invalid pre-Go1.8 file.
-			//
-			// See https://golang.org/issues/12594
-			// See https://golang.org/issues/21005
-			if p2.err != nil {
-				hdr.AccessTime, hdr.ChangeTime = time.Time{}, time.Time{}
-				ustar := tr.blk.USTAR()
-				if s := p.parseString(ustar.Prefix()); isASCII(s) {
-					prefix = s
-				}
+			if s := p.parseString(ustar.Prefix()); isASCII(s) {
+				prefix = s
 			}
 		}
-		if len(prefix) > 0 {
-			hdr.Name = prefix + "/" + hdr.Name
+	}
+	if len(prefix) > 0 {
+		hdr.Name = prefix + "/" + hdr.Name
+	}
+	return hdr, &tr.blk, tr.headerError(p.err, KindNumeric)
+}
+
+// decodeFields decodes the fields of hdr other than the Name, Linkname,
+// Size, and Typeflag from blk, a header block of the given format.
+func (tr *Reader) decodeFields(hdr *Header, blk *block, format int, p *parser) {
+	v7 := blk.V7()
+	hdr.Mode = p.parseNumeric(v7.Mode())
+	hdr.SetUid64(p.parseNumeric(v7.UID()))
+	hdr.SetGid64(p.parseNumeric(v7.GID()))
+	hdr.ModTime = time.Unix(p.parseNumeric(v7.ModTime()), 0)
+	if format <= formatV7 {
+		return
+	}
+	ustar := blk.USTAR()
+	hdr.Uname = tr.parseName(ustar.UserName())
+	hdr.Gname = tr.parseName(ustar.GroupName())
+	hdr.Devmajor = p.parseNumeric(ustar.DevMajor())
+	hdr.Devminor = p.parseNumeric(ustar.DevMinor())
+	switch format {
+	case formatSTAR:
+		star := blk.STAR()
+		hdr.AccessTime = time.Unix(p.parseNumeric(star.AccessTime()), 0)
+		hdr.ChangeTime = time.Unix(p.parseNumeric(star.ChangeTime()), 0)
+	case formatGNU:
+		// Times that cannot be parsed are those of the pre-Go1.8 bug
+		// handled by readHeader.
+		if atime, ctime, ok := gnuTimes(blk); ok {
+			hdr.AccessTime, hdr.ChangeTime = atime, ctime
+		}
+		if hdr.Typeflag == TypeGNUMultiVolume {
+			hdr.VolumeOffset = p.parseNumeric(blk.GNU().Offset())
 		}
 	}
-	return hdr, &tr.blk, p.err
+}
+
+// gnuTimes parses the access and change times of blk, a GNU header block,
+// which are zero if unset. It reports false if they cannot be parsed.
+func gnuTimes(blk *block) (atime, ctime time.Time, ok bool) {
+	var p parser
+	gnu := blk.GNU()
+	if b := gnu.AccessTime(); b[0] != 0 {
+		atime = time.Unix(p.parseNumeric(b), 0)
+	}
+	if b := gnu.ChangeTime(); b[0] != 0 {
+		ctime = time.Unix(p.parseNumeric(b), 0)
+	}
+	if p.err != nil {
+		return time.Time{}, time.Time{}, false
+	}
+	return atime, ctime, true
+}
+
+// maxInternedNames is the maximum number of distinct names that a Reader
+// interns, which bounds the memory used for archives with unique names.
+const maxInternedNames = 1024
+
+// parseName parses b as a NUL-terminated string for the Uname or Gname
+// field, reusing a previously interned string if possible.
+func (tr *Reader) parseName(b []byte) string {
+	if !tr.InternNames {
+		var p parser
+		return p.parseString(b)
+	}
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	if s, ok := tr.names[string(b)]; ok {
+		return s // The conversion does not allocate
+	}
+	return tr.internName(string(b))
+}
+
+// internName returns a previously interned string equal to s,
+// or interns s if there is room.
+func (tr *Reader) internName(s string) string {
+	if s2, ok := tr.names[s]; ok {
+		return s2
+	}
+	if tr.names == nil {
+		tr.names = make(map[string]string)
+	}
+	if len(tr.names) < maxInternedNames {
+		tr.names[s] = s
+	}
+	return s
+}
+
+// readTrailerBlock reads a single block into tr.blk that may possibly be
+// part of the end-of-archive trailer. If AllowShortTrailer is set, then a
+// partially read block consisting only of zeros is reported as io.EOF.
+func (tr *Reader) readTrailerBlock() error {
+	n, err := io.ReadFull(tr.r, tr.blk[:])
+	if err == nil {
+		tr.hdrOff, tr.nextOff = tr.nextOff, tr.nextOff+blockSize
+	}
+	if err == io.ErrUnexpectedEOF && tr.AllowShortTrailer && bytes.Equal(tr.blk[:n], zeroBlock[:n]) {
+		tr.nextOff += int64(n)
+		err = io.EOF
+	}
+	if err == io.ErrUnexpectedEOF && tr.DetailedErrors {
+		err = &TruncatedError{Offset: tr.nextOff + int64(n), Missing: int64(blockSize - n)}
+	}
+	return err
 }
 
 // readOldGNUSparseMap reads the sparse map from the old GNU sparse format.
@@ -534,7 +1822,7 @@ func (tr *Reader) readOldGNUSparseMap(hdr *Header, blk *block) ([]sparseEntry, e
 	// Make sure that the input format is GNU.
 	// Unfortunately, the STAR format also has a sparse header format that uses
 	// the same type flag but has a completely different layout.
-	if blk.GetFormat() != formatGNU {
+	if blk.guessFormat() != formatGNU {
 		return nil, ErrHeader
 	}
 
@@ -567,6 +1855,9 @@ func (tr *Reader) readOldGNUSparseMap(hdr *Header, blk *block) ([]sparseEntry, e
 				}
 				return nil, err
 			}
+			tr.dataEnd += blockSize
+			tr.nextOff += blockSize
+			tr.rawHdrs.Write(blk[:])
 			s = blk.Sparse()
 			continue
 		}
@@ -648,6 +1939,47 @@ func readGNUSparseMap1x0(r io.Reader) ([]sparseEntry, error) {
 	return sp, nil
 }
 
+// readSunHolesData reads the sparse map as stored in the SUN.holesdata
+// record written by Solaris tar, given the size of the data stored in the
+// archive, and returns it along with the size of the file. The record is
+// a list of ascending offsets that alternately start a data region and
+// a hole, such that " 0 5 10 15" holds data at 0 and 10 and ends in
+// a hole up to 15, the size of the file. If the list ends with a data
+// region, that region holds the remainder of the stored data.
+func readSunHolesData(v string, size int64) ([]sparseEntry, int64, error) {
+	fields := strings.Fields(v)
+	if len(fields) == 0 {
+		return nil, 0, ErrHeader
+	}
+	offs := make([]int64, len(fields))
+	for i, f := range fields {
+		off, err := strconv.ParseInt(f, 10, 64)
+		if err != nil || off < 0 || (i > 0 && off < offs[i-1]) {
+			return nil, 0, ErrHeader
+		}
+		offs[i] = off
+	}
+
+	sp := make([]sparseEntry, 0, (len(offs)+1)/2)
+	var stored, end int64
+	for i := 0; i < len(offs); i += 2 {
+		if i+1 < len(offs) {
+			end = offs[i+1]
+		} else {
+			if size < stored || offs[i] > math.MaxInt64-(size-stored) {
+				return nil, 0, ErrHeader
+			}
+			end = offs[i] + size - stored
+		}
+		sp = append(sp, sparseEntry{offset: offs[i], numBytes: end - offs[i]})
+		stored += end - offs[i]
+	}
+	if stored != size {
+		return nil, 0, ErrHeader // Stored data does not match the map
+	}
+	return sp, end, nil
+}
+
 // readGNUSparseMap0x1 reads the sparse map as stored in GNU's PAX sparse format
 // version 0.1. The sparse map is stored in the PAX headers.
 func readGNUSparseMap0x1(extHdrs map[string]string) ([]sparseEntry, error) {
@@ -682,6 +2014,12 @@ func readGNUSparseMap0x1(extHdrs map[string]string) ([]sparseEntry, error) {
 	return sp, nil
 }
 
+// dataOffset returns the offset of the data of the entry most recently
+// returned by Next, as stored in the archive after any sparse map blocks.
+func (tr *Reader) dataOffset() int64 {
+	return tr.dataEnd - tr.rawNB
+}
+
 // numBytes returns the number of bytes left to read in the current file's entry
 // in the tar archive, or 0 if there is no current file.
 func (tr *Reader) numBytes() int64 {
@@ -699,7 +2037,33 @@ func (tr *Reader) numBytes() int64 {
 // Calling Read on special types like TypeLink, TypeSymLink, TypeChar,
 // TypeBlock, TypeDir, and TypeFifo returns 0, io.EOF regardless of what
 // the Header.Size claims.
+//
+// If ContentTransform is set, the data is read through the io.Reader that
+// it returned for the entry.
 func (tr *Reader) Read(b []byte) (int, error) {
+	var n int
+	var err error
+	if tr.xr != nil {
+		n, err = tr.xr.Read(b)
+	} else {
+		n, err = tr.readData(b)
+	}
+	if tr.Metrics != nil {
+		if n > 0 {
+			tr.Metrics.Bytes(MetricsRead, n)
+		}
+		tr.reportError(err)
+	}
+	return n, err
+}
+
+// entryData is the io.Reader passed to Reader.ContentTransform.
+type entryData struct{ tr *Reader }
+
+func (d entryData) Read(b []byte) (int, error) { return d.tr.readData(b) }
+
+// readData reads the data of the current entry as stored in the archive.
+func (tr *Reader) readData(b []byte) (int, error) {
 	if tr.err != nil {
 		return 0, tr.err
 	}
@@ -709,8 +2073,24 @@ func (tr *Reader) Read(b []byte) (int, error) {
 
 	n, err := tr.curr.Read(b)
 	if err != nil && err != io.EOF {
+		err = tr.truncatedError(err)
 		tr.err = err
 	}
+	if tr.digests != nil {
+		for _, d := range tr.digests {
+			d.Write(b[:n])
+		}
+		if err == io.EOF {
+			derr := verifyDigests(tr.name, tr.digests)
+			tr.digests = nil
+			if derr != nil && tr.DetailedErrors {
+				return n, derr
+			}
+			if derr != nil {
+				return n, ErrDigestMismatch
+			}
+		}
+	}
 	return n, err
 }
 
@@ -760,18 +2140,32 @@ func newSparseFileReader(rfr numBytesReader, sp []sparseEntry, total int64) (*sp
 	return &sparseFileReader{rfr: rfr, sp: sp, total: total}, nil
 }
 
+// validateSparseEntries reports whether sp is a valid sparse map for a file
+// of the given size, according to the same checks as newSparseFileReader.
+func validateSparseEntries(sp []SparseEntry, size int64) bool {
+	if size < 0 {
+		return false
+	}
+	var sp2 []sparseEntry
+	for _, s := range sp {
+		sp2 = append(sp2, sparseEntry{offset: s.Offset, numBytes: s.Length})
+	}
+	_, err := newSparseFileReader(nil, sp2, size)
+	return err == nil
+}
+
 // readHole reads a sparse hole ending at endOffset.
 func (sfr *sparseFileReader) readHole(b []byte, endOffset int64) int {
 	n64 := endOffset - sfr.pos
 	if n64 > int64(len(b)) {
 		n64 = int64(len(b))
 	}
-	n := int(n64)
-	for i := 0; i < n; i++ {
-		b[i] = 0
+	b = b[:n64]
+	for i := range b {
+		b[i] = 0 // Compiled as a bulk memory clear
 	}
 	sfr.pos += n64
-	return n
+	return len(b)
 }
 
 // Read reads the sparse file data in expanded form.
@@ -5,21 +5,33 @@
 package tar
 
 import (
+	"bufio"
 	"bytes"
 	"crypto/md5"
+	"errors"
 	"fmt"
+	"internal/race"
 	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
+	"path/filepath"
 	"reflect"
+	"runtime"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 )
 
 func TestReader(t *testing.T) {
+	// The sparse map of the PAX sparse entries in sparse-formats.tar.
+	var sparseMap []string
+	for i := 1; i < 190; i += 2 {
+		sparseMap = append(sparseMap, fmt.Sprintf("%d,1", i))
+	}
+
 	vectors := []struct {
 		file    string    // Test input file
 		headers []*Header // Expected output headers
@@ -80,6 +92,11 @@ func TestReader(t *testing.T) {
 			Gname:    "david",
 			Devmajor: 0,
 			Devminor: 0,
+			PAXRecords: map[string]string{
+				paxGNUSparseSize:      "200",
+				paxGNUSparseNumBlocks: "95",
+				paxGNUSparseMap:       strings.Join(sparseMap, ","),
+			},
 		}, {
 			Name:     "sparse-posix-0.1",
 			Mode:     420,
@@ -93,6 +110,12 @@ func TestReader(t *testing.T) {
 			Gname:    "david",
 			Devmajor: 0,
 			Devminor: 0,
+			PAXRecords: map[string]string{
+				paxGNUSparseSize:      "200",
+				paxGNUSparseNumBlocks: "95",
+				paxGNUSparseMap:       strings.Join(sparseMap, ","),
+				paxGNUSparseName:      "sparse-posix-0.1",
+			},
 		}, {
 			Name:     "sparse-posix-1.0",
 			Mode:     420,
@@ -106,6 +129,12 @@ func TestReader(t *testing.T) {
 			Gname:    "david",
 			Devmajor: 0,
 			Devminor: 0,
+			PAXRecords: map[string]string{
+				paxGNUSparseMajor:    "1",
+				paxGNUSparseMinor:    "0",
+				paxGNUSparseName:     "sparse-posix-1.0",
+				paxGNUSparseRealSize: "200",
+			},
 		}, {
 			Name:     "end",
 			Mode:     420,
@@ -187,6 +216,12 @@ func TestReader(t *testing.T) {
 			ChangeTime: time.Unix(1350244992, 23960108),
 			AccessTime: time.Unix(1350244992, 23960108),
 			Typeflag:   TypeReg,
+			PAXRecords: map[string]string{
+				"path":  "a/123456789101112131415161718192021222324252627282930313233343536373839404142434445464748495051525354555657585960616263646566676869707172737475767778798081828384858687888990919293949596979899100",
+				"mtime": "1350244992.023960108",
+				"atime": "1350244992.023960108",
+				"ctime": "1350244992.023960108",
+			},
 		}, {
 			Name:       "a/b",
 			Mode:       0777,
@@ -200,6 +235,12 @@ func TestReader(t *testing.T) {
 			AccessTime: time.Unix(1350266320, 910238425),
 			Typeflag:   TypeSymlink,
 			Linkname:   "123456789101112131415161718192021222324252627282930313233343536373839404142434445464748495051525354555657585960616263646566676869707172737475767778798081828384858687888990919293949596979899100",
+			PAXRecords: map[string]string{
+				"linkpath": "123456789101112131415161718192021222324252627282930313233343536373839404142434445464748495051525354555657585960616263646566676869707172737475767778798081828384858687888990919293949596979899100",
+				"mtime":    "1350266320.910238425",
+				"atime":    "1350266320.910238425",
+				"ctime":    "1350266320.910238425",
+			},
 		}},
 	}, {
 		file: "testdata/pax-bad-hdr-file.tar",
@@ -219,6 +260,9 @@ func TestReader(t *testing.T) {
 			Typeflag: '0',
 			Uname:    "joetsai",
 			Gname:    "eng",
+			PAXRecords: map[string]string{
+				"size": "000000000000000000000999",
+			},
 		}},
 		chksums: []string{
 			"0afb597b283fe61b5d4879669a350556",
@@ -259,6 +303,14 @@ func TestReader(t *testing.T) {
 				// Interestingly, selinux encodes the terminating null inside the xattr
 				"security.selinux": "unconfined_u:object_r:default_t:s0\x00",
 			},
+			PAXRecords: map[string]string{
+				"mtime":                         "1386065770.44825232",
+				"atime":                         "1389782991.41987522",
+				"ctime":                         "1389782956.794414986",
+				"SCHILY.xattr.user.key":         "value",
+				"SCHILY.xattr.user.key2":        "value2",
+				"SCHILY.xattr.security.selinux": "unconfined_u:object_r:default_t:s0\x00",
+			},
 		}, {
 			Name:       "small2.txt",
 			Mode:       0644,
@@ -274,6 +326,12 @@ func TestReader(t *testing.T) {
 			Xattrs: map[string]string{
 				"security.selinux": "unconfined_u:object_r:default_t:s0\x00",
 			},
+			PAXRecords: map[string]string{
+				"mtime": "1386065770.449252304",
+				"atime": "1389782991.41987522",
+				"ctime": "1386065770.449252304",
+				"SCHILY.xattr.security.selinux": "unconfined_u:object_r:default_t:s0\x00",
+			},
 		}},
 	}, {
 		// Matches the behavior of GNU, BSD, and STAR tar utilities.
@@ -334,6 +392,9 @@ func TestReader(t *testing.T) {
 			Linkname: "PAX4/PAX4/long-linkpath-name",
 			ModTime:  time.Unix(0, 0),
 			Typeflag: '2',
+			PAXRecords: map[string]string{
+				"linkpath": "PAX4/PAX4/long-linkpath-name",
+			},
 		}},
 	}, {
 		// Both BSD and GNU tar truncate long names at first NUL even
@@ -1065,6 +1126,56 @@ func TestReadTruncation(t *testing.T) {
 	}
 }
 
+// TestReadShortTrailer tests that a truncated end-of-archive trailer is
+// only accepted when the Reader is configured to allow it.
+func TestReadShortTrailer(t *testing.T) {
+	buf, err := ioutil.ReadFile("testdata/ustar-file-reg.tar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	data := string(buf[:1536]) + strings.Repeat("\x00", 1024)
+	trash := strings.Repeat("garbage ", 64) // Exactly 512 bytes
+
+	vectors := []struct {
+		input   string // Input stream
+		lenient bool   // Value of AllowShortTrailer
+		cnt     int    // Expected number of headers read
+		err     error  // Expected error outcome
+	}{
+		{data[:1536], false, 1, io.EOF},
+		{data[:1536], true, 1, io.EOF},
+		{data[:1537], false, 1, io.ErrUnexpectedEOF},
+		{data[:1537], true, 1, io.EOF},
+		{data[:2047], false, 1, io.ErrUnexpectedEOF},
+		{data[:2047], true, 1, io.EOF},
+		{data[:2049], false, 1, io.ErrUnexpectedEOF},
+		{data[:2049], true, 1, io.EOF},
+		{data, true, 1, io.EOF},
+		{data[:1536] + trash[:1], true, 1, io.ErrUnexpectedEOF},
+		{data[:2048] + trash[:100], true, 1, io.ErrUnexpectedEOF},
+		{strings.Repeat("\x00", 100), true, 0, io.EOF},
+	}
+
+	for i, v := range vectors {
+		tr := NewReader(strings.NewReader(v.input))
+		tr.AllowShortTrailer = v.lenient
+
+		var cnt int
+		for {
+			if _, err = tr.Next(); err != nil {
+				break
+			}
+			cnt++
+		}
+		if err != v.err {
+			t.Errorf("test %d, Next(): got %v, want %v", i, err, v.err)
+		}
+		if cnt != v.cnt {
+			t.Errorf("test %d, Next(): got %d headers, want %d headers", i, cnt, v.cnt)
+		}
+	}
+}
+
 // TestReadHeaderOnly tests that Reader does not attempt to read special
 // header-only files.
 func TestReadHeaderOnly(t *testing.T) {
@@ -1123,6 +1234,11 @@ func TestMergePAX(t *testing.T) {
 			Name:    "a/b/c",
 			Uid:     1000,
 			ModTime: time.Unix(1350244992, 23960108),
+			PAXRecords: map[string]string{
+				"path":  "a/b/c",
+				"uid":   "1000",
+				"mtime": "1350244992.023960108",
+			},
 		},
 		ok: true,
 	}, {
@@ -1136,6 +1252,19 @@ func TestMergePAX(t *testing.T) {
 		},
 		want: &Header{
 			Xattrs: map[string]string{"key": "value"},
+			PAXRecords: map[string]string{
+				"missing":          "missing",
+				"SCHILY.xattr.key": "value",
+			},
+		},
+		ok: true,
+	}, {
+		in: map[string]string{
+			"SCHILY.fflags": "uchg,nodump",
+		},
+		want: &Header{
+			FileFlags:  "uchg,nodump",
+			PAXRecords: map[string]string{"SCHILY.fflags": "uchg,nodump"},
 		},
 		ok: true,
 	}}
@@ -1168,7 +1297,7 @@ func TestParsePAX(t *testing.T) {
 		{"13 key1=haha\n13 key2=nana\n13 key3=kaka\n",
 			map[string]string{"key1": "haha", "key2": "nana", "key3": "kaka"}, true},
 		{"13 key1=val1\n13 key2=val2\n8 key1=\n",
-			map[string]string{"key2": "val2"}, true},
+			map[string]string{"key1": "", "key2": "val2"}, true},
 		{"22 GNU.sparse.size=10\n26 GNU.sparse.numblocks=2\n" +
 			"23 GNU.sparse.offset=1\n25 GNU.sparse.numbytes=2\n" +
 			"23 GNU.sparse.offset=3\n25 GNU.sparse.numbytes=4\n",
@@ -1182,8 +1311,7 @@ func TestParsePAX(t *testing.T) {
 	}
 
 	for i, v := range vectors {
-		r := strings.NewReader(v.in)
-		got, err := parsePAX(r)
+		got, err := parsePAX([]byte(v.in), DuplicateLastWins, false)
 		if !reflect.DeepEqual(got, v.want) && !(len(got) == 0 && len(v.want) == 0) {
 			t.Errorf("test %d, parsePAX(...):\ngot  %v\nwant %v", i, got, v.want)
 		}
@@ -1191,4 +1319,2381 @@ func TestParsePAX(t *testing.T) {
 			t.Errorf("test %d, parsePAX(...): got %v, want %v", i, ok, v.ok)
 		}
 	}
+
+	const dup = "13 key1=val1\n13 key1=val2\n"
+	for _, v := range []struct {
+		dup  DuplicateKeyPolicy
+		want map[string]string
+	}{
+		{DuplicateLastWins, map[string]string{"key1": "val2"}},
+		{DuplicateFirstWins, map[string]string{"key1": "val1"}},
+		{DuplicateReject, nil},
+	} {
+		got, err := parsePAX([]byte(dup), v.dup, false)
+		if !reflect.DeepEqual(got, v.want) || (err == nil) != (v.want != nil) {
+			t.Errorf("parsePAX(%q, %d) = (%v, %v), want %v", dup, v.dup, got, err, v.want)
+		}
+	}
+}
+
+func TestReaderDetailedErrors(t *testing.T) {
+	// The archive has the following layout:
+	//	0x0000: header of "a"
+	//	0x0200: data of "a"
+	//	0x0600: extended header of "文件"
+	//	0x0800: extended header data
+	//	0x0a00: header of "文件"
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "a", Typeflag: TypeReg, Size: 600}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := tw.Write(make([]byte, 600)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "文件", Typeflag: TypeReg}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := b.Bytes()
+
+	// setBlock returns a copy of archive where the header block at off is
+	// modified by f, then reformatted as USTAR to fix the checksum.
+	setBlock := func(off int, f func(*block)) []byte {
+		data := append([]byte(nil), archive...)
+		var blk block
+		copy(blk[:], data[off:])
+		f(&blk)
+		blk.SetFormat(formatUSTAR)
+		copy(data[off:], blk[:])
+		return data
+	}
+
+	vectors := []struct {
+		data []byte
+		want *HeaderError
+	}{{
+		data: func() []byte {
+			data := append([]byte(nil), archive...)
+			data[0xa00] ^= 0xff
+			return data
+		}(),
+		want: &HeaderError{Offset: 0xa00, Index: 1, Kind: KindChecksum},
+	}, {
+		data: func() []byte {
+			data := append([]byte(nil), archive...)
+			data[0x800] = 'x'
+			return data
+		}(),
+		want: &HeaderError{Offset: 0x600, Index: 1, Kind: KindPAXRecord},
+	}, {
+		data: setBlock(0x000, func(blk *block) { copy(blk.V7().Mode(), "0x0") }),
+		want: &HeaderError{Offset: 0x000, Index: 0, Kind: KindNumeric},
+	}, {
+		data: func() []byte {
+			data := append([]byte(nil), archive[:0x600]...)
+			data = append(data, make([]byte, blockSize)...)
+			return append(data, archive[:blockSize]...)
+		}(),
+		want: &HeaderError{Offset: 0x800, Index: 1, Kind: KindTrailer},
+	}}
+
+	for i, v := range vectors {
+		for _, detailed := range []bool{false, true} {
+			tr := NewReader(bytes.NewReader(v.data))
+			tr.DetailedErrors = detailed
+			var err error
+			for err == nil {
+				_, err = tr.Next()
+			}
+			var want error = ErrHeader
+			if detailed {
+				want = v.want
+			}
+			if !reflect.DeepEqual(err, want) {
+				t.Errorf("test %d, detailed %v, Next() = %v, want %v", i, detailed, err, want)
+			}
+		}
+	}
+
+	want := "tar: invalid tar header at offset 512 (entry 3): bad checksum"
+	if got := (&HeaderError{Offset: 512, Index: 3, Kind: KindChecksum}).Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+func TestReaderDisallowSkip(t *testing.T) {
+	f, err := os.Open("testdata/gnu.tar")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer f.Close()
+
+	tr := NewReader(f)
+	tr.DisallowSkip = true
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v, want nil", err)
+	}
+	var buf [2]byte
+	if _, err := io.ReadFull(tr, buf[:]); err != nil {
+		t.Fatalf("ReadFull() = %v, want nil", err)
+	}
+	if _, err := tr.Next(); err != ErrUnreadData {
+		t.Fatalf("Next() = %v, want %v", err, ErrUnreadData)
+	}
+
+	// The error is not persistent.
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		t.Fatalf("Copy() = %v, want nil", err)
+	}
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v, want nil", err)
+	}
+	if hdr.Name != "small2.txt" {
+		t.Errorf("Name = %q, want %q", hdr.Name, "small2.txt")
+	}
+	if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+		t.Fatalf("Copy() = %v, want nil", err)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReadOldGNUSparseExtended(t *testing.T) {
+	// Build a sparse file with 30 fragments of 1 byte, each followed by
+	// a hole of 9 bytes. This requires two extension blocks, since the
+	// header holds 4 entries and each extension block holds 21 entries.
+	const numEntries = 30
+	var f formatter
+	var blks []block
+	var want []byte
+	var data []byte
+	for i := 0; i < numEntries; i++ {
+		want = append(want, byte('a'+i%26))
+		want = append(want, make([]byte, 9)...)
+		data = append(data, byte('a'+i%26))
+	}
+
+	var hdr block
+	v7, gnu := hdr.V7(), hdr.GNU()
+	f.formatString(v7.Name(), "sparse.db")
+	f.formatOctal(v7.Mode(), 0644)
+	f.formatOctal(v7.UID(), 0)
+	f.formatOctal(v7.GID(), 0)
+	f.formatOctal(v7.Size(), int64(len(data)))
+	f.formatOctal(v7.ModTime(), 0)
+	v7.TypeFlag()[0] = TypeGNUSparse
+	f.formatOctal(gnu.RealSize(), int64(len(want)))
+	sa := gnu.Sparse()
+	for i, j := 0, 0; i < numEntries; i, j = i+1, j+1 {
+		if j == sa.MaxEntries() {
+			sa.IsExtended()[0] = 1
+			blks = append(blks, block{})
+			sa, j = blks[len(blks)-1].Sparse(), 0
+		}
+		f.formatOctal(sa.Entry(j).Offset()[:11], int64(10*i))
+		f.formatOctal(sa.Entry(j).NumBytes()[:11], 1)
+	}
+	hdr.SetFormat(formatGNU)
+	if f.err != nil {
+		t.Fatalf("unexpected error: %v", f.err)
+	}
+	if len(blks) != 2 {
+		t.Fatalf("got %d extension blocks, want 2", len(blks))
+	}
+
+	var b bytes.Buffer
+	b.Write(hdr[:])
+	for _, blk := range blks {
+		b.Write(blk[:])
+	}
+	b.Write(data)
+	b.Write(make([]byte, blockSize-len(data)))
+	b.Write(zeroBlock[:])
+	b.Write(zeroBlock[:])
+
+	tr := NewReader(&b)
+	h, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v, want nil", err)
+	}
+	if h.Name != "sparse.db" || h.Size != int64(len(want)) {
+		t.Errorf("Next() = (%q, %d), want (%q, %d)", h.Name, h.Size, "sparse.db", len(want))
+	}
+	got, err := ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v, want nil", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("ReadAll() = %q, want %q", got, want)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+	if got, want := tr.TrailerSize(), int64(blockSize-len(data)+2*blockSize); got != want {
+		t.Errorf("TrailerSize() = %d, want %d", got, want)
+	}
+
+	// The data follows the extension blocks.
+	archive := append(append(hdr[:], blks[0][:]...), blks[1][:]...)
+	archive = append(append(archive, data...), make([]byte, 3*blockSize-len(data))...)
+	tr = NewReader(bytes.NewReader(archive))
+	var info *EntryInfo
+	tr.Audit = func(_ *Header, i *EntryInfo) error { info = i; return nil }
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v, want nil", err)
+	}
+	if want := int64(3 * blockSize); info == nil || info.DataOffset != want {
+		t.Errorf("EntryInfo = %+v, want DataOffset %d", info, want)
+	}
+	ix, err := NewIndexBytes(archive)
+	if err != nil {
+		t.Fatalf("NewIndexBytes() = %v", err)
+	}
+	if off, n := ix.DataRange(0); off != 3*blockSize || n != int64(len(data)) {
+		t.Errorf("DataRange(0) = (%d, %d), want (%d, %d)", off, n, 3*blockSize, len(data))
+	}
+}
+
+func TestReaderSources(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.NumericEncoding = NumericBase256
+	if err := tw.WriteGlobalHeader(map[string]string{paxUname: "gopher", paxGid: "7"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	hdrs := []*Header{
+		{Name: "ustar", Typeflag: TypeReg},
+		{Name: "文件", Typeflag: TypeReg, ModTime: time.Unix(0, 5), Xattrs: map[string]string{"user.k": "v"}},
+		{Name: "gnu", Typeflag: TypeReg, Uid: 1 << 30, AccessTime: time.Unix(1, 0)},
+	}
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 10}, nil); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	var (
+		blk = FieldSource{Kind: SourceHeader}
+		gnu = FieldSource{Kind: SourceGNU}
+		pax = func(k string) FieldSource { return FieldSource{Kind: SourcePAX, Key: k} }
+		glb = func(k string) FieldSource { return FieldSource{Kind: SourceGlobalPAX, Key: k} }
+	)
+	ustarSources := func(m map[string]FieldSource) map[string]FieldSource {
+		m2 := map[string]FieldSource{
+			"Name": blk, "Mode": blk, "Uid": blk, "Gid": glb(paxGid), "Size": blk,
+			"ModTime": blk, "Typeflag": blk, "Linkname": blk, "Uname": glb(paxUname),
+			"Gname": blk, "Devmajor": blk, "Devminor": blk,
+		}
+		for k, v := range m {
+			m2[k] = v
+		}
+		return m2
+	}
+	wants := []map[string]FieldSource{
+		{"Name": blk, "Typeflag": blk},
+		ustarSources(nil),
+		ustarSources(map[string]FieldSource{"Name": pax(paxPath), "ModTime": pax(paxMtime), "Xattrs": pax(paxXattr)}),
+		ustarSources(map[string]FieldSource{"AccessTime": gnu}),
+		ustarSources(map[string]FieldSource{"Name": pax(paxGNUSparseName), "Size": pax(paxGNUSparseRealSize), "ModTime": blk}),
+	}
+
+	tr := NewReader(&b)
+	tr.TrackSources = true
+	for i, want := range wants {
+		if _, err := tr.Next(); err != nil {
+			t.Fatalf("test %d, Next() = %v", i, err)
+		}
+		if got := tr.Sources(); !reflect.DeepEqual(got, want) {
+			t.Errorf("test %d, Sources() = %v, want %v", i, got, want)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+	if got := tr.Sources(); got != nil {
+		t.Errorf("Sources() = %v, want nil", got)
+	}
+}
+
+func TestReaderGlobalPAXRecords(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, step := range []func() error{
+		func() error { return tw.WriteGlobalHeader(map[string]string{"comment": "hello", paxGname: "gopher"}) },
+		func() error { return tw.WriteHeader(&Header{Name: "a", Typeflag: TypeReg}) },
+		func() error { return tw.WriteGlobalHeader(map[string]string{"comment": ""}) },
+		func() error { return tw.WriteHeader(&Header{Name: "b", Typeflag: TypeReg}) },
+		func() error { return tw.WriteHeader(&Header{Name: "c", Typeflag: TypeReg}) },
+		tw.Close,
+	} {
+		if err := step(); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	tr := NewReader(&b)
+	if got := tr.GlobalPAXRecords(); got != nil {
+		t.Errorf("GlobalPAXRecords() = %v, want nil", got)
+	}
+	wants := []struct {
+		name    string
+		gname   string
+		globals map[string]string
+	}{
+		{globalHeaderName, "", map[string]string{"comment": "hello", paxGname: "gopher"}},
+		{"a", "gopher", map[string]string{"comment": "hello", paxGname: "gopher"}},
+		{globalHeaderName, "", map[string]string{paxGname: "gopher"}},
+		{"b", "gopher", map[string]string{paxGname: "gopher"}},
+		{"c", "", nil}, // Globals are reset before reading this entry
+	}
+	for i, want := range wants {
+		if want.name == "c" {
+			tr.ResetGlobalPAXRecords()
+		}
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("test %d, Next() = %v", i, err)
+		}
+		if hdr.Name != want.name || hdr.Gname != want.gname {
+			t.Errorf("test %d, Next() = (%q, %q), want (%q, %q)", i, hdr.Name, hdr.Gname, want.name, want.gname)
+		}
+		got := tr.GlobalPAXRecords()
+		if !reflect.DeepEqual(got, want.globals) {
+			t.Errorf("test %d, GlobalPAXRecords() = %v, want %v", i, got, want.globals)
+		}
+		if got != nil {
+			got["mutated"] = "true" // Must not affect the Reader
+		}
+	}
+}
+
+func TestReaderTrailingPAXRecords(t *testing.T) {
+	// The header block of the entry that follows the extended header is
+	// replaced by the end-of-archive trailer.
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "a", Typeflag: TypeReg}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	recs := map[string]string{"comment": "archive metadata", "GO.tool": "builder"}
+	if err := tw.WriteHeader(&Header{Name: "meta", Typeflag: TypeReg, PAXRecords: recs}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	data := append([]byte(nil), b.Bytes()[:b.Len()-blockSize]...)
+	data = append(data, make([]byte, 2*blockSize)...)
+
+	tr := NewReader(bytes.NewReader(data))
+	if hdr, err := tr.Next(); err != nil || hdr.Name != "a" {
+		t.Fatalf("Next() = (%v, %v), want entry %q", hdr, err, "a")
+	}
+	if got := tr.TrailingPAXRecords(); got != nil {
+		t.Errorf("TrailingPAXRecords() before io.EOF = %v, want nil", got)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("Next() = %v, want io.EOF", err)
+	}
+	if got := tr.TrailingPAXRecords(); !reflect.DeepEqual(got, recs) {
+		t.Errorf("TrailingPAXRecords() = %v, want %v", got, recs)
+	}
+
+	// An archive whose extended headers all precede an entry has none.
+	tr = NewReader(bytes.NewReader(append(b.Bytes(), make([]byte, 2*blockSize)...)))
+	for {
+		if _, err := tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+	}
+	if got := tr.TrailingPAXRecords(); got != nil {
+		t.Errorf("TrailingPAXRecords() = %v, want nil", got)
+	}
+}
+
+func TestReaderLazyHeaders(t *testing.T) {
+	files, err := filepath.Glob("testdata/*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := NewReader(bytes.NewReader(data))
+		lr := NewReader(bytes.NewReader(data))
+		lr.LazyHeaders = true
+		for i := 0; ; i++ {
+			want, err := tr.Next()
+			got, lerr := lr.Next()
+			if err != nil {
+				// Errors in fields that are not decoded by Next are
+				// reported by FullHeader instead.
+				if lerr == nil {
+					if _, lerr = lr.FullHeader(); lerr == nil {
+						t.Errorf("%s: entry %d: lazy Next() and FullHeader() = nil, want %v", file, i, err)
+					}
+				}
+				break
+			}
+			if lerr != nil {
+				t.Errorf("%s: entry %d: lazy Next() = %v", file, i, lerr)
+				break
+			}
+			if got.Name != want.Name || got.Linkname != want.Linkname || got.Size != want.Size || got.Typeflag != want.Typeflag {
+				t.Errorf("%s: entry %d: lazy Next() = %+v, want fields of %+v", file, i, got, want)
+			}
+			if want.Typeflag != TypeXGlobalHeader && (got.Mode != 0 || !got.ModTime.IsZero() || got.PAXRecords != nil) {
+				t.Errorf("%s: entry %d: lazy Next() decoded other fields: %+v", file, i, got)
+			}
+			full, err := lr.FullHeader()
+			if err != nil {
+				t.Errorf("%s: entry %d: FullHeader() = %v", file, i, err)
+			} else if !reflect.DeepEqual(full, want) {
+				t.Errorf("%s: entry %d: FullHeader() = %+v, want %+v", file, i, full, want)
+			}
+			if i%2 == 0 && want.Size < 1<<20 {
+				// The data is read the same either way.
+				want, _ := ioutil.ReadAll(tr)
+				got, _ := ioutil.ReadAll(lr)
+				if !bytes.Equal(got, want) {
+					t.Errorf("%s: entry %d: lazy data differs", file, i)
+				}
+			}
+		}
+	}
+
+	if _, err := NewReader(bytes.NewReader(nil)).FullHeader(); err == nil {
+		t.Errorf("FullHeader() without LazyHeaders succeeded")
+	}
+}
+
+func TestReadGNUVolumeAndNames(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	hdrs := []struct {
+		hdr  *Header
+		data string
+	}{
+		{&Header{Name: "Backup 2017-08-01", Typeflag: TypeGNUVolumeHeader, ModTime: time.Unix(1501545600, 0)}, ""},
+		{&Header{Name: "./@renamed", Typeflag: TypeGNUNames, Size: 12}, "Rold\x00Rnew\x00\x00\x00"},
+		{&Header{Name: "file.txt", Typeflag: TypeReg, Size: 5}, "Kilts"},
+	}
+	for _, v := range hdrs {
+		if err := tw.WriteHeader(v.hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, v.data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(&b)
+	for i, v := range hdrs {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("test %d, Next() = %v", i, err)
+		}
+		if hdr.Typeflag != v.hdr.Typeflag || hdr.Name != v.hdr.Name {
+			t.Errorf("test %d, Next() = (%q, %q), want (%q, %q)", i, hdr.Typeflag, hdr.Name, v.hdr.Typeflag, v.hdr.Name)
+		}
+		if got, err := ioutil.ReadAll(tr); err != nil || string(got) != v.data {
+			t.Errorf("test %d, ReadAll() = (%q, %v), want (%q, nil)", i, got, err, v.data)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestReaderInsecurePath(t *testing.T) {
+	names := []struct {
+		name     string
+		insecure bool
+	}{
+		{"file.txt", false},
+		{"dir/file.txt", false},
+		{"./dir/", false},
+		{"a..b/..c", false},
+		{"/etc/passwd", true},
+		{"../file.txt", true},
+		{"dir/../../file.txt", true},
+		{"dir/..", true},
+		{`dir\file.txt`, runtime.GOOS == "windows"},
+		{"C:file.txt", runtime.GOOS == "windows"},
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, v := range names {
+		if err := tw.WriteHeader(&Header{Name: v.name, Typeflag: TypeReg}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	for _, allow := range []bool{false, true} {
+		tr := NewReader(bytes.NewReader(b.Bytes()))
+		tr.AllowInsecurePaths = allow
+		for _, v := range names {
+			hdr, err := tr.Next()
+			var want error
+			if v.insecure && !allow {
+				want = ErrInsecurePath
+			}
+			if err != want {
+				t.Errorf("allow %v, Next() for %q = %v, want %v", allow, v.name, err, want)
+			}
+			if hdr == nil || hdr.Name != v.name {
+				t.Errorf("allow %v, Next() = %v, want header for %q", allow, hdr, v.name)
+			}
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("allow %v, Next() = %v, want %v", allow, err, io.EOF)
+		}
+	}
+}
+
+func TestReaderInternNames(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for i := 0; i < 4; i++ {
+		hdr := &Header{Name: fmt.Sprintf("file%d", i), Typeflag: TypeReg, Uname: "gopher", Gname: "golang"}
+		if i%2 == 1 {
+			hdr.Uname = "gophér" // Requires a PAX record
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	for _, intern := range []bool{false, true} {
+		tr := NewReader(bytes.NewReader(b.Bytes()))
+		tr.InternNames = intern
+		var hdrs []*Header
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			hdrs = append(hdrs, hdr)
+		}
+		if len(hdrs) != 4 {
+			t.Fatalf("got %d headers, want 4", len(hdrs))
+		}
+
+		// Interned names are reused without allocating.
+		if intern && !testing.Short() && !race.Enabled {
+			field := []byte("golang\x00\x00")
+			if allocs := testing.AllocsPerRun(10, func() { tr.parseName(field) }); allocs > 0 {
+				t.Errorf("got %v allocs for parseName, want 0", allocs)
+			}
+		}
+		if _, got := tr.names["gophér"]; got != intern {
+			t.Errorf("intern %v, PAX Uname interned = %v, want %v", intern, got, intern)
+		}
+		if hdrs[0].Uname != "gopher" || hdrs[1].Uname != "gophér" || hdrs[0].Gname != "golang" {
+			t.Errorf("intern %v, got names (%q, %q, %q)", intern, hdrs[0].Uname, hdrs[1].Uname, hdrs[0].Gname)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	type entry struct {
+		hdr  *Header
+		sp   []SparseEntry
+		data string // Data written
+		want string // Data read
+	}
+	entries := []entry{
+		{hdr: &Header{Name: "small.txt", Typeflag: TypeReg, Size: 5}, data: "Kilts", want: "Kilts"},
+		{hdr: &Header{Name: "dir/", Typeflag: TypeDir}},
+		{hdr: &Header{Name: "文件", Typeflag: TypeReg, Size: 1024}, data: strings.Repeat("ab", 512), want: strings.Repeat("ab", 512)},
+		{hdr: &Header{Name: "sparse", Typeflag: TypeReg, Size: 10}, sp: []SparseEntry{{2, 3}}, data: "xyz", want: "\x00\x00xyz\x00\x00\x00\x00\x00"},
+		{hdr: &Header{Name: "empty", Typeflag: TypeReg}},
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "index"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	for _, e := range entries {
+		var err error
+		if e.sp != nil {
+			err = tw.WriteSparseHeader(e.hdr, e.sp)
+		} else {
+			err = tw.WriteHeader(e.hdr)
+		}
+		if err != nil {
+			t.Fatalf("write header for %q: %v", e.hdr.Name, err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	ix, err := NewIndex(bytes.NewReader(b.Bytes()), int64(b.Len()))
+	if err != nil {
+		t.Fatalf("NewIndex() = %v", err)
+	}
+	if got, want := ix.Len(), len(entries)+1; got != want {
+		t.Fatalf("Len() = %d, want %d", got, want)
+	}
+	if hdr := ix.Header(0); hdr.Typeflag != TypeXGlobalHeader {
+		t.Errorf("Header(0).Typeflag = %q, want %q", hdr.Typeflag, TypeXGlobalHeader)
+	}
+
+	// Read all entries concurrently, several times over.
+	const numReaders = 4
+	errc := make(chan error, numReaders*len(entries))
+	for n := 0; n < numReaders; n++ {
+		for i, e := range entries {
+			go func(i int, e entry) {
+				hdr := ix.Header(i + 1)
+				if hdr.Name != e.hdr.Name || hdr.Size != e.hdr.Size {
+					errc <- fmt.Errorf("Header(%d) = (%q, %d), want (%q, %d)", i+1, hdr.Name, hdr.Size, e.hdr.Name, e.hdr.Size)
+					return
+				}
+				if hdr.PAXRecords["comment"] != "index" {
+					errc <- fmt.Errorf("Header(%d).PAXRecords = %v, want global record", i+1, hdr.PAXRecords)
+					return
+				}
+				got, err := ioutil.ReadAll(ix.Open(i + 1))
+				if err != nil || string(got) != e.want {
+					errc <- fmt.Errorf("ReadAll(Open(%d)) = (%q, %v), want (%q, nil)", i+1, got, err, e.want)
+					return
+				}
+				errc <- nil
+			}(i, e)
+		}
+	}
+	for n := 0; n < numReaders*len(entries); n++ {
+		if err := <-errc; err != nil {
+			t.Error(err)
+		}
+	}
+
+	// Truncated archives are rejected.
+	if _, err := NewIndex(bytes.NewReader(b.Bytes()), int64(b.Len())/2); err != io.ErrUnexpectedEOF {
+		t.Errorf("NewIndex() = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+// countReader counts the number of calls to Read.
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (cr *countReader) Read(b []byte) (int, error) {
+	cr.n++
+	return cr.r.Read(b)
+}
+
+func TestReaderReadAhead(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	const numEntries = 100
+	for i := 0; i < numEntries; i++ {
+		if err := tw.WriteHeader(&Header{Name: fmt.Sprintf("file%d", i), Typeflag: TypeReg, Size: 3}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, "abc"); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	readAll := func(tr *Reader) {
+		for i := 0; ; i++ {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				if i != numEntries {
+					t.Errorf("got %d entries, want %d", i, numEntries)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			if i%2 == 0 {
+				continue // Skip the data of some entries
+			}
+			if data, err := ioutil.ReadAll(tr); err != nil || string(data) != "abc" {
+				t.Fatalf("ReadAll(%q) = (%q, %v), want (%q, nil)", hdr.Name, data, err, "abc")
+			}
+		}
+	}
+
+	cr := &countReader{r: bytes.NewReader(b.Bytes())}
+	readAll(NewReader(cr))
+	unbuffered := cr.n
+
+	cr = &countReader{r: bytes.NewReader(b.Bytes())}
+	tr := NewReader(cr)
+	tr.ReadAheadSize = 64 << 10
+	readAll(tr)
+	if cr.n >= unbuffered/10 {
+		t.Errorf("got %d reads with read-ahead, want far fewer than %d", cr.n, unbuffered)
+	}
+
+	// An existing *bufio.Reader is used as is.
+	br := bufio.NewReader(bytes.NewReader(b.Bytes()))
+	tr = NewReader(br)
+	tr.ReadAheadSize = 64 << 10
+	readAll(tr)
+	if tr.r != io.Reader(br) {
+		t.Errorf("the *bufio.Reader was wrapped")
+	}
+}
+
+func TestIndexBytes(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Size: 5}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "Kilts"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 10}, []SparseEntry{{2, 3}}); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "xyz"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := b.Bytes()
+
+	ix, err := NewIndexBytes(archive)
+	if err != nil {
+		t.Fatalf("NewIndexBytes() = %v", err)
+	}
+	data, ok := ix.Bytes(0)
+	if !ok || string(data) != "Kilts" {
+		t.Fatalf("Bytes(0) = (%q, %v), want (%q, true)", data, ok, "Kilts")
+	}
+	if cap(data) != len(data) {
+		t.Errorf("cap(Bytes(0)) = %d, want %d", cap(data), len(data))
+	}
+	if &data[0] != &archive[blockSize] {
+		t.Errorf("Bytes(0) is not a sub-slice of the archive")
+	}
+	if _, ok := ix.Bytes(1); ok {
+		t.Errorf("Bytes(1) reported true for a sparse file")
+	}
+	if got, err := ioutil.ReadAll(ix.Open(1)); err != nil || string(got) != "\x00\x00xyz\x00\x00\x00\x00\x00" {
+		t.Errorf("ReadAll(Open(1)) = (%q, %v)", got, err)
+	}
+
+	ix, err = NewIndex(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("NewIndex() = %v", err)
+	}
+	if _, ok := ix.Bytes(0); ok {
+		t.Errorf("Bytes(0) reported true for an Index not created by NewIndexBytes")
+	}
+}
+
+func TestIndexFile(t *testing.T) {
+	tmp, err := ioutil.TempFile("", "TestIndexFile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	// Leftover contents of the file must not affect the Index.
+	if _, err := tmp.Write(bytes.Repeat([]byte{0xff}, 1<<16)); err != nil {
+		t.Fatal(err)
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "dir/", Typeflag: TypeDir, Mode: 0755},
+		{Name: "dir/file", Typeflag: TypeReg, Mode: 0644, Size: 5},
+		{Name: strings.Repeat("long/", 30) + "file", Typeflag: TypeReg, Mode: 0644, Size: 600},
+		{Name: "dir/file", Typeflag: TypeReg, Mode: 0600, Size: 3, PAXRecords: map[string]string{"comment": "again"}},
+	} {
+		if err := tw.WriteFile(hdr, strings.NewReader(strings.Repeat("x", int(hdr.Size)))); err != nil {
+			t.Fatalf("WriteFile(%q) = %v", hdr.Name, err)
+		}
+	}
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "global"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 10}, []SparseEntry{{2, 3}}); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "abc"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archives := map[string][]byte{"written": b.Bytes()}
+	files, err := filepath.Glob("testdata/*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		archives[file] = data
+	}
+
+	for name, data := range archives {
+		want, werr := NewIndex(bytes.NewReader(data), int64(len(data)))
+		got, gerr := NewIndexFile(bytes.NewReader(data), int64(len(data)), tmp)
+		if gerr != werr {
+			t.Errorf("%s: NewIndexFile() = %v, want %v", name, gerr, werr)
+			continue
+		}
+		if werr != nil && werr != ErrInsecurePath {
+			continue
+		}
+		if got.Len() != want.Len() {
+			t.Errorf("%s: Len() = %d, want %d", name, got.Len(), want.Len())
+			continue
+		}
+		for i := 0; i < want.Len(); i++ {
+			whdr, ghdr := want.Header(i), got.Header(i)
+			if !reflect.DeepEqual(ghdr, whdr) {
+				t.Errorf("%s: Header(%d) = %+v, want %+v", name, i, ghdr, whdr)
+			}
+			if j, ok := got.Lookup(whdr.Name); whdr.Typeflag != TypeXGlobalHeader {
+				if wj, wok := want.Lookup(whdr.Name); j != wj || ok != wok {
+					t.Errorf("%s: Lookup(%q) = (%d, %v), want (%d, %v)", name, whdr.Name, j, ok, wj, wok)
+				}
+			}
+			woff, wlen := want.DataRange(i)
+			if goff, glen := got.DataRange(i); goff != woff || glen != wlen {
+				t.Errorf("%s: DataRange(%d) = (%d, %d), want (%d, %d)", name, i, goff, glen, woff, wlen)
+			}
+			if whdr.Size > 1<<20 {
+				continue // Skip reading the holes of large sparse files
+			}
+			wdata, werr := ioutil.ReadAll(want.Open(i))
+			gdata, gerr := ioutil.ReadAll(got.Open(i))
+			if !bytes.Equal(gdata, wdata) || gerr != werr {
+				t.Errorf("%s: ReadAll(Open(%d)) = (%q, %v), want (%q, %v)", name, i, gdata, gerr, wdata, werr)
+			}
+		}
+		if i, ok := got.Lookup("missing"); ok {
+			t.Errorf("%s: Lookup(%q) = (%d, true), want false", name, "missing", i)
+		}
+		wfis, werr := want.ReadDir(".")
+		gfis, gerr := got.ReadDir(".")
+		if len(gfis) != len(wfis) || gerr != werr {
+			t.Errorf("%s: ReadDir(\".\") = (%d files, %v), want (%d files, %v)", name, len(gfis), gerr, len(wfis), werr)
+		}
+	}
+}
+
+type countReaderAt struct {
+	r io.ReaderAt
+	n int
+}
+
+func (cr *countReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	cr.n++
+	return cr.r.ReadAt(b, off)
+}
+
+func TestCachedReaderAt(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for i := 0; i < 20; i++ {
+		data := strings.Repeat(string(rune('a'+i)), 100*i)
+		if err := tw.WriteHeader(&Header{Name: fmt.Sprint("file", i), Typeflag: TypeReg, Size: int64(len(data))}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := b.Bytes()
+
+	cr := &countReaderAt{r: bytes.NewReader(archive)}
+	c := NewCachedReaderAt(cr, int64(len(archive)))
+	c.BlockSize = 4096
+	c.Blocks = 2
+	c.Prefetch = 1
+	ix, err := NewIndex(c, c.Size())
+	if err != nil {
+		t.Fatalf("NewIndex() = %v", err)
+	}
+	nblocks := (len(archive) + c.BlockSize - 1) / c.BlockSize
+	if want := (nblocks + 1) / 2; cr.n != want {
+		t.Errorf("NewIndex made %d reads, want %d", cr.n, want)
+	}
+	for i := 0; i < ix.Len(); i++ {
+		got, err := ioutil.ReadAll(ix.Open(i))
+		if want := strings.Repeat(string(rune('a'+i)), 100*i); err != nil || string(got) != want {
+			t.Errorf("ReadAll(Open(%d)) = (%d bytes, %v), want %d bytes", i, len(got), err, len(want))
+		}
+	}
+
+	// Reads beyond the end and from truncated sources.
+	p := make([]byte, 10)
+	if n, err := c.ReadAt(p, int64(len(archive))-5); n != 5 || err != io.EOF {
+		t.Errorf("ReadAt(end-5) = (%d, %v), want (5, EOF)", n, err)
+	}
+	c = NewCachedReaderAt(bytes.NewReader(archive[:100]), int64(len(archive)))
+	if _, err := c.ReadAt(p, 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("ReadAt(truncated) = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReaderAllocs(t *testing.T) {
+	switch {
+	case testing.Short():
+		t.Skip("skipping malloc count in short mode")
+	case race.Enabled:
+		t.Skip("skipping malloc count under race detector")
+	}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	const numEntries = 10
+	for i := 0; i < numEntries; i++ {
+		hdr := &Header{Name: fmt.Sprintf("file%d", i), Typeflag: TypeReg, Mode: 0644, Size: 3, Uname: "user", Gname: "group"}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, "abc"); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := b.Bytes()
+
+	br := bytes.NewReader(archive)
+	tr := NewReader(br)
+	tr.InternNames = true
+	allocs := testing.AllocsPerRun(100, func() {
+		br.Reset(archive)
+		*tr = Reader{r: br, InternNames: true, names: tr.names}
+		for {
+			if _, err := tr.Next(); err != nil {
+				if err != io.EOF {
+					t.Fatalf("Next() = %v", err)
+				}
+				break
+			}
+		}
+	})
+	// Each entry requires the Header and its name.
+	if perEntry := allocs / numEntries; perEntry > 2 {
+		t.Errorf("got %v allocations per entry, want at most 2", perEntry)
+	}
+}
+
+func TestReaderTruncatedError(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Size: 1000}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := tw.Write(make([]byte, 1000)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	dataTrunc := b.Bytes()[:blockSize+300]
+	headerTrunc := b.Bytes()[:100]
+
+	vectors := []struct {
+		label string
+		input []byte
+		read  bool // Whether to read the data, rather than skip it
+		seek  bool // Whether the input is an io.Seeker
+		want  TruncatedError
+	}{
+		{"Read", dataTrunc, true, false, TruncatedError{"file", blockSize + 300, 700}},
+		{"Skip", dataTrunc, false, false, TruncatedError{"file", blockSize + 300, 700}},
+		{"SeekSkip", dataTrunc, false, true, TruncatedError{"file", blockSize + 300, 700}},
+		{"Header", headerTrunc, false, false, TruncatedError{"", 100, blockSize - 100}},
+	}
+
+	for _, v := range vectors {
+		t.Run(v.label, func(t *testing.T) {
+			var r io.Reader = bytes.NewReader(v.input)
+			if !v.seek {
+				r = struct{ io.Reader }{r}
+			}
+			tr := NewReader(r)
+			tr.DetailedErrors = true
+			_, err := tr.Next()
+			if err == nil {
+				if v.read {
+					_, err = ioutil.ReadAll(tr)
+				} else {
+					_, err = tr.Next()
+				}
+			}
+			got, ok := err.(*TruncatedError)
+			if !ok {
+				t.Fatalf("got %v, want *TruncatedError", err)
+			}
+			if *got != v.want {
+				t.Errorf("got %+v, want %+v", *got, v.want)
+			}
+		})
+	}
+
+	// Without DetailedErrors, io.ErrUnexpectedEOF is reported.
+	tr := NewReader(bytes.NewReader(dataTrunc))
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if _, err := tr.Next(); err != io.ErrUnexpectedEOF {
+		t.Errorf("Next() = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestReaderTrailerSize(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Size: 5}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "Kilts"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := b.Bytes()
+
+	vectors := []struct {
+		label      string
+		input      string
+		shortTrail bool
+		want       int64
+	}{
+		{"Full", string(archive) + "Next", false, blockSize - 5 + 2*blockSize},
+		{"OneZeroBlock", string(archive[:2*blockSize]), false, blockSize - 5},
+		{"ShortTrailer", string(archive[:2*blockSize+100]), true, blockSize - 5 + 100},
+		{"ShortPadding", string(archive[:blockSize+100]), false, 100 - 5},
+		{"NoTrailer", string(archive[:blockSize+5]), false, 0},
+	}
+	for _, v := range vectors {
+		t.Run(v.label, func(t *testing.T) {
+			r := strings.NewReader(v.input)
+			tr := NewReader(struct{ io.Reader }{r})
+			tr.AllowShortTrailer = v.shortTrail
+			if _, err := tr.Next(); err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			if got := tr.TrailerSize(); got != 0 {
+				t.Errorf("TrailerSize() before io.EOF = %d, want 0", got)
+			}
+			if _, err := tr.Next(); err != io.EOF {
+				t.Fatalf("Next() = %v, want io.EOF", err)
+			}
+			if got := tr.TrailerSize(); got != v.want {
+				t.Errorf("TrailerSize() = %d, want %d", got, v.want)
+			}
+			if got, want := int64(len(v.input)-r.Len()), blockSize+5+tr.TrailerSize(); got != want {
+				t.Errorf("consumed %d bytes, want %d", got, want)
+			}
+		})
+	}
+}
+
+func TestReaderFind(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, e := range []struct{ name, data string }{
+		{"a", "first"}, {"b", "second"}, {"c", "third"}, {"b", "fourth"},
+	} {
+		if err := tw.WriteHeader(&Header{Name: e.name, Typeflag: TypeReg, Size: int64(len(e.data))}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	for _, want := range []string{"second", "third", "fourth"} {
+		if _, err := tr.Find("b", "c"); err != nil {
+			t.Fatalf("Find() = %v", err)
+		}
+		if got, err := ioutil.ReadAll(tr); err != nil || string(got) != want {
+			t.Errorf("ReadAll() = (%q, %v), want (%q, nil)", got, err, want)
+		}
+	}
+	if _, err := tr.Find("b", "c"); err != io.EOF {
+		t.Errorf("Find() = %v, want io.EOF", err)
+	}
+
+	ix, err := NewIndexBytes(b.Bytes())
+	if err != nil {
+		t.Fatalf("NewIndexBytes() = %v", err)
+	}
+	if i, ok := ix.Lookup("b"); !ok || i != 3 {
+		t.Errorf("Lookup(%q) = (%d, %v), want (3, true)", "b", i, ok)
+	}
+	if i, ok := ix.Lookup("a"); !ok || i != 0 {
+		t.Errorf("Lookup(%q) = (%d, %v), want (0, true)", "a", i, ok)
+	}
+	if _, ok := ix.Lookup("d"); ok {
+		t.Errorf("Lookup(%q) reported true", "d")
+	}
+}
+
+func TestReaderFindRejected(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "/abs", Typeflag: TypeReg, Size: 1},
+		{Name: "setuid", Typeflag: TypeReg, Mode: 04755, Size: 1},
+		{Name: "audited", Typeflag: TypeReg, Size: 1},
+		{Name: "target", Typeflag: TypeReg, Size: 1},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, hdr.Name[:1]); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	errAudit := errors.New("rejected by audit")
+	for _, disallowSkip := range []bool{false, true} {
+		newReader := func() *Reader {
+			tr := NewReader(bytes.NewReader(b.Bytes()))
+			tr.SpecialModes = SpecialModesError
+			tr.DisallowSkip = disallowSkip
+			tr.Audit = func(hdr *Header, _ *EntryInfo) error {
+				if hdr.Name == "audited" {
+					return errAudit
+				}
+				return nil
+			}
+			return tr
+		}
+		tr := newReader()
+		if hdr, err := tr.Find("target"); err != nil || hdr.Name != "target" {
+			t.Errorf("DisallowSkip=%v: Find() = (%v, %v), want %q", disallowSkip, hdr, err, "target")
+		} else if got, err := ioutil.ReadAll(tr); err != nil || string(got) != "t" {
+			t.Errorf("DisallowSkip=%v: ReadAll() = (%q, %v), want (%q, nil)", disallowSkip, got, err, "t")
+		}
+		tr = newReader()
+		if hdr, err := tr.Find("audited"); err != errAudit || hdr == nil || hdr.Name != "audited" {
+			t.Errorf("DisallowSkip=%v: Find() = (%v, %v), want %q and %v", disallowSkip, hdr, err, "audited", errAudit)
+		}
+		tr = newReader()
+		if _, err := tr.NextType(TypeDir); err != io.EOF {
+			t.Errorf("DisallowSkip=%v: NextType() = %v, want io.EOF", disallowSkip, err)
+		}
+	}
+}
+
+func TestReaderNextType(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "types"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	for _, hdr := range []*Header{
+		{Name: "dir/", Typeflag: TypeDir},
+		{Name: "dir/a", Typeflag: TypeReg},
+		{Name: "dir/b", Typeflag: TypeSymlink, Linkname: "a"},
+		{Name: "dir/c", Typeflag: TypeLink, Linkname: "dir/a"},
+		{Name: "dir/d", Typeflag: TypeRegA},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	for _, want := range []string{"dir/a", "dir/d"} {
+		if hdr, err := tr.NextRegular(); err != nil || hdr.Name != want {
+			t.Fatalf("NextRegular() = (%v, %v), want %q", hdr, err, want)
+		}
+	}
+	if _, err := tr.NextRegular(); err != io.EOF {
+		t.Errorf("NextRegular() = %v, want io.EOF", err)
+	}
+
+	tr = NewReader(bytes.NewReader(b.Bytes()))
+	for _, want := range []string{"dir/b", "dir/c"} {
+		if hdr, err := tr.NextType(TypeSymlink, TypeLink); err != nil || hdr.Name != want {
+			t.Fatalf("NextType() = (%v, %v), want %q", hdr, err, want)
+		}
+	}
+	if _, err := tr.NextType(TypeSymlink, TypeLink); err != io.EOF {
+		t.Errorf("NextType() = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderSelect(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	names := []string{"lib/", "lib/a.so", "lib/x/b.so", "lib/x/b.txt", "c.so", "doc/readme"}
+	for _, name := range names {
+		typ := byte(TypeReg)
+		if strings.HasSuffix(name, "/") {
+			typ = TypeDir
+		}
+		if err := tw.WriteHeader(&Header{Name: name, Typeflag: typ, Size: 1}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if typ == TypeReg {
+			if _, err := io.WriteString(tw, "x"); err != nil {
+				t.Fatalf("WriteString() = %v", err)
+			}
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	vectors := []struct {
+		include, exclude []string
+		want             []string
+		err              error
+	}{
+		{nil, nil, names, nil},
+		{[]string{"**/*.so"}, nil, []string{"lib/a.so", "lib/x/b.so", "c.so"}, nil},
+		{[]string{"lib/**"}, []string{"**/*.txt"}, []string{"lib/", "lib/a.so", "lib/x/b.so"}, nil},
+		{[]string{"lib"}, nil, []string{"lib/"}, nil},
+		{nil, []string{"lib/**", "*.so"}, []string{"doc/readme"}, nil},
+		{[]string{"lib/*"}, nil, []string{"lib/a.so"}, nil},
+		{[]string{"["}, nil, nil, path.ErrBadPattern},
+		{[]string{"c\\.so"}, nil, []string{"c.so"}, nil},
+		{nil, []string{"lib/[a-"}, nil, path.ErrBadPattern},
+		{nil, []string{"**/[]a]"}, nil, path.ErrBadPattern},
+		{[]string{"*.so\\"}, nil, nil, path.ErrBadPattern},
+	}
+	for i, v := range vectors {
+		tr := NewReader(bytes.NewReader(b.Bytes()))
+		tr.DisallowSkip = true
+		tr.Include, tr.Exclude = v.include, v.exclude
+		var got []string
+		var err error
+		for {
+			var hdr *Header
+			if hdr, err = tr.Next(); err != nil {
+				break
+			}
+			got = append(got, hdr.Name)
+			if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+				t.Fatalf("test %d, Copy() = %v", i, err)
+			}
+		}
+		if err == io.EOF {
+			err = nil
+		}
+		if err != v.err || !reflect.DeepEqual(got, v.want) {
+			t.Errorf("test %d, got (%q, %v), want (%q, %v)", i, got, err, v.want, v.err)
+		}
+	}
+}
+
+func TestReaderStripComponents(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "repo-1234/", Typeflag: TypeDir},
+		{Name: "repo-1234/src/", Typeflag: TypeDir},
+		{Name: "repo-1234/src/main.go", Typeflag: TypeReg},
+		{Name: "repo-1234/src/link", Typeflag: TypeLink, Linkname: "repo-1234/src/main.go"},
+		{Name: "repo-1234/src/symlink", Typeflag: TypeSymlink, Linkname: "main.go"},
+		{Name: "toplevel", Typeflag: TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	vectors := []struct {
+		strip  int
+		prefix string
+		want   []string // Name and Linkname of each entry
+	}{
+		{1, "", []string{
+			"src/:", "src/main.go:", "src/link:src/main.go", "src/symlink:main.go",
+		}},
+		{2, "dst/", []string{
+			"dst/main.go:", "dst/link:dst/main.go", "dst/symlink:main.go",
+		}},
+		{0, "../", []string{
+			"../repo-1234/:", "../repo-1234/src/:", "../repo-1234/src/main.go:",
+			"../repo-1234/src/link:../repo-1234/src/main.go", "../repo-1234/src/symlink:main.go",
+			"../toplevel:",
+		}},
+	}
+	for _, v := range vectors {
+		tr := NewReader(bytes.NewReader(b.Bytes()))
+		tr.StripComponents, tr.NamePrefix = v.strip, v.prefix
+		var got []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil && !(err == ErrInsecurePath && v.prefix == "../") {
+				t.Fatalf("Next() = %v", err)
+			}
+			got = append(got, hdr.Name+":"+hdr.Linkname)
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("StripComponents=%d, NamePrefix=%q: got %q, want %q", v.strip, v.prefix, got, v.want)
+		}
+	}
+}
+
+func TestReaderMaxExtendedHeaderSize(t *testing.T) {
+	big := strings.Repeat("x", 3<<20)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Xattrs: map[string]string{"user.big": big}}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	hdr, err := tr.Next()
+	if err != nil || hdr.Xattrs["user.big"] != big {
+		t.Fatalf("Next() = %v, want header with large extended attribute", err)
+	}
+	tr = NewReader(bytes.NewReader(b.Bytes()))
+	tr.MaxExtendedHeaderSize = 1 << 20
+	if _, err := tr.Next(); err != ErrFieldTooLong {
+		t.Errorf("Next() = %v, want %v", err, ErrFieldTooLong)
+	}
+}
+
+func TestIndexCopyTo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar-copyto")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// The data of the second entry starts at offset 4096, so that it may
+	// be cloned on file systems with blocks of up to that size.
+	data := []string{strings.Repeat("p", 4096-3*blockSize), strings.Repeat("0123456789", 1000)}
+	f, err := os.Create(filepath.Join(dir, "archive.tar"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	tw := NewWriter(f)
+	for i, d := range data {
+		if err := tw.WriteHeader(&Header{Name: fmt.Sprint(i), Typeflag: TypeReg, Size: int64(len(d))}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, d); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ix, err := NewIndex(f, fi.Size())
+	if err != nil {
+		t.Fatalf("NewIndex() = %v", err)
+	}
+
+	for i, d := range data {
+		dst, err := os.Create(filepath.Join(dir, fmt.Sprint(i)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := ix.CopyTo(i, dst)
+		dst.Close()
+		if n != int64(len(d)) || err != nil {
+			t.Errorf("CopyTo(%d) = (%d, %v), want (%d, nil)", i, n, err, len(d))
+		}
+		if got, err := ioutil.ReadFile(dst.Name()); err != nil || string(got) != d {
+			t.Errorf("entry %d: copied %d bytes (%v), want %d", i, len(got), err, len(d))
+		}
+	}
+
+	// The bytes that were cloned are counted even if dst cannot be
+	// advanced past them.
+	defer func(f func(dst, src *os.File, dstOff, srcOff, n int64) int64) { cloneRange = f }(cloneRange)
+	cloneRange = func(dst, src *os.File, dstOff, srcOff, n int64) int64 {
+		dst.Close()
+		return 4096
+	}
+	dst, err := os.Create(filepath.Join(dir, "partial"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n, err := ix.CopyTo(1, dst); n != 4096 || err == nil {
+		t.Errorf("CopyTo() after a partial clone = (%d, %v), want (4096, error)", n, err)
+	}
+}
+
+func TestReaderSection(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Size: 10}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "0123456789"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 10}, []SparseEntry{{2, 3}}); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "xyz"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	if _, ok := NewReader(bytes.NewBuffer(b.Bytes())).Section(); ok {
+		t.Error("Section() before Next reported true")
+	}
+	tr := NewReader(bytes.NewBuffer(b.Bytes()))
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if _, ok := tr.Section(); ok {
+		t.Error("Section() for an io.Reader that is not an io.ReaderAt reported true")
+	}
+
+	tr = NewReader(bytes.NewReader(b.Bytes()))
+	tr.ReadAheadSize = 4096
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	sr, ok := tr.Section()
+	if !ok {
+		t.Fatal("Section() reported false")
+	}
+	p := make([]byte, 3)
+	if n, err := sr.ReadAt(p, 6); n != 3 || err != nil || string(p) != "678" {
+		t.Errorf("ReadAt(6) = (%d, %v, %q), want (3, nil, \"678\")", n, err, p)
+	}
+	if got, err := ioutil.ReadAll(tr); err != nil || string(got) != "0123456789" {
+		t.Errorf("ReadAll() = (%q, %v), want \"0123456789\"", got, err)
+	}
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if _, ok := tr.Section(); ok {
+		t.Error("Section() for a sparse file reported true")
+	}
+}
+
+// readCounter is an io.ReadSeeker that counts the bytes read from it.
+type readCounter struct {
+	io.ReadSeeker
+	n int64
+}
+
+func (rc *readCounter) Read(b []byte) (int, error) {
+	n, err := rc.ReadSeeker.Read(b)
+	rc.n += int64(n)
+	return n, err
+}
+
+func TestReaderSkipSparse(t *testing.T) {
+	const fragment = 1 << 20
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	sp := []SparseEntry{{0, fragment}, {4 * fragment, fragment}}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 8 * fragment}, sp); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if _, err := tw.Write(make([]byte, 2*fragment)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	for _, read := range []int{0, 100, fragment + 100} {
+		rc := &readCounter{ReadSeeker: bytes.NewReader(b.Bytes())}
+		tr := NewReader(rc)
+		if _, err := tr.Next(); err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if _, err := io.CopyN(ioutil.Discard, tr, int64(read)); err != nil {
+			t.Fatalf("CopyN() = %v", err)
+		}
+		if hdr, err := tr.Next(); err != nil || hdr.Name != "file" {
+			t.Fatalf("Next() = (%v, %v), want file", hdr, err)
+		}
+		// The unread data fragments must be skipped using Seek.
+		if max := int64(read) + 8*blockSize; rc.n > max {
+			t.Errorf("after reading %d bytes: read %d bytes from the input, want at most %d", read, rc.n, max)
+		}
+	}
+}
+
+func TestReaderChecksums(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, name := range []string{"cafe", "next"} {
+		if err := tw.WriteHeader(&Header{Name: name, Typeflag: TypeReg}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	// Use a byte for which the signed and unsigned checksums differ.
+	archive := b.Bytes()
+	var blk Block
+	copy(blk[:], archive)
+	blk[3] = 0xe9
+	blk.SetChecksum()
+	copy(archive, blk[:])
+
+	for _, v := range []struct {
+		policy ChecksumPolicy
+		ok     bool
+	}{
+		{ChecksumEither, true},
+		{ChecksumUnsigned, true},
+		{ChecksumSigned, false},
+	} {
+		tr := NewReader(bytes.NewReader(archive))
+		tr.Checksums = v.policy
+		if _, err := tr.Next(); (err == nil) != v.ok {
+			t.Errorf("policy %d: Next() = %v, want ok = %v", v.policy, err, v.ok)
+		}
+	}
+
+	// Corrupt the checksum of the first header.
+	bad := append([]byte(nil), archive...)
+	copy(bad[148:], "0000000\x00")
+	tr := NewReader(bytes.NewReader(bad))
+	if _, err := tr.Next(); err != ErrHeader {
+		t.Errorf("Next() = %v, want %v", err, ErrHeader)
+	}
+	tr = NewReader(bytes.NewReader(bad))
+	tr.ContinueOnBadChecksum = true
+	tr.DetailedErrors = true
+	hdr, err := tr.Next()
+	if herr, ok := err.(*HeaderError); !ok || herr.Kind != KindChecksum || hdr == nil || hdr.Name != "caf\xe9" {
+		t.Errorf("Next() = (%v, %v), want the header with a *HeaderError of KindChecksum", hdr, err)
+	}
+	if hdr, err := tr.Next(); err != nil || hdr.Name != "next" {
+		t.Errorf("Next() = (%v, %v), want next", hdr, err)
+	}
+}
+
+func TestReaderAIX(t *testing.T) {
+	long := strings.Repeat("long", 30)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: long, Typeflag: TypeReg, Size: 1},
+		{Name: "ids", Typeflag: TypeReg},
+	} {
+		if err := tw.WriteFile(hdr, strings.NewReader(strings.Repeat("x", int(hdr.Size)))); err != nil {
+			t.Fatalf("WriteFile() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	// Rewrite the extended header with the older typeflag, and store
+	// the IDs of the last entry as an unterminated octal field and
+	// a base-256 field.
+	archive := b.Bytes()
+	rewrite := func(off int, f func(*Block)) {
+		var blk Block
+		copy(blk[:], archive[off:])
+		f(&blk)
+		blk.SetChecksum()
+		copy(archive[off:], blk[:])
+	}
+	rewrite(0, func(blk *Block) { blk[156] = 'X' })
+	rewrite(len(archive)-3*BlockSize, func(blk *Block) {
+		copy(blk[108:116], "77777777")
+		FormatNumeric(blk[116:124], 1<<30)
+	})
+
+	tr := NewReader(bytes.NewReader(archive))
+	if hdr, err := tr.Next(); err != nil || hdr.Name != long || hdr.Typeflag != TypeReg {
+		t.Fatalf("Next() = (%v, %v), want %q", hdr, err, long)
+	}
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != "ids" || hdr.Uid != 077777777 || hdr.Gid != 1<<30 {
+		t.Fatalf("Next() = (%v, %v), want ids with Uid %d and Gid %d", hdr, err, 077777777, 1<<30)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderAudit(t *testing.T) {
+	long := strings.Repeat("long", 30)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "ok", Typeflag: TypeReg, Size: 1},
+		{Name: long, Typeflag: TypeReg, Size: 1},
+		{Name: "veto", Typeflag: TypeReg, Size: 1},
+		{Name: "last", Typeflag: TypeReg, Size: 1},
+	} {
+		if err := tw.WriteFile(hdr, strings.NewReader("x")); err != nil {
+			t.Fatalf("WriteFile() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	errVeto := errors.New("vetoed")
+	var infos []EntryInfo
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	tr.Audit = func(hdr *Header, info *EntryInfo) error {
+		infos = append(infos, *info)
+		switch hdr.Name {
+		case long:
+			return SkipEntry
+		case "veto":
+			return errVeto
+		}
+		return nil
+	}
+	for _, want := range []struct {
+		name string
+		err  error
+	}{
+		{"ok", nil},
+		{"veto", errVeto},
+		{"last", nil},
+	} {
+		if hdr, err := tr.Next(); err != want.err || hdr.Name != want.name {
+			t.Fatalf("Next() = (%v, %v), want (%q, %v)", hdr, err, want.name, want.err)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want io.EOF", err)
+	}
+
+	if len(infos) != 4 {
+		t.Fatalf("Audit called %d times, want 4", len(infos))
+	}
+	for i, want := range []struct {
+		offset   int64
+		format   string
+		extended bool
+	}{
+		{0, "USTAR", false},
+		{2048, "PAX", true},
+		{3072, "USTAR", false},
+		{4096, "USTAR", false},
+	} {
+		info := infos[i]
+		if info.Index != i || info.Offset != want.offset || info.DataOffset != want.offset+512 || info.Format != want.format || info.Extended != want.extended || len(info.Raw) != 512 {
+			t.Errorf("entry %d: EntryInfo = %+v, want offset %d, format %s, extended %v", i, info, want.offset, want.format, want.extended)
+		}
+	}
+}
+
+func TestNormalizeNames(t *testing.T) {
+	// Stand-ins for NFC and NFD that only convert "\u00e9".
+	nfc := func(s string) string { return strings.Replace(s, "e\u0301", "\u00e9", -1) }
+	nfd := func(s string) string { return strings.Replace(s, "\u00e9", "e\u0301", -1) }
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.NormalizeNames = nfd
+	for _, hdr := range []*Header{
+		{Name: "caf\u00e9/", Typeflag: TypeDir},
+		{Name: "link", Typeflag: TypeSymlink, Linkname: "caf\u00e9/"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	tr.NormalizeNames = nfc
+	tr.Include = []string{"caf\u00e9", "link"}
+	for _, want := range []struct{ name, link, origName, origLink string }{
+		{"caf\u00e9/", "", "cafe\u0301/", ""},
+		{"link", "caf\u00e9/", "link", "cafe\u0301/"},
+	} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if hdr.Name != want.name || hdr.Linkname != want.link {
+			t.Errorf("Next() = (%q, %q), want (%q, %q)", hdr.Name, hdr.Linkname, want.name, want.link)
+		}
+		if name, link := tr.OriginalNames(); name != want.origName || link != want.origLink {
+			t.Errorf("OriginalNames() = (%q, %q), want (%q, %q)", name, link, want.origName, want.origLink)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderWindowsNames(t *testing.T) {
+	names := []string{"file", "dir/Con", "lpt1.txt", "com10", "trailing. ", "what?/x", "a:b", "nul .c"}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, name := range names {
+		if err := tw.WriteHeader(&Header{Name: name, Typeflag: TypeReg}); err != nil {
+			t.Fatalf("WriteHeader(%q) = %v", name, err)
+		}
+	}
+	if err := tw.WriteHeader(&Header{Name: "link", Typeflag: TypeLink, Linkname: "dir/Con"}); err != nil {
+		t.Fatalf("WriteHeader(link) = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	for _, v := range []struct {
+		policy WindowsNamePolicy
+		want   []string // Names returned, followed by "!" if ErrWindowsName is reported
+	}{
+		{WindowsNamesAllow, append(names, "link")},
+		{WindowsNamesError, []string{"file", "dir/Con!", "lpt1.txt!", "com10", "trailing. !", "what?/x!", "a:b!", "nul .c!", "link"}},
+		{WindowsNamesSkip, []string{"file", "com10", "link"}},
+		{WindowsNamesRename, []string{"file", "dir/Con_", "lpt1_.txt", "com10", "trailing__", "what_/x", "a_b", "nul _.c", "link->dir/Con_"}},
+	} {
+		tr := NewReader(bytes.NewReader(b.Bytes()))
+		tr.WindowsNames = v.policy
+		var got []string
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil && err != ErrWindowsName {
+				t.Fatalf("policy %d: Next() = %v", v.policy, err)
+			}
+			name := hdr.Name
+			if err == ErrWindowsName {
+				name += "!"
+			}
+			if v.policy == WindowsNamesRename && hdr.Typeflag == TypeLink {
+				name += "->" + hdr.Linkname
+			}
+			got = append(got, name)
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("policy %d: names = %q, want %q", v.policy, got, v.want)
+		}
+	}
+}
+
+func TestReaderSpecialModes(t *testing.T) {
+	modes := []int64{0755, 04755, 02775, 01777}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for i, mode := range modes {
+		if err := tw.WriteHeader(&Header{Name: strconv.Itoa(i), Typeflag: TypeReg, Mode: mode}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	stripped := []int64{0755, 0755, 0775, 0777}
+	privileged := stripped
+	if os.Geteuid() == 0 {
+		privileged = modes
+	}
+	for _, v := range []struct {
+		policy SpecialModePolicy
+		want   []int64
+		errs   []bool
+	}{
+		{SpecialModesPreserve, modes, []bool{false, false, false, false}},
+		{SpecialModesPrivileged, privileged, []bool{false, false, false, false}},
+		{SpecialModesStrip, stripped, []bool{false, false, false, false}},
+		{SpecialModesError, modes, []bool{false, true, true, true}},
+	} {
+		tr := NewReader(bytes.NewReader(b.Bytes()))
+		tr.SpecialModes = v.policy
+		for i := range modes {
+			hdr, err := tr.Next()
+			if hdr == nil || (err == ErrSpecialMode) != v.errs[i] || (err != nil && err != ErrSpecialMode) {
+				t.Fatalf("policy %d, entry %d: Next() = (%v, %v)", v.policy, i, hdr, err)
+			}
+			if hdr.Mode != v.want[i] {
+				t.Errorf("policy %d, entry %d: Mode = %o, want %o", v.policy, i, hdr.Mode, v.want[i])
+			}
+		}
+	}
+}
+
+func TestReaderUmask(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Mode: 04777}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	for _, v := range []struct {
+		umask int64
+		want  int64
+	}{
+		{0, 04777},
+		{022, 04755},
+		{077, 04700},
+		{ProcessUmask, 04777 &^ processUmask()},
+	} {
+		tr := NewReader(bytes.NewReader(b.Bytes()))
+		tr.Umask = v.umask
+		if hdr, err := tr.Next(); err != nil || hdr.Mode != v.want {
+			t.Errorf("Umask %o: Next() = (%v, %v), want Mode %o", v.umask, hdr, err, v.want)
+		}
+	}
+}
+
+func TestReadSunHolesData(t *testing.T) {
+	vectors := []struct {
+		value     string        // Input record
+		size      int64         // Size of the stored data
+		sparseMap []sparseEntry // Expected sparse entries
+		realSize  int64         // Expected size of the file
+		err       error
+	}{
+		{value: " 0 5", size: 5, sparseMap: []sparseEntry{{0, 5}}, realSize: 5},
+		{value: " 0 2 5 8", size: 5, sparseMap: []sparseEntry{{0, 2}, {5, 3}}, realSize: 8},
+		{value: " 0 2 5 8 20 20", size: 5, sparseMap: []sparseEntry{{0, 2}, {5, 3}, {20, 0}}, realSize: 20},
+		{value: " 4 6 10", size: 5, sparseMap: []sparseEntry{{4, 2}, {10, 3}}, realSize: 13},
+		{value: "0", size: 0, sparseMap: []sparseEntry{{0, 0}}, realSize: 0},
+		{value: " ", size: 0, err: ErrHeader},
+		{value: " 0 2 5 8", size: 6, err: ErrHeader},
+		{value: " 0 2 5", size: 1, err: ErrHeader},
+		{value: " 0 5 2 8", size: 6, err: ErrHeader},
+		{value: " 0 -5", size: 0, err: ErrHeader},
+		{value: " 0 5x", size: 5, err: ErrHeader},
+		{value: " 9223372036854775807", size: 1, err: ErrHeader},
+	}
+
+	for i, v := range vectors {
+		sp, realSize, err := readSunHolesData(v.value, v.size)
+		if err != v.err {
+			t.Errorf("test %d, readSunHolesData(%q, %d): got error %v, want %v", i, v.value, v.size, err, v.err)
+			continue
+		}
+		if !reflect.DeepEqual(sp, v.sparseMap) || realSize != v.realSize {
+			t.Errorf("test %d, readSunHolesData(%q, %d) = (%v, %d), want (%v, %d)", i, v.value, v.size, sp, realSize, v.sparseMap, v.realSize)
+		}
+	}
+
+	// Write a record of the same length under another key and rename it,
+	// since the Writer does not write SUN.holesdata records itself.
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	hdr := &Header{Name: "holes", Typeflag: TypeReg, Size: 5, PAXRecords: map[string]string{"SUN.holesdatX": " 0 2 5 8"}}
+	if err := tw.WriteFile(hdr, strings.NewReader("abcde")); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := bytes.Replace(b.Bytes(), []byte("SUN.holesdatX"), []byte(paxSunHolesData), 1)
+
+	tr := NewReader(bytes.NewReader(archive))
+	tr.TrackSources = true
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if hdr.Size != 8 {
+		t.Errorf("Size = %d, want 8", hdr.Size)
+	}
+	if got, want := tr.Sources()["Size"], (FieldSource{Kind: SourcePAX, Key: paxSunHolesData}); got != want {
+		t.Errorf("Sources()[Size] = %v, want %v", got, want)
+	}
+	if data, err := ioutil.ReadAll(tr); err != nil || string(data) != "ab\x00\x00\x00cde" {
+		t.Errorf("ReadAll() = (%q, %v), want %q", data, err, "ab\x00\x00\x00cde")
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want io.EOF", err)
+	}
+}
+
+func TestReaderUnusualNames(t *testing.T) {
+	long := strings.Repeat("long", 30)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "", Typeflag: TypeDir, Mode: 0755},
+		{Name: "/", Typeflag: TypeDir, Mode: 0755},
+		{Name: long + "xx", Typeflag: TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%q) = %v", hdr.Name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	// Pad the path record of the last entry with NULs.
+	archive := bytes.Replace(b.Bytes(), []byte(long+"xx\n"), []byte(long+"\x00\x00\n"), 1)
+
+	for _, allow := range []bool{false, true} {
+		tr := NewReader(bytes.NewReader(archive))
+		tr.AllowUnusualNames = allow
+		if hdr, err := tr.Next(); err != nil || hdr.Name != "" {
+			t.Errorf("allow %v: Next() = (%v, %v), want empty name", allow, hdr, err)
+		}
+		wantErr := ErrInsecurePath
+		if allow {
+			wantErr = nil
+		}
+		if hdr, err := tr.Next(); err != wantErr || hdr.Name != "/" {
+			t.Errorf("allow %v: Next() = (%v, %v), want / with error %v", allow, hdr, err, wantErr)
+		}
+		hdr, err := tr.Next()
+		if !allow {
+			if err != ErrHeader {
+				t.Errorf("Next() = %v, want %v", err, ErrHeader)
+			}
+			continue
+		}
+		if err != nil || hdr.Name != long {
+			t.Errorf("allow %v: Next() = (%v, %v), want %q", allow, hdr, err, long)
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("allow %v: Next() = %v, want io.EOF", allow, err)
+		}
+	}
+}
+
+func TestOpenIndex(t *testing.T) {
+	long := strings.Repeat("long/", 30) + "file"
+	write := func(opts func(*Writer)) []byte {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		opts(tw)
+		entries := []struct {
+			hdr  *Header
+			data string
+		}{
+			{&Header{Name: "dir/", Typeflag: TypeDir, Mode: 0755}, ""},
+			{&Header{Name: "dir/file", Typeflag: TypeReg, Mode: 0644, Size: 5}, "hello"},
+			{&Header{Name: long, Typeflag: TypeReg, Mode: 0644, Size: 600}, strings.Repeat("x", 600)},
+			{&Header{Name: "link", Typeflag: TypeSymlink, Linkname: "dir/file"}, ""},
+			{&Header{Name: "dir/file", Typeflag: TypeReg, Mode: 0600, Size: 3}, "bye"},
+		}
+		for _, e := range entries {
+			if err := tw.WriteFile(e.hdr, strings.NewReader(e.data)); err != nil {
+				t.Fatalf("WriteFile(%q) = %v", e.hdr.Name, err)
+			}
+		}
+		if err := tw.WriteGlobalHeader(map[string]string{"comment": "global"}); err != nil {
+			t.Fatalf("WriteGlobalHeader() = %v", err)
+		}
+		if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 10}, []SparseEntry{{2, 3}}); err != nil {
+			t.Fatalf("WriteSparseHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, "abc"); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		return b.Bytes()
+	}
+
+	plain := write(func(*Writer) {})
+	want, err := NewIndexBytes(plain)
+	if err != nil {
+		t.Fatalf("NewIndexBytes() = %v", err)
+	}
+	for _, v := range []struct {
+		opts        func(*Writer)
+		omitPadding bool
+		suffix      int // Number of zero bytes appended to the archive
+	}{
+		{func(tw *Writer) { tw.WriteIndex = true }, false, 0},
+		{func(tw *Writer) { tw.WriteIndex, tw.IndexDigest = true, "sha256" }, false, 10240 - 1024},
+		{func(tw *Writer) { tw.WriteIndex = true }, true, 0},
+	} {
+		archive := write(func(tw *Writer) {
+			v.opts(tw)
+			tw.OmitFinalPadding = v.omitPadding
+		})
+		archive = append(archive, make([]byte, v.suffix)...)
+		ix, err := OpenIndex(bytes.NewReader(archive), int64(len(archive)))
+		if err != nil {
+			t.Fatalf("OpenIndex() = %v", err)
+		}
+		if !ix.lazy {
+			t.Fatal("OpenIndex did not use the trailing index")
+		}
+
+		// The archive is otherwise identical to one with the final padding,
+		// which NewIndex requires.
+		padded := write(v.opts)
+		full, err := NewIndex(bytes.NewReader(padded), int64(len(padded)))
+		if err != nil {
+			t.Fatalf("NewIndex() = %v", err)
+		}
+		if ix.Len() != full.Len() || ix.Len() != want.Len()+1 {
+			t.Fatalf("Len() = %d, want %d", ix.Len(), full.Len())
+		}
+		for _, name := range []string{"dir/file", "link", "sparse", long, globalHeaderName} {
+			i, ok := ix.Lookup(name)
+			j, ok2 := full.Lookup(name)
+			if i != j || ok != ok2 {
+				t.Errorf("Lookup(%q) = (%d, %v), want (%d, %v)", name, i, ok, j, ok2)
+			}
+		}
+		for i := 0; i < ix.Len(); i++ {
+			got, hdr := ix.Header(i), full.Header(i)
+			if !reflect.DeepEqual(got, hdr) {
+				t.Errorf("Header(%d) = %+v, want %+v", i, got, hdr)
+			}
+			data, err := ioutil.ReadAll(ix.Open(i))
+			wantData, _ := ioutil.ReadAll(full.Open(i))
+			if err != nil || !bytes.Equal(data, wantData) {
+				t.Errorf("%s: ReadAll(Open()) = (%q, %v), want %q", hdr.Name, data, err, wantData)
+			}
+		}
+		i, _ := ix.Lookup("dir/file")
+		if alg, sum := ix.Digest(i); alg != "" {
+			h := newDigest(alg)
+			io.WriteString(h, "bye")
+			if alg != "sha256" || !bytes.Equal(sum, h.Sum(nil)) {
+				t.Errorf("Digest() = (%q, %x), want sha256 of %q", alg, sum, "bye")
+			}
+		}
+	}
+
+	// Archives without an index are read in full.
+	ix, err := OpenIndex(bytes.NewReader(plain), int64(len(plain)))
+	if err != nil || ix.lazy || ix.Len() != want.Len() {
+		t.Errorf("OpenIndex() without an index = (%d entries, lazy %v, %v), want %d entries", ix.Len(), ix.lazy, err, want.Len())
+	}
+}
+
+func TestIndexReadDir(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "bin/tool", Typeflag: TypeReg, Mode: 0755, ModTime: mtime},
+		{Name: "share/doc/tool/README", Typeflag: TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "share/doc/", Typeflag: TypeDir, Mode: 0700, ModTime: mtime},
+		{Name: "./share/man", Typeflag: TypeSymlink, Linkname: "doc", Mode: 0777, ModTime: mtime},
+		{Name: "share/doc/tool/README", Typeflag: TypeReg, Mode: 0600, ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	ix, err := NewIndexBytes(b.Bytes())
+	if err != nil {
+		t.Fatalf("NewIndexBytes() = %v", err)
+	}
+
+	vectors := []struct {
+		dir  string
+		want []string // Name and mode of each file
+		err  bool
+	}{
+		{".", []string{"bin dr-xr-xr-x", "share dr-xr-xr-x"}, false},
+		{"bin", []string{"tool -rwxr-xr-x"}, false},
+		{"/share/", []string{"doc drwx------", "man Lrwxrwxrwx"}, false},
+		{"share/doc", []string{"tool dr-xr-xr-x"}, false},
+		{"share/doc/tool", []string{"README -rw-------"}, false},
+		{"share/doc/tool/README", nil, true},
+		{"missing", nil, true},
+	}
+	for _, v := range vectors {
+		fis, err := ix.ReadDir(v.dir)
+		if (err != nil) != v.err {
+			t.Errorf("ReadDir(%q) = %v, want error %v", v.dir, err, v.err)
+			continue
+		}
+		var got []string
+		for _, fi := range fis {
+			got = append(got, fi.Name()+" "+fi.Mode().String())
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("ReadDir(%q) = %q, want %q", v.dir, got, v.want)
+		}
+	}
+}
+
+func TestIndexSection(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	data := strings.Repeat("0123456789", 100)
+	if err := tw.WriteFile(&Header{Name: "file", Mode: 0644, Size: int64(len(data))}, strings.NewReader(data)); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Size: 10}, []SparseEntry{{2, 3}}); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "abc"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := b.Bytes()
+	ix, err := NewIndexBytes(archive)
+	if err != nil {
+		t.Fatalf("NewIndexBytes() = %v", err)
+	}
+
+	off, length := ix.DataRange(0)
+	if got := string(archive[off : off+length]); got != data {
+		t.Errorf("DataRange(0) = (%d, %d), which holds %q, want %q", off, length, got, data)
+	}
+	sr, ok := ix.Section(0)
+	if !ok {
+		t.Fatal("Section(0) reports false")
+	}
+	if n, err := sr.Seek(-5, io.SeekEnd); err != nil || n != length-5 {
+		t.Errorf("Seek() = (%d, %v), want %d", n, err, length-5)
+	}
+	if got, err := ioutil.ReadAll(sr); err != nil || string(got) != data[len(data)-5:] {
+		t.Errorf("ReadAll() after Seek = (%q, %v), want %q", got, err, data[len(data)-5:])
+	}
+
+	if _, ok := ix.Section(1); ok {
+		t.Error("Section(1) of a sparse file reports true")
+	}
+	off, length = ix.DataRange(1)
+	if got := string(archive[off : off+length]); got != "abc" {
+		t.Errorf("DataRange(1) holds %q, want the stored fragments", got)
+	}
+}
+
+func TestReaderState(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteFile(&Header{Name: "first", Mode: 0644, Size: 3}, strings.NewReader("abc")); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "global"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	data := strings.Repeat("0123456789", 100)
+	for _, name := range []string{"second", "third"} {
+		if err := tw.WriteFile(&Header{Name: name, Mode: 0644, Size: int64(len(data))}, strings.NewReader(data)); err != nil {
+			t.Fatalf("WriteFile() = %v", err)
+		}
+	}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Size: 10}, []SparseEntry{{2, 3}}); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	io.WriteString(tw, "xyz")
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	archive := b.Bytes()
+
+	// readRest returns the remaining data of the current entry, followed by
+	// the names, global comments, and data of the remaining entries.
+	readRest := func(tr *Reader) []string {
+		var got []string
+		for {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("ReadAll() = %v", err)
+			}
+			got = append(got, string(data))
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return got
+			}
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			got = append(got, hdr.Name+" "+hdr.PAXRecords["comment"])
+		}
+	}
+	all := readRest(NewReader(bytes.NewReader(archive)))
+
+	for _, v := range []struct {
+		entries int   // Number of entries read before saving the state
+		read    int64 // Number of bytes of their data read
+	}{
+		{0, 0}, {1, 0}, {1, 2}, {2, 0}, {3, 0}, {3, 100}, {4, 1000},
+	} {
+		tr := NewReader(bytes.NewReader(archive))
+		for i := 0; i < v.entries; i++ {
+			if _, err := tr.Next(); err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+		}
+		if _, err := io.CopyN(ioutil.Discard, tr, v.read); err != nil {
+			t.Fatalf("CopyN() = %v", err)
+		}
+		st, err := tr.State()
+		if err != nil {
+			t.Fatalf("%d entries: State() = %v", v.entries, err)
+		}
+		tr = NewReader(bytes.NewReader(archive[st.Offset:]))
+		if err := tr.Restore(st); err != nil {
+			t.Fatalf("%d entries: Restore() = %v", v.entries, err)
+		}
+		got := readRest(tr)
+		want := append([]string{all[2*v.entries][v.read:]}, all[2*v.entries+1:]...)
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%d entries, %d bytes: entries = %q, want %q", v.entries, v.read, got, want)
+		}
+	}
+
+	// The state cannot be saved within a sparse file or at the end.
+	tr := NewReader(bytes.NewReader(archive))
+	for i := 0; i < 5; i++ {
+		tr.Next()
+	}
+	if _, err := tr.State(); err == nil {
+		t.Error("State() within a sparse file = nil, want error")
+	}
+	readRest(tr)
+	if _, err := tr.State(); err == nil {
+		t.Error("State() at the end = nil, want error")
+	}
+	if err := tr.Restore(ReaderState{}); err == nil {
+		t.Error("Restore() on a used Reader = nil, want error")
+	}
+	if err := NewReader(nil).Restore(ReaderState{Offset: 1}); err == nil {
+		t.Error("Restore() with a misaligned state = nil, want error")
+	}
+}
+
+func BenchmarkReadSparse(b *testing.B) {
+	// A file of 1 MiB that is almost entirely a hole, which Read fills in.
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 1 << 20}, []SparseEntry{{1<<20 - 1, 1}}); err != nil {
+		b.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "x"); err != nil {
+		b.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatalf("Close() = %v", err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	data := make([]byte, 32<<10)
+	b.SetBytes(1 << 20)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Seek(0, io.SeekStart)
+		tr := NewReader(r)
+		if _, err := tr.Next(); err != nil {
+			b.Fatalf("Next() = %v", err)
+		}
+		if _, err := io.CopyBuffer(ioutil.Discard, struct{ io.Reader }{tr}, data); err != nil {
+			b.Fatalf("Copy() = %v", err)
+		}
+	}
+}
+
+func BenchmarkReaderNext(b *testing.B) {
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	const numEntries = 100
+	for i := 0; i < numEntries; i++ {
+		hdr := &Header{Name: fmt.Sprintf("dir/file%d", i), Typeflag: TypeReg, Mode: 0644, Size: 3, Uname: "user", Gname: "group", ModTime: time.Unix(1500000000, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			b.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, "abc"); err != nil {
+			b.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		b.Fatalf("Close() = %v", err)
+	}
+	r := bytes.NewReader(buf.Bytes())
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		r.Seek(0, io.SeekStart)
+		tr := NewReader(r)
+		tr.InternNames = true
+		for {
+			if _, err := tr.Next(); err != nil {
+				if err != io.EOF {
+					b.Fatalf("Next() = %v", err)
+				}
+				break
+			}
+		}
+	}
 }
@@ -0,0 +1,280 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+)
+
+// A Fix describes a correction made by Repair.
+type Fix struct {
+	Offset int64  // Offset in the input of the affected block or padding
+	Name   string // Name of the affected entry, if any
+	Reason string // Description of the correction
+}
+
+func (f Fix) String() string {
+	if f.Name == "" {
+		return fmt.Sprintf("offset %d: %s", f.Offset, f.Reason)
+	}
+	return fmt.Sprintf("offset %d: %s: %s", f.Offset, f.Name, f.Reason)
+}
+
+// Repair copies the tar archive from r to w, correcting damage that is
+// commonly caused by tools that do not properly implement the format:
+//
+//	* Header blocks with an incorrect checksum are written with the
+//	correct checksum.
+//	* Missing or non-zero padding after the data of an entry is replaced
+//	with zeros.
+//	* Zero blocks between entries, such as those left behind by
+//	concatenating archives, are removed.
+//	* A missing or incomplete end-of-archive trailer is regenerated, and
+//	any input following it is discarded.
+//	* Data of an entry that is cut short by the end of the input is filled
+//	out with zeros.
+//
+// Repair returns the corrections that were made, in the order that they
+// were applied. It stops at the first damage it cannot correct, such as a
+// header block that is unrecognizable, for which it reports ErrHeader,
+// or a truncated header block, for which it reports io.ErrUnexpectedEOF.
+func Repair(w io.Writer, r io.Reader) ([]Fix, error) {
+	rp := repairer{w: w, r: bufio.NewReader(r)}
+	err := rp.repair()
+	return rp.fixes, err
+}
+
+type repairer struct {
+	w     io.Writer
+	r     *bufio.Reader
+	off   int64 // Offset in the input
+	blk   block // Current header block
+	fixes []Fix
+}
+
+func (rp *repairer) fix(off int64, name, reason string) {
+	rp.fixes = append(rp.fixes, Fix{off, name, reason})
+}
+
+func (rp *repairer) repair() error {
+	var localSize, globalSize string // Size records of extended headers
+	for {
+		off := rp.off
+		n, err := io.ReadFull(rp.r, rp.blk[:])
+		rp.off += int64(n)
+		switch {
+		case err == io.EOF:
+			rp.fix(off, "", "added missing end-of-archive trailer")
+			return rp.writeTrailer()
+		case err == io.ErrUnexpectedEOF && isZero(rp.blk[:n]):
+			rp.fix(off, "", "completed truncated end-of-archive trailer")
+			return rp.writeTrailer()
+		case err != nil:
+			return err
+		}
+
+		if rp.blk.IsZero() {
+			next, _ := rp.r.Peek(blockSize)
+			switch {
+			case len(next) == blockSize && isZero(next):
+				return rp.writeTrailer() // Intact trailer
+			case isZero(next):
+				rp.fix(off, "", "completed truncated end-of-archive trailer")
+				return rp.writeTrailer()
+			default:
+				rp.fix(off, "", "removed zero block between entries")
+				continue
+			}
+		}
+
+		name := rp.name()
+		if rp.blk.GetFormat() == formatUnknown {
+			if !rp.plausibleHeader() {
+				return ErrHeader
+			}
+			rp.blk.SetFormat(formatV7) // Only updates the checksum
+			rp.fix(off, name, "corrected header checksum")
+		}
+		if _, err := rp.w.Write(rp.blk[:]); err != nil {
+			return err
+		}
+
+		// Determine the size of the data, as done by Reader.Next.
+		var p parser
+		typ := rp.blk.V7().TypeFlag()[0]
+		size := p.parseNumeric(rp.blk.V7().Size())
+		switch typ {
+		case TypeXHeader, typeXHeaderOld, TypeXGlobalHeader, TypeGNULongName, TypeGNULongLink:
+		default:
+			for _, s := range []string{localSize, globalSize} {
+				if s != "" {
+					size, err = strconv.ParseInt(s, 10, 64)
+					if err != nil {
+						p.err = ErrHeader
+					}
+					break
+				}
+			}
+			localSize = ""
+		}
+		if p.err != nil || size < 0 {
+			return ErrHeader
+		}
+		if isHeaderOnlyType(typ) {
+			size = 0
+		}
+		if typ == TypeGNUSparse && rp.blk.GetFormat() == formatGNU {
+			if err := rp.copySparseExtensions(); err != nil {
+				return err
+			}
+		}
+
+		// Copy the data, retaining extended headers for their size records.
+		var data bytes.Buffer
+		dst := rp.w
+		if typ == TypeXHeader || typ == typeXHeaderOld || typ == TypeXGlobalHeader {
+			dst = io.MultiWriter(rp.w, &data)
+		}
+		nc, err := io.CopyN(dst, rp.r, size)
+		rp.off += nc
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if missing := size - nc; missing > 0 {
+			rp.fix(rp.off, name, fmt.Sprintf("filled truncated data with %d zero bytes", missing))
+			if _, err := io.CopyN(rp.w, zeroReader{}, missing); err != nil {
+				return err
+			}
+		}
+		if recs, err := parsePAX(data.Bytes(), DuplicateLastWins, false); err == nil && data.Len() > 0 {
+			switch typ {
+			case TypeXHeader, typeXHeaderOld:
+				localSize = recs[paxSize]
+			case TypeXGlobalHeader:
+				if s, ok := recs[paxSize]; ok {
+					globalSize = s
+				}
+			}
+		}
+
+		if err := rp.repairPadding(name, size); err != nil {
+			return err
+		}
+	}
+}
+
+// repairPadding consumes the padding after data of the given size, and
+// writes correct padding in its place.
+func (rp *repairer) repairPadding(name string, size int64) error {
+	pad := int(-size & (blockSize - 1))
+	if pad == 0 {
+		return nil
+	}
+	b, _ := rp.r.Peek(pad + blockSize)
+	switch {
+	case len(b) < pad:
+		rp.fix(rp.off, name, "completed truncated padding")
+	case isZero(b[:pad]):
+		// Intact padding.
+	case rp.isHeader(b):
+		rp.fix(rp.off, name, "inserted missing padding")
+		b = nil
+	default:
+		rp.fix(rp.off, name, "cleared non-zero padding")
+	}
+	if len(b) > pad {
+		b = b[:pad]
+	}
+	rp.r.Discard(len(b))
+	rp.off += int64(len(b))
+	_, err := rp.w.Write(zeroBlock[:pad])
+	return err
+}
+
+// copySparseExtensions copies the extension blocks of an old GNU sparse
+// header in rp.blk, which are not covered by its checksum.
+func (rp *repairer) copySparseExtensions() error {
+	blk := rp.blk
+	for s := blk.GNU().Sparse(); s.IsExtended()[0] > 0; s = blk.Sparse() {
+		n, err := io.ReadFull(rp.r, blk[:])
+		rp.off += int64(n)
+		if err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return err
+		}
+		if _, err := rp.w.Write(blk[:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// isHeader reports whether b begins with a valid non-zero header block.
+func (rp *repairer) isHeader(b []byte) bool {
+	if len(b) < blockSize || isZero(b[:blockSize]) {
+		return false
+	}
+	var blk block
+	copy(blk[:], b)
+	return blk.GetFormat() != formatUnknown
+}
+
+// plausibleHeader reports whether rp.blk, which has an invalid checksum,
+// is likely to be a damaged header block rather than some other data.
+func (rp *repairer) plausibleHeader() bool {
+	magic := string(rp.blk.USTAR().Magic())
+	if magic == magicUSTAR || magic == magicGNU {
+		return true
+	}
+	var p parser
+	v7 := rp.blk.V7()
+	p.parseOctal(v7.Mode())
+	p.parseOctal(v7.Size())
+	p.parseOctal(v7.ModTime())
+	return p.err == nil && v7.Name()[0] != 0
+}
+
+// name returns the name of the entry with the header in rp.blk, ignoring any
+// extended headers, for describing fixes.
+func (rp *repairer) name() string {
+	var p parser
+	name := p.parseString(rp.blk.V7().Name())
+	if string(rp.blk.USTAR().Magic()) == magicUSTAR && string(rp.blk.STAR().Trailer()) != trailerSTAR {
+		if prefix := p.parseString(rp.blk.USTAR().Prefix()); prefix != "" {
+			name = path.Join(prefix, name)
+		}
+	}
+	return name
+}
+
+func (rp *repairer) writeTrailer() error {
+	_, err := rp.w.Write(zeroBlock[:])
+	if err == nil {
+		_, err = rp.w.Write(zeroBlock[:])
+	}
+	return err
+}
+
+// isZero reports whether b consists entirely of zeros.
+func isZero(b []byte) bool {
+	return bytes.Equal(b, zeroBlock[:len(b)])
+}
+
+// zeroReader reads an endless stream of zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(b []byte) (int, error) {
+	for i := range b {
+		b[i] = 0
+	}
+	return len(b), nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// A ReproIssue describes a property of an entry that depends on when,
+// where, or by whom an archive was created, rather than only on the files
+// that it holds, such that building it again yields a different archive.
+type ReproIssue struct {
+	Name   string // Name of the entry
+	Field  string // Name of the Header field or PAX record
+	Reason string // Description of the issue
+}
+
+func (i ReproIssue) String() string {
+	return fmt.Sprintf("%s: %s: %s", i.Name, i.Field, i.Reason)
+}
+
+// volatileRecords are the keys of PAX records whose values describe the
+// file system from which an archive was created.
+var volatileRecords = []string{
+	"LIBARCHIVE.creationtime",
+	"SCHILY.dev", "SCHILY.ino", "SCHILY.nlink",
+}
+
+// CheckReproducible reads the tar archive from r and reports why it would
+// differ if it were created again from the same files, in the order of
+// the entries. The issues reported are:
+//
+//	- modification times other than the Unix epoch, and any access and
+//	  change times, which are not clamped
+//	- user and group IDs and names other than zero and empty
+//	- entries whose names sort before that of the preceding entry
+//	- PAX records of local or global headers that describe the source
+//	  file system, such as SCHILY.ino, and extended headers whose names
+//	  hold a process ID, as GNU tar writes by default
+//
+// Name order is not required for an archive to be reproducible, but
+// archivers that list directories in the order of the file system
+// produce a different order on different systems.
+func CheckReproducible(r io.Reader) ([]ReproIssue, error) {
+	var issues []ReproIssue
+	var prev string
+	tr := NewReader(r)
+	tr.AllowInsecurePaths = true // Names are only reported
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return issues, nil
+		}
+		if err != nil {
+			return issues, err
+		}
+		report := func(field, reason string) {
+			issues = append(issues, ReproIssue{hdr.Name, field, reason})
+		}
+
+		for _, k := range volatileRecords {
+			v, ok := hdr.PAXRecords[k]
+			if g, global := tr.globals[k]; ok && (!global || g != v || hdr.Typeflag == TypeXGlobalHeader) {
+				report(k, "PAX record describes the source file system")
+			}
+		}
+		if hdr.Typeflag == TypeXGlobalHeader {
+			continue
+		}
+		if raw := tr.rawHdrs.Bytes(); len(raw) >= blockSize {
+			var p parser
+			var blk block
+			copy(blk[:], raw)
+			name := p.parseString(blk.V7().Name())
+			if typ := blk.V7().TypeFlag()[0]; (typ == TypeXHeader || typ == typeXHeaderOld) && hasProcessID(name) {
+				report("Typeflag", "extended header name holds a process ID")
+			}
+		}
+
+		if hdr.ModTime.Unix() != 0 || hdr.ModTime.Nanosecond() != 0 {
+			report("ModTime", "modification time is not the Unix epoch")
+		}
+		if !hdr.AccessTime.IsZero() {
+			report("AccessTime", "access time is set")
+		}
+		if !hdr.ChangeTime.IsZero() {
+			report("ChangeTime", "change time is set")
+		}
+		if hdr.Uid64() != 0 || hdr.Gid64() != 0 {
+			report("Uid", "user or group ID is not zero")
+		}
+		if hdr.Uname != "" || hdr.Gname != "" {
+			report("Uname", "user or group name is set")
+		}
+		if hdr.Name < prev {
+			report("Name", fmt.Sprintf("entry follows %q, which sorts after it", prev))
+		}
+		prev = hdr.Name
+	}
+}
+
+// hasProcessID reports whether name, the name of an extended header, has
+// an element of the form "PaxHeaders.N" for a positive process ID N.
+func hasProcessID(name string) bool {
+	for _, elem := range strings.Split(name, "/") {
+		pid := strings.TrimPrefix(elem, "PaxHeaders.")
+		if pid == elem || pid == "" || pid == "0" {
+			continue
+		}
+		if strings.Trim(pid, "0123456789") == "" {
+			return true
+		}
+	}
+	return false
+}
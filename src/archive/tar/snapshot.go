@@ -0,0 +1,203 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A Snapshot is the state of a GNU tar listed-incremental backup, as stored
+// in a snapshot file (conventionally with a ".snar" extension) by the
+// --listed-incremental option of GNU tar. It records the directories seen by
+// the backup so that later backups only need to archive what has changed.
+//
+// Only version 2 of the snapshot format, which is used by GNU tar 1.16 and
+// later, is supported.
+type Snapshot struct {
+	Version string    // Version of GNU tar that wrote the snapshot; "1.16" if empty
+	Time    time.Time // Time at which the backup began
+	Dirs    []SnapshotDir
+}
+
+// A SnapshotDir records a directory in a Snapshot.
+type SnapshotDir struct {
+	NFS      bool      // Whether the directory is on an NFS file system
+	ModTime  time.Time // Modification time of the directory
+	Dev, Ino uint64    // Device and inode number of the directory
+	Name     string    // Name of the directory
+	Contents []DumpDirEntry
+}
+
+// A DumpDirEntry is an entry of the contents of a directory, as recorded in
+// a SnapshotDir or in the data of a TypeGNUDumpDir entry.
+//
+// The Kind is one of:
+//
+//	'Y'  file that is contained in the archive
+//	'N'  file that is not contained in the archive
+//	'D'  subdirectory
+//	'R'  original name of a renamed directory
+//	'T'  new name of a renamed directory, following its 'R' entry
+//	'X'  name of a temporary directory used during extraction
+type DumpDirEntry struct {
+	Kind byte
+	Name string
+}
+
+const snapshotVersion = "2" // Version of the snapshot format
+
+// ReadSnapshot reads a snapshot file from r.
+// It reports ErrSnapshot if the snapshot is malformed or of an unsupported
+// version.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	br := bufio.NewReader(r)
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, ErrSnapshot
+	}
+	line = strings.TrimSuffix(strings.TrimPrefix(line, "GNU tar-"), "\n")
+	i := strings.LastIndexByte(line, '-')
+	if i < 0 || line[i+1:] != snapshotVersion {
+		return nil, ErrSnapshot
+	}
+	s := &Snapshot{Version: line[:i]}
+
+	var fieldErr error
+	field := func() string {
+		f, err := br.ReadString(0)
+		if err != nil && fieldErr == nil {
+			fieldErr = ErrSnapshot
+		}
+		return strings.TrimSuffix(f, "\x00")
+	}
+	number := func() uint64 {
+		n, err := strconv.ParseUint(field(), 10, 64)
+		if err != nil && fieldErr == nil {
+			fieldErr = ErrSnapshot
+		}
+		return n
+	}
+	timestamp := func() time.Time {
+		sec, nsec := number(), number()
+		if nsec >= 1e9 && fieldErr == nil {
+			fieldErr = ErrSnapshot
+		}
+		return time.Unix(int64(sec), int64(nsec))
+	}
+
+	s.Time = timestamp()
+	for fieldErr == nil {
+		if _, err := br.Peek(1); err == io.EOF {
+			break
+		}
+		var d SnapshotDir
+		switch field() {
+		case "0":
+		case "1":
+			d.NFS = true
+		default:
+			return nil, ErrSnapshot
+		}
+		d.ModTime = timestamp()
+		d.Dev, d.Ino = number(), number()
+		d.Name = field()
+		for f := field(); f != "" && fieldErr == nil; f = field() {
+			d.Contents = append(d.Contents, DumpDirEntry{f[0], f[1:]})
+		}
+		if field() != "" { // Record terminator
+			return nil, ErrSnapshot
+		}
+		s.Dirs = append(s.Dirs, d)
+	}
+	if fieldErr != nil {
+		return nil, fieldErr
+	}
+	return s, nil
+}
+
+// WriteTo writes the snapshot to w in the format of a snapshot file.
+// It reports ErrSnapshot if the version or any name cannot be represented.
+func (s *Snapshot) WriteTo(w io.Writer) (int64, error) {
+	version := s.Version
+	if version == "" {
+		version = "1.16"
+	}
+	if strings.ContainsAny(version, "-\n") {
+		return 0, ErrSnapshot
+	}
+
+	var b bytes.Buffer
+	b.WriteString("GNU tar-" + version + "-" + snapshotVersion + "\n")
+	field := func(f string) {
+		b.WriteString(f)
+		b.WriteByte(0)
+	}
+	timestamp := func(t time.Time) {
+		field(strconv.FormatInt(t.Unix(), 10))
+		field(strconv.Itoa(t.Nanosecond()))
+	}
+
+	timestamp(s.Time)
+	for _, d := range s.Dirs {
+		if d.Name == "" || hasNUL(d.Name) {
+			return 0, ErrSnapshot
+		}
+		if d.NFS {
+			field("1")
+		} else {
+			field("0")
+		}
+		timestamp(d.ModTime)
+		field(strconv.FormatUint(d.Dev, 10))
+		field(strconv.FormatUint(d.Ino, 10))
+		field(d.Name)
+		contents, err := FormatDumpDir(d.Contents)
+		if err != nil {
+			return 0, err
+		}
+		b.Write(contents)
+		b.WriteByte(0) // Record terminator
+	}
+	return b.WriteTo(w)
+}
+
+// ParseDumpDir parses the contents of a directory from the data of a
+// TypeGNUDumpDir entry.
+// It reports ErrSnapshot if the data is malformed.
+func ParseDumpDir(b []byte) ([]DumpDirEntry, error) {
+	var entries []DumpDirEntry
+	for {
+		i := bytes.IndexByte(b, 0)
+		switch {
+		case i < 0:
+			return nil, ErrSnapshot
+		case i == 0:
+			return entries, nil // Terminating empty entry
+		}
+		entries = append(entries, DumpDirEntry{b[0], string(b[1:i])})
+		b = b[i+1:]
+	}
+}
+
+// FormatDumpDir formats the contents of a directory for use as the data of
+// a TypeGNUDumpDir entry.
+// It reports ErrSnapshot if any entry has an empty kind or a name with NUL.
+func FormatDumpDir(entries []DumpDirEntry) ([]byte, error) {
+	var b []byte
+	for _, e := range entries {
+		if e.Kind == 0 || hasNUL(e.Name) {
+			return nil, ErrSnapshot
+		}
+		b = append(b, e.Kind)
+		b = append(b, e.Name...)
+		b = append(b, 0)
+	}
+	return append(b, 0), nil
+}
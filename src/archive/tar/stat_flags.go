@@ -0,0 +1,39 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build darwin dragonfly freebsd netbsd openbsd
+
+package tar
+
+import (
+	"strings"
+	"syscall"
+)
+
+// fileFlags are the names of the BSD file flags, as used by chflags(1)
+// and bsdtar, with the values they have on all of the BSD systems.
+var fileFlags = []struct {
+	name string
+	bit  uint32
+}{
+	{"nodump", 0x00000001}, // UF_NODUMP
+	{"uchg", 0x00000002},   // UF_IMMUTABLE
+	{"uappnd", 0x00000004}, // UF_APPEND
+	{"opaque", 0x00000008}, // UF_OPAQUE
+	{"hidden", 0x00008000}, // UF_HIDDEN
+	{"arch", 0x00010000},   // SF_ARCHIVED
+	{"schg", 0x00020000},   // SF_IMMUTABLE
+	{"sappnd", 0x00040000}, // SF_APPEND
+	{"sunlnk", 0x00100000}, // SF_NOUNLINK
+}
+
+func statFlags(st *syscall.Stat_t) string {
+	var names []string
+	for _, f := range fileFlags {
+		if uint32(st.Flags)&f.bit != 0 {
+			names = append(names, f.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
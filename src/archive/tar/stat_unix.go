@@ -20,13 +20,14 @@ func statUnix(fi os.FileInfo, h *Header) error {
 	if !ok {
 		return nil
 	}
-	h.Uid = int(sys.Uid)
-	h.Gid = int(sys.Gid)
+	h.SetUid64(int64(sys.Uid))
+	h.SetGid64(int64(sys.Gid))
 	// TODO(bradfitz): populate username & group.  os/user
 	// doesn't cache LookupId lookups, and lacks group
 	// lookup functions.
 	h.AccessTime = statAtime(sys)
 	h.ChangeTime = statCtime(sys)
+	h.FileFlags = statFlags(sys)
 	// TODO(bradfitz): major/minor device numbers?
 	return nil
 }
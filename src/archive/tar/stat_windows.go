@@ -0,0 +1,21 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import "os"
+
+func init() {
+	sysStat = statWindows
+}
+
+// statWindows translates the separators in the target of a symbolic link
+// or junction point, both of which os.Lstat reports as os.ModeSymlink, so
+// that the link can be resolved on other systems.
+func statWindows(fi os.FileInfo, h *Header) error {
+	if h.Typeflag == TypeSymlink {
+		h.Linkname = windowsLinkname(h.Linkname)
+	}
+	return nil
+}
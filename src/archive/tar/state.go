@@ -0,0 +1,81 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"errors"
+	"fmt"
+)
+
+// A ReaderState is the position of a Reader within an archive, along with
+// the state that it needs to continue reading from there, as returned by
+// Reader.State. Its fields are exported so that it can be serialized, such
+// as with encoding/json, to continue reading a large archive after the
+// process is restarted.
+type ReaderState struct {
+	Offset    int64             // Offset in the archive of the next byte to be read
+	Name      string            // Name of the current entry
+	Remaining int64             // Number of bytes of data of the current entry that are unread
+	Pad       int64             // Number of bytes of padding that follow them
+	Index     int               // Number of entries returned by Next
+	Globals   map[string]string // Records from preceding global headers
+}
+
+// errBadState is returned by Reader.Restore for an invalid ReaderState.
+var errBadState = errors.New("tar: invalid reader state")
+
+// State returns the state of tr, from which a new Reader can continue
+// reading the archive, using Restore, as tr would.
+//
+// It reports an error if tr has encountered an error, including io.EOF at
+// the end of the archive, or if the data of the current entry is partially
+// read and is that of a sparse file, is being verified against a digest,
+// or is transformed by ContentTransform, since the state of such data
+// cannot be saved. Calling Next first avoids the latter.
+func (tr *Reader) State() (ReaderState, error) {
+	if tr.err != nil {
+		return ReaderState{}, fmt.Errorf("archive/tar: reader state cannot be saved: %v", tr.err)
+	}
+	nb := tr.numBytes()
+	if nb > 0 && (tr.curr != &tr.rfr || tr.digests != nil || tr.xr != nil) {
+		return ReaderState{}, fmt.Errorf("archive/tar: entry %q: reader state cannot be saved while its data is being read", tr.name)
+	}
+	return ReaderState{
+		Offset:    tr.nextOff - tr.pad - nb,
+		Name:      tr.name,
+		Remaining: nb,
+		Pad:       tr.pad,
+		Index:     tr.index,
+		Globals:   mergePAXRecords(nil, tr.globals),
+	}, nil
+}
+
+// Restore sets up tr, a new Reader on which Next has not been called, to
+// continue reading an archive from st, as returned by State. The io.Reader
+// passed to NewReader must be positioned at st.Offset in the archive, such
+// as by seeking, and the options of tr should be those of the Reader that
+// returned st. Any unread data of the current entry may then be read with
+// Read; there is no current header, and RawHeader and Section report none.
+func (tr *Reader) Restore(st ReaderState) error {
+	if tr.started || tr.err != nil {
+		return errors.New("archive/tar: Restore called on a Reader that is in use")
+	}
+	if st.Offset < 0 || st.Remaining < 0 || st.Pad < 0 || st.Index < 0 ||
+		st.Pad >= blockSize || (st.Offset+st.Remaining+st.Pad)%blockSize != 0 {
+		return errBadState
+	}
+	tr.start()
+	tr.name = st.Name
+	tr.pad = st.Pad
+	tr.rfr = regFileReader{r: tr.r, nb: st.Remaining}
+	tr.curr = &tr.rfr
+	tr.hdrOff = st.Offset
+	tr.dataEnd = st.Offset + st.Remaining
+	tr.nextOff = tr.dataEnd + tr.pad
+	tr.rawNB = st.Remaining
+	tr.index = st.Index
+	tr.globals = mergePAXRecords(nil, st.Globals)
+	return nil
+}
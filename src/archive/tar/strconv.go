@@ -17,6 +17,53 @@ func hasNUL(s string) bool {
 	return strings.IndexByte(s, 0) >= 0
 }
 
+// urlEncode percent-encodes the bytes of s that are not printable ASCII
+// characters, as well as '%' and '=', as done for the names in
+// LIBARCHIVE.xattr records.
+func urlEncode(s string) string {
+	const hex = "0123456789ABCDEF"
+	var b []byte
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c > '~' || c == '%' || c == '=' {
+			if b == nil {
+				b = append(b, s[:i]...)
+			}
+			b = append(b, '%', hex[c>>4], hex[c&0xf])
+		} else if b != nil {
+			b = append(b, c)
+		}
+	}
+	if b == nil {
+		return s
+	}
+	return string(b)
+}
+
+// urlDecode decodes the percent-encoding of s, reporting false if
+// it is malformed.
+func urlDecode(s string) (string, bool) {
+	if strings.IndexByte(s, '%') < 0 {
+		return s, true
+	}
+	b := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		if s[i] != '%' {
+			b = append(b, s[i])
+			continue
+		}
+		if i+2 >= len(s) {
+			return "", false
+		}
+		c, err := strconv.ParseUint(s[i+1:i+3], 16, 8)
+		if err != nil {
+			return "", false
+		}
+		b = append(b, byte(c))
+		i += 2
+	}
+	return string(b), true
+}
+
 // isASCII reports whether the input is an ASCII C-style string.
 func isASCII(s string) bool {
 	for _, c := range s {
@@ -52,7 +99,7 @@ type formatter struct {
 
 // parseString parses bytes as a NUL-terminated C-style string.
 // If a NUL byte is not found then the whole slice is returned as a string.
-func (*parser) parseString(b []byte) string {
+func (p *parser) parseString(b []byte) string {
 	if i := bytes.IndexByte(b, 0); i >= 0 {
 		return string(b[:i])
 	}
@@ -153,14 +200,30 @@ func (p *parser) parseOctal(b []byte) int64 {
 	// spaces or NULs.
 	// So we remove leading and trailing NULs and spaces to
 	// be sure.
-	b = bytes.Trim(b, " \x00")
+	// We do so by hand, since bytes.Trim allocates.
+	for len(b) > 0 && (b[0] == ' ' || b[0] == 0) {
+		b = b[1:]
+	}
+	for len(b) > 0 && (b[len(b)-1] == ' ' || b[len(b)-1] == 0) {
+		b = b[:len(b)-1]
+	}
 
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i] // Treat as a NUL-terminated string
+	}
 	if len(b) == 0 {
 		return 0
 	}
-	x, perr := strconv.ParseUint(p.parseString(b), 8, 64)
-	if perr != nil {
-		p.err = ErrHeader
+
+	// Parse the digits directly, rather than with strconv.ParseUint,
+	// to avoid allocating a string for every field of every header.
+	var x uint64
+	for _, c := range b {
+		if c < '0' || c > '7' || x>>61 > 0 {
+			p.err = ErrHeader // Invalid digit or integer overflow
+			return 0
+		}
+		x = x<<3 | uint64(c-'0')
 	}
 	return int64(x)
 }
@@ -171,12 +234,30 @@ func (f *formatter) formatOctal(b []byte, x int64) {
 		f.err = ErrFieldTooLong
 	}
 
-	s := strconv.FormatInt(x, 8)
+	// Format the digits from the least significant one.
+	var buf [22]byte // Enough for the octal digits of any int64
+	i := len(buf)
+	for u := uint64(x); ; u >>= 3 {
+		i--
+		buf[i] = '0' + byte(u&7)
+		if u < 8 {
+			break
+		}
+	}
+	digits := buf[i:]
+
 	// Add leading zeros, but leave room for a NUL.
-	if n := len(b) - len(s) - 1; n > 0 {
-		s = strings.Repeat("0", n) + s
+	n := len(b) - 1
+	if n < len(digits) {
+		n = len(digits)
+	}
+	for i := range b[:n-len(digits)] {
+		b[i] = '0'
+	}
+	copy(b[n-len(digits):], digits)
+	if n < len(b) {
+		b[n] = 0
 	}
-	f.formatString(b, s)
 }
 
 // fitsInOctal reports whether the integer x fits in a field n-bytes long
@@ -189,12 +270,18 @@ func fitsInOctal(n int, x int64) bool {
 // parsePAXTime takes a string of the form %d.%d as described in the PAX
 // specification. Note that this implementation allows for negative timestamps,
 // which is allowed for by the PAX specification, but not always portable.
+//
+// Some deviations seen from other producers are tolerated: sub-second
+// digits beyond nanosecond precision are truncated, surrounding spaces and
+// NULs are ignored, and a comma may separate the sub-seconds, as written by
+// producers that format the value according to the locale.
 func parsePAXTime(s string) (time.Time, error) {
 	const maxNanoSecondDigits = 9
 
 	// Split string into seconds and sub-seconds parts.
+	s = strings.Trim(s, " \t\x00")
 	ss, sn := s, ""
-	if pos := strings.IndexByte(s, '.'); pos >= 0 {
+	if pos := strings.IndexAny(s, ".,"); pos >= 0 {
 		ss, sn = s[:pos], s[pos+1:]
 	}
 
@@ -243,8 +330,9 @@ func formatPAXTime(ts time.Time) (s string) {
 
 // parsePAXRecord parses the input PAX record string into a key-value pair.
 // If parsing is successful, it will slice off the currently read record and
-// return the remainder as r.
-func parsePAXRecord(s string) (k, v, r string, err error) {
+// return the remainder as r. If trimNUL is set, trailing NULs are removed
+// from the values of records that may not contain NULs, such as path.
+func parsePAXRecord(s string, trimNUL bool) (k, v, r string, err error) {
 	// The size field ends at the first space.
 	sp := strings.IndexByte(s, ' ')
 	if sp == -1 {
@@ -270,6 +358,9 @@ func parsePAXRecord(s string) (k, v, r string, err error) {
 	}
 	k, v = rec[:eq], rec[eq+1:]
 
+	if trimNUL && (k == paxPath || k == paxLinkpath || k == paxUname || k == paxGname) {
+		v = strings.TrimRight(v, "\x00")
+	}
 	if !validPAXRecord(k, v) {
 		return "", "", s, ErrHeader
 	}
@@ -5,6 +5,7 @@
 package tar
 
 import (
+	"internal/race"
 	"math"
 	"strings"
 	"testing"
@@ -275,6 +276,12 @@ func TestParsePAXTime(t *testing.T) {
 		{"\x00", time.Time{}, false},
 		{"𝟵𝟴𝟳𝟲𝟱.𝟰𝟯𝟮𝟭𝟬", time.Time{}, false}, // Unicode numbers (U+1D7EC to U+1D7F5)
 		{"98765﹒43210", time.Time{}, false}, // Unicode period (U+FE52)
+		{"1350244992.0239601089123456789", time.Unix(1350244992, 23960108), true},
+		{" 1350244992.3\x00", time.Unix(1350244992, 300000000), true},
+		{"1350244992,3", time.Unix(1350244992, 300000000), true},
+		{"-1,5", time.Unix(-1, -5e8), true},
+		{"1.2,3", time.Time{}, false},
+		{"1 2", time.Time{}, false},
 	}
 
 	for _, v := range vectors {
@@ -371,7 +378,7 @@ func TestParsePAXRecord(t *testing.T) {
 	}
 
 	for _, v := range vectors {
-		key, val, res, err := parsePAXRecord(v.in)
+		key, val, res, err := parsePAXRecord(v.in, false)
 		ok := (err == nil)
 		if ok != v.ok {
 			if v.ok {
@@ -432,3 +439,28 @@ func TestFormatPAXRecord(t *testing.T) {
 		}
 	}
 }
+
+func TestNumericAllocs(t *testing.T) {
+	switch {
+	case testing.Short():
+		t.Skip("skipping malloc count in short mode")
+	case race.Enabled:
+		t.Skip("skipping malloc count under race detector")
+	}
+	var blk block
+	fields := [][]byte{blk.V7().Mode(), blk.V7().Size(), blk.V7().ModTime(), blk.GNU().AccessTime()}
+	allocs := testing.AllocsPerRun(100, func() {
+		var f formatter
+		var p parser
+		for i, b := range fields {
+			f.formatNumeric(b, int64(01234567)<<uint(8*i))
+			p.parseNumeric(b)
+		}
+		if f.err != nil || p.err != nil {
+			t.Fatalf("unexpected errors: %v, %v", f.err, p.err)
+		}
+	})
+	if allocs > 0 {
+		t.Errorf("got %v allocs, want 0", allocs)
+	}
+}
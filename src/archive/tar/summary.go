@@ -0,0 +1,103 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"io"
+	"sort"
+)
+
+// A Summary describes the contents of a tar archive, as computed by Summarize.
+type Summary struct {
+	Entries       int            // Number of entries, excluding global headers
+	GlobalHeaders int            // Number of global headers (TypeXGlobalHeader)
+	Types         map[byte]int   // Number of entries of each type flag
+	Formats       map[string]int // Number of entries encoded in each format
+	DataSize      int64          // Total size of the data of all entries
+
+	Largest      []*Header // Headers of the largest entries, largest first
+	LongestNames []string  // Longest entry names, longest first
+
+	Sparse bool // Some entries are sparse files
+	Xattrs bool // Some entries have extended attributes
+	PAX    bool // Some entries have PAX records, or there are global headers
+}
+
+// Summarize reads the tar archive from r in a single pass and returns
+// a Summary of its contents, in which the n largest entries and the n
+// longest names are retained.
+//
+// The formats of entries are counted under the names "V7", "USTAR", "PAX",
+// "GNU", and "STAR", where entries with an extended header count as "PAX".
+// The DataSize of sparse files is their logical size, which includes holes.
+func Summarize(r io.Reader, n int) (*Summary, error) {
+	s := &Summary{Types: make(map[byte]int), Formats: make(map[string]int)}
+	tr := NewReader(r)
+	tr.AllowInsecurePaths = true // Names are only reported
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return s, nil
+		}
+		if err != nil {
+			return s, err
+		}
+		if hdr.Typeflag == TypeXGlobalHeader {
+			s.GlobalHeaders++
+			s.PAX = true
+			continue
+		}
+
+		s.Entries++
+		s.Types[hdr.Typeflag]++
+		s.Formats[formatName(tr.format)]++
+		if !isHeaderOnlyType(hdr.Typeflag) {
+			s.DataSize += hdr.Size
+		}
+		if _, ok := tr.curr.(*sparseFileReader); ok {
+			s.Sparse = true
+		}
+		if len(hdr.Xattrs) > 0 {
+			s.Xattrs = true
+		}
+		if len(hdr.PAXRecords) > 0 {
+			s.PAX = true
+		}
+
+		if i := sort.Search(len(s.Largest), func(i int) bool { return s.Largest[i].Size < hdr.Size }); i < n {
+			s.Largest = append(s.Largest, nil)
+			copy(s.Largest[i+1:], s.Largest[i:])
+			s.Largest[i] = hdr
+			if len(s.Largest) > n {
+				s.Largest = s.Largest[:n]
+			}
+		}
+		if i := sort.Search(len(s.LongestNames), func(i int) bool { return len(s.LongestNames[i]) < len(hdr.Name) }); i < n {
+			s.LongestNames = append(s.LongestNames, "")
+			copy(s.LongestNames[i+1:], s.LongestNames[i:])
+			s.LongestNames[i] = hdr.Name
+			if len(s.LongestNames) > n {
+				s.LongestNames = s.LongestNames[:n]
+			}
+		}
+	}
+}
+
+// formatName returns the name of the format of an entry as reported in
+// Summary.Formats.
+func formatName(format int) string {
+	switch {
+	case format&formatPAX > 0:
+		return "PAX"
+	case format&formatGNU > 0:
+		return "GNU"
+	case format&formatSTAR > 0:
+		return "STAR"
+	case format&formatUSTAR > 0:
+		return "USTAR"
+	default:
+		return "V7"
+	}
+}
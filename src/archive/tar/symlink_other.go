@@ -0,0 +1,18 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !windows
+
+package tar
+
+import (
+	"errors"
+	"os"
+)
+
+func symlinkNotPermitted(err error) bool { return os.IsPermission(err) }
+
+func createJunction(link, target string) error {
+	return &os.LinkError{Op: "junction", Old: target, New: link, Err: errors.New("not supported")}
+}
@@ -0,0 +1,79 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	fsctlSetReparsePoint   = 0x000900A4
+	ioReparseTagMountPoint = 0xA0000003
+)
+
+// symlinkNotPermitted reports whether err is the result of creating a
+// symbolic link without the privilege to do so.
+func symlinkNotPermitted(err error) bool {
+	if le, ok := err.(*os.LinkError); ok {
+		err = le.Err
+	}
+	return err == syscall.ERROR_PRIVILEGE_NOT_HELD || os.IsPermission(err)
+}
+
+// createJunction creates a junction point at link to the directory target.
+func createJunction(link, target string) error {
+	target, err := filepath.Abs(target)
+	if err != nil {
+		return &os.LinkError{Op: "junction", Old: target, New: link, Err: err}
+	}
+	// The REPARSE_DATA_BUFFER of a mount point holds the NT name of the
+	// target, followed by its name for display, each NUL-terminated.
+	subst, err := syscall.UTF16FromString(`\??\` + target)
+	if err != nil {
+		return &os.LinkError{Op: "junction", Old: target, New: link, Err: err}
+	}
+	display, err := syscall.UTF16FromString(target)
+	if err != nil {
+		return &os.LinkError{Op: "junction", Old: target, New: link, Err: err}
+	}
+	// The header holds the tag and the length of the data that follows,
+	// which starts with the offsets and lengths in bytes of both names.
+	buf := []uint16{
+		ioReparseTagMountPoint & 0xffff, ioReparseTagMountPoint >> 16,
+		uint16(8 + 2*len(subst) + 2*len(display)), 0,
+		0, uint16(2 * (len(subst) - 1)), uint16(2 * len(subst)), uint16(2 * (len(display) - 1)),
+	}
+	buf = append(buf, subst...)
+	buf = append(buf, display...)
+
+	if err := os.Mkdir(link, 0777); err != nil {
+		return err
+	}
+	if err := setReparsePoint(link, buf); err != nil {
+		os.Remove(link)
+		return &os.LinkError{Op: "junction", Old: target, New: link, Err: err}
+	}
+	return nil
+}
+
+// setReparsePoint sets the reparse point of the directory name to the
+// REPARSE_DATA_BUFFER in buf.
+func setReparsePoint(name string, buf []uint16) error {
+	p, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return err
+	}
+	h, err := syscall.CreateFile(p, syscall.GENERIC_WRITE, 0, nil, syscall.OPEN_EXISTING,
+		syscall.FILE_FLAG_OPEN_REPARSE_POINT|syscall.FILE_FLAG_BACKUP_SEMANTICS, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.CloseHandle(h)
+	var n uint32
+	return syscall.DeviceIoControl(h, fsctlSetReparsePoint, (*byte)(unsafe.Pointer(&buf[0])), uint32(2*len(buf)), nil, 0, &n, nil)
+}
@@ -5,14 +5,25 @@
 package tar
 
 import (
+	"archive/zip"
 	"bytes"
+	"compress/gzip"
+	_ "crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/fnv"
 	"internal/testenv"
+	"io"
 	"io/ioutil"
 	"math"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -45,6 +56,46 @@ func TestFileInfoHeader(t *testing.T) {
 	}
 }
 
+type fileInfoNames struct {
+	os.FileInfo
+	uname, gname string
+	err          error
+}
+
+func (fi fileInfoNames) Uname() (string, error) { return fi.uname, fi.err }
+func (fi fileInfoNames) Gname() (string, error) { return fi.gname, fi.err }
+
+func TestFileInfoHeaderNames(t *testing.T) {
+	fi, err := os.Stat("testdata/small.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := FileInfoHeader(fileInfoNames{fi, "gopher", "golang", nil}, "")
+	if err != nil {
+		t.Fatalf("FileInfoHeader: %v", err)
+	}
+	if h.Uname != "gopher" || h.Gname != "golang" {
+		t.Errorf("names = (%q, %q); want (%q, %q)", h.Uname, h.Gname, "gopher", "golang")
+	}
+	if g, e := h.Size, int64(5); g != e {
+		t.Errorf("Size = %v; want %v", g, e)
+	}
+
+	// The names take precedence over those of a Header.
+	fi = headerFileInfo{&Header{Name: "small.txt", Uname: "root", Gname: "wheel"}}
+	if h, err = FileInfoHeader(fileInfoNames{fi, "gopher", "golang", nil}, ""); err != nil {
+		t.Fatalf("FileInfoHeader: %v", err)
+	}
+	if h.Uname != "gopher" || h.Gname != "golang" {
+		t.Errorf("names = (%q, %q); want (%q, %q)", h.Uname, h.Gname, "gopher", "golang")
+	}
+
+	errLookup := errors.New("lookup failed")
+	if _, err := FileInfoHeader(fileInfoNames{fi, "", "", errLookup}, ""); err != errLookup {
+		t.Errorf("FileInfoHeader = %v; want %v", err, errLookup)
+	}
+}
+
 func TestFileInfoHeaderDir(t *testing.T) {
 	fi, err := os.Stat("testdata")
 	if err != nil {
@@ -104,6 +155,22 @@ func TestFileInfoHeaderSymlink(t *testing.T) {
 	}
 }
 
+func TestWindowsLinkname(t *testing.T) {
+	vectors := []struct{ in, want string }{
+		{"file", "file"},
+		{`dir\file`, "dir/file"},
+		{`..\up\file`, "../up/file"},
+		{`C:\Users\gopher`, "C:/Users/gopher"},
+		{`\\server\share\dir`, "//server/share/dir"},
+		{"already/slashed", "already/slashed"},
+	}
+	for _, v := range vectors {
+		if got := windowsLinkname(v.in); got != v.want {
+			t.Errorf("windowsLinkname(%q) = %q, want %q", v.in, got, v.want)
+		}
+	}
+}
+
 func TestRoundTrip(t *testing.T) {
 	data := []byte("some file contents")
 
@@ -136,6 +203,7 @@ func TestRoundTrip(t *testing.T) {
 	if err != nil {
 		t.Fatalf("tr.Next: %v", err)
 	}
+	hdr.PAXRecords = map[string]string{paxUid: "2097152"}
 	if !reflect.DeepEqual(rHdr, hdr) {
 		t.Errorf("Header mismatch.\n got %+v\nwant %+v", rHdr, hdr)
 	}
@@ -148,6 +216,109 @@ func TestRoundTrip(t *testing.T) {
 	}
 }
 
+func TestHeaderID64(t *testing.T) {
+	const uid, gid = 1 << 40, 1<<33 + 7
+
+	hdr := &Header{Name: "file.txt"}
+	hdr.SetUid64(uid)
+	hdr.SetGid64(gid)
+	if got := hdr.Uid64(); got != uid {
+		t.Errorf("Uid64() = %d, want %d", got, int64(uid))
+	}
+	if got := hdr.Gid64(); got != gid {
+		t.Errorf("Gid64() = %d, want %d", got, int64(gid))
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("tw.WriteHeader: %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tw.Close: %v", err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte("uid=1099511627776\n")) {
+		t.Error("expected PAX record for the full uid")
+	}
+
+	rHdr, err := NewReader(&b).Next()
+	if err != nil {
+		t.Fatalf("tr.Next: %v", err)
+	}
+	if got := rHdr.Uid64(); got != uid {
+		t.Errorf("Uid64() = %d, want %d", got, int64(uid))
+	}
+	if got := rHdr.Gid64(); got != gid {
+		t.Errorf("Gid64() = %d, want %d", got, int64(gid))
+	}
+
+	// Directly modifying the fields takes precedence over prior values.
+	rHdr.Uid, rHdr.Gid = 5, 6
+	if got := rHdr.Uid64(); got != 5 {
+		t.Errorf("Uid64() = %d, want 5", got)
+	}
+	if got := rHdr.Gid64(); got != 6 {
+		t.Errorf("Gid64() = %d, want 6", got)
+	}
+}
+
+func TestGlobalHeader(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "hello", paxUname: "gopher"}); err != nil {
+		t.Fatalf("tw.WriteGlobalHeader: %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "a.txt", Typeflag: TypeReg}); err != nil {
+		t.Fatalf("tw.WriteHeader: %v", err)
+	}
+	// Records for keys that correspond to Header fields are ignored.
+	if err := tw.WriteHeader(&Header{Name: "b.txt", Typeflag: TypeReg, PAXRecords: map[string]string{paxUname: "rawr", "foo": "bar"}}); err != nil {
+		t.Fatalf("tw.WriteHeader: %v", err)
+	}
+	if err := tw.WriteGlobalHeader(map[string]string{paxUname: ""}); err != nil {
+		t.Fatalf("tw.WriteGlobalHeader: %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "c.txt", Typeflag: TypeReg}); err != nil {
+		t.Fatalf("tw.WriteHeader: %v", err)
+	}
+	if err := tw.WriteGlobalHeader(map[string]string{"bad=key": "value"}); err != ErrHeader {
+		t.Fatalf("tw.WriteGlobalHeader = %v, want %v", err, ErrHeader)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tw.Close: %v", err)
+	}
+
+	want := []struct {
+		typeflag byte
+		name     string
+		uname    string
+		records  map[string]string
+	}{
+		{TypeXGlobalHeader, globalHeaderName, "", map[string]string{"comment": "hello", paxUname: "gopher"}},
+		{TypeReg, "a.txt", "gopher", map[string]string{"comment": "hello", paxUname: "gopher"}},
+		{TypeReg, "b.txt", "gopher", map[string]string{"comment": "hello", paxUname: "gopher", "foo": "bar"}},
+		{TypeXGlobalHeader, globalHeaderName, "", map[string]string{paxUname: ""}},
+		{TypeReg, "c.txt", "", map[string]string{"comment": "hello"}},
+	}
+	tr := NewReader(&b)
+	for i, w := range want {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("entry %d, tr.Next: %v", i, err)
+		}
+		if hdr.Typeflag != w.typeflag || hdr.Name != w.name || hdr.Uname != w.uname {
+			t.Errorf("entry %d, got (%q, %q, %q), want (%q, %q, %q)",
+				i, hdr.Typeflag, hdr.Name, hdr.Uname, w.typeflag, w.name, w.uname)
+		}
+		if !reflect.DeepEqual(hdr.PAXRecords, w.records) {
+			t.Errorf("entry %d, PAXRecords = %v, want %v", i, hdr.PAXRecords, w.records)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Fatalf("tr.Next = %v, want %v", err, io.EOF)
+	}
+}
+
 type headerRoundTripTest struct {
 	h  *Header
 	fm os.FileMode
@@ -356,6 +527,15 @@ func TestHeaderAllowedFormats(t *testing.T) {
 	}{{
 		header:  &Header{},
 		formats: formatUSTAR | formatPAX | formatGNU,
+	}, {
+		header:  &Header{Typeflag: TypeGNUMultiVolume, VolumeOffset: 5},
+		formats: formatGNU,
+	}, {
+		header:  &Header{Typeflag: TypeGNUMultiVolume, VolumeOffset: 1 << 40},
+		formats: formatGNU,
+	}, {
+		header:  &Header{Typeflag: TypeReg, VolumeOffset: 5},
+		formats: formatUSTAR | formatPAX | formatGNU,
 	}, {
 		header:  &Header{Size: 077777777777},
 		formats: formatUSTAR | formatPAX | formatGNU,
@@ -438,13 +618,25 @@ func TestHeaderAllowedFormats(t *testing.T) {
 		header:  &Header{Xattrs: map[string]string{"foo": "bar"}},
 		paxHdrs: map[string]string{paxXattr + "foo": "bar"},
 		formats: formatPAX,
+	}, {
+		header:  &Header{FileFlags: "uchg,nodump"},
+		paxHdrs: map[string]string{paxFflags: "uchg,nodump"},
+		formats: formatPAX,
+	}, {
+		header:  &Header{PAXRecords: map[string]string{paxFflags: "uchg"}},
+		formats: formatUSTAR | formatPAX | formatGNU,
 	}, {
 		header:  &Header{Xattrs: map[string]string{"用戶名": "\x00hello"}},
 		paxHdrs: map[string]string{paxXattr + "用戶名": "\x00hello"},
 		formats: formatPAX,
 	}, {
 		header:  &Header{Xattrs: map[string]string{"foo=bar": "baz"}},
-		formats: formatUnknown,
+		paxHdrs: map[string]string{paxLibXattr + "foo%3Dbar": "YmF6"},
+		formats: formatPAX,
+	}, {
+		header:  &Header{Xattrs: map[string]string{"user.bin": "\xff\x00"}},
+		paxHdrs: map[string]string{paxXattr + "user.bin": "\xff\x00", paxLibXattr + "user.bin": "/wA"},
+		formats: formatPAX,
 	}, {
 		header:  &Header{Xattrs: map[string]string{"foo": ""}},
 		formats: formatUnknown,
@@ -482,6 +674,25 @@ func TestHeaderAllowedFormats(t *testing.T) {
 		header:  &Header{ChangeTime: time.Unix(123, 456)},
 		paxHdrs: map[string]string{paxCtime: "123.000000456"},
 		formats: formatPAX,
+	}, {
+		header:  &Header{PAXRecords: map[string]string{"comment": "hello"}},
+		paxHdrs: map[string]string{"comment": "hello"},
+		formats: formatPAX,
+	}, {
+		header:  &Header{PAXRecords: map[string]string{paxPath: "foo", paxGNUSparse + "size": "5"}},
+		formats: formatUSTAR | formatPAX | formatGNU,
+	}, {
+		header:  &Header{Name: "用戶名", PAXRecords: map[string]string{paxPath: "foo"}},
+		paxHdrs: map[string]string{paxPath: "用戶名"},
+		formats: formatPAX | formatGNU,
+	}, {
+		header:  &Header{Name: "hi\x80\x81bye", Linkname: "☺"},
+		paxHdrs: map[string]string{paxPath: "hi\x80\x81bye", paxLinkpath: "☺", paxHdrCharset: "BINARY"},
+		formats: formatPAX | formatGNU,
+	}, {
+		header:  &Header{Uname: "\xff", PAXRecords: map[string]string{paxHdrCharset: "ISO-8859-1"}},
+		paxHdrs: map[string]string{paxUname: "\xff", paxHdrCharset: "BINARY"},
+		formats: formatPAX | formatGNU,
 	}}
 
 	for i, v := range vectors {
@@ -494,3 +705,1987 @@ func TestHeaderAllowedFormats(t *testing.T) {
 		}
 	}
 }
+
+func TestProfileCheck(t *testing.T) {
+	type problem struct {
+		field string
+		fatal bool
+	}
+	vectors := []struct {
+		profile *Profile
+		header  *Header
+		want    []problem
+	}{{
+		profile: ProfileUSTAR,
+		header:  &Header{Name: "file.txt", Typeflag: TypeReg, Uid: 1000},
+	}, {
+		profile: ProfileUSTAR,
+		header:  &Header{Name: strings.Repeat("a", 256), Typeflag: TypeReg},
+		want:    []problem{{"Header", true}},
+	}, {
+		profile: ProfileUSTAR,
+		header:  &Header{Name: "文件", Typeflag: TypeReg},
+		want:    []problem{{"Header", true}, {"Name", false}},
+	}, {
+		profile: ProfileBusyBox,
+		header:  &Header{Name: "文件", Typeflag: TypeReg},
+	}, {
+		profile: ProfileBSDTar,
+		header:  &Header{Name: "../file", Typeflag: TypeReg},
+		want:    []problem{{"Name", true}},
+	}, {
+		profile: ProfileUSTAR,
+		header:  &Header{Name: "big", Typeflag: TypeReg, Size: 1 << 34},
+		want:    []problem{{"Header", true}},
+	}, {
+		profile: ProfileBusyBox,
+		header:  &Header{Name: "file", Typeflag: TypeReg, ModTime: time.Unix(0, 5), Xattrs: map[string]string{"user.key": "value"}},
+		want:    []problem{{"ModTime", false}, {"Xattrs", false}},
+	}, {
+		profile: ProfileBSDTar,
+		header:  &Header{Name: "file", Typeflag: TypeReg, ModTime: time.Unix(0, 5), Xattrs: map[string]string{"user.key": "value"}},
+	}, {
+		profile: Profile7Zip,
+		header:  &Header{Name: "link", Typeflag: TypeSymlink, Linkname: "file", Uname: "gopher"},
+		want:    []problem{{"Typeflag", true}, {"Uid", false}},
+	}, {
+		profile: Profile7Zip,
+		header:  &Header{Name: "dev", Typeflag: TypeChar, Devmajor: 1},
+		want:    []problem{{"Typeflag", true}},
+	}, {
+		profile: &Profile{GNU: true},
+		header:  &Header{Name: "file", Typeflag: TypeReg, PAXRecords: map[string]string{"GOLANG.key": "value"}},
+		want:    []problem{{"Header", true}},
+	}, {
+		profile: Profile7Zip,
+		header:  &Header{Name: "dir/con.txt", Typeflag: TypeReg},
+		want:    []problem{{"Name", true}},
+	}, {
+		profile: ProfileBSDTar,
+		header:  &Header{Name: "dir/con.txt", Typeflag: TypeReg},
+	}}
+
+	for i, v := range vectors {
+		var got []problem
+		for _, p := range v.profile.CheckHeader(v.header) {
+			if p.Name != v.header.Name {
+				t.Errorf("test %d, problem name = %q, want %q", i, p.Name, v.header.Name)
+			}
+			got = append(got, problem{p.Field, p.Fatal})
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("test %d, CheckHeader() = %v, want %v", i, got, v.want)
+		}
+	}
+}
+
+func TestProfileCheckArchive(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "hello"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	hdrs := []*Header{
+		{Name: "file", Typeflag: TypeReg},
+		{Name: "link", Typeflag: TypeLink, Linkname: "file"},
+		{Name: "文件", Typeflag: TypeReg},
+	}
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	probs, err := ProfileUSTAR.CheckArchive(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("CheckArchive() = %v, want nil", err)
+	}
+	var got []string
+	for _, p := range probs {
+		got = append(got, p.Name+":"+p.Field)
+	}
+	want := []string{
+		globalHeaderName + ":Typeflag",
+		"file:Header", // Inherits the global "comment" record
+		"link:Header",
+		"文件:Header",
+		"文件:Name",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("CheckArchive() = %q, want %q", got, want)
+	}
+
+	probs, err = ProfileBSDTar.CheckArchive(bytes.NewReader(b.Bytes()))
+	if len(probs) != 0 || err != nil {
+		t.Errorf("CheckArchive() = (%v, %v), want (nil, nil)", probs, err)
+	}
+
+	_, err = ProfileBSDTar.CheckArchive(bytes.NewReader(b.Bytes()[:blockSize+10]))
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("CheckArchive() = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	RegisterDigest("fnv64", func() hash.Hash { return fnv.New64() })
+	const data = "Hello, world!"
+
+	hdr := &Header{Name: "file", Typeflag: TypeReg, Size: int64(len(data))}
+	for _, name := range []string{"sha256", "fnv64"} {
+		if err := hdr.SetDigest(name, strings.NewReader(data)); err != nil {
+			t.Fatalf("SetDigest(%q) = %v", name, err)
+		}
+	}
+	if err := hdr.SetDigest("blake2b-256", strings.NewReader(data)); err != ErrDigestUnavailable {
+		t.Fatalf("SetDigest(%q) = %v, want %v", "blake2b-256", err, ErrDigestUnavailable)
+	}
+	if got, want := hdr.PAXRecords["GO.digest.sha256"], "315f5bdb76d078c43b8ac0064e4a0164612b1fce77c869345bfc94c75894edd3"; got != want {
+		t.Fatalf("sha256 record = %q, want %q", got, want)
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, data); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	read := func(archive []byte, verify bool) error {
+		tr := NewReader(bytes.NewReader(archive))
+		tr.VerifyDigests = verify
+		if _, err := tr.Next(); err != nil {
+			return err
+		}
+		_, err := ioutil.ReadAll(tr)
+		return err
+	}
+	if err := read(b.Bytes(), true); err != nil {
+		t.Errorf("read intact archive: %v", err)
+	}
+	corrupt := append([]byte(nil), b.Bytes()...)
+	i := bytes.Index(corrupt, []byte(data))
+	corrupt[i] = 'J'
+	if err := read(corrupt, true); err != ErrDigestMismatch {
+		t.Errorf("read corrupt archive: got %v, want %v", err, ErrDigestMismatch)
+	}
+	if err := read(corrupt, false); err != nil {
+		t.Errorf("read corrupt archive without VerifyDigests: %v", err)
+	}
+
+	// Detailed errors, and data that is skipped rather than read.
+	tr := NewReader(bytes.NewReader(corrupt))
+	tr.VerifyDigests, tr.DetailedErrors = true, true
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if _, err := tr.Read(make([]byte, 3)); err != nil {
+		t.Fatalf("Read() = %v", err)
+	}
+	_, err := tr.Next()
+	derr, ok := err.(*DigestError)
+	if !ok || derr.Name != "file" || derr.Algorithm != "fnv64" || len(derr.Got) != 8 || len(derr.Want) != 8 {
+		t.Fatalf("Next() = %v, want *DigestError for fnv64", err)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	entry := func(name, data string) []byte {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.OmitTrailer = true
+		if err := tw.WriteHeader(&Header{Name: name, Typeflag: TypeReg, Mode: 0644, Size: int64(len(data))}); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		return b.Bytes()
+	}
+	join := func(bs ...[]byte) []byte { return bytes.Join(bs, nil) }
+	trailer := zeroBlock[:]
+	zeros := func(n int) []byte { return make([]byte, n) }
+
+	a, b := entry("a", "Kilts"), entry("b", strings.Repeat("x", 600))
+	badChksum := append([]byte(nil), a...)
+	badChksum[100] = '1' // Mode is now 01644
+	badPadding := append([]byte(nil), a...)
+	badPadding[blockSize+10] = 'z'
+	noPadding := a[:blockSize+5]
+
+	vectors := []struct {
+		label string
+		input []byte
+		fixes []string // Reasons of the expected fixes
+		err   error
+		data  []string // Expected data of the entries in the output
+	}{{
+		label: "Intact",
+		input: join(a, b, trailer, trailer),
+		data:  []string{"Kilts", strings.Repeat("x", 600)},
+	}, {
+		label: "Damaged",
+		input: join(badChksum, trailer, b[:blockSize+100]),
+		fixes: []string{
+			"corrected header checksum",
+			"removed zero block between entries",
+			"filled truncated data with 500 zero bytes",
+			"completed truncated padding",
+			"added missing end-of-archive trailer",
+		},
+		data: []string{"Kilts", strings.Repeat("x", 100) + string(zeros(500))},
+	}, {
+		label: "Padding",
+		input: join(badPadding, noPadding, b, trailer[:100]),
+		fixes: []string{
+			"cleared non-zero padding",
+			"inserted missing padding",
+			"completed truncated end-of-archive trailer",
+		},
+		data: []string{"Kilts", "Kilts", strings.Repeat("x", 600)},
+	}, {
+		label: "Garbage",
+		input: join(a, bytes.Repeat([]byte{0xff}, blockSize)),
+		err:   ErrHeader,
+	}, {
+		label: "TruncatedHeader",
+		input: join(a, b[:100]),
+		err:   io.ErrUnexpectedEOF,
+	}}
+
+	for _, v := range vectors {
+		t.Run(v.label, func(t *testing.T) {
+			var out bytes.Buffer
+			fixes, err := Repair(&out, bytes.NewReader(v.input))
+			if err != v.err {
+				t.Fatalf("Repair() = %v, want %v", err, v.err)
+			}
+			var got []string
+			for _, f := range fixes {
+				got = append(got, f.Reason)
+			}
+			if !reflect.DeepEqual(got, v.fixes) {
+				t.Errorf("fixes = %q, want %q", got, v.fixes)
+			}
+			if v.err != nil {
+				return
+			}
+			if len(v.fixes) == 0 && !bytes.Equal(out.Bytes(), v.input) {
+				t.Errorf("output of intact archive differs from input")
+			}
+
+			tr := NewReader(&out)
+			var data []string
+			for {
+				_, err := tr.Next()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("Next() = %v", err)
+				}
+				b, err := ioutil.ReadAll(tr)
+				if err != nil {
+					t.Fatalf("ReadAll() = %v", err)
+				}
+				data = append(data, string(b))
+			}
+			if !reflect.DeepEqual(data, v.data) {
+				t.Errorf("data = %q, want %q", data, v.data)
+			}
+			if out.Len() != 0 {
+				t.Errorf("%d bytes follow the trailer", out.Len())
+			}
+		})
+	}
+}
+
+func TestSummarize(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "summary"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	longName := strings.Repeat("d", 120) // Too long for USTAR
+	for _, hdr := range []*Header{
+		{Name: "dir/", Typeflag: TypeDir},
+		{Name: "dir/small", Typeflag: TypeReg, Size: 5},
+		{Name: "dir/large", Typeflag: TypeReg, Size: 2000, Xattrs: map[string]string{"user.key": "value"}},
+		{Name: longName, Typeflag: TypeReg, Size: 100},
+		{Name: "link", Typeflag: TypeSymlink, Linkname: "dir/small"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%q) = %v", hdr.Name, err)
+		}
+		if _, err := tw.Write(make([]byte, hdr.Size)); err != nil {
+			t.Fatalf("Write() = %v", err)
+		}
+	}
+	if err := tw.WriteSparseHeader(&Header{Name: "sparse", Typeflag: TypeReg, Size: 1000}, []SparseEntry{{0, 10}}); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v", err)
+	}
+	if _, err := tw.Write(make([]byte, 10)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	s, err := Summarize(&b, 2)
+	if err != nil {
+		t.Fatalf("Summarize() = %v", err)
+	}
+	if s.Entries != 6 || s.GlobalHeaders != 1 {
+		t.Errorf("Entries, GlobalHeaders = %d, %d, want 6, 1", s.Entries, s.GlobalHeaders)
+	}
+	if want := map[byte]int{TypeDir: 1, TypeReg: 4, TypeSymlink: 1}; !reflect.DeepEqual(s.Types, want) {
+		t.Errorf("Types = %v, want %v", s.Types, want)
+	}
+	if want := map[string]int{"USTAR": 3, "PAX": 3}; !reflect.DeepEqual(s.Formats, want) {
+		t.Errorf("Formats = %v, want %v", s.Formats, want)
+	}
+	if got, want := s.DataSize, int64(5+2000+100+1000); got != want {
+		t.Errorf("DataSize = %d, want %d", got, want)
+	}
+	if len(s.Largest) != 2 || s.Largest[0].Name != "dir/large" || s.Largest[1].Name != "sparse" {
+		t.Errorf("Largest has unexpected entries")
+	}
+	if want := []string{longName, "dir/small"}; !reflect.DeepEqual(s.LongestNames, want) {
+		t.Errorf("LongestNames = %q, want %q", s.LongestNames, want)
+	}
+	if !s.Sparse || !s.Xattrs || !s.PAX {
+		t.Errorf("Sparse, Xattrs, PAX = %v, %v, %v, want all true", s.Sparse, s.Xattrs, s.PAX)
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	const input = "GNU tar-1.29-2\n" +
+		"1500000000\x00123\x00" +
+		"0\x001400000000\x000\x002049\x00131073\x00dir\x00Yfile\x00Dsub\x00Nold\x00\x00\x00" +
+		"1\x001400000001\x00500\x002049\x00131074\x00dir/sub\x00\x00\x00"
+	want := &Snapshot{
+		Version: "1.29",
+		Time:    time.Unix(1500000000, 123),
+		Dirs: []SnapshotDir{{
+			ModTime: time.Unix(1400000000, 0),
+			Dev:     2049,
+			Ino:     131073,
+			Name:    "dir",
+			Contents: []DumpDirEntry{
+				{'Y', "file"}, {'D', "sub"}, {'N', "old"},
+			},
+		}, {
+			NFS:     true,
+			ModTime: time.Unix(1400000001, 500),
+			Dev:     2049,
+			Ino:     131074,
+			Name:    "dir/sub",
+		}},
+	}
+
+	got, err := ReadSnapshot(strings.NewReader(input))
+	if err != nil {
+		t.Fatalf("ReadSnapshot() = %v", err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("ReadSnapshot() = %+v, want %+v", got, want)
+	}
+	var b bytes.Buffer
+	if _, err := got.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo() = %v", err)
+	}
+	if b.String() != input {
+		t.Errorf("WriteTo() wrote %q, want %q", b.String(), input)
+	}
+
+	for _, bad := range []string{
+		"",
+		"GNU tar-1.29-1\n1500000000\x000\x00",
+		"GNU tar-1.29-2\n1500000000\x00",
+		"GNU tar-1.29-2\n1500000000\x000\x002\x00",
+		"GNU tar-1.29-2\n1500000000\x000\x000\x000\x000\x000\x000\x00dir\x00\x00",
+	} {
+		if _, err := ReadSnapshot(strings.NewReader(bad)); err != ErrSnapshot {
+			t.Errorf("ReadSnapshot(%q) = %v, want %v", bad, err, ErrSnapshot)
+		}
+	}
+
+	// Dumpdir entries hold the contents of a directory in the archive.
+	contents := want.Dirs[0].Contents
+	data, err := FormatDumpDir(contents)
+	if err != nil {
+		t.Fatalf("FormatDumpDir() = %v", err)
+	}
+	b.Reset()
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "dir/", Typeflag: TypeGNUDumpDir, Size: int64(len(data))}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := tw.Write(data); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	var blk block
+	copy(blk[:], b.Bytes())
+	if format := blk.GetFormat(); format != formatGNU {
+		t.Errorf("dumpdir entry written in format %d, want GNU", format)
+	}
+	tr := NewReader(&b)
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	data, err = ioutil.ReadAll(tr)
+	if err != nil {
+		t.Fatalf("ReadAll() = %v", err)
+	}
+	if got, err := ParseDumpDir(data); err != nil || !reflect.DeepEqual(got, contents) {
+		t.Errorf("ParseDumpDir() = (%v, %v), want (%v, nil)", got, err, contents)
+	}
+	if _, err := ParseDumpDir([]byte("Yfile")); err != ErrSnapshot {
+		t.Errorf("ParseDumpDir() = %v, want %v", err, ErrSnapshot)
+	}
+}
+
+func TestZipConversion(t *testing.T) {
+	mtime := time.Unix(1500000000, 123)
+	atime := time.Unix(1500000100, 0)
+	entries := []struct {
+		hdr  *Header
+		data string
+	}{
+		{&Header{Name: "dir/", Typeflag: TypeDir, Mode: 0755, ModTime: mtime}, ""},
+		{&Header{Name: "dir/file", Typeflag: TypeReg, Mode: 0640, Uid: 1000, Gid: 100, Uname: "gopher", ModTime: mtime, AccessTime: atime, Size: 5}, "hello"},
+		{&Header{Name: "dir/link", Typeflag: TypeSymlink, Mode: 0777, Linkname: "file", ModTime: mtime}, ""},
+		{&Header{Name: "dir/hard", Typeflag: TypeLink, Linkname: "dir/file", ModTime: mtime}, ""},
+	}
+	var tb bytes.Buffer
+	tw := NewWriter(&tb)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	var zb bytes.Buffer
+	zw := zip.NewWriter(&zb)
+	losses, err := ToZip(zw, NewReader(&tb))
+	if err != nil {
+		t.Fatalf("ToZip() = %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	// Set the archive comment in the end of central directory record,
+	// whose last field is the length of the comment that follows it.
+	comment := "comment"
+	binary.LittleEndian.PutUint16(zb.Bytes()[zb.Len()-2:], uint16(len(comment)))
+	zb.WriteString(comment)
+	wantLosses := []Loss{
+		{"dir/", "truncated times to whole seconds"},
+		{"dir/file", "dropped user and group names"},
+		{"dir/file", "truncated times to whole seconds"},
+		{"dir/link", "truncated times to whole seconds"},
+		{"dir/hard", "omitted hard link to dir/file"},
+	}
+	if !reflect.DeepEqual(losses, wantLosses) {
+		t.Errorf("ToZip() losses = %v, want %v", losses, wantLosses)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(zb.Bytes()), int64(zb.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader() = %v", err)
+	}
+	tb.Reset()
+	tw = NewWriter(&tb)
+	losses, err = FromZip(tw, zr)
+	if err != nil {
+		t.Fatalf("FromZip() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if want := []Loss{{"", "dropped archive comment"}}; !reflect.DeepEqual(losses, want) {
+		t.Errorf("FromZip() losses = %v, want %v", losses, want)
+	}
+
+	tr := NewReader(&tb)
+	for _, e := range entries[:3] {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		want := *e.hdr
+		want.Uname = ""
+		want.ModTime = mtime.Truncate(time.Second)
+		if got := hdr.FileInfo().Mode(); got != want.FileInfo().Mode() {
+			t.Errorf("%s: mode = %v, want %v", hdr.Name, got, want.FileInfo().Mode())
+		}
+		if hdr.Name != want.Name || hdr.Typeflag != want.Typeflag || hdr.Linkname != want.Linkname || hdr.Size != want.Size ||
+			hdr.Uid != want.Uid || hdr.Gid != want.Gid || !hdr.ModTime.Equal(want.ModTime) || !hdr.AccessTime.Equal(want.AccessTime) {
+			t.Errorf("Next() = %+v, want %+v", hdr, want)
+		}
+		if data, err := ioutil.ReadAll(tr); err != nil || string(data) != e.data {
+			t.Errorf("%s: data = (%q, %v), want %q", hdr.Name, data, err, e.data)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+}
+
+func TestCPIO(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	entries := []struct {
+		hdr  *Header
+		data string
+	}{
+		{&Header{Name: "dir/", Typeflag: TypeDir, Mode: 0755, ModTime: mtime}, ""},
+		{&Header{Name: "dir/file", Typeflag: TypeReg, Mode: 0640, Uid: 1000, Gid: 100, ModTime: mtime, Size: 5}, "hello"},
+		{&Header{Name: "dir/link", Typeflag: TypeSymlink, Mode: 0777, Linkname: "file", ModTime: mtime}, ""},
+		{&Header{Name: "dev/null", Typeflag: TypeChar, Mode: 0666, Devmajor: 1, Devminor: 3, ModTime: mtime}, ""},
+		{&Header{Name: "empty", Typeflag: TypeReg, Mode: 0600, ModTime: mtime}, ""},
+	}
+	var tb bytes.Buffer
+	tw := NewWriter(&tb)
+	for _, e := range entries {
+		if err := tw.WriteHeader(e.hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.WriteHeader(&Header{Name: "hard", Typeflag: TypeLink, Linkname: "dir/file"}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	var cb bytes.Buffer
+	cw := NewCPIOWriter(&cb)
+	losses, err := TarToCPIO(cw, NewReader(&tb))
+	if err != nil {
+		t.Fatalf("TarToCPIO() = %v", err)
+	}
+	if err := cw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if want := []Loss{{"hard", "omitted hard link to dir/file"}}; !reflect.DeepEqual(losses, want) {
+		t.Errorf("TarToCPIO() losses = %v, want %v", losses, want)
+	}
+	if cb.Len()%4 != 0 {
+		t.Errorf("cpio archive has size %d, want multiple of 4", cb.Len())
+	}
+	if !strings.HasPrefix(cb.String(), "07070100000001000041ED") {
+		t.Errorf("cpio archive begins with %q", cb.String()[:22])
+	}
+
+	tb.Reset()
+	tw = NewWriter(&tb)
+	if err := CPIOToTar(tw, NewCPIOReader(bytes.NewReader(cb.Bytes()))); err != nil {
+		t.Fatalf("CPIOToTar() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	tr := NewReader(&tb)
+	for _, e := range entries {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		want := e.hdr
+		if hdr.Name != want.Name || hdr.Typeflag != want.Typeflag || hdr.Linkname != want.Linkname || hdr.Size != want.Size ||
+			hdr.Mode&07777 != want.Mode || hdr.Uid != want.Uid || hdr.Gid != want.Gid || !hdr.ModTime.Equal(want.ModTime) ||
+			hdr.Devmajor != want.Devmajor || hdr.Devminor != want.Devminor {
+			t.Errorf("Next() = %+v, want %+v", hdr, want)
+		}
+		if data, err := ioutil.ReadAll(tr); err != nil || string(data) != e.data {
+			t.Errorf("%s: data = (%q, %v), want %q", hdr.Name, data, err, e.data)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+
+	// Hard links share an inode, with the data stored with the first link.
+	var hb bytes.Buffer
+	for _, e := range []struct {
+		name  string
+		ino   int
+		nlink int
+		data  string
+	}{{"a", 7, 2, "data"}, {"b", 7, 2, ""}, {cpioTrailer, 0, 1, ""}} {
+		fmt.Fprintf(&hb, "070701%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X%08X", e.ino, c_ISREG|0644, 0, 0, e.nlink, 0, len(e.data), 0, 0, 0, 0, len(e.name)+1, 0)
+		hb.WriteString(e.name)
+		hb.Write(zeroBlock[:1+(-(cpioHeaderSize+len(e.name)+1)&3)])
+		hb.WriteString(e.data)
+		hb.Write(zeroBlock[:-len(e.data)&3])
+	}
+	cr := NewCPIOReader(&hb)
+	if hdr, err := cr.Next(); err != nil || hdr.Typeflag != TypeReg || hdr.Size != 4 {
+		t.Fatalf("Next() = (%+v, %v), want regular file of size 4", hdr, err)
+	}
+	if hdr, err := cr.Next(); err != nil || hdr.Typeflag != TypeLink || hdr.Linkname != "a" {
+		t.Fatalf("Next() = (%+v, %v), want link to %q", hdr, err, "a")
+	}
+	if _, err := cr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+	if _, err := NewCPIOReader(strings.NewReader(cb.String()[:cb.Len()-200])).Next(); err != nil {
+		t.Errorf("Next() on truncated archive = %v, want nil for first entry", err)
+	}
+	cr = NewCPIOReader(strings.NewReader(cb.String()[:200]))
+	for err == nil {
+		_, err = cr.Next()
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("Next() on truncated archive = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+}
+
+func TestWriteLayerDiff(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestWriteLayerDiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	mtime := time.Unix(1500000000, 0)
+	for _, f := range []struct{ name, data string }{
+		{"base/a", "a"},
+		{"base/b", "b"},
+		{"base/d/x", "x"},
+		{"base/d/y", "y"},
+		{"base/e", "e"},
+		{"upper/a", "changed"},
+		{"upper/c", "c"},
+		{"upper/d/y", "y"},
+		{"upper/e/f", "f"},
+	} {
+		name := filepath.Join(tmpdir, filepath.FromSlash(f.name))
+		if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(name, []byte(f.data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(name, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"base/d", "upper/d"} {
+		if err := os.Chtimes(filepath.Join(tmpdir, dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := WriteLayerDiff(tw, filepath.Join(tmpdir, "base"), filepath.Join(tmpdir, "upper")); err != nil {
+		t.Fatalf("WriteLayerDiff() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	want := []string{".wh.b", "a: changed", "c: c", "d/.wh.x", "e/", "e/f: f"}
+	var got []string
+	tr := NewReader(&b)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil {
+			t.Fatalf("ReadAll() = %v", err)
+		}
+		if len(data) > 0 {
+			got = append(got, hdr.Name+": "+string(data))
+		} else {
+			got = append(got, hdr.Name)
+		}
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestApplyLayer(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestApplyLayer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	// Applying the difference between base and upper to a copy of base
+	// must result in upper.
+	mtime := time.Unix(1500000000, 0)
+	for _, f := range []struct{ name, data string }{
+		{"base/a", "a"},
+		{"base/b", "b"},
+		{"base/d/x", "x"},
+		{"base/d/y", "y"},
+		{"base/e", "e"},
+		{"base/g/h", "h"},
+		{"upper/a", "changed"},
+		{"upper/c", "c"},
+		{"upper/d/y", "y"},
+		{"upper/e/f", "f"},
+		{"upper/g/h", "h"},
+		{"upper/ro/file", "r"},
+	} {
+		for _, root := range []string{"", "target/"} {
+			if root != "" && !strings.HasPrefix(f.name, "base/") {
+				continue
+			}
+			name := filepath.Join(tmpdir, filepath.FromSlash(root+f.name))
+			if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(name, []byte(f.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			if err := os.Chtimes(name, mtime, mtime); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := os.Chmod(filepath.Join(tmpdir, "upper", "ro"), 0555); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(tmpdir, "upper", "ro"), 0755)
+	defer os.Chmod(filepath.Join(tmpdir, "target", "base", "ro"), 0755)
+	for _, dir := range []string{"base/d", "base/g", "upper/g", "upper/ro", "target/base/d", "target/base/g"} {
+		if err := os.Chtimes(filepath.Join(tmpdir, dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := WriteLayerDiff(tw, filepath.Join(tmpdir, "base"), filepath.Join(tmpdir, "upper")); err != nil {
+		t.Fatalf("WriteLayerDiff() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	target := filepath.Join(tmpdir, "target", "base")
+	if err := ApplyLayer(NewReader(&b), target); err != nil {
+		t.Fatalf("ApplyLayer() = %v", err)
+	}
+	b.Reset()
+	tw = NewWriter(&b)
+	if err := WriteLayerDiff(tw, target, filepath.Join(tmpdir, "upper")); err != nil {
+		t.Fatalf("WriteLayerDiff() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if hdr, err := NewReader(&b).Next(); err != io.EOF {
+		t.Errorf("applied layer differs from upper: Next() = (%+v, %v), want io.EOF", hdr, err)
+	}
+
+	// Opaque directories and whiteouts only delete the files of the lower
+	// layers, and hard links are linked to files within the directory.
+	b.Reset()
+	tw = NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "d/", Typeflag: TypeDir, Mode: 0755},
+		{Name: "d/z", Typeflag: TypeReg, Mode: 0644},
+		{Name: "d/" + WhiteoutOpaque, Typeflag: TypeReg},
+		{Name: "d/" + WhiteoutPrefix + "z", Typeflag: TypeReg},
+		{Name: "link", Typeflag: TypeLink, Linkname: "./a"},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if err := ApplyLayer(NewReader(&b), target); err != nil {
+		t.Fatalf("ApplyLayer() = %v", err)
+	}
+	if names, err := readDirNames(filepath.Join(target, "d")); err != nil || !reflect.DeepEqual(names, []string{"z"}) {
+		t.Errorf("opaque directory contains %q (%v), want only z", names, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(target, "link")); err != nil || string(data) != "changed" {
+		t.Errorf("hard link contains %q (%v), want %q", data, err, "changed")
+	}
+}
+
+func TestApplyLayerInsecure(t *testing.T) {
+	testenv.MustHaveSymlink(t)
+	tmpdir, err := ioutil.TempDir("", "TestApplyLayerInsecure")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	dir := filepath.Join(tmpdir, "dir")
+	outside := filepath.Join(tmpdir, "outside")
+	for _, d := range []string{dir, outside} {
+		if err := os.Mkdir(d, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := ioutil.WriteFile(filepath.Join(outside, "secret"), []byte("secret"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Symlink(outside, filepath.Join(dir, "evil")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, hdr := range []*Header{
+		{Name: "../escape", Typeflag: TypeReg},
+		{Name: "a/../../escape", Typeflag: TypeReg},
+		{Name: "evil/file", Typeflag: TypeReg},
+		{Name: "evil/" + WhiteoutPrefix + "secret", Typeflag: TypeReg},
+		{Name: "evil/" + WhiteoutOpaque, Typeflag: TypeReg},
+		{Name: WhiteoutPrefix, Typeflag: TypeReg},
+		{Name: "evil/" + WhiteoutPrefix, Typeflag: TypeReg},
+		{Name: "link", Typeflag: TypeLink, Linkname: "evil/secret"},
+		{Name: "link", Typeflag: TypeLink, Linkname: "../outside/secret"},
+	} {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		tr := NewReader(&b)
+		tr.AllowInsecurePaths = true
+		if err := ApplyLayer(tr, dir); err != ErrInsecurePath {
+			t.Errorf("ApplyLayer(%q -> %q) = %v, want %v", hdr.Name, hdr.Linkname, err, ErrInsecurePath)
+		}
+	}
+	if names, err := readDirNames(outside); err != nil || !reflect.DeepEqual(names, []string{"secret"}) {
+		t.Errorf("directory outside contains %q (%v), want only secret", names, err)
+	}
+	if _, err := os.Stat(filepath.Join(tmpdir, "escape")); !os.IsNotExist(err) {
+		t.Errorf("file written outside of the directory: %v", err)
+	}
+}
+
+func TestApplyLayerReplacedDir(t *testing.T) {
+	testenv.MustHaveSymlink(t)
+	tmpdir, err := ioutil.TempDir("", "TestApplyLayerReplacedDir")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	outside := filepath.Join(tmpdir, "outside")
+	if err := os.MkdirAll(filepath.Join(outside, "b"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// A directory entry replaced by a symbolic link, directly or through
+	// one of its parents, must not have its metadata applied to the target.
+	mtime := time.Unix(1000000000, 0)
+	for i, hdrs := range [][]*Header{{
+		{Name: "d/", Typeflag: TypeDir, Mode: 0700, ModTime: mtime},
+		{Name: "d", Typeflag: TypeSymlink, Linkname: outside},
+	}, {
+		{Name: "a/b/", Typeflag: TypeDir, Mode: 0700, ModTime: mtime},
+		{Name: WhiteoutPrefix + "a", Typeflag: TypeReg},
+		{Name: "a", Typeflag: TypeSymlink, Linkname: outside},
+	}} {
+		dir := filepath.Join(tmpdir, fmt.Sprintf("dir%d", i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("WriteHeader() = %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		if err := ApplyLayer(NewReader(&b), dir); err != nil {
+			t.Fatalf("test %d, ApplyLayer() = %v", i, err)
+		}
+		for _, p := range []string{outside, filepath.Join(outside, "b")} {
+			fi, err := os.Stat(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if fi.Mode().Perm() == 0700 || fi.ModTime().Equal(mtime) {
+				t.Errorf("test %d, metadata of %s changed to %v, %v", i, p, fi.Mode(), fi.ModTime())
+			}
+		}
+	}
+}
+
+func TestApplyLayerSymlinks(t *testing.T) {
+	defer func(f func(string, string) error) { symlink = f }(symlink)
+	symlink = func(oldname, newname string) error {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: os.ErrPermission}
+	}
+	tmpdir, err := ioutil.TempDir("", "TestApplyLayerSymlinks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	junction := "error" // Systems other than Windows have no junction points
+	if runtime.GOOS == "windows" {
+		junction = "junction"
+	}
+	vectors := []struct {
+		policy   SymlinkPolicy
+		name     string
+		linkname string
+		want     string // Either "error", "skipped", or "junction"
+	}{
+		{SymlinkCreate, "rel", "d", "error"},
+		{SymlinkSkip, "rel", "d", "skipped"},
+		{SymlinkSkip, "d/file-link", "file", "skipped"},
+		{SymlinkJunction, "rel", "d", junction},
+		{SymlinkJunction, "d/abs", "/d", junction},
+		{SymlinkJunction, "d/file-link", "file", "error"},
+		{SymlinkJunction, "d/missing", "missing", "error"},
+		{SymlinkJunction, "escape", "../..", "error"},
+	}
+	for i, v := range vectors {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		for _, hdr := range []*Header{
+			{Name: "d/", Typeflag: TypeDir, Mode: 0755},
+			{Name: "d/file", Typeflag: TypeReg, Mode: 0644, Size: 5},
+			{Name: v.name, Typeflag: TypeSymlink, Linkname: v.linkname},
+		} {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("WriteHeader() = %v", err)
+			}
+			io.WriteString(tw, strings.Repeat("x", int(hdr.Size)))
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+
+		dir := filepath.Join(tmpdir, fmt.Sprint(i))
+		if err := os.Mkdir(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		link := filepath.Join(dir, filepath.FromSlash(v.name))
+		err := ApplyLayerSymlinks(NewReader(&b), dir, v.policy)
+		var got string
+		if err != nil {
+			if !os.IsPermission(err) {
+				t.Errorf("test %d, ApplyLayerSymlinks() = %v, want permission error", i, err)
+			}
+			got = "error"
+		} else if _, err := os.Lstat(link); os.IsNotExist(err) {
+			got = "skipped"
+		} else if data, err := ioutil.ReadFile(filepath.Join(link, "file")); err == nil && string(data) == "xxxxx" {
+			got = "junction"
+		}
+		if got != v.want {
+			t.Errorf("test %d, %s -> %s with policy %d: got %q, want %q", i, v.name, v.linkname, v.policy, got, v.want)
+		}
+	}
+}
+
+func TestArchiverWriteFiles(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestArchiverWriteFiles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+
+	mtime := time.Unix(1500000000, 0)
+	var names []string
+	for i, size := range []int{0, 5, maxArchiverBuffer, maxArchiverBuffer + 1, 100, 3 * blockSize} {
+		name := fmt.Sprintf("d/file%d", i)
+		data := bytes.Repeat([]byte{byte('a' + i)}, size)
+		path := filepath.Join(tmpdir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, name)
+	}
+	if err := os.Chtimes(filepath.Join(tmpdir, "d"), mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	names = append([]string{"d"}, names...)
+
+	// The output must match that of writing each file in turn, except for
+	// the access times, which reading the files may change.
+	clearAtime := func(hdr *Header) error {
+		hdr.AccessTime = time.Time{}
+		delete(hdr.PAXRecords, "atime")
+		return nil
+	}
+	var want bytes.Buffer
+	tw := NewWriter(&want)
+	tw.HeaderHooks = []func(*Header) error{clearAtime}
+	for _, name := range names {
+		path := filepath.Join(tmpdir, filepath.FromSlash(name))
+		fi, err := os.Lstat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr, err := FileInfoHeader(fi, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		hdr.Name = strings.TrimSuffix(name, "/")
+		if fi.IsDir() {
+			hdr.Name += "/"
+		}
+		var data []byte
+		if !fi.IsDir() {
+			if data, err = ioutil.ReadFile(path); err != nil {
+				t.Fatal(err)
+			}
+			if err := hdr.SetDigest("sha256", bytes.NewReader(data)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.WriteFile(hdr, bytes.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, workers := range []int{0, 1, 3} {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.HeaderHooks = []func(*Header) error{clearAtime}
+		a := &Archiver{Workers: workers, Digest: "sha256"}
+		if err := a.WriteFiles(tw, tmpdir, names); err != nil {
+			t.Fatalf("Workers %d: WriteFiles() = %v", workers, err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Workers %d: Close() = %v", workers, err)
+		}
+		if !bytes.Equal(b.Bytes(), want.Bytes()) {
+			t.Errorf("Workers %d: output differs from writing each file in turn", workers)
+		}
+	}
+
+	later := mtime.Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(tmpdir, "d", "file4"), later, later); err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	a := &Archiver{Workers: 2, ModifiedAfter: mtime}
+	if err := a.WriteFiles(NewWriter(&b), tmpdir, names); err != nil {
+		t.Fatalf("WriteFiles() with ModifiedAfter = %v", err)
+	}
+	var got []string
+	for tr := NewReader(&b); ; {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		got = append(got, hdr.Name)
+	}
+	if want := []string{"d/", "d/file4"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("WriteFiles() with ModifiedAfter wrote %q, want %q", got, want)
+	}
+
+	a = &Archiver{Workers: 2}
+	err = a.WriteFiles(NewWriter(ioutil.Discard), tmpdir, append(names, "missing"))
+	if !os.IsNotExist(err) {
+		t.Errorf("WriteFiles() with a missing file = %v, want a not-exist error", err)
+	}
+	a.Digest = "unknown"
+	if err := a.WriteFiles(NewWriter(ioutil.Discard), tmpdir, names); err != ErrDigestUnavailable {
+		t.Errorf("WriteFiles() with Digest %q = %v, want %v", a.Digest, err, ErrDigestUnavailable)
+	}
+}
+
+func TestAppleDouble(t *testing.T) {
+	finderInfo := []byte("TEXTttxt" + strings.Repeat("\x00", 24))
+	for _, v := range []struct{ finderInfo, rsrc []byte }{
+		{nil, nil},
+		{finderInfo, nil},
+		{nil, []byte("resource fork")},
+		{finderInfo, []byte("resource fork")},
+	} {
+		b := encodeAppleDouble(v.finderInfo, v.rsrc)
+		fi, rsrc, err := decodeAppleDouble(b)
+		if err != nil || !bytes.Equal(fi, v.finderInfo) || !bytes.Equal(rsrc, v.rsrc) {
+			t.Errorf("decodeAppleDouble(encodeAppleDouble(%q, %q)) = (%q, %q, %v)", v.finderInfo, v.rsrc, fi, rsrc, err)
+		}
+	}
+
+	// Extended attributes stored after the Finder information are ignored.
+	b := encodeAppleDouble(append(finderInfo, "ATTR"...), nil)
+	if fi, _, err := decodeAppleDouble(b); err != nil || !bytes.Equal(fi, finderInfo) {
+		t.Errorf("decodeAppleDouble() = (%q, %v), want %q", fi, err, finderInfo)
+	}
+	for _, b := range [][]byte{nil, []byte("not AppleDouble data at all"), b[:len(b)-1]} {
+		if _, _, err := decodeAppleDouble(b); err == nil {
+			t.Errorf("decodeAppleDouble(%q) succeeded, want error", b)
+		}
+		if err := ApplyAppleDouble("unused", bytes.NewReader(b)); err == nil {
+			t.Errorf("ApplyAppleDouble(%q) succeeded, want error", b)
+		}
+	}
+	if got, want := appleDoubleName("dir/sub/"), "dir/._sub"; got != want {
+		t.Errorf("appleDoubleName() = %q, want %q", got, want)
+	}
+}
+
+func TestArchiverAppleDouble(t *testing.T) {
+	tmpdir, err := ioutil.TempDir("", "TestArchiverAppleDouble")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpdir)
+	if err := os.Mkdir(filepath.Join(tmpdir, "d"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"a", "d/b"} {
+		if err := ioutil.WriteFile(filepath.Join(tmpdir, filepath.FromSlash(name)), []byte(name), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	defer func(f func(string) ([]byte, []byte, error)) { readAppleMetadata = f }(readAppleMetadata)
+	readAppleMetadata = func(name string) (finderInfo, rsrc []byte, err error) {
+		if filepath.Base(name) == "a" {
+			return nil, []byte("fork"), nil
+		}
+		return nil, nil, nil
+	}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	a := &Archiver{Workers: 2, AppleDouble: true}
+	if err := a.WriteFiles(tw, tmpdir, []string{"a", "d", "d/b"}); err != nil {
+		t.Fatalf("WriteFiles() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	var got []string
+	tr := NewReader(&b)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		got = append(got, hdr.Name)
+		if hdr.Name == "._a" {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatalf("ReadAll() = %v", err)
+			}
+			if _, rsrc, err := decodeAppleDouble(data); err != nil || string(rsrc) != "fork" {
+				t.Errorf("resource fork = (%q, %v), want %q", rsrc, err, "fork")
+			}
+		}
+	}
+	if want := []string{"._a", "a", "d/", "d/b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+// testACL is a PAX extension for the "SUN.acl." records of the tests.
+type testACL struct{}
+
+func (testACL) DecodePAX(records map[string]string) (interface{}, error) {
+	if records["type"] != "posix" {
+		return nil, errors.New("unknown ACL type")
+	}
+	return strings.Split(records["entries"], ","), nil
+}
+
+func (testACL) EncodePAX(v interface{}) (map[string]string, error) {
+	entries, ok := v.([]string)
+	if !ok {
+		return nil, errors.New("not an ACL")
+	}
+	return map[string]string{"type": "posix", "entries": strings.Join(entries, ",")}, nil
+}
+
+func TestPAXExtension(t *testing.T) {
+	RegisterPAXExtension("SUN.acl.", testACL{})
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	hdrs := []*Header{{
+		Name:       "acl",
+		Mode:       0644,
+		Typeflag:   TypeReg,
+		Extensions: map[string]interface{}{"SUN.acl.": []string{"user::rw-", "other::r--"}},
+		PAXRecords: map[string]string{"SUN.acl.entries": "ignored", "SUN.devmajor": "0"},
+	}, {
+		Name:       "plain",
+		Mode:       0644,
+		Typeflag:   TypeReg,
+		PAXRecords: map[string]string{"SCHILY.nlink": "1"},
+	}}
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%q) = %v", hdr.Name, err)
+		}
+	}
+	if err := tw.WriteHeader(&Header{Name: "bad", Typeflag: TypeReg, Extensions: map[string]interface{}{"SUN.acl.": 0}}); err == nil {
+		t.Error("WriteHeader with an unencodable extension succeeded")
+	}
+	if err := tw.WriteHeader(&Header{Name: "bad", Typeflag: TypeReg, Extensions: map[string]interface{}{"UNKNOWN.": 0}}); err == nil {
+		t.Error("WriteHeader with an unregistered extension succeeded")
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(&b)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if got, want := hdr.Extensions["SUN.acl."], []string{"user::rw-", "other::r--"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Extensions[SUN.acl.] = %v, want %v", got, want)
+	}
+	wantRecs := map[string]string{
+		"SUN.acl.type":    "posix",
+		"SUN.acl.entries": "user::rw-,other::r--",
+		"SUN.devmajor":    "0",
+	}
+	if !reflect.DeepEqual(hdr.PAXRecords, wantRecs) {
+		t.Errorf("PAXRecords = %v, want %v", hdr.PAXRecords, wantRecs)
+	}
+	if hdr, err = tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if hdr.Extensions != nil || hdr.PAXRecords["SCHILY.nlink"] != "1" {
+		t.Errorf("Extensions = %v, PAXRecords = %v; want unknown records to pass through", hdr.Extensions, hdr.PAXRecords)
+	}
+
+	if err := mergePAX(new(Header), map[string]string{"SUN.acl.type": "nfs4"}); err != ErrHeader {
+		t.Errorf("mergePAX with an undecodable record = %v, want %v", err, ErrHeader)
+	}
+}
+
+func TestFileAttrs(t *testing.T) {
+	f, err := ioutil.TempFile("", "tar-attrs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+
+	if err := ApplyFileAttrs(name, &Header{Typeflag: TypeReg}); err != nil {
+		t.Errorf("ApplyFileAttrs() with no flags = %v", err)
+	}
+	if err := ApplyFileAttrs(name, &Header{Typeflag: TypeReg, FileFlags: "nodump"}); err != nil {
+		t.Skipf("cannot set file flags: %v", err)
+	}
+	fi, err := os.Lstat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hdr, err := FileInfoHeader(fi, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ReadFileAttrs(name, hdr); err != nil {
+		t.Fatalf("ReadFileAttrs() = %v", err)
+	}
+	if hdr.FileFlags != "nodump" {
+		t.Skipf("file flags are not supported: FileFlags = %q", hdr.FileFlags)
+	}
+}
+
+func TestAltStreams(t *testing.T) {
+	for _, v := range []struct{ in, want string }{
+		{"::$DATA", ""},
+		{":Zone.Identifier:$DATA", "Zone.Identifier"},
+		{":name:$INDEX_ALLOCATION", ""},
+		{"name", ""},
+	} {
+		if got := altStreamName(v.in); got != v.want {
+			t.Errorf("altStreamName(%q) = %q, want %q", v.in, got, v.want)
+		}
+	}
+	for _, name := range []string{"", "a:b", `..\x`, "../x", "nul\x00"} {
+		if validAltStream(name) {
+			t.Errorf("validAltStream(%q) = true, want false", name)
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		return
+	}
+	f, err := ioutil.TempFile("", "tar-streams")
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := f.Name()
+	f.Close()
+	defer os.Remove(name)
+	key := paxAltStream + "Zone.Identifier"
+	want := "[ZoneTransfer]\r\nZoneId=3\r\n"
+	hdr := &Header{Typeflag: TypeReg, PAXRecords: map[string]string{key: base64.StdEncoding.EncodeToString([]byte(want))}}
+	if err := ApplyFileAttrs(name, hdr); err != nil {
+		t.Skipf("cannot write alternate data streams: %v", err)
+	}
+	hdr = &Header{Typeflag: TypeReg}
+	if err := ReadFileAttrs(name, hdr); err != nil {
+		t.Fatalf("ReadFileAttrs() = %v", err)
+	}
+	if got, err := base64.StdEncoding.DecodeString(hdr.PAXRecords[key]); err != nil || string(got) != want {
+		t.Errorf("stream Zone.Identifier = (%q, %v), want %q", got, err, want)
+	}
+}
+
+func TestReadMap(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, e := range []struct {
+		hdr  Header
+		data string
+	}{
+		{Header{Name: "./", Typeflag: TypeDir, Mode: 0755, ModTime: mtime}, ""},
+		{Header{Name: "dir/", Typeflag: TypeDir, Mode: 0750, ModTime: mtime}, ""},
+		{Header{Name: "dir/file", Typeflag: TypeReg, Mode: 0644, Size: 3, ModTime: mtime}, "old"},
+		{Header{Name: "./dir/file", Typeflag: TypeReg, Mode: 0600, Size: 3, ModTime: mtime}, "new"},
+		{Header{Name: "link", Typeflag: TypeLink, Linkname: "dir/file"}, ""},
+		{Header{Name: "/sym", Typeflag: TypeSymlink, Linkname: "dir", Mode: 0777}, ""},
+	} {
+		if err := tw.WriteHeader(&e.hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+		if _, err := io.WriteString(tw, e.data); err != nil {
+			t.Fatalf("WriteString() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	files, err := ReadMap(NewReader(&b))
+	if err != ErrInsecurePath {
+		t.Fatalf("ReadMap() = %v, want %v", err, ErrInsecurePath)
+	}
+	want := map[string]struct {
+		data string
+		mode os.FileMode
+	}{
+		".":        {"", os.ModeDir | 0755},
+		"dir":      {"", os.ModeDir | 0750},
+		"dir/file": {"new", 0600},
+		"link":     {"new", 0600},
+		"sym":      {"dir", os.ModeSymlink | 0777},
+	}
+	if len(files) != len(want) {
+		t.Errorf("ReadMap() returned %d files, want %d", len(files), len(want))
+	}
+	for name, w := range want {
+		f := files[name]
+		if f == nil {
+			t.Errorf("missing file %q", name)
+			continue
+		}
+		if string(f.Data) != w.data || f.Mode != w.mode {
+			t.Errorf("file %q = (%q, %v), want (%q, %v)", name, f.Data, f.Mode, w.data, w.mode)
+		}
+	}
+	if f := files["dir/file"]; f != nil && !f.ModTime.Equal(mtime) {
+		t.Errorf("ModTime = %v, want %v", f.ModTime, mtime)
+	}
+}
+
+func TestReadMapImplicitDirs(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, name := range []string{"a/b/c", "a/d", "e/"} {
+		hdr := &Header{Name: name, Typeflag: TypeReg, Mode: 0644}
+		if strings.HasSuffix(name, "/") {
+			hdr.Typeflag, hdr.Mode = TypeDir, 0700
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	files, err := ReadMap(NewReader(&b))
+	if err != nil {
+		t.Fatalf("ReadMap() = %v", err)
+	}
+	want := map[string]os.FileMode{
+		"a":     os.ModeDir | 0555,
+		"a/b":   os.ModeDir | 0555,
+		"a/b/c": 0644,
+		"a/d":   0644,
+		"e":     os.ModeDir | 0700,
+	}
+	got := make(map[string]os.FileMode)
+	for name, f := range files {
+		got[name] = f.Mode
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("ReadMap() modes = %v, want %v", got, want)
+	}
+	if f := files["a/b"]; f != nil && f.Sys != nil {
+		t.Errorf("implied directory has Sys %v, want nil", f.Sys)
+	}
+}
+
+func TestCheckLinks(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, hdr := range []*Header{
+		{Name: "a", Typeflag: TypeReg},
+		{Name: "link-a", Typeflag: TypeLink, Linkname: "./a"},
+		{Name: "link-b", Typeflag: TypeLink, Linkname: "b"},
+		{Name: "link-c", Typeflag: TypeLink, Linkname: "c"},
+		{Name: "b", Typeflag: TypeReg},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	errs, err := CheckLinks(bytes.NewReader(b.Bytes()))
+	if err != nil {
+		t.Fatalf("CheckLinks() = %v", err)
+	}
+	want := []*LinkError{
+		{Name: "link-b", Linkname: "b", Forward: true},
+		{Name: "link-c", Linkname: "c"},
+	}
+	if !reflect.DeepEqual(errs, want) {
+		t.Errorf("CheckLinks() = %v, want %v", errs, want)
+	}
+
+	tw = NewWriter(ioutil.Discard)
+	tw.CheckLinks = true
+	if err := tw.WriteHeader(&Header{Name: "a", Typeflag: TypeReg, Size: -1}); err != ErrHeader {
+		t.Fatalf("WriteHeader(a) = %v, want %v", err, ErrHeader)
+	}
+	if err := tw.WriteHeader(&Header{Name: "link", Typeflag: TypeLink, Linkname: "a"}); err == nil {
+		t.Error("WriteHeader(link) for an unwritten target succeeded")
+	} else if _, ok := err.(*LinkError); !ok {
+		t.Errorf("WriteHeader(link) = %v, want a *LinkError", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "./a", Typeflag: TypeReg}); err != nil {
+		t.Fatalf("WriteHeader(a) = %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "link", Typeflag: TypeLink, Linkname: "a"}); err != nil {
+		t.Errorf("WriteHeader(link) = %v", err)
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Size: 600, Uid: 1 << 20}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := tw.Write(make([]byte, 600)); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	br := NewBlockReader(bytes.NewReader(b.Bytes()))
+	var blk Block
+	if err := br.ReadBlock(&blk); err != nil {
+		t.Fatalf("ReadBlock() = %v", err)
+	}
+	if size, err := ParseNumeric(blk[124:136]); size != 600 || err != nil {
+		t.Errorf("ParseNumeric(size) = (%d, %v), want (600, nil)", size, err)
+	}
+	if uid, err := ParseNumeric(blk[108:116]); uid != 1<<20 || err != nil {
+		t.Errorf("ParseNumeric(uid) = (%d, %v), want (%d, nil)", uid, err, 1<<20)
+	}
+	want := blk
+	blk.SetChecksum()
+	if blk != want {
+		t.Error("SetChecksum() changed the checksum of a valid header")
+	}
+	if err := br.Skip(2); err != nil || br.Offset() != 3*BlockSize {
+		t.Errorf("Skip(2) = %v at offset %d, want nil at offset %d", err, br.Offset(), 3*BlockSize)
+	}
+	for i := 0; i < 2; i++ {
+		if err := br.ReadBlock(&blk); err != nil || !blk.IsZero() {
+			t.Errorf("ReadBlock() = %v, IsZero() = %v; want trailer", err, blk.IsZero())
+		}
+	}
+	if err := br.ReadBlock(&blk); err != io.EOF {
+		t.Errorf("ReadBlock() = %v, want io.EOF", err)
+	}
+
+	// A header with a size that only fits in base-256 encoding.
+	var out bytes.Buffer
+	bw := NewBlockWriter(&out)
+	blk = Block{}
+	copy(blk[:], "big")
+	blk[156] = TypeReg
+	if err := FormatNumeric(blk[124:136], 1<<40); err != nil {
+		t.Fatalf("FormatNumeric() = %v", err)
+	}
+	if err := FormatNumeric(blk[100:101], 1<<40); err != ErrFieldTooLong {
+		t.Errorf("FormatNumeric(1-byte field) = %v, want %v", err, ErrFieldTooLong)
+	}
+	blk.SetChecksum()
+	if err := bw.WriteBlock(&blk); err != nil || bw.Offset() != BlockSize {
+		t.Fatalf("WriteBlock() = %v at offset %d", err, bw.Offset())
+	}
+	hdr, err := NewReader(&out).Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if hdr.Name != "big" || hdr.Size != 1<<40 {
+		t.Errorf("Next() = (%q, %d), want (\"big\", %d)", hdr.Name, hdr.Size, int64(1<<40))
+	}
+}
+
+func TestManifest(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	write := func(pax bool, modify func(*Header), data string) []byte {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.AlwaysPAX = pax
+		for _, hdr := range []*Header{
+			{Name: "dir/", Typeflag: TypeDir, Mode: 0755, ModTime: mtime},
+			{Name: "dir/file", Typeflag: TypeReg, Mode: 0644, ModTime: mtime, Size: int64(len(data)), Xattrs: map[string]string{"user.k": "v"}},
+			{Name: "dir/link", Typeflag: TypeSymlink, Linkname: "file", ModTime: mtime},
+		} {
+			if modify != nil {
+				modify(hdr)
+			}
+			body := ""
+			if hdr.Typeflag == TypeReg {
+				body = data
+			}
+			if err := tw.WriteFile(hdr, strings.NewReader(body)); err != nil {
+				t.Fatalf("WriteFile() = %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		return b.Bytes()
+	}
+
+	m, err := NewManifest(bytes.NewReader(write(false, nil, "hello")), "sha256")
+	if err != nil {
+		t.Fatalf("NewManifest() = %v", err)
+	}
+	text, err := m.MarshalText()
+	if err != nil {
+		t.Fatalf("MarshalText() = %v", err)
+	}
+	var m2 Manifest
+	if err := m2.UnmarshalText(text); err != nil || !reflect.DeepEqual(&m2, m) {
+		t.Fatalf("UnmarshalText() = (%v, %v), want %v", m2, err, m)
+	}
+	if err := m.Verify(bytes.NewReader(write(true, nil, "hello"))); err != nil {
+		t.Errorf("Verify(PAX encoding) = %v", err)
+	}
+
+	vectors := []struct {
+		archive []byte
+		index   int
+		reason  string
+	}{
+		{write(false, nil, "jello"), 1, "sha256 digest of data mismatch"},
+		{write(false, nil, "hello!"), 1, "size is 6, want 5"},
+		{write(false, func(h *Header) { h.Mode |= 02000 }, "hello"), 0, "sha256 digest of metadata mismatch"},
+		{write(false, func(h *Header) { h.Xattrs = nil }, "hello"), 1, "sha256 digest of metadata mismatch"},
+		{write(false, func(h *Header) { h.Name = strings.Replace(h.Name, "dir", "dst", 1) }, "hello"), 0, `name is "dst/"`},
+	}
+	for i, v := range vectors {
+		err := m.Verify(bytes.NewReader(v.archive))
+		if merr, ok := err.(*ManifestError); !ok || merr.Index != v.index || merr.Reason != v.reason {
+			t.Errorf("test %d, Verify() = %v, want entry %d: %s", i, err, v.index, v.reason)
+		}
+	}
+
+	short := *m
+	short.Entries = short.Entries[:2]
+	if err, ok := short.Verify(bytes.NewReader(write(false, nil, "hello"))).(*ManifestError); !ok || err.Index != 2 || err.Name != "dir/link" {
+		t.Errorf("Verify(short manifest) = %v, want an error for an unlisted entry", err)
+	}
+	long := *m
+	long.Entries = append(long.Entries[:3:3], ManifestEntry{Name: "extra"})
+	if err, ok := long.Verify(bytes.NewReader(write(false, nil, "hello"))).(*ManifestError); !ok || err.Index != 3 || err.Name != "extra" {
+		t.Errorf("Verify(long manifest) = %v, want an error for a missing entry", err)
+	}
+	if _, err := NewManifest(bytes.NewReader(nil), "none"); err != ErrDigestUnavailable {
+		t.Errorf("NewManifest(none) = %v, want %v", err, ErrDigestUnavailable)
+	}
+	if err := m2.UnmarshalText(append(text, "bogus\n"...)); err == nil {
+		t.Errorf("UnmarshalText(bogus) succeeded unexpectedly")
+	}
+}
+
+func TestCheckCollisions(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	for _, name := range []string{
+		"dir/", "Dir/", "dir/file", "dir/File", "./dir/file", "dir/file",
+		"\u212a", "k", "nul.", "nul", "caf\u00e9", "cafe\u0301",
+	} {
+		if err := tw.WriteHeader(&Header{Name: name, Typeflag: TypeReg}); err != nil {
+			t.Fatalf("WriteHeader(%q) = %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	// A stand-in for NFD that only decomposes "\u00e9".
+	nfd := func(s string) string { return strings.Replace(s, "\u00e9", "e\u0301", -1) }
+	for _, v := range []struct {
+		normalize func(string) string
+		want      []CollisionError
+	}{{
+		want: []CollisionError{{"Dir/", "dir"}, {"dir/File", "dir/file"}, {"k", "\u212a"}, {"nul", "nul."}},
+	}, {
+		normalize: nfd,
+		want:      []CollisionError{{"Dir/", "dir"}, {"dir/File", "dir/file"}, {"k", "\u212a"}, {"nul", "nul."}, {"cafe\u0301", "caf\u00e9"}},
+	}} {
+		errs, err := CheckCollisions(bytes.NewReader(b.Bytes()), v.normalize)
+		if err != nil {
+			t.Fatalf("CheckCollisions() = %v", err)
+		}
+		var got []CollisionError
+		for _, e := range errs {
+			got = append(got, *e)
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("CheckCollisions() = %q, want %q", got, v.want)
+		}
+	}
+
+	var c CollisionChecker
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	tr.Audit = c.Audit
+	for _, name := range []string{"dir/", "Dir/"} {
+		hdr, err := tr.Next()
+		if hdr == nil || hdr.Name != name {
+			t.Fatalf("Next() = (%v, %v), want %q", hdr, err, name)
+		}
+		if _, ok := err.(*CollisionError); ok != (name == "Dir/") {
+			t.Errorf("Next() = (%q, %v)", hdr.Name, err)
+		}
+	}
+}
+
+func TestCheckReproducible(t *testing.T) {
+	epoch := time.Unix(0, 0)
+	write := func(pidNames bool, hdrs ...*Header) []byte {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		if pidNames {
+			tw.PAXHeaderName = "%d/PaxHeaders.%p/%f"
+		}
+		for _, hdr := range hdrs {
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("WriteHeader() = %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		return b.Bytes()
+	}
+	long := strings.Repeat("long", 30)
+
+	type issue struct{ name, field string }
+	vectors := []struct {
+		archive []byte
+		want    []issue
+	}{{
+		archive: write(false,
+			&Header{Name: "a/", Typeflag: TypeDir, ModTime: epoch},
+			&Header{Name: "a/b", Typeflag: TypeReg, ModTime: epoch},
+			&Header{Name: long, Typeflag: TypeReg, ModTime: epoch},
+		),
+	}, {
+		archive: write(true,
+			&Header{Name: "b", Typeflag: TypeReg, ModTime: time.Unix(1500000000, 0), Uid: 1000, Uname: "gopher"},
+			&Header{Name: "a", Typeflag: TypeReg, ModTime: epoch, AccessTime: time.Unix(1500000000, 0)},
+			&Header{Name: long, Typeflag: TypeReg, ModTime: epoch},
+			&Header{Name: "m", Typeflag: TypeReg, ModTime: epoch, PAXRecords: map[string]string{"SCHILY.ino": "1234"}},
+		),
+		want: []issue{
+			{"b", "ModTime"}, {"b", "Uid"}, {"b", "Uname"},
+			{"a", "Typeflag"}, {"a", "AccessTime"}, {"a", "Name"},
+			{long, "Typeflag"},
+			{"m", "SCHILY.ino"}, {"m", "Typeflag"},
+		},
+	}}
+	for i, v := range vectors {
+		issues, err := CheckReproducible(bytes.NewReader(v.archive))
+		if err != nil {
+			t.Fatalf("test %d, CheckReproducible() = %v", i, err)
+		}
+		var got []issue
+		for _, is := range issues {
+			got = append(got, issue{is.Name, is.Field})
+		}
+		if !reflect.DeepEqual(got, v.want) {
+			t.Errorf("test %d, CheckReproducible() = %v, want %v", i, got, v.want)
+		}
+	}
+}
+
+// testMetrics is a Metrics that records the events that it receives.
+type testMetrics struct {
+	entries []string
+	bytes   map[MetricsOp]int
+	errors  []string
+}
+
+func (m *testMetrics) Entry(op MetricsOp, hdr *Header, format string) {
+	m.entries = append(m.entries, fmt.Sprintf("%v %s %s", op, format, hdr.Name))
+}
+
+func (m *testMetrics) Bytes(op MetricsOp, n int) {
+	if m.bytes == nil {
+		m.bytes = make(map[MetricsOp]int)
+	}
+	m.bytes[op] += n
+}
+
+func (m *testMetrics) Error(op MetricsOp, class ErrorClass, err error) {
+	m.errors = append(m.errors, fmt.Sprintf("%v %v", op, class))
+}
+
+func TestMetrics(t *testing.T) {
+	long := strings.Repeat("a", 150)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	wm := new(testMetrics)
+	tw.Metrics = wm
+	if err := tw.WriteFile(&Header{Name: "ustar", Mode: 0644, Size: 5}, strings.NewReader("hello")); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	if err := tw.WriteFile(&Header{Name: long, Mode: 0644, Size: 3}, strings.NewReader("bye")); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	tw.NumericEncoding = NumericBase256
+	if err := tw.WriteHeader(&Header{Name: "gnu", Mode: 0644, Uid: 1 << 30}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.WriteDeferredHeader(&Header{Name: "deferred", Mode: 0644}); err != nil {
+		t.Fatalf("WriteDeferredHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "spooled"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if _, err := tw.Write([]byte("x")); err != ErrWriteAfterClose {
+		t.Fatalf("Write() after Close = %v, want %v", err, ErrWriteAfterClose)
+	}
+	tw.Write([]byte("x")) // A persistent error is only reported once
+	wantEntries := []string{"write USTAR ustar", "write PAX " + long, "write GNU gnu", "write USTAR deferred"}
+	if !reflect.DeepEqual(wm.entries, wantEntries) {
+		t.Errorf("Writer entries = %q, want %q", wm.entries, wantEntries)
+	}
+	if got, want := wm.bytes[MetricsWrite], len("hello")+len("bye")+len("spooled"); got != want {
+		t.Errorf("Writer bytes = %d, want %d", got, want)
+	}
+	if want := []string{"write usage"}; !reflect.DeepEqual(wm.errors, want) {
+		t.Errorf("Writer errors = %q, want %q", wm.errors, want)
+	}
+
+	// Non-persistent errors are reported each time.
+	wm = new(testMetrics)
+	tw = NewWriter(ioutil.Discard)
+	tw.Metrics = wm
+	if err := tw.WriteHeader(&Header{Name: "small", Size: 1}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	tw.Write([]byte("ab"))
+	tw.Write([]byte("cd"))
+	tw.WriteHeader(&Header{Name: "bad", Size: -1})
+	if want := []string{"write usage", "write usage", "write header"}; !reflect.DeepEqual(wm.errors, want) {
+		t.Errorf("Writer errors = %q, want %q", wm.errors, want)
+	}
+
+	archive := b.Bytes()
+	rm := new(testMetrics)
+	tr := NewReader(bytes.NewReader(archive[:len(archive)-3*blockSize+4])) // Truncate the data of the last entry
+	tr.Metrics = rm
+	for {
+		if _, err := tr.Next(); err != nil {
+			break
+		}
+		io.Copy(ioutil.Discard, tr)
+	}
+	tr.Next()
+	wantEntries = []string{"read USTAR ustar", "read PAX " + long, "read GNU gnu", "read USTAR deferred"}
+	if !reflect.DeepEqual(rm.entries, wantEntries) {
+		t.Errorf("Reader entries = %q, want %q", rm.entries, wantEntries)
+	}
+	if got, want := rm.bytes[MetricsRead], len("hello")+len("bye")+len("spoo"); got != want {
+		t.Errorf("Reader bytes = %d, want %d", got, want)
+	}
+	if want := []string{"read truncated"}; !reflect.DeepEqual(rm.errors, want) {
+		t.Errorf("Reader errors = %q, want %q", rm.errors, want)
+	}
+}
+
+func TestAPK(t *testing.T) {
+	// segment returns a gzip stream holding a tar archive of the given
+	// files, without the trailer unless it is the data segment.
+	segment := func(trailer bool, files ...string) []byte {
+		var b bytes.Buffer
+		zw := gzip.NewWriter(&b)
+		tw := NewWriter(zw)
+		tw.OmitTrailer = !trailer
+		for _, name := range files {
+			if err := tw.WriteFile(&Header{Name: name, Mode: 0644, Size: int64(len(name))}, strings.NewReader(name)); err != nil {
+				t.Fatalf("WriteFile() = %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatalf("gzip Close() = %v", err)
+		}
+		return b.Bytes()
+	}
+	unsigned := append(segment(false, ".PKGINFO"), segment(true, "usr/bin/tool", "usr/share/doc")...)
+	wantNames := []string{".PKGINFO", "usr/bin/tool", "usr/share/doc"}
+
+	// names checks that r is the package without its signature segment.
+	names := func(r io.Reader) []string {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Fatalf("gzip.NewReader() = %v", err)
+		}
+		var got []string
+		tr := NewReader(zr)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return got
+			}
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			got = append(got, hdr.Name)
+		}
+	}
+
+	sigs := []APKSignature{
+		{Name: ".SIGN.RSA.builder.rsa.pub", Data: []byte("signature")},
+		{Name: ".SIGN.RSA256.builder.rsa.pub", Data: bytes.Repeat([]byte{0xff}, 600)},
+	}
+	var b bytes.Buffer
+	if err := WriteAPKSignatures(&b, sigs); err != nil {
+		t.Fatalf("WriteAPKSignatures() = %v", err)
+	}
+	b.Write(unsigned)
+	got, rest, err := SplitAPK(&b)
+	if err != nil {
+		t.Fatalf("SplitAPK() = %v", err)
+	}
+	if !reflect.DeepEqual(got, sigs) {
+		t.Errorf("SplitAPK() signatures = %q, want %q", got, sigs)
+	}
+	if got := names(rest); !reflect.DeepEqual(got, wantNames) {
+		t.Errorf("entries after the signatures = %q, want %q", got, wantNames)
+	}
+
+	got, rest, err = SplitAPK(bytes.NewReader(unsigned))
+	if err != nil || got != nil {
+		t.Fatalf("SplitAPK() of an unsigned package = (%q, %v), want no signatures", got, err)
+	}
+	if data, err := ioutil.ReadAll(rest); err != nil || !bytes.Equal(data, unsigned) {
+		t.Errorf("SplitAPK() of an unsigned package does not return the whole package")
+	}
+}
+
+func TestHeaderListString(t *testing.T) {
+	mtime := time.Date(2017, 6, 20, 15, 4, 59, 0, time.UTC)
+	vectors := []struct {
+		hdr  Header
+		want string
+	}{{
+		Header{Name: "dir/file.txt", Mode: 0644, Uname: "gopher", Gname: "staff", Size: 1234, ModTime: mtime},
+		"-rw-r--r-- gopher/staff   1234 2017-06-20 15:04 dir/file.txt",
+	}, {
+		Header{Name: "dir/", Typeflag: TypeDir, Mode: 01777, Uid: 1000, Gid: 100, ModTime: mtime},
+		"drwxrwxrwt 1000/100          0 2017-06-20 15:04 dir/",
+	}, {
+		Header{Name: "bin/su", Typeflag: TypeReg, Mode: 06744, Uname: "root", Gname: "root", Size: 63568, ModTime: mtime},
+		"-rwsr-Sr-- root/root     63568 2017-06-20 15:04 bin/su",
+	}, {
+		Header{Name: "link", Typeflag: TypeSymlink, Linkname: "../target", Mode: 0777, Uname: "a", Gname: "b", ModTime: mtime},
+		"lrwxrwxrwx a/b               0 2017-06-20 15:04 link -> ../target",
+	}, {
+		Header{Name: "hard", Typeflag: TypeLink, Linkname: "dir/file.txt", Mode: 0644, Uname: "a", Gname: "b", ModTime: mtime},
+		"hrw-r--r-- a/b               0 2017-06-20 15:04 hard link to dir/file.txt",
+	}, {
+		Header{Name: "dev/sda", Typeflag: TypeBlock, Mode: 0660, Uname: "root", Gname: "disk", Devmajor: 8, Devminor: 1, ModTime: mtime},
+		"brw-rw---- root/disk       8,1 2017-06-20 15:04 dev/sda",
+	}, {
+		Header{Name: "a-very-long-owner-name-file", Mode: 0600, Uname: "a-very-long-owner", Gname: "group", Size: 12345678, ModTime: mtime.In(time.FixedZone("", 3600))},
+		"-rw------- a-very-long-owner/group 12345678 2017-06-20 16:04 a-very-long-owner-name-file",
+	}, {
+		Header{Name: "new\nline\\\u00e9", Typeflag: 'Z', ModTime: mtime},
+		"?--------- 0/0               0 2017-06-20 15:04 new\\nline\\\\\u00e9",
+	}}
+	for i, v := range vectors {
+		if got := v.hdr.ListString(); got != v.want {
+			t.Errorf("test %d, ListString():\ngot  %q\nwant %q", i, got, v.want)
+		}
+	}
+}
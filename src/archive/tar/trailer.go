@@ -0,0 +1,294 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Keys of the PAX records of the global header written by Writer.WriteIndex.
+// The offset record is always the last one, with a fixed length, such that
+// it can be found from the end of the archive.
+const (
+	paxIndex       = "GO.index"
+	paxIndexOffset = "GO.indexoffset"
+
+	indexVersion         = "tar-index-v1"
+	indexOffsetRecordLen = 39 // len("39 GO.indexoffset=%020d\n")
+)
+
+// An indexRecord describes an entry written by a Writer for its index.
+type indexRecord struct {
+	hoff, doff, size int64  // Offsets of the entry and its data, and size of its data
+	typ              byte   // Type flag of the entry
+	sum              []byte // Digest of the stored data, if any
+	name             string
+}
+
+// startIndexEntry records where the data of the current file entry, whose
+// last header block of the given type was just written, begins.
+func (tw *Writer) startIndexEntry(flag byte) error {
+	if !tw.WriteIndex {
+		return nil
+	}
+	tw.irec = indexRecord{hoff: tw.ent, doff: tw.off, typ: flag}
+	if tw.IndexDigest != "" && tw.ih == nil {
+		if tw.ih = newDigest(tw.IndexDigest); tw.ih == nil {
+			return fmt.Errorf("archive/tar: digest algorithm %q is not available", tw.IndexDigest)
+		}
+	}
+	if tw.ih != nil {
+		tw.ih.Reset()
+	}
+	return nil
+}
+
+// finishIndexEntry adds the current file entry, which was just flushed,
+// to the index.
+func (tw *Writer) finishIndexEntry() {
+	rec := tw.irec
+	rec.size, rec.name = tw.size, tw.name
+	if tw.ih != nil {
+		rec.sum = tw.ih.Sum(nil)
+	}
+	tw.idx = append(tw.idx, rec)
+}
+
+// writeIndex writes the index of the entries written so far as a global
+// extended header.
+func (tw *Writer) writeIndex() error {
+	alg := tw.IndexDigest
+	if alg == "" {
+		alg = "-"
+	}
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %s\n", indexVersion, alg)
+	for _, rec := range tw.idx {
+		sum := "-"
+		if rec.sum != nil {
+			sum = hex.EncodeToString(rec.sum)
+		}
+		fmt.Fprintf(&b, "%d %d %d %d %s %s\n", rec.hoff, rec.doff, rec.size, rec.typ, sum, strconv.Quote(rec.name))
+	}
+	data, err := formatPAXRecord(paxIndex, b.String())
+	if err != nil {
+		return err
+	}
+	off, err := formatPAXRecord(paxIndexOffset, fmt.Sprintf("%020d", tw.off))
+	if err != nil || len(off) != indexOffsetRecordLen {
+		return ErrHeader // Should never happen
+	}
+	tw.ent, tw.name = tw.off, globalHeaderName
+	if err := tw.writeRawFile(globalHeaderName, data+off, TypeXGlobalHeader, formatPAX); err != nil {
+		return err
+	}
+	if tw.OmitFinalPadding {
+		tw.pad = 0
+	}
+	return tw.flush()
+}
+
+// OpenIndex is like NewIndex, but if the archive ends with an index written
+// by a Writer with WriteIndex set, it uses that index instead of reading
+// the headers of all entries. The header of each entry is then only read
+// from r when it is first needed, which any method other than Len, Lookup,
+// and Digest does. If the header cannot be read or does not match
+// the index, the Header method returns one with only the Name, Typeflag,
+// and Size fields set, from the index.
+//
+// As with NewIndex, ErrInsecurePath is returned along with the complete
+// Index if any entry has an insecure name.
+func OpenIndex(r io.ReaderAt, size int64) (*Index, error) {
+	ix := readTrailingIndex(r, size)
+	if ix == nil {
+		return NewIndex(r, size)
+	}
+	for _, e := range ix.entries {
+		if e.typ != TypeXGlobalHeader && isInsecurePath(e.name) {
+			return ix, ErrInsecurePath
+		}
+	}
+	return ix, nil
+}
+
+// readTrailingIndex returns an Index read from the index at the end of the
+// archive in r, or nil if there is none or it is malformed.
+func readTrailingIndex(r io.ReaderAt, size int64) *Index {
+	// Find the last block of the index, skipping the trailer and any zero
+	// blocks that pad the archive to the default record size of 10240 bytes.
+	// The last block is incomplete if OmitFinalPadding was set.
+	var blk block
+	end := size + (-size & (blockSize - 1))
+	for i := 0; ; i++ {
+		if end < 2*blockSize || i > 20 {
+			return nil
+		}
+		end -= blockSize
+		blk.Reset()
+		n, err := r.ReadAt(blk[:], end)
+		if err != nil && (err != io.EOF || end+int64(n) != size) {
+			return nil
+		}
+		if !blk.IsZero() {
+			break
+		}
+	}
+	tail := bytes.TrimRight(blk[:], "\x00")
+	if len(tail) < indexOffsetRecordLen {
+		return nil
+	}
+	k, v, _, err := parsePAXRecord(string(tail[len(tail)-indexOffsetRecordLen:]), false)
+	if err != nil || k != paxIndexOffset {
+		return nil
+	}
+	hoff, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || hoff < 0 || hoff >= end {
+		return nil
+	}
+
+	tr := NewReader(io.NewSectionReader(r, hoff, size-hoff))
+	hdr, err := tr.Next()
+	if err != nil || hdr.Typeflag != TypeXGlobalHeader || hdr.PAXRecords[paxIndexOffset] != v {
+		return nil
+	}
+	ix, err := parseIndex(hdr.PAXRecords[paxIndex], hoff)
+	if err != nil {
+		return nil
+	}
+	ix.r, ix.size = r, size
+	ix.entries = append(ix.entries, indexEntry{
+		hoff:   hoff,
+		offset: hoff + tr.nextOff - tr.pad,
+		typ:    TypeXGlobalHeader,
+		name:   globalHeaderName,
+	})
+	return ix
+}
+
+// parseIndex parses the value of a GO.index record, whose entries must
+// precede the given offset.
+func parseIndex(s string, limit int64) (*Index, error) {
+	lines := strings.Split(s, "\n")
+	if len(lines) < 2 || lines[len(lines)-1] != "" {
+		return nil, ErrHeader
+	}
+	f := strings.Fields(lines[0])
+	if len(f) != 2 || f[0] != indexVersion {
+		return nil, ErrHeader
+	}
+	ix := &Index{names: make(map[string]int), lazy: true}
+	if f[1] != "-" {
+		ix.alg = f[1]
+	}
+	for _, line := range lines[1 : len(lines)-1] {
+		f := strings.SplitN(line, " ", 6)
+		if len(f) != 6 {
+			return nil, ErrHeader
+		}
+		var n [4]int64
+		for i := range n {
+			var err error
+			if n[i], err = strconv.ParseInt(f[i], 10, 64); err != nil || n[i] < 0 {
+				return nil, ErrHeader
+			}
+		}
+		name, err := strconv.Unquote(f[5])
+		if err != nil || n[3] > 0xff || n[1] < n[0] || n[2] > limit-n[1] {
+			return nil, ErrHeader
+		}
+		e := indexEntry{hoff: n[0], offset: n[1], length: n[2], typ: byte(n[3]), name: name}
+		if f[4] != "-" {
+			if e.sum, err = hex.DecodeString(f[4]); err != nil {
+				return nil, ErrHeader
+			}
+		}
+		if e.typ == TypeXGlobalHeader {
+			e.offset, e.length = e.offset+e.length, 0 // As read by NewIndex
+		} else {
+			ix.names[name] = len(ix.entries)
+		}
+		if isHeaderOnlyType(e.typ) {
+			e.length = 0
+		}
+		ix.entries = append(ix.entries, e)
+	}
+	return ix, nil
+}
+
+// entry returns the i-th entry, first reading its header if the Index was
+// read from a trailing index or created by NewIndexFile.
+func (ix *Index) entry(i int) *indexEntry {
+	if ix.file != nil {
+		return ix.file.entry(ix, i)
+	}
+	e := &ix.entries[i]
+	if !ix.lazy {
+		return e
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	return ix.load(i)
+}
+
+// load reads the header of the i-th entry, if it has not been read yet.
+// The records of preceding global headers are applied to it, as by
+// NewIndex. It must be called with ix.mu held.
+func (ix *Index) load(i int) *indexEntry {
+	e := &ix.entries[i]
+	if e.hdr != nil {
+		return e
+	}
+	var globals map[string]string
+	if e.typ != TypeXGlobalHeader {
+		for j := 0; j < i; j++ {
+			if ix.entries[j].typ == TypeXGlobalHeader {
+				globals = mergePAXRecords(globals, ix.load(j).hdr.PAXRecords)
+			}
+		}
+	}
+	ix.readEntry(e, globals)
+	return e
+}
+
+// readEntry reads the header of e, which is at e.hoff, with the records of
+// the preceding global headers in globals. If it cannot be read or does not
+// match e, e is given a header with only the Name, Typeflag, and Size fields
+// set.
+func (ix *Index) readEntry(e *indexEntry, globals map[string]string) {
+	tr := NewReader(io.NewSectionReader(ix.r, e.hoff, ix.size-e.hoff))
+	tr.AllowInsecurePaths = true // Reported by OpenIndex
+	tr.globals = globals
+	hdr, err := tr.Next()
+	if err != nil || hdr.Name != e.name || hdr.Typeflag != e.typ {
+		e.hdr = &Header{Name: e.name, Typeflag: e.typ, Size: e.length}
+		return
+	}
+	e.hdr, e.length = hdr, tr.numBytes()
+	e.offset = e.hoff + tr.dataOffset()
+	if sfr, ok := tr.curr.(*sparseFileReader); ok {
+		e.sp = append([]sparseEntry{}, sfr.sp...)
+	}
+}
+
+// Digest returns the name of the digest algorithm and the digest of the
+// data of the i-th entry, as stored in the archive, that are recorded in
+// the index at the end of the archive from which the Index was read by
+// OpenIndex. It returns an empty name and a nil digest if there is none.
+//
+// Note that the stored data of a sparse file includes its sparse map.
+func (ix *Index) Digest(i int) (name string, sum []byte) {
+	if ix.file != nil {
+		return "", nil
+	}
+	if e := &ix.entries[i]; e.sum != nil {
+		return ix.alg, append([]byte(nil), e.sum...)
+	}
+	return "", nil
+}
@@ -0,0 +1,9 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build !linux,!darwin,!dragonfly,!freebsd,!openbsd,!netbsd,!solaris
+
+package tar
+
+func processUmask() int64 { return 0 }
@@ -0,0 +1,41 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// +build linux darwin dragonfly freebsd openbsd netbsd solaris
+
+package tar
+
+import (
+	"bytes"
+	"io/ioutil"
+	"runtime"
+	"strconv"
+	"sync"
+	"syscall"
+)
+
+var umaskMu sync.Mutex
+
+// processUmask returns the file mode creation mask of the process.
+func processUmask() int64 {
+	if runtime.GOOS == "linux" {
+		// Since Linux 4.7, the mask can be read without changing it.
+		if b, err := ioutil.ReadFile("/proc/self/status"); err == nil {
+			if i := bytes.Index(b, []byte("\nUmask:")); i >= 0 {
+				b = b[i+len("\nUmask:"):]
+				if j := bytes.IndexByte(b, '\n'); j >= 0 {
+					b = b[:j]
+				}
+				if m, err := strconv.ParseInt(string(bytes.TrimSpace(b)), 8, 64); err == nil {
+					return m
+				}
+			}
+		}
+	}
+	umaskMu.Lock()
+	defer umaskMu.Unlock()
+	m := syscall.Umask(022)
+	syscall.Umask(m)
+	return int64(m)
+}
@@ -0,0 +1,110 @@
+// Copyright 2017 The Go Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package tar
+
+import "strings"
+
+// A WindowsNamePolicy selects how a Reader handles the names of entries
+// that cannot be created on Windows: those with an element that is a
+// reserved device name such as CON, NUL, COM1, or LPT1, with or without an
+// extension; that ends in a period or space, which Windows removes; or that
+// contains a control character or one of the characters <>:"\|?*.
+type WindowsNamePolicy int
+
+const (
+	// WindowsNamesAllow returns such names as they are.
+	WindowsNamesAllow WindowsNamePolicy = iota
+
+	// WindowsNamesError causes Next to report ErrWindowsName along with
+	// the header of such an entry. The error is not persistent; Next may
+	// be called again to continue.
+	WindowsNamesError
+
+	// WindowsNamesSkip causes Next to skip over such entries.
+	WindowsNamesSkip
+
+	// WindowsNamesRename causes Next to rename such entries, and the
+	// targets of such hard links, by replacing each invalid character,
+	// as well as each trailing period and space, with an underscore,
+	// and by appending an underscore to reserved device names, such that
+	// "aux.c" becomes "aux_.c".
+	WindowsNamesRename
+)
+
+// windowsNameProblem returns why name cannot be created on Windows,
+// or the empty string if it can.
+func windowsNameProblem(name string) string {
+	for _, elem := range strings.Split(name, "/") {
+		if elem == "" || elem == "." || elem == ".." {
+			continue
+		}
+		if strings.IndexFunc(elem, isWindowsInvalid) >= 0 {
+			return "invalid character"
+		}
+		if c := elem[len(elem)-1]; c == '.' || c == ' ' {
+			return "trailing period or space"
+		}
+		if isWindowsReserved(elem) {
+			return "reserved device name"
+		}
+	}
+	return ""
+}
+
+// windowsName returns name renamed as for WindowsNamesRename.
+func windowsName(name string) string {
+	elems := strings.Split(name, "/")
+	for i, elem := range elems {
+		if elem == "" || elem == "." || elem == ".." {
+			continue
+		}
+		elem = strings.Map(func(r rune) rune {
+			if isWindowsInvalid(r) {
+				return '_'
+			}
+			return r
+		}, elem)
+		if t := strings.TrimRight(elem, ". "); len(t) < len(elem) {
+			elem = t + strings.Repeat("_", len(elem)-len(t))
+		}
+		if isWindowsReserved(elem) {
+			base := elem
+			if j := strings.IndexByte(elem, '.'); j >= 0 {
+				base = elem[:j]
+			}
+			elem = base + "_" + elem[len(base):]
+		}
+		elems[i] = elem
+	}
+	return strings.Join(elems, "/")
+}
+
+// windowsLinkname returns target, the target of a symbolic link or junction
+// point on Windows as reported by os.Readlink, with forward slashes in place
+// of backslashes, so that the link can be resolved on other systems. Volume
+// names are kept, such that C:\dir becomes C:/dir.
+func windowsLinkname(target string) string {
+	return strings.Replace(target, `\`, "/", -1)
+}
+
+// isWindowsInvalid reports whether r may not occur in a name on Windows.
+func isWindowsInvalid(r rune) bool {
+	return r < ' ' || strings.ContainsRune(`<>:"\|?*`, r)
+}
+
+// isWindowsReserved reports whether elem is the name of a device on
+// Windows, which is the case regardless of case, extension, and spaces
+// before the extension.
+func isWindowsReserved(elem string) bool {
+	if i := strings.IndexByte(elem, '.'); i >= 0 {
+		elem = elem[:i]
+	}
+	elem = strings.ToUpper(strings.TrimRight(elem, " "))
+	switch elem {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	return len(elem) == 4 && (elem[:3] == "COM" || elem[:3] == "LPT") && '1' <= elem[3] && elem[3] <= '9'
+}
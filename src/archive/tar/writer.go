@@ -5,11 +5,17 @@
 package tar
 
 import (
+	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"io/ioutil"
+	"os"
 	"path"
 	"sort"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,13 +23,255 @@ import (
 // A Writer provides sequential writing of a tar archive in POSIX.1 format.
 // A tar archive consists of a sequence of files.
 // Call WriteHeader to begin a new file, and then call Write to supply that file's data,
-// writing at most hdr.Size bytes in total.
+// writing at most hdr.Size bytes in total. Optionally, call Flush to complete
+// the file before the next call to WriteHeader; this is required if
+// ExplicitFlush is set. Call Close to complete the archive.
+//
+// For a given sequence of headers and data, a Writer always produces the
+// same output. In particular, the records of a PAX extended header are
+// sorted by key unless PAXRecordOrder is set.
 type Writer struct {
-	w   io.Writer
-	nb  int64  // number of unwritten bytes for current file entry
-	pad int64  // amount of padding to write after current file entry
-	hdr Header // Shallow copy of Header that is safe for mutations
-	blk block  // Buffer to use as temporary local storage
+	// OmitTrailer suppresses the two zero blocks that Close normally writes
+	// to mark the end of the archive. This is useful when the archive is
+	// framed by some external means and the trailer is redundant.
+	OmitTrailer bool
+
+	// OmitFinalPadding suppresses the block padding that Close normally
+	// writes after the data of the last entry. It has no effect on the
+	// padding of any other entry. If WriteIndex is set, the index is the
+	// last entry.
+	OmitFinalPadding bool
+
+	// DataAlignment, if positive, is a multiple of 512 at which the data
+	// of each file entry written by WriteHeader begins in the archive,
+	// such that it can be memory-mapped or read with direct I/O in place.
+	// The extended header of the entry is padded as needed with a
+	// GO.padding record, which makes the entry use the PAX format.
+	// Entries that cannot be written in the PAX format, and entries with
+	// no data, which include those begun by WriteDeferredHeader if
+	// BackfillHeaders is set, are not aligned.
+	DataAlignment int64
+
+	// PadShortEntries causes the Writer to fill out the remainder of an
+	// entry with zeros if fewer than Header.Size bytes were written to it.
+	// Otherwise, the next call to WriteHeader, Flush, or Close reports an
+	// error naming the entry and the number of bytes that were missing.
+	PadShortEntries bool
+
+	// ExplicitFlush requires that Flush be called to complete each entry.
+	// Otherwise, WriteHeader and WriteGlobalHeader implicitly call Flush.
+	// If set, they report an error naming the entry that was not flushed.
+	// Close always flushes the last entry.
+	ExplicitFlush bool
+
+	// NumericEncoding selects how numeric fields that do not fit in the
+	// octal fields of a USTAR header (such as sizes of 8GiB or more,
+	// negative timestamps, and large user and group IDs) are encoded.
+	NumericEncoding NumericEncoding
+
+	// TimePrecision selects how the sub-second portion of ModTime,
+	// AccessTime, and ChangeTime is handled.
+	TimePrecision TimePrecision
+
+	// AlwaysPAX causes every entry to be written in the PAX format with
+	// records for its name, modification time, and owner, as well as its
+	// link target, access time, and change time if they are set, even if
+	// the USTAR fields could hold them. The set of records written for an
+	// entry thus depends only on which fields of its header are set,
+	// which suits readers that treat PAX records as the canonical source
+	// of metadata. Empty user and group names are not recorded.
+	AlwaysPAX bool
+
+	// PreferUSTARPrefix causes names longer than the USTAR name field,
+	// but which can be split between its prefix and name fields, to be
+	// stored that way even in entries that are written in the PAX format
+	// for other reasons, rather than in a PAX path record. It also avoids
+	// the GNU format for such names, which has no prefix field and would
+	// need a long name entry, where PAX can be used. Readers that only
+	// understand plain USTAR then see the full names of such entries.
+	// Unless AlwaysPAX is set, no path record is written for them.
+	PreferUSTARPrefix bool
+
+	// PAXRecordOrder, if non-nil, controls which PAX records are written
+	// in an extended header and in what order. It is called with the keys of the
+	// records sorted in increasing byte-wise order (the default ordering)
+	// and returns the keys to write in the order that they are to be written.
+	// Keys that are omitted are not written, losing the corresponding
+	// information. Unknown and repeated keys in the result are ignored.
+	PAXRecordOrder func(keys []string) []string
+
+	// HeaderHooks is a list of functions that WriteHeader calls, in order,
+	// on a copy of each header before it is encoded. A hook may modify the
+	// header (for example, to clear user names or clamp timestamps) without
+	// affecting the caller's Header. If a hook returns an error, WriteHeader
+	// returns it without writing the header.
+	HeaderHooks []func(*Header) error
+
+	// NormalizeNames, if non-nil, is applied by WriteHeader to the name and
+	// link target of a copy of each header before HeaderHooks are called,
+	// such as to write names in a single Unicode normal form with the
+	// String method of norm.NFC from the golang.org/x/text/unicode/norm
+	// package, whatever form they have on the local file system.
+	NormalizeNames func(string) string
+
+	// PAXHeaderName is the template for the name of the synthetic file
+	// entry used to hold an extended header (TypeXHeader), following the
+	// exthdr.name option of the POSIX pax utility. Within the template,
+	// "%d" is replaced by the directory of the entry's name, "%f" by the
+	// last element of its name, "%p" by the current process ID, "%n" by
+	// the sequence number of the extended header in the archive
+	// (starting at 1), and "%%" by a single '%'. The result is cleaned
+	// as by path.Clean and truncated to fit within the header.
+	//
+	// If empty, "%d/PaxHeaders.0/%f" is used. GNU tar uses
+	// "%d/PaxHeaders.%p/%f" by default.
+	PAXHeaderName string
+
+	// WriteBufferSize, if positive, is the size of a buffer in which the
+	// Writer collects headers, padding, and data before writing them to
+	// the underlying io.Writer, such that archives of many small files are
+	// not written with many small writes. Writes of data at least as large
+	// as the buffer bypass it when it is empty. Buffered output is written
+	// by Close, so errors from the underlying io.Writer may be reported
+	// for a later entry than the one they occurred in.
+	// It only has an effect if set before the first call to WriteHeader.
+	WriteBufferSize int
+
+	// CheckLinks causes WriteHeader to report a *LinkError, without
+	// writing the header, for a hard link (TypeLink) whose target has not
+	// been written by a preceding call to WriteHeader, which most readers
+	// would fail to extract. Names are compared after cleaning them as
+	// ReadMap does.
+	CheckLinks bool
+
+	// ParentDirs, if non-nil, is the template for the directory entries
+	// that the Writer writes for the parent directories of each entry
+	// begun by WriteHeader, WriteDeferredHeader, or WriteSparseHeader,
+	// before it, unless they have been written as entries already, since
+	// some extractors fail on archives that lack them. Its Name, Typeflag,
+	// Size, and Linkname are ignored. If its Mode is zero, 0755 is used,
+	// and if its ModTime is zero, that of the entry is used.
+	//
+	// The parent directories are those of the name of the entry as it is
+	// written, after NormalizeNames and HeaderHooks, so their entries are
+	// not passed to either. Leading slashes are omitted from their names,
+	// and an entry has none beyond a ".." element of its name. Names are
+	// compared after cleaning them as ReadMap does; directories written
+	// again by the caller after their contents are not omitted.
+	ParentDirs *Header
+
+	// SpoolSize is the number of bytes of the data of an entry begun by
+	// WriteDeferredHeader that are held in memory. Further data is held
+	// in a temporary file in SpoolDir, or in the default directory for
+	// temporary files if SpoolDir is empty. If SpoolSize is zero,
+	// 1 MiB of data is held in memory.
+	SpoolSize int64
+	SpoolDir  string
+
+	// BackfillHeaders causes WriteDeferredHeader, if the underlying
+	// io.Writer is an io.WriteSeeker such as *os.File, to write the header
+	// at once with a size of zero and then the data as it is written,
+	// rather than spooling the data. Once the entry is flushed, the Writer
+	// seeks back to fill in the size and checksum of the header. The
+	// archive is the same, except that errors in the header are reported
+	// by WriteDeferredHeader, and that the data must be less than 8 GiB
+	// unless the header is in the GNU format; otherwise, Flush reports
+	// an error, which is persistent.
+	BackfillHeaders bool
+
+	// ContentTransform, if non-nil, is called by WriteHeader for each entry
+	// that has data, such as to compress, encrypt, or scan it. The data
+	// passed to Write is written to the io.WriteCloser that it returns,
+	// which writes the transformed data to w and is closed when the entry
+	// is flushed. Header.Size is the size of the data before it is
+	// transformed, and Write enforces it as usual; the transformed data is
+	// spooled as by WriteDeferredHeader so that the header can be written
+	// with the size of the data that is stored. The transform may modify
+	// hdr, which is a copy of the caller's Header, such as to add a PAX
+	// record describing the transformation. If it returns nil, the data of
+	// that entry is written as is.
+	//
+	// It does not apply to entries begun by WriteDeferredHeader,
+	// WriteSparseHeader, or CopyEntry.
+	ContentTransform func(hdr *Header, w io.Writer) io.WriteCloser
+
+	// SyncEntries causes Flush to commit each entry to stable storage once
+	// it is complete, such that a crash loses at most the entry being
+	// written. SyncBytes, if positive, causes the Writer to do so whenever
+	// SyncBytes bytes have been written since it last did, even within an
+	// entry. Either writes out any buffered output and then calls the Sync
+	// method of the underlying io.Writer if it has one, as *os.File does.
+	// An error from Sync names the entry and is persistent.
+	SyncEntries bool
+	SyncBytes   int64
+
+	// EntryFlushed, if non-nil, is called by Flush once each entry is
+	// complete and, if requested, synced, with the entry's name and the
+	// value of Written at that point, such as to record progress markers
+	// at which a restarted job can resume. If it returns an error, Flush
+	// returns it.
+	EntryFlushed func(name string, written int64) error
+
+	// Limiter, if non-nil, limits the rate at which the Writer writes
+	// the archive, including headers and padding, before any buffering
+	// for WriteBufferSize.
+	Limiter Limiter
+
+	// Metrics, if non-nil, receives the headers that WriteHeader writes,
+	// including those of entries begun by other methods, the amount of
+	// data that Write accepts, and the errors reported by WriteHeader,
+	// Write, Flush, and Close. Headers whose writing is deferred, as by
+	// WriteDeferredHeader, are received once they are written.
+	Metrics Metrics
+
+	// Journal, if non-nil, receives a record each time Flush completes
+	// an entry, once any buffered output has been written out and, if
+	// SyncEntries is set, synced. The record names the entry and the
+	// offset at which it ends. If the archive is written to seekable
+	// storage from its start, RecoverArchive can use the journal after
+	// a crash to cut the archive back to its last complete entry and
+	// finalize it. Records are only appended, so that a crash while one
+	// is written leaves the preceding ones intact. An error writing the
+	// journal names the entry and is persistent.
+	Journal io.Writer
+
+	// WriteIndex causes Close to write an index of the entries of the
+	// archive, just before the trailer, from which OpenIndex locates the
+	// entries without reading their headers. The index is held in the
+	// PAX records of a final global extended header, which other readers
+	// ignore or, as Reader does, return as such. If IndexDigest is not
+	// empty, it names a digest algorithm, as for Header.SetDigest, with
+	// which the data of each entry is hashed for the index.
+	WriteIndex  bool
+	IndexDigest string
+
+	w    io.Writer
+	bw   *bufio.Writer   // buffer in front of w, if WriteBufferSize is set
+	init bool            // whether anything has been written
+	nb   int64           // number of unwritten bytes for current file entry
+	pad  int64           // amount of padding to write after current file entry
+	size int64           // total number of data bytes for current file entry
+	name string          // name of current file entry
+	nxhr int64           // number of extended headers written
+	open bool            // whether the current file entry has not been flushed
+	off  int64           // number of bytes written to w
+	ent  int64           // offset in w where the current file entry began
+	hdr  Header          // Shallow copy of Header that is safe for mutations
+	blk  block           // Buffer to use as temporary local storage
+	spl  *spool          // data of current file entry, if its header is deferred
+	xw   io.WriteCloser  // transform of the data of current file entry, if any
+	bf   *backfill       // header of current file entry, if it is to be filled in
+	sw   syncer          // w, if it can be synced
+	ws   io.WriteSeeker  // w, if it can seek
+	soff int64           // value of off when output was last synced
+	seen map[string]bool // cleaned names of entries written, if CheckLinks is set
+	idx  []indexRecord   // entries written, if WriteIndex is set
+	irec indexRecord     // current file entry, if WriteIndex is set
+	ih   hash.Hash       // digest of the data of current file entry, if IndexDigest is set
+	merr error           // error last reported to Metrics
+	dirs map[string]bool // cleaned names of directories written, if ParentDirs is set
+	dry  bool            // whether headers are only encoded, by EntrySize, without recording their names
+	raw  bool            // whether the current header is written without NormalizeNames, HeaderHooks, and ParentDirs
 
 	// err is a persistent error.
 	// It is only the responsibility of every exported method of Writer to
@@ -31,52 +279,871 @@ type Writer struct {
 	err error
 }
 
+// A NumericEncoding selects between the two mechanisms for encoding numeric
+// values that are too large (or negative) for a USTAR header: PAX records
+// and GNU base-256 (binary) fields. Some consumers only support one of them.
+type NumericEncoding int
+
+const (
+	// NumericDefault uses PAX records where possible and only falls back
+	// to base-256 encoding when a header cannot otherwise be represented.
+	NumericDefault NumericEncoding = iota
+
+	// NumericBase256 uses base-256 encoding in preference to PAX records
+	// when numeric fields are the only reason a plain USTAR header cannot
+	// be used. Fields that GNU cannot represent (such as sub-second
+	// timestamps) still require PAX records.
+	NumericBase256
+
+	// NumericPAX never uses base-256 encoding. Headers that cannot be
+	// represented with PAX records are rejected with ErrHeader.
+	NumericPAX
+)
+
+// A TimePrecision selects how precisely the Writer records timestamps.
+// Only the PAX format can store timestamps with sub-second precision.
+type TimePrecision int
+
+const (
+	// TimeDefault records timestamps with full precision, using PAX
+	// records whenever a timestamp has a sub-second component.
+	TimeDefault TimePrecision = iota
+
+	// TimeSeconds truncates timestamps to whole seconds (towards negative
+	// infinity) so that sub-second components never require PAX records.
+	TimeSeconds
+
+	// TimePAX always records non-zero timestamps as PAX records with full
+	// precision, even if they would fit in the USTAR or GNU header fields.
+	// Headers that cannot be represented in the PAX format are rejected
+	// with ErrHeader.
+	TimePAX
+)
+
 // NewWriter creates a new Writer writing to w.
 func NewWriter(w io.Writer) *Writer { return &Writer{w: w} }
 
 // Flush finishes writing the current file's block padding.
-// The current file must be fully written before Flush can be called.
+// The current file must be fully written before Flush can be called,
+// unless PadShortEntries is set.
 //
-// Deprecated: This is unecessary as the next call to WriteHeader or Close
-// will implicitly flush out the file's padding.
+// Unless ExplicitFlush is set, calling Flush is optional as the next call to
+// WriteHeader or Close implicitly flushes out the file's padding. However,
+// calling it reports any error writing the padding while the file is still
+// the current one. Such errors name the file and are persistent.
 func (tw *Writer) Flush() error {
+	err := tw.flushEntry()
+	if tw.Metrics != nil {
+		tw.reportError(err)
+	}
+	return err
+}
+
+// flushEntry is Flush without the reporting of errors to tw.Metrics.
+func (tw *Writer) flushEntry() error {
+	open := tw.open
+	if err := tw.flush(); err != nil || !open {
+		return err
+	}
+	if tw.WriteIndex {
+		tw.finishIndexEntry()
+	}
+	if tw.SyncEntries {
+		if err := tw.syncOutput(); err != nil {
+			tw.err = fmt.Errorf("archive/tar: entry %q: syncing: %v", tw.name, err)
+			return tw.err
+		}
+	}
+	if tw.Journal != nil {
+		if err := tw.writeJournal(); err != nil {
+			tw.err = fmt.Errorf("archive/tar: entry %q: writing journal: %v", tw.name, err)
+			return tw.err
+		}
+	}
+	if tw.EntryFlushed != nil {
+		return tw.EntryFlushed(tw.name, tw.off) // Non-fatal error
+	}
+	return nil
+}
+
+// flush is Flush without the handling of entries that are complete.
+func (tw *Writer) flush() error {
 	if tw.err != nil {
 		return tw.err
 	}
+	if tw.xw != nil {
+		if err := tw.closeTransform(); err != nil {
+			return err
+		}
+	}
+	if tw.spl != nil {
+		if err := tw.flushSpool(); err != nil {
+			return err
+		}
+	}
+	if tw.bf != nil {
+		if err := tw.flushBackfill(); err != nil {
+			return err
+		}
+	}
 	if tw.nb > 0 {
-		return fmt.Errorf("archive/tar: missed writing %d bytes", tw.nb)
+		if !tw.PadShortEntries {
+			return fmt.Errorf("archive/tar: entry %q: wrote %d of %d bytes", tw.name, tw.size-tw.nb, tw.size)
+		}
+		if tw.ih != nil {
+			io.CopyN(tw.ih, zeroReader{}, tw.nb)
+		}
+		tw.pad += tw.nb
+		tw.nb = 0
+	}
+	for tw.pad > 0 {
+		n := tw.pad
+		if n > blockSize {
+			n = blockSize
+		}
+		if _, err := tw.write(zeroBlock[:n]); err != nil {
+			tw.err = fmt.Errorf("archive/tar: entry %q: writing padding: %v", tw.name, err)
+			return tw.err
+		}
+		tw.pad -= n
 	}
-	if _, tw.err = tw.w.Write(zeroBlock[:tw.pad]); tw.err != nil {
+	tw.open = false
+	return nil
+}
+
+// implicitFlush flushes the current file entry before another is written.
+// If ExplicitFlush is set, it reports an error instead if the current file
+// entry has not already been flushed.
+func (tw *Writer) implicitFlush() error {
+	if tw.err != nil {
 		return tw.err
 	}
-	tw.pad = 0
+	if tw.ExplicitFlush && tw.open {
+		return fmt.Errorf("archive/tar: entry %q: not flushed", tw.name) // Non-fatal error
+	}
+	return tw.flushEntry()
+}
+
+// Written reports the total number of bytes written to the underlying
+// io.Writer so far, including any that are buffered.
+func (tw *Writer) Written() int64 {
+	return tw.off
+}
+
+// EntryWritten reports the number of bytes written to the underlying
+// io.Writer for the current file entry so far. This includes the header
+// blocks, any extended headers that precede them, the file's data,
+// and any padding written by Flush. It reports zero after Close.
+func (tw *Writer) EntryWritten() int64 {
+	return tw.off - tw.ent
+}
+
+// EntrySize reports the number of bytes that WriteHeader followed by
+// hdr.Size bytes of data and Flush would add to the archive, given the
+// options of tw that affect the encoding of headers. This includes any
+// extended headers or GNU long name entries, the header block, and the
+// padding of the data. The header is encoded, but not written, and any
+// error that WriteHeader would report for it is returned. HeaderHooks and
+// NormalizeNames are called as by WriteHeader, and the entries that it
+// would write for ParentDirs are included. The size of the data is
+// taken as is, regardless of ContentTransform, and any padding for
+// DataAlignment, which depends on the offset of the entry, is excluded.
+//
+// An archive also ends with the 1024 bytes of the trailer written by
+// Close, unless OmitTrailer is set.
+func (tw *Writer) EntrySize(hdr *Header) (int64, error) {
+	ew := tw.encoder()
+	if err := ew.writeHeader(hdr, nil); err != nil {
+		return 0, err
+	}
+	return ew.off + ew.nb + ew.pad, nil
+}
+
+// encoder returns a Writer that discards its output, but encodes headers
+// as tw does. It shares the names recorded by tw, which it does not modify.
+func (tw *Writer) encoder() *Writer {
+	return &Writer{
+		NumericEncoding:   tw.NumericEncoding,
+		TimePrecision:     tw.TimePrecision,
+		AlwaysPAX:         tw.AlwaysPAX,
+		PreferUSTARPrefix: tw.PreferUSTARPrefix,
+		PAXRecordOrder:    tw.PAXRecordOrder,
+		HeaderHooks:       tw.HeaderHooks,
+		NormalizeNames:    tw.NormalizeNames,
+		PAXHeaderName:     tw.PAXHeaderName,
+		CheckLinks:        tw.CheckLinks,
+		ParentDirs:        tw.ParentDirs,
+		w:                 ioutil.Discard,
+		nxhr:              tw.nxhr,
+		seen:              tw.seen,
+		dirs:              tw.dirs,
+		dry:               true,
+	}
+}
+
+// write writes b to the underlying io.Writer, counting the bytes written.
+func (tw *Writer) write(b []byte) (int, error) {
+	if !tw.init {
+		tw.init = true
+		tw.sw, _ = tw.w.(syncer)
+		tw.ws, _ = tw.w.(io.WriteSeeker)
+		if tw.WriteBufferSize > 0 {
+			tw.bw = bufio.NewWriterSize(tw.w, tw.WriteBufferSize)
+			tw.w = tw.bw
+		}
+	}
+	if tw.Limiter != nil {
+		if err := tw.Limiter.WaitN(len(b)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := tw.w.Write(b)
+	tw.off += int64(n)
+	if err == nil && tw.SyncBytes > 0 && tw.off-tw.soff >= tw.SyncBytes {
+		err = tw.syncOutput()
+	}
+	return n, err
+}
+
+// A syncer is an io.Writer that can commit its output to stable storage.
+type syncer interface {
+	Sync() error
+}
+
+// syncOutput writes out any buffered output and syncs the underlying
+// io.Writer, if it is a syncer.
+func (tw *Writer) syncOutput() error {
+	if tw.bw != nil {
+		if err := tw.bw.Flush(); err != nil {
+			return err
+		}
+	}
+	tw.soff = tw.off
+	if tw.sw != nil {
+		return tw.sw.Sync()
+	}
 	return nil
 }
 
 // WriteHeader writes hdr and prepares to accept the file's contents.
-// WriteHeader calls Flush if it is not the first header.
+// WriteHeader calls Flush if it is not the first header,
+// unless ExplicitFlush is set.
 // Calling after a Close will return ErrWriteAfterClose.
+//
+// If ContentTransform is set, the header is only written once the entry is
+// flushed, as for WriteDeferredHeader, and errors in hdr are reported then.
 func (tw *Writer) WriteHeader(hdr *Header) error {
-	if err := tw.Flush(); err != nil {
+	err := tw.writeEntryHeader(hdr)
+	if tw.Metrics != nil {
+		tw.reportError(err)
+	}
+	return err
+}
+
+// writeEntryHeader is WriteHeader without the reporting of errors to
+// tw.Metrics.
+func (tw *Writer) writeEntryHeader(hdr *Header) error {
+	if tw.ContentTransform == nil || isHeaderOnlyType(hdr.Typeflag) {
+		return tw.writeHeader(hdr, nil)
+	}
+	if err := tw.implicitFlush(); err != nil {
+		return err
+	}
+	if hdr.Size < 0 {
+		return ErrHeader // Non-fatal error
+	}
+	spl := &spool{hdr: *hdr, max: tw.SpoolSize, dir: tw.SpoolDir}
+	xw := tw.ContentTransform(&spl.hdr, spl)
+	if xw == nil {
+		return tw.writeHeader(hdr, nil)
+	}
+	tw.ent = tw.off
+	tw.name = hdr.Name
+	tw.spl, tw.xw = spl, xw
+	tw.nb, tw.size = hdr.Size, hdr.Size
+	tw.open = true
+	return nil
+}
+
+// closeTransform completes the transformed data of the current file entry,
+// padding it with zeros if PadShortEntries is set.
+func (tw *Writer) closeTransform() error {
+	if tw.nb > 0 && !tw.PadShortEntries {
+		return fmt.Errorf("archive/tar: entry %q: wrote %d of %d bytes", tw.name, tw.size-tw.nb, tw.size)
+	}
+	xw := tw.xw
+	tw.xw = nil
+	var err error
+	for tw.nb > 0 && err == nil {
+		n := tw.nb
+		if n > blockSize {
+			n = blockSize
+		}
+		var nn int
+		nn, err = xw.Write(zeroBlock[:n])
+		tw.nb -= int64(nn)
+	}
+	if cerr := xw.Close(); err == nil {
+		err = cerr
+	}
+	tw.nb = 0
+	if err != nil {
+		tw.spl.close()
+		tw.spl = nil
+		tw.err = fmt.Errorf("archive/tar: entry %q: transforming data: %v", tw.name, err)
+		return tw.err
+	}
+	return nil
+}
+
+// WriteFile writes hdr followed by the file's data, which is read from r
+// until io.EOF, and flushes the entry unless ExplicitFlush is set.
+// The data must be exactly hdr.Size bytes long, or none for special types
+// like TypeDir, which have no data itself; r may be nil if there is none.
+// An error naming the entry is reported if r is shorter, in which case the
+// entry remains incomplete, or if r is longer, in which case the excess is
+// not written.
+func (tw *Writer) WriteFile(hdr *Header, r io.Reader) error {
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if r == nil {
+		r = strings.NewReader("")
+	}
+	size := tw.nb
+	n, err := io.CopyN(tw, r, size)
+	if err == io.EOF {
+		return fmt.Errorf("archive/tar: entry %q: read %d of %d bytes", tw.name, n, size)
+	}
+	if err != nil {
+		return err
+	}
+	if nr, _ := io.ReadFull(r, tw.blk[:1]); nr > 0 {
+		return fmt.Errorf("archive/tar: entry %q: data is longer than %d bytes", tw.name, size)
+	}
+	if tw.ExplicitFlush {
+		return nil
+	}
+	return tw.Flush()
+}
+
+// WriteDir writes a header for a directory as returned by DirHeader,
+// with the given modification time.
+func (tw *Writer) WriteDir(name string, mtime time.Time) error {
+	hdr := DirHeader(name)
+	hdr.ModTime = mtime
+	return tw.WriteHeader(hdr)
+}
+
+// WriteSymlink writes a header for a symbolic link as returned by
+// SymlinkHeader, with the given modification time.
+func (tw *Writer) WriteSymlink(name, target string, mtime time.Time) error {
+	hdr := SymlinkHeader(name, target)
+	hdr.ModTime = mtime
+	return tw.WriteHeader(hdr)
+}
+
+// WriteDevice writes a header for a device as returned by DeviceHeader,
+// with the given modification time. It reports ErrHeader if typeflag is
+// neither TypeChar nor TypeBlock.
+func (tw *Writer) WriteDevice(name string, typeflag byte, major, minor int64, mtime time.Time) error {
+	if typeflag != TypeChar && typeflag != TypeBlock {
+		return ErrHeader
+	}
+	hdr := DeviceHeader(name, typeflag, major, minor)
+	hdr.ModTime = mtime
+	return tw.WriteHeader(hdr)
+}
+
+// WriteDeferredHeader begins a regular file whose size is not known in
+// advance, such as one whose contents are generated on the fly. Call Write
+// to supply the file's data, which may be of any length. The data is
+// spooled, in memory up to SpoolSize bytes and in a temporary file beyond
+// that, until the entry is flushed, at which point hdr is written with
+// its Size set to the length of the data, followed by the data.
+//
+// Errors in hdr are thus only reported when the entry is flushed, by Flush,
+// WriteHeader, or Close. It reports ErrHeader if hdr is of a special type
+// like TypeDir, which has no data.
+func (tw *Writer) WriteDeferredHeader(hdr *Header) error {
+	if err := tw.implicitFlush(); err != nil {
+		return err
+	}
+	if isHeaderOnlyType(hdr.Typeflag) {
+		return ErrHeader // Non-fatal error
+	}
+	if tw.BackfillHeaders {
+		ws := tw.ws
+		if !tw.init {
+			ws, _ = tw.w.(io.WriteSeeker)
+		}
+		if ws != nil {
+			hdr := *hdr
+			hdr.Size = 0
+			if err := tw.writeHeader(&hdr, nil); err != nil {
+				return err
+			}
+			tw.bf = &backfill{blk: tw.blk, hoff: tw.off - blockSize}
+			return nil
+		}
+	}
+	tw.ent = tw.off
+	tw.name = hdr.Name
+	tw.spl = &spool{hdr: *hdr, max: tw.SpoolSize, dir: tw.SpoolDir}
+	tw.open = true
+	return nil
+}
+
+// A backfill holds the header block of a file entry begun by
+// WriteDeferredHeader whose size is filled in once it is flushed.
+type backfill struct {
+	blk  block // header block, as written with a size of zero
+	hoff int64 // value of off before the header block was written
+}
+
+// flushBackfill fills in the size and checksum of the header of the current
+// file entry, whose data follows it, and prepares to write its padding.
+func (tw *Writer) flushBackfill() error {
+	bf := tw.bf
+	tw.bf = nil
+	size := tw.off - bf.hoff - blockSize
+	var f formatter
+	switch field := bf.blk.V7().Size(); {
+	case bf.blk.guessFormat() == formatGNU:
+		f.formatNumeric(field, size)
+	case fitsInOctal(len(field), size):
+		f.formatOctal(field, size)
+	default:
+		f.err = ErrFieldTooLong
+	}
+	if f.err != nil {
+		tw.err = fmt.Errorf("archive/tar: entry %q: %d bytes of data do not fit in the header", tw.name, size)
+		return tw.err
+	}
+	(*Block)(&bf.blk).SetChecksum()
+
+	// Overwrite the header block in the underlying io.Writer.
+	var err error
+	if tw.bw != nil {
+		err = tw.bw.Flush()
+	}
+	var cur int64
+	if err == nil {
+		cur, err = tw.ws.Seek(0, io.SeekCurrent)
+	}
+	if err == nil {
+		_, err = tw.ws.Seek(cur-(tw.off-bf.hoff), io.SeekStart)
+	}
+	if err == nil {
+		_, err = tw.ws.Write(bf.blk[:])
+	}
+	if err == nil {
+		_, err = tw.ws.Seek(cur, io.SeekStart)
+	}
+	if err != nil {
+		tw.err = fmt.Errorf("archive/tar: entry %q: filling in header: %v", tw.name, err)
+		return tw.err
+	}
+	tw.size = size
+	tw.pad = -size & (blockSize - 1) // blockSize is a power of two
+	return nil
+}
+
+// flushSpool writes the header and the data of the current file entry,
+// whose header was deferred.
+func (tw *Writer) flushSpool() error {
+	spl := tw.spl
+	tw.spl, tw.open = nil, false
+	defer spl.close()
+	hdr := spl.hdr
+	hdr.Size = spl.size
+	if err := tw.writeHeader(&hdr, nil); err != nil {
+		return err
+	}
+	r, err := spl.reader()
+	if err == nil {
+		_, err = io.Copy(dataWriter{tw}, r)
+	}
+	if err != nil && tw.err == nil {
+		tw.err = fmt.Errorf("archive/tar: entry %q: reading spooled data: %v", tw.name, err)
+		return tw.err
+	}
+	return err
+}
+
+// A spool holds the data of a file entry whose header is deferred.
+type spool struct {
+	hdr  Header
+	max  int64  // number of bytes to hold in memory
+	dir  string // directory for the temporary file
+	size int64  // number of bytes written
+	buf  bytes.Buffer
+	f    *os.File // temporary file holding the data, if any
+}
+
+func (s *spool) Write(b []byte) (int, error) {
+	if s.f == nil {
+		max := s.max
+		if max <= 0 {
+			max = 1 << 20
+		}
+		if int64(s.buf.Len()+len(b)) <= max {
+			s.size += int64(len(b))
+			return s.buf.Write(b)
+		}
+		f, err := ioutil.TempFile(s.dir, "tar-spool")
+		if err != nil {
+			return 0, err
+		}
+		s.f = f
+		if _, err := s.buf.WriteTo(f); err != nil {
+			return 0, err
+		}
+	}
+	n, err := s.f.Write(b)
+	s.size += int64(n)
+	return n, err
+}
+
+// reader returns a reader for the data that was written.
+func (s *spool) reader() (io.Reader, error) {
+	if s.f == nil {
+		return &s.buf, nil
+	}
+	_, err := s.f.Seek(0, io.SeekStart)
+	return s.f, err
+}
+
+// close discards the data.
+func (s *spool) close() {
+	if s.f != nil {
+		s.f.Close()
+		os.Remove(s.f.Name())
+	}
+}
+
+// WriteSparseHeader writes hdr for a sparse regular file and prepares to
+// accept the file's data fragments. The file is encoded using the GNU
+// sparse format 1.0, which requires the PAX format.
+//
+// The sparse map sp lists the data fragments of the file in increasing
+// order of offset; all other regions of the file are holes (that read
+// back as zeros). The fragments must not overlap and must lie within
+// hdr.Size, which is the logical size of the file.
+// After WriteSparseHeader, call Write to supply only the contents of the
+// fragments in order, writing exactly the sum of their lengths in total.
+func (tw *Writer) WriteSparseHeader(hdr *Header, sp []SparseEntry) error {
+	if sp == nil {
+		sp = []SparseEntry{}
+	}
+	return tw.writeHeader(hdr, sp)
+}
+
+// writeHeader writes hdr. If sp is non-nil, hdr is written as a sparse file
+// with sp as the sparse map.
+func (tw *Writer) writeHeader(hdr *Header, sp []SparseEntry) (err error) {
+	if err := tw.implicitFlush(); err != nil {
 		return err
 	}
 
 	tw.hdr = *hdr // Shallow copy of Header
-	switch allowedFormats, paxHdrs := tw.hdr.allowedFormats(); {
+	if tw.NormalizeNames != nil && !tw.raw {
+		tw.hdr.Name = tw.NormalizeNames(tw.hdr.Name)
+		if tw.hdr.Linkname != "" {
+			tw.hdr.Linkname = tw.NormalizeNames(tw.hdr.Linkname)
+		}
+	}
+	if len(tw.HeaderHooks) > 0 && !tw.raw {
+		tw.hdr.Xattrs = copyRecords(hdr.Xattrs)
+		tw.hdr.PAXRecords = copyRecords(hdr.PAXRecords)
+		tw.hdr.Extensions = copyExtensions(hdr.Extensions)
+		for _, hook := range tw.HeaderHooks {
+			if err := hook(&tw.hdr); err != nil {
+				return err // Non-fatal error
+			}
+		}
+	}
+	if tw.CheckLinks {
+		if tw.hdr.Typeflag == TypeLink && !tw.seen[mapName(tw.hdr.Linkname)] {
+			return &LinkError{Name: tw.hdr.Name, Linkname: tw.hdr.Linkname} // Non-fatal error
+		}
+		defer func() {
+			if err == nil && !tw.dry {
+				if tw.seen == nil {
+					tw.seen = make(map[string]bool)
+				}
+				tw.seen[mapName(tw.name)] = true
+			}
+		}()
+	}
+	if tw.ParentDirs != nil {
+		if !tw.raw {
+			if err := tw.writeParentDirs(); err != nil {
+				return err
+			}
+		}
+		if tw.hdr.Typeflag == TypeDir {
+			defer func() {
+				if err == nil && !tw.dry {
+					if tw.dirs == nil {
+						tw.dirs = make(map[string]bool)
+					}
+					tw.dirs[mapName(tw.name)] = true
+				}
+			}()
+		}
+	}
+	tw.name = tw.hdr.Name
+	tw.ent = tw.off
+	if tw.DataAlignment > 0 {
+		h, err := tw.alignHeader(&tw.hdr, sp)
+		if err != nil {
+			return err // Non-fatal error
+		}
+		tw.hdr = *h
+	}
+
+	// A sparse file stores the sparse map and then the data fragments
+	// under a synthetic name, with the real name and size in PAX records.
+	var sparseMap string
+	var sparseHdrs map[string]string
+	if sp != nil {
+		var dataSize int64
+		sparseMap, dataSize = formatGNUSparseMap1x0(sp)
+		if !validateSparseEntries(sp, tw.hdr.Size) ||
+			(tw.hdr.Typeflag != TypeReg && tw.hdr.Typeflag != TypeRegA) {
+			return ErrHeader // Non-fatal error
+		}
+		sparseHdrs = map[string]string{
+			paxGNUSparseMajor:    "1",
+			paxGNUSparseMinor:    "0",
+			paxGNUSparseName:     tw.hdr.Name,
+			paxGNUSparseRealSize: strconv.FormatInt(tw.hdr.Size, 10),
+		}
+		dir, file := path.Split(tw.hdr.Name)
+		tw.hdr.Name = path.Join(dir, "GNUSparseFile.0", file)
+		tw.hdr.Size = int64(len(sparseMap)) + dataSize
+	}
+	if tw.TimePrecision == TimeSeconds {
+		tw.hdr.ModTime = tw.hdr.ModTime.Truncate(time.Second)
+		tw.hdr.AccessTime = tw.hdr.AccessTime.Truncate(time.Second)
+		tw.hdr.ChangeTime = tw.hdr.ChangeTime.Truncate(time.Second)
+	}
+	allowedFormats, paxHdrs := tw.hdr.allowedFormats()
+	if tw.TimePrecision == TimePAX && allowedFormats != formatUnknown {
+		for k, ts := range map[string]time.Time{
+			paxMtime: tw.hdr.ModTime,
+			paxAtime: tw.hdr.AccessTime,
+			paxCtime: tw.hdr.ChangeTime,
+		} {
+			if !ts.IsZero() {
+				paxHdrs[k] = formatPAXTime(ts)
+				allowedFormats &= formatPAX
+			}
+		}
+	}
+	if tw.AlwaysPAX && allowedFormats&formatPAX != 0 {
+		paxHdrs[paxPath] = tw.hdr.Name
+		paxHdrs[paxUid] = strconv.FormatInt(tw.hdr.Uid64(), 10)
+		paxHdrs[paxGid] = strconv.FormatInt(tw.hdr.Gid64(), 10)
+		for k, v := range map[string]string{paxLinkpath: tw.hdr.Linkname, paxUname: tw.hdr.Uname, paxGname: tw.hdr.Gname} {
+			if v != "" {
+				paxHdrs[k] = v
+			}
+		}
+		for k, ts := range map[string]time.Time{
+			paxMtime: tw.hdr.ModTime,
+			paxAtime: tw.hdr.AccessTime,
+			paxCtime: tw.hdr.ChangeTime,
+		} {
+			if _, ok := paxHdrs[k]; !ok && !ts.IsZero() {
+				paxHdrs[k] = formatPAXTime(ts)
+			}
+		}
+		allowedFormats &= formatPAX
+	}
+	if sparseHdrs != nil && allowedFormats != formatUnknown {
+		for k, v := range sparseHdrs {
+			paxHdrs[k] = v
+		}
+		allowedFormats &= formatPAX
+	}
+	if tw.NumericEncoding == NumericPAX {
+		allowedFormats &^= formatGNU
+	}
+	if _, _, ok := splitUSTARPath(tw.hdr.Name); ok && tw.PreferUSTARPrefix && !hasNUL(tw.hdr.Name) {
+		if allowedFormats&formatPAX != 0 {
+			allowedFormats &^= formatGNU // GNU has no prefix field
+		}
+		if !tw.AlwaysPAX {
+			delete(paxHdrs, paxPath)
+		}
+	}
+	preferGNU := tw.NumericEncoding == NumericBase256 && onlyNumericPAX(paxHdrs)
+	switch {
 	case allowedFormats&formatUSTAR != 0:
 		tw.err = tw.writeUSTARHeader(&tw.hdr)
-		return tw.err
+		return tw.reportEntry(formatUSTAR)
+	case allowedFormats&formatGNU != 0 && preferGNU:
+		tw.err = tw.writeGNUHeader(&tw.hdr)
+		return tw.reportEntry(formatGNU)
 	case allowedFormats&formatPAX != 0:
 		tw.err = tw.writePAXHeader(&tw.hdr, paxHdrs)
-		return tw.err
+		if tw.err == nil && sparseHdrs != nil {
+			_, tw.err = io.WriteString(dataWriter{tw}, sparseMap)
+		}
+		return tw.reportEntry(formatPAX)
 	case allowedFormats&formatGNU != 0:
 		tw.err = tw.writeGNUHeader(&tw.hdr)
-		return tw.err
+		return tw.reportEntry(formatGNU)
 	default:
 		return ErrHeader // Non-fatal error
 	}
 }
 
+// WriteRawHeader writes blk, a raw header block such as one returned by
+// Reader.RawHeader, verbatim and prepares to accept the file's contents.
+// The size of the contents and the type flag are taken from blk, which
+// must be exactly one block long and have a valid checksum.
+// None of the Writer's options that affect header encoding apply.
+func (tw *Writer) WriteRawHeader(blk []byte) error {
+	if err := tw.implicitFlush(); err != nil {
+		return err
+	}
+	tw.ent = tw.off
+
+	if len(blk) != blockSize {
+		return ErrHeader // Non-fatal error
+	}
+	copy(tw.blk[:], blk)
+	var p parser
+	size := p.parseNumeric(tw.blk.V7().Size())
+	if tw.blk.GetFormat() == formatUnknown || p.err != nil || size < 0 {
+		return ErrHeader // Non-fatal error
+	}
+	tw.name = p.parseString(tw.blk.V7().Name())
+	tw.err = tw.writeRawHeader(&tw.blk, size, tw.blk.V7().TypeFlag()[0])
+	return tw.err
+}
+
+// CopyEntry writes the entry most recently returned by tr.Next verbatim,
+// without decoding and re-encoding it, and copies its data from tr.
+// The entry is written as it was stored in the input, including any
+// extended headers, GNU long name entries, and sparse maps that precede
+// its data, regardless of Reader options such as StripComponents and of
+// changes made to the Header returned by Next. Only the padding after the
+// data is written anew, as zeros. None of the Writer's options that affect
+// header encoding apply.
+//
+// The data of the entry must not have been read from tr.
+func (tw *Writer) CopyEntry(tr *Reader) error {
+	if err := tw.implicitFlush(); err != nil {
+		return err
+	}
+	if !tr.hasRaw || tr.err != nil {
+		return errors.New("archive/tar: CopyEntry: no current entry") // Non-fatal error
+	}
+	if tr.rfr.nb != tr.rawNB {
+		return fmt.Errorf("archive/tar: entry %q: CopyEntry after Read", tr.name) // Non-fatal error
+	}
+	tw.ent = tw.off
+	tw.name = tr.name
+
+	raw := tr.rawHdrs.Bytes()
+	if len(raw) == 0 {
+		raw = tr.raw[:]
+	}
+	if _, err := tw.write(raw); err != nil {
+		tw.err = err
+		return err
+	}
+	tw.nb, tw.size = tr.rfr.nb, tr.rfr.nb
+	tw.pad = tr.pad
+	tw.open = true
+	if err := tw.startIndexEntry(tr.raw.V7().TypeFlag()[0]); err != nil {
+		tw.err = err
+		return err
+	}
+	if _, err := io.Copy(tw, &tr.rfr); err != nil {
+		return err
+	}
+	return nil
+}
+
+// formatGNUSparseMap1x0 formats the sparse map sp as stored in GNU's PAX
+// sparse format version 1.0, padded to a multiple of the block size.
+// It also returns the total length of the data fragments.
+func formatGNUSparseMap1x0(sp []SparseEntry) (string, int64) {
+	var b []byte
+	var dataSize int64
+	b = strconv.AppendInt(b, int64(len(sp)), 10)
+	b = append(b, '\n')
+	for _, s := range sp {
+		b = strconv.AppendInt(b, s.Offset, 10)
+		b = append(b, '\n')
+		b = strconv.AppendInt(b, s.Length, 10)
+		b = append(b, '\n')
+		dataSize += s.Length
+	}
+	b = append(b, zeroBlock[:-len(b)&(blockSize-1)]...)
+	return string(b), dataSize
+}
+
+// copyRecords returns a copy of m, preserving whether it is nil.
+func copyRecords(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	m2 := make(map[string]string, len(m))
+	for k, v := range m {
+		m2[k] = v
+	}
+	return m2
+}
+
+// onlyNumericPAX reports whether all of the PAX records needed to represent
+// a header are for numeric fields that base-256 encoding could hold instead.
+func onlyNumericPAX(paxHdrs map[string]string) bool {
+	for k := range paxHdrs {
+		switch k {
+		case paxSize, paxUid, paxGid, paxMtime, paxAtime, paxCtime:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// WriteGlobalHeader writes a global extended header (TypeXGlobalHeader)
+// holding the given PAX records. Readers apply these records as defaults
+// for all subsequent entries in the archive, unless overridden by an
+// entry's own records. A record with an empty value removes the default
+// set by a prior global header.
+//
+// The Writer does not apply the records itself; the fields of each header
+// passed to WriteHeader are encoded as usual.
+func (tw *Writer) WriteGlobalHeader(records map[string]string) error {
+	if err := tw.implicitFlush(); err != nil {
+		return err
+	}
+	tw.ent = tw.off
+	for k, v := range records {
+		if !validPAXRecord(k, v) {
+			return ErrHeader // Non-fatal error
+		}
+	}
+	data, err := tw.formatPAXRecords(records)
+	if err != nil {
+		return err
+	}
+	tw.name = globalHeaderName
+	tw.err = tw.writeRawFile(globalHeaderName, data, TypeXGlobalHeader, formatPAX)
+	return tw.err
+}
+
+// globalHeaderName is the name used for global extended headers.
+const globalHeaderName = "GlobalHead.0.0"
+
 func (tw *Writer) writeUSTARHeader(hdr *Header) error {
 	// Check if we can use USTAR prefix/suffix splitting.
 	var namePrefix string
@@ -97,41 +1164,101 @@ func (tw *Writer) writeUSTARHeader(hdr *Header) error {
 
 func (tw *Writer) writePAXHeader(hdr *Header, paxHdrs map[string]string) error {
 	// Write PAX records to the output.
-	if len(paxHdrs) > 0 {
-		// Sort keys for deterministic ordering.
-		var keys []string
-		for k := range paxHdrs {
-			keys = append(keys, k)
-		}
-		sort.Strings(keys)
-
-		// Write each record to a buffer.
-		var buf bytes.Buffer
-		for _, k := range keys {
-			rec, err := formatPAXRecord(k, paxHdrs[k])
-			if err != nil {
-				return err
-			}
-			buf.WriteString(rec)
-		}
-
+	data, err := tw.formatPAXRecords(paxHdrs)
+	if err != nil {
+		return err
+	}
+	if len(data) > 0 {
 		// Write the extended header file.
-		dir, file := path.Split(hdr.Name)
-		name := path.Join(dir, "PaxHeaders.0", file)
-		data := buf.String()
+		name := tw.paxHeaderName(hdr.Name)
 		if err := tw.writeRawFile(name, data, TypeXHeader, formatPAX); err != nil {
 			return err
 		}
 	}
 
-	// Pack the main header.
+	// Pack the main header, splitting the name if so configured.
+	var namePrefix string
+	if prefix, suffix, ok := splitUSTARPath(hdr.Name); ok && tw.PreferUSTARPrefix && !hasNUL(hdr.Name) {
+		namePrefix, hdr.Name = prefix, suffix
+	}
 	var f formatter // Ignore errors since they are expected
 	fmtStr := func(b []byte, s string) { f.formatString(b, toASCII(s)) }
 	blk := tw.templateV7Plus(hdr, fmtStr, f.formatOctal)
+	fmtStr(blk.USTAR().Prefix(), namePrefix)
 	blk.SetFormat(formatPAX)
 	return tw.writeRawHeader(blk, hdr.Size, hdr.Typeflag)
 }
 
+// paxHeaderName expands tw.PAXHeaderName for an entry with the given name.
+func (tw *Writer) paxHeaderName(name string) string {
+	tmpl := tw.PAXHeaderName
+	if tmpl == "" {
+		tmpl = "%d/PaxHeaders.0/%f"
+	}
+	tw.nxhr++
+
+	dir, file := path.Split(name)
+	var b []byte
+	for i := 0; i < len(tmpl); i++ {
+		if tmpl[i] != '%' || i+1 == len(tmpl) {
+			b = append(b, tmpl[i])
+			continue
+		}
+		i++
+		switch tmpl[i] {
+		case 'd':
+			b = append(b, path.Clean(dir)...)
+		case 'f':
+			b = append(b, file...)
+		case 'p':
+			b = strconv.AppendInt(b, int64(os.Getpid()), 10)
+		case 'n':
+			b = strconv.AppendInt(b, tw.nxhr, 10)
+		case '%':
+			b = append(b, '%')
+		default:
+			b = append(b, '%', tmpl[i]) // Leave unknown directives as is
+		}
+	}
+	return path.Clean(string(b))
+}
+
+// formatPAXRecords formats the records of an extended header.
+// The records are ordered by key in increasing byte-wise order, unless
+// tw.PAXRecordOrder chooses otherwise.
+func (tw *Writer) formatPAXRecords(paxHdrs map[string]string) (string, error) {
+	if len(paxHdrs) == 0 {
+		return "", nil
+	}
+
+	// Sort keys for deterministic ordering.
+	keys := make([]string, 0, len(paxHdrs))
+	for k := range paxHdrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	if tw.PAXRecordOrder != nil {
+		keys = tw.PAXRecordOrder(keys)
+	}
+
+	// Write each record to a buffer.
+	var buf bytes.Buffer
+	seen := make(map[string]bool, len(keys))
+	for _, k := range keys {
+		v, ok := paxHdrs[k]
+		if !ok || seen[k] {
+			continue // Ignore unknown and duplicate keys
+		}
+		seen[k] = true
+		rec, err := formatPAXRecord(k, v)
+		if err != nil {
+			return "", err
+		}
+		buf.WriteString(rec)
+	}
+	return buf.String(), nil
+}
+
 func (tw *Writer) writeGNUHeader(hdr *Header) error {
 	// TODO(dsnet): Support writing sparse files.
 	// See https://golang.org/issue/13548
@@ -160,6 +1287,9 @@ func (tw *Writer) writeGNUHeader(hdr *Header) error {
 	if !hdr.ChangeTime.IsZero() {
 		f.formatNumeric(blk.GNU().ChangeTime(), hdr.ChangeTime.Unix())
 	}
+	if hdr.Typeflag == TypeGNUMultiVolume {
+		f.formatNumeric(blk.GNU().Offset(), hdr.VolumeOffset)
+	}
 	blk.SetFormat(formatGNU)
 	return tw.writeRawHeader(blk, hdr.Size, hdr.Typeflag)
 }
@@ -188,8 +1318,8 @@ func (tw *Writer) templateV7Plus(hdr *Header, fmtStr stringFormatter, fmtNum num
 	fmtStr(v7.Name(), hdr.Name)
 	fmtStr(v7.LinkName(), hdr.Linkname)
 	fmtNum(v7.Mode(), hdr.Mode)
-	fmtNum(v7.UID(), int64(hdr.Uid))
-	fmtNum(v7.GID(), int64(hdr.Gid))
+	fmtNum(v7.UID(), hdr.Uid64())
+	fmtNum(v7.GID(), hdr.Gid64())
 	fmtNum(v7.Size(), hdr.Size)
 	fmtNum(v7.ModTime(), modTime.Unix())
 
@@ -232,7 +1362,7 @@ func (tw *Writer) writeRawFile(name, data string, flag byte, format int) error {
 	if err := tw.writeRawHeader(&tw.blk, int64(len(data)), flag); err != nil {
 		return err
 	}
-	_, err := io.WriteString(tw, data)
+	_, err := io.WriteString(dataWriter{tw}, data)
 	return err
 }
 
@@ -240,18 +1370,19 @@ func (tw *Writer) writeRawFile(name, data string, flag byte, format int) error {
 // It sets up the Writer such that it can accept a file of the given size.
 // If the flag is a special header-only flag, then the size is treated as zero.
 func (tw *Writer) writeRawHeader(blk *block, size int64, flag byte) error {
-	if err := tw.Flush(); err != nil {
+	if err := tw.flush(); err != nil {
 		return err
 	}
-	if _, err := tw.w.Write(blk[:]); err != nil {
+	if _, err := tw.write(blk[:]); err != nil {
 		return err
 	}
 	if isHeaderOnlyType(flag) {
 		size = 0
 	}
-	tw.nb = size
+	tw.nb, tw.size = size, size
 	tw.pad = -size & (blockSize - 1) // blockSize is a power of two
-	return nil
+	tw.open = true
+	return tw.startIndexEntry(flag)
 }
 
 // splitUSTARPath splits a path according to USTAR prefix and suffix rules.
@@ -283,16 +1414,67 @@ func splitUSTARPath(name string) (prefix, suffix string, ok bool) {
 // TypeBlock, TypeDir, and TypeFifo returns (0, ErrWriteTooLong) regardless
 // of what the Header.Size claims.
 func (tw *Writer) Write(b []byte) (int, error) {
+	n, err := tw.writeData(b)
+	if tw.Metrics != nil {
+		if n > 0 {
+			tw.Metrics.Bytes(MetricsWrite, n)
+		}
+		tw.reportError(err)
+	}
+	return n, err
+}
+
+// writeData is Write without the reporting to tw.Metrics.
+func (tw *Writer) writeData(b []byte) (int, error) {
 	if tw.err != nil {
 		return 0, tw.err
 	}
+	if tw.xw != nil {
+		overwrite := int64(len(b)) > tw.nb
+		if overwrite {
+			b = b[:tw.nb]
+		}
+		n, err := tw.xw.Write(b)
+		tw.nb -= int64(n)
+		if err != nil {
+			tw.spl.close()
+			tw.spl, tw.xw = nil, nil
+			tw.err = fmt.Errorf("archive/tar: entry %q: transforming data: %v", tw.name, err)
+			return n, tw.err
+		}
+		if overwrite {
+			return n, ErrWriteTooLong // Non-fatal error
+		}
+		return n, nil
+	}
+	if tw.spl != nil {
+		n, err := tw.spl.Write(b)
+		if err != nil {
+			tw.spl.close()
+			tw.spl = nil
+			tw.err = fmt.Errorf("archive/tar: entry %q: spooling data: %v", tw.name, err)
+			return n, tw.err
+		}
+		return n, nil
+	}
+	if tw.bf != nil {
+		n, err := tw.write(b)
+		if tw.ih != nil {
+			tw.ih.Write(b[:n])
+		}
+		tw.err = err
+		return n, err
+	}
 
 	overwrite := int64(len(b)) > tw.nb
 	if overwrite {
 		b = b[:tw.nb]
 	}
-	n, err := tw.w.Write(b)
+	n, err := tw.write(b)
 	tw.nb -= int64(n)
+	if tw.ih != nil {
+		tw.ih.Write(b[:n])
+	}
 	if err == nil && overwrite {
 		return n, ErrWriteTooLong // Non-fatal error
 	}
@@ -302,19 +1484,43 @@ func (tw *Writer) Write(b []byte) (int, error) {
 
 // Close closes the tar archive, flushing any unwritten
 // data to the underlying writer.
+// It reports an error if the current file was not fully written,
+// even if OmitTrailer or OmitFinalPadding is set.
 func (tw *Writer) Close() error {
+	err := tw.close()
+	if tw.Metrics != nil {
+		tw.reportError(err)
+	}
+	return err
+}
+
+// close is Close without the reporting of errors to tw.Metrics.
+func (tw *Writer) close() error {
 	if tw.err == ErrWriteAfterClose {
 		return nil
 	}
 	if tw.err != nil {
 		return tw.err
 	}
+	if tw.OmitFinalPadding && !tw.WriteIndex {
+		tw.pad = 0
+	}
 
 	// Trailer: two zero blocks.
-	err := tw.Flush()
-	for i := 0; i < 2 && err == nil; i++ {
-		_, err = tw.w.Write(zeroBlock[:])
+	err := tw.flushEntry()
+	if err == nil && tw.WriteIndex {
+		err = tw.writeIndex()
+	}
+	for i := 0; i < 2 && err == nil && !tw.OmitTrailer; i++ {
+		_, err = tw.write(zeroBlock[:])
+	}
+	if err == nil && tw.bw != nil {
+		err = tw.bw.Flush()
+	}
+	if err == nil && (tw.SyncEntries || tw.SyncBytes > 0) {
+		err = tw.syncOutput()
 	}
+	tw.ent = tw.off
 
 	// Ensure all future actions are invalid.
 	tw.err = ErrWriteAfterClose
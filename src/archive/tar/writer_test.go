@@ -6,13 +6,16 @@ package tar
 
 import (
 	"bytes"
+	"compress/gzip"
 	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
 	"os"
 	"path"
 	"reflect"
 	"sort"
+	"strconv"
 	"strings"
 	"testing"
 	"testing/iotest"
@@ -207,10 +210,9 @@ func TestWriter(t *testing.T) {
 			header: &Header{
 				Name:     "bad-null.txt",
 				Typeflag: '0',
-				Xattrs:   map[string]string{"null\x00null\x00": "fizzbuzz"},
+				Xattrs:   map[string]string{"null\x00null\x00": "fizzbuzz"}, // Stored as LIBARCHIVE.xattr
 			},
 		}},
-		err: ErrHeader,
 	}, {
 		entries: []*entry{{
 			header: &Header{
@@ -505,6 +507,92 @@ func TestPaxHeadersSorted(t *testing.T) {
 	}
 }
 
+func TestPAXRecordOrder(t *testing.T) {
+	hdr := &Header{
+		Name: "small.txt",
+		Xattrs: map[string]string{
+			"foo": "foo",
+			"bar": "bar",
+			"baz": "baz",
+		},
+	}
+
+	var gotKeys []string
+	var buf bytes.Buffer
+	tw := NewWriter(&buf)
+	tw.PAXRecordOrder = func(keys []string) []string {
+		gotKeys = append([]string(nil), keys...)
+		return []string{paxXattr + "foo", "missing", paxXattr + "bar", paxXattr + "foo"}
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatal(err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	wantKeys := []string{paxXattr + "bar", paxXattr + "baz", paxXattr + "foo"}
+	if !reflect.DeepEqual(gotKeys, wantKeys) {
+		t.Errorf("PAXRecordOrder called with %q, want %q", gotKeys, wantKeys)
+	}
+	if bytes.Contains(buf.Bytes(), []byte("baz=baz")) {
+		t.Error("filtered PAX record was written")
+	}
+	if bytes.Count(buf.Bytes(), []byte("foo=foo")) != 1 {
+		t.Error("repeated PAX record was not written exactly once")
+	}
+	if i, j := bytes.Index(buf.Bytes(), []byte("foo=foo")), bytes.Index(buf.Bytes(), []byte("bar=bar")); i > j {
+		t.Error("PAX records are not in the requested order")
+	}
+
+	got, err := NewReader(&buf).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"foo": "foo", "bar": "bar"}
+	if !reflect.DeepEqual(got.Xattrs, want) {
+		t.Errorf("Xattrs = %v, want %v", got.Xattrs, want)
+	}
+}
+
+func TestPAXHeaderName(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	vectors := []struct {
+		tmpl  string   // Value of PAXHeaderName
+		name  string   // Name of the entries
+		wants []string // Expected names of the extended headers
+	}{
+		{"", "a/b/文件", []string{"a/b/PaxHeaders.0/文件", "a/b/PaxHeaders.0/文件"}},
+		{"", "文件", []string{"PaxHeaders.0/文件", "PaxHeaders.0/文件"}},
+		{"", "/dir/文件/", []string{"/dir/文件/PaxHeaders.0", "/dir/文件/PaxHeaders.0"}},
+		{"%d/PaxHeaders.%p/%f", "a/文件", []string{"a/PaxHeaders." + pid + "/文件", "a/PaxHeaders." + pid + "/文件"}},
+		{"%d/PaxHeaders/%f.%n", "文件", []string{"PaxHeaders/文件.1", "PaxHeaders/文件.2"}},
+		{"100%%/%q%", "文件", []string{"100%/%q%", "100%/%q%"}},
+	}
+
+	for i, v := range vectors {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.PAXHeaderName = v.tmpl
+		var offsets []int
+		for range v.wants {
+			offsets = append(offsets, b.Len())
+			if err := tw.WriteHeader(&Header{Name: v.name, Typeflag: TypeReg}); err != nil {
+				t.Fatalf("test %d, WriteHeader() = %v, want nil", i, err)
+			}
+		}
+
+		for j, want := range v.wants {
+			var blk block
+			copy(blk[:], b.Bytes()[offsets[j]:])
+			var p parser
+			if got := p.parseString(blk.V7().Name()); got != toASCII(want) {
+				t.Errorf("test %d, entry %d, extended header name = %q, want %q", i, j, got, toASCII(want))
+			}
+		}
+	}
+}
+
 func TestUSTARLongName(t *testing.T) {
 	// Create an archive with a path that failed to split with USTAR extension in previous versions.
 	fileinfo, err := os.Stat("testdata/small.txt")
@@ -532,6 +620,7 @@ func TestUSTARLongName(t *testing.T) {
 	}
 	// Test that we can get a long name back out of the archive.
 	reader := NewReader(&buf)
+	reader.AllowInsecurePaths = true // The name is absolute
 	hdr, err = reader.Next()
 	if err != nil {
 		t.Fatal(err)
@@ -587,6 +676,19 @@ func (w *failOnceWriter) Write(b []byte) (int, error) {
 	return len(b), nil
 }
 
+// limitWriter accepts n bytes and then reports io.ErrShortWrite.
+type limitWriter struct{ n int }
+
+func (w *limitWriter) Write(b []byte) (int, error) {
+	if len(b) > w.n {
+		n := w.n
+		w.n = 0
+		return n, io.ErrShortWrite
+	}
+	w.n -= len(b)
+	return len(b), nil
+}
+
 func TestWriterErrors(t *testing.T) {
 	t.Run("HeaderOnly", func(t *testing.T) {
 		tw := NewWriter(new(bytes.Buffer))
@@ -656,6 +758,110 @@ func TestWriterErrors(t *testing.T) {
 		}
 	})
 
+	t.Run("ShortEntry", func(t *testing.T) {
+		tw := NewWriter(new(bytes.Buffer))
+		hdr := &Header{Name: "small.txt", Size: 5}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v, want nil", err)
+		}
+		if _, err := io.WriteString(tw, "Kil"); err != nil {
+			t.Fatalf("WriteString() = %v, want nil", err)
+		}
+		err := tw.WriteHeader(&Header{Name: "small2.txt"})
+		if err == nil {
+			t.Fatalf("WriteHeader() = %v, want non-nil error", err)
+		}
+		if got, want := err.Error(), `archive/tar: entry "small.txt": wrote 3 of 5 bytes`; got != want {
+			t.Errorf("WriteHeader() = %q, want %q", got, want)
+		}
+	})
+
+	t.Run("PadShortEntries", func(t *testing.T) {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.PadShortEntries = true
+		if err := tw.WriteHeader(&Header{Name: "small.txt", Size: 5}); err != nil {
+			t.Fatalf("WriteHeader() = %v, want nil", err)
+		}
+		if _, err := io.WriteString(tw, "Kil"); err != nil {
+			t.Fatalf("WriteString() = %v, want nil", err)
+		}
+		if err := tw.WriteHeader(&Header{Name: "big.txt", Size: 2 * blockSize}); err != nil {
+			t.Fatalf("WriteHeader() = %v, want nil", err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v, want nil", err)
+		}
+		if got, want := b.Len(), 7*blockSize; got != want {
+			t.Fatalf("output size = %d, want %d", got, want)
+		}
+
+		tr := NewReader(&b)
+		for _, want := range []string{"Kil\x00\x00", strings.Repeat("\x00", 2*blockSize)} {
+			if _, err := tr.Next(); err != nil {
+				t.Fatalf("Next() = %v, want nil", err)
+			}
+			if got, err := ioutil.ReadAll(tr); err != nil || string(got) != want {
+				t.Errorf("ReadAll() = (%q, %v), want (%q, nil)", got, err, want)
+			}
+		}
+	})
+
+	t.Run("ExplicitFlush", func(t *testing.T) {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.ExplicitFlush = true
+		if err := tw.WriteHeader(&Header{Name: "small.txt", Size: 5}); err != nil {
+			t.Fatalf("WriteHeader() = %v, want nil", err)
+		}
+		if _, err := io.WriteString(tw, "Kilts"); err != nil {
+			t.Fatalf("WriteString() = %v, want nil", err)
+		}
+		err := tw.WriteHeader(&Header{Name: "small2.txt"})
+		if err == nil {
+			t.Fatalf("WriteHeader() = %v, want non-nil error", err)
+		}
+		if got, want := err.Error(), `archive/tar: entry "small.txt": not flushed`; got != want {
+			t.Errorf("WriteHeader() = %q, want %q", got, want)
+		}
+		if err := tw.WriteGlobalHeader(map[string]string{"comment": "hi"}); err == nil {
+			t.Errorf("WriteGlobalHeader() = %v, want non-nil error", err)
+		}
+		if err := tw.Flush(); err != nil {
+			t.Fatalf("Flush() = %v, want nil", err)
+		}
+		if err := tw.WriteHeader(&Header{Name: "small2.txt"}); err != nil {
+			t.Fatalf("WriteHeader() = %v, want nil", err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v, want nil", err)
+		}
+		if got, want := b.Len(), 5*blockSize; got != want {
+			t.Errorf("output size = %d, want %d", got, want)
+		}
+	})
+
+	t.Run("PaddingError", func(t *testing.T) {
+		tw := NewWriter(&limitWriter{n: blockSize + 5})
+		if err := tw.WriteHeader(&Header{Name: "small.txt", Size: 5}); err != nil {
+			t.Fatalf("WriteHeader() = %v, want nil", err)
+		}
+		if _, err := io.WriteString(tw, "Kilts"); err != nil {
+			t.Fatalf("WriteString() = %v, want nil", err)
+		}
+		err := tw.Flush()
+		if err == nil {
+			t.Fatalf("Flush() = %v, want non-nil error", err)
+		}
+		want := `archive/tar: entry "small.txt": writing padding: short write`
+		if got := err.Error(); got != want {
+			t.Errorf("Flush() = %q, want %q", got, want)
+		}
+		if err2 := tw.WriteHeader(&Header{Name: "small2.txt"}); err2 != err {
+			t.Errorf("WriteHeader() = %v, want %v", err2, err)
+		}
+	})
+
 	t.Run("Persistence", func(t *testing.T) {
 		tw := NewWriter(new(failOnceWriter))
 		if err := tw.WriteHeader(&Header{}); err != io.ErrShortWrite {
@@ -676,6 +882,256 @@ func TestWriterErrors(t *testing.T) {
 	})
 }
 
+func TestWriterOmitTrailer(t *testing.T) {
+	vectors := []struct {
+		omitTrailer bool
+		omitPadding bool
+		size        int
+	}{
+		{false, false, 4 * blockSize},
+		{true, false, 2 * blockSize},
+		{false, true, blockSize + 5 + 2*blockSize},
+		{true, true, blockSize + 5},
+	}
+
+	for i, v := range vectors {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.OmitTrailer = v.omitTrailer
+		tw.OmitFinalPadding = v.omitPadding
+		if err := tw.WriteHeader(&Header{Name: "small.txt", Size: 5}); err != nil {
+			t.Fatalf("test %d, WriteHeader() = %v, want nil", i, err)
+		}
+		if _, err := io.WriteString(tw, "Kilts"); err != nil {
+			t.Fatalf("test %d, WriteString() = %v, want nil", i, err)
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("test %d, Close() = %v, want nil", i, err)
+		}
+		if b.Len() != v.size {
+			t.Errorf("test %d, output size = %d, want %d", i, b.Len(), v.size)
+		}
+
+		// The output must still be readable. Omitting the final padding
+		// misaligns the trailer, which must then be treated as short.
+		tr := NewReader(&b)
+		tr.AllowShortTrailer = true
+		if _, err := tr.Next(); err != nil {
+			t.Fatalf("test %d, Next() = %v, want nil", i, err)
+		}
+		if got, err := ioutil.ReadAll(tr); err != nil || string(got) != "Kilts" {
+			t.Errorf("test %d, ReadAll() = (%q, %v), want (%q, nil)", i, got, err, "Kilts")
+		}
+		if _, err := tr.Next(); err != io.EOF {
+			t.Errorf("test %d, Next() = %v, want %v", i, err, io.EOF)
+		}
+	}
+
+	// Close must still validate that the last entry was fully written.
+	tw := NewWriter(new(bytes.Buffer))
+	tw.OmitTrailer, tw.OmitFinalPadding = true, true
+	if err := tw.WriteHeader(&Header{Name: "small.txt", Size: 5}); err != nil {
+		t.Fatalf("WriteHeader() = %v, want nil", err)
+	}
+	if err := tw.Close(); err == nil {
+		t.Fatalf("Close() = %v, want non-nil error", err)
+	}
+}
+
+func TestWriterNumericEncoding(t *testing.T) {
+	vectors := []struct {
+		header *Header
+		enc    NumericEncoding
+		format int   // Expected format of the first block
+		err    error // Expected error from WriteHeader
+	}{{
+		header: &Header{Name: "small.txt", Uid: 1 << 30},
+		enc:    NumericDefault,
+		format: formatPAX,
+	}, {
+		header: &Header{Name: "small.txt", Uid: 1 << 30},
+		enc:    NumericBase256,
+		format: formatGNU,
+	}, {
+		header: &Header{Name: "small.txt", Uid: 1 << 30},
+		enc:    NumericPAX,
+		format: formatPAX,
+	}, {
+		header: &Header{Name: "small.txt", ModTime: time.Unix(-1, 0)},
+		enc:    NumericBase256,
+		format: formatGNU,
+	}, {
+		header: &Header{Name: "small.txt", ModTime: time.Unix(-1, 500)},
+		enc:    NumericBase256,
+		format: formatPAX,
+	}, {
+		header: &Header{Name: "small.txt", Uname: strings.Repeat("u", 33), Uid: 1 << 30},
+		enc:    NumericBase256,
+		format: formatPAX,
+	}, {
+		header: &Header{Name: "small.txt"},
+		enc:    NumericBase256,
+		format: formatUSTAR,
+	}, {
+		header: &Header{Name: "small.txt", Devmajor: -1},
+		enc:    NumericDefault,
+		format: formatGNU,
+	}, {
+		header: &Header{Name: "small.txt", Devmajor: -1},
+		enc:    NumericPAX,
+		err:    ErrHeader,
+	}}
+
+	for i, v := range vectors {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.NumericEncoding = v.enc
+		if err := tw.WriteHeader(v.header); err != v.err {
+			t.Fatalf("test %d, WriteHeader() = %v, want %v", i, err, v.err)
+		}
+		if v.err != nil {
+			continue
+		}
+
+		var blk block
+		copy(blk[:], b.Bytes())
+		format := blk.GetFormat()
+		if blk.V7().TypeFlag()[0] == TypeXHeader {
+			format = formatPAX
+		}
+		if format != v.format {
+			t.Errorf("test %d, got format %d, want %d", i, format, v.format)
+		}
+	}
+}
+
+func TestWriterTimePrecision(t *testing.T) {
+	mtime := time.Unix(1350244992, 23960108)
+	vectors := []struct {
+		header    *Header
+		precision TimePrecision
+		format    int       // Expected format of the first block
+		modTime   time.Time // Expected ModTime when read back
+		err       error     // Expected error from WriteHeader
+	}{{
+		header:    &Header{Name: "small.txt", ModTime: mtime},
+		precision: TimeDefault,
+		format:    formatPAX,
+		modTime:   mtime,
+	}, {
+		header:    &Header{Name: "small.txt", ModTime: mtime},
+		precision: TimeSeconds,
+		format:    formatUSTAR,
+		modTime:   time.Unix(1350244992, 0),
+	}, {
+		header:    &Header{Name: "small.txt", ModTime: time.Unix(-1, 500)},
+		precision: TimeSeconds,
+		format:    formatPAX,
+		modTime:   time.Unix(-1, 0),
+	}, {
+		header:    &Header{Name: "small.txt", ModTime: time.Unix(1350244992, 0)},
+		precision: TimePAX,
+		format:    formatPAX,
+		modTime:   time.Unix(1350244992, 0),
+	}, {
+		header:    &Header{Name: "small.txt"},
+		precision: TimePAX,
+		format:    formatUSTAR,
+		modTime:   time.Unix(0, 0),
+	}, {
+		header:    &Header{Name: "small.txt", ModTime: mtime, Devmajor: -1},
+		precision: TimePAX,
+		err:       ErrHeader,
+	}}
+
+	for i, v := range vectors {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.TimePrecision = v.precision
+		if err := tw.WriteHeader(v.header); err != v.err {
+			t.Fatalf("test %d, WriteHeader() = %v, want %v", i, err, v.err)
+		}
+		if v.err != nil {
+			continue
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("test %d, Close() = %v, want nil", i, err)
+		}
+
+		var blk block
+		copy(blk[:], b.Bytes())
+		format := blk.GetFormat()
+		if blk.V7().TypeFlag()[0] == TypeXHeader {
+			format = formatPAX
+		}
+		if format != v.format {
+			t.Errorf("test %d, got format %d, want %d", i, format, v.format)
+		}
+
+		hdr, err := NewReader(&b).Next()
+		if err != nil {
+			t.Fatalf("test %d, Next() = %v, want nil", i, err)
+		}
+		if !hdr.ModTime.Equal(v.modTime) {
+			t.Errorf("test %d, ModTime = %v, want %v", i, hdr.ModTime, v.modTime)
+		}
+	}
+}
+
+func TestWriterHeaderHooks(t *testing.T) {
+	errPolicy := errors.New("policy violation")
+	var calls []string
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.HeaderHooks = []func(*Header) error{
+		func(h *Header) error {
+			calls = append(calls, "first:"+h.Name)
+			if strings.HasPrefix(h.Name, "/") {
+				return errPolicy
+			}
+			h.Uname, h.Gname = "", ""
+			h.Xattrs["hook"] = "set"
+			return nil
+		},
+		func(h *Header) error {
+			calls = append(calls, "second:"+h.Name)
+			h.Name = "prefix/" + h.Name
+			return nil
+		},
+	}
+
+	hdr := &Header{Name: "file.txt", Uname: "gopher", Gname: "gophers", Xattrs: map[string]string{}}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader() = %v, want nil", err)
+	}
+	if hdr.Name != "file.txt" || hdr.Uname != "gopher" || len(hdr.Xattrs) != 0 {
+		t.Errorf("hooks modified the caller's header: %+v", *hdr)
+	}
+	if err := tw.WriteHeader(&Header{Name: "/etc/passwd"}); err != errPolicy {
+		t.Fatalf("WriteHeader() = %v, want %v", err, errPolicy)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v, want nil", err)
+	}
+
+	wantCalls := []string{"first:file.txt", "second:file.txt", "first:/etc/passwd"}
+	if !reflect.DeepEqual(calls, wantCalls) {
+		t.Errorf("hook calls = %q, want %q", calls, wantCalls)
+	}
+
+	tr := NewReader(&b)
+	got, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v, want nil", err)
+	}
+	if got.Name != "prefix/file.txt" || got.Uname != "" || got.Gname != "" || got.Xattrs["hook"] != "set" {
+		t.Errorf("unexpected header: %+v", *got)
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want %v", err, io.EOF)
+	}
+}
+
 func TestSplitUSTARPath(t *testing.T) {
 	sr := strings.Repeat
 
@@ -749,6 +1205,7 @@ func TestIssue12594(t *testing.T) {
 		}
 
 		tr := NewReader(&b)
+		tr.AllowInsecurePaths = true // Some of the names are absolute
 		hdr, err := tr.Next()
 		if err != nil {
 			t.Errorf("test %d, unexpected Next error: %v", i, err)
@@ -758,3 +1215,1318 @@ func TestIssue12594(t *testing.T) {
 		}
 	}
 }
+
+func TestWriterWritten(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	check := func(wantTotal, wantEntry int64) {
+		t.Helper()
+		if got := tw.Written(); got != wantTotal || got != int64(b.Len()) {
+			t.Errorf("Written() = %d, want %d", got, wantTotal)
+		}
+		if got := tw.EntryWritten(); got != wantEntry {
+			t.Errorf("EntryWritten() = %d, want %d", got, wantEntry)
+		}
+	}
+
+	check(0, 0)
+	if err := tw.WriteHeader(&Header{Name: "small.txt", Size: 5}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	check(blockSize, blockSize)
+	if _, err := io.WriteString(tw, "Kil"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	check(blockSize+3, blockSize+3)
+	if _, err := io.WriteString(tw, "ts"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	check(2*blockSize, 2*blockSize)
+
+	// The extended header counts towards the entry.
+	if err := tw.WriteHeader(&Header{Name: "文件", Size: 1}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	check(5*blockSize, 3*blockSize)
+	if _, err := io.WriteString(tw, "x"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	check(5*blockSize+1, 3*blockSize+1)
+
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	check(8*blockSize, 0)
+}
+
+func TestWriteSparseHeader(t *testing.T) {
+	vectors := []struct {
+		name string
+		size int64
+		sp   []SparseEntry
+		data string // Contents of the data fragments
+		want string // Expanded contents of the file
+	}{
+		{"sparse.db", 10, []SparseEntry{{2, 3}, {7, 1}}, "abcd", "\x00\x00abc\x00\x00d\x00\x00"},
+		{"dir/holes", 5, nil, "", "\x00\x00\x00\x00\x00"},
+		{"full", 3, []SparseEntry{{0, 3}}, "abc", "abc"},
+		{strings.Repeat("d/", 60) + "文件", 1 << 20, []SparseEntry{{1 << 19, 1}}, "x",
+			strings.Repeat("\x00", 1<<19) + "x" + strings.Repeat("\x00", 1<<19-1)},
+	}
+
+	for i, v := range vectors {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		hdr := &Header{Name: v.name, Typeflag: TypeReg, Size: v.size, Mode: 0644}
+		if err := tw.WriteSparseHeader(hdr, v.sp); err != nil {
+			t.Errorf("test %d, WriteSparseHeader() = %v, want nil", i, err)
+			continue
+		}
+		if _, err := io.WriteString(tw, v.data); err != nil {
+			t.Errorf("test %d, WriteString() = %v, want nil", i, err)
+			continue
+		}
+		if err := tw.WriteHeader(&Header{Name: "next", Typeflag: TypeReg}); err != nil {
+			t.Errorf("test %d, WriteHeader() = %v, want nil", i, err)
+			continue
+		}
+		if err := tw.Close(); err != nil {
+			t.Errorf("test %d, Close() = %v, want nil", i, err)
+			continue
+		}
+
+		tr := NewReader(&b)
+		got, err := tr.Next()
+		if err != nil {
+			t.Errorf("test %d, Next() = %v, want nil", i, err)
+			continue
+		}
+		if got.Name != v.name || got.Size != v.size || got.Mode != 0644 {
+			t.Errorf("test %d, Next() = (%q, %d, %o), want (%q, %d, %o)", i, got.Name, got.Size, got.Mode, v.name, v.size, 0644)
+		}
+		data, err := ioutil.ReadAll(tr)
+		if err != nil || string(data) != v.want {
+			t.Errorf("test %d, ReadAll() = (%q, %v), want (%q, nil)", i, data, err, v.want)
+		}
+		if got, err := tr.Next(); err != nil || got.Name != "next" {
+			t.Errorf("test %d, Next() = (%v, %v), want next entry", i, got, err)
+		}
+	}
+
+	// Invalid sparse maps and headers.
+	invalid := []struct {
+		hdr *Header
+		sp  []SparseEntry
+	}{
+		{&Header{Name: "f", Typeflag: TypeReg, Size: 10}, []SparseEntry{{8, 3}}},
+		{&Header{Name: "f", Typeflag: TypeReg, Size: 10}, []SparseEntry{{4, 2}, {3, 1}}},
+		{&Header{Name: "f", Typeflag: TypeReg, Size: 10}, []SparseEntry{{-1, 2}}},
+		{&Header{Name: "f", Typeflag: TypeSymlink}, nil},
+	}
+	for i, v := range invalid {
+		tw := NewWriter(new(bytes.Buffer))
+		if err := tw.WriteSparseHeader(v.hdr, v.sp); err != ErrHeader {
+			t.Errorf("invalid test %d, WriteSparseHeader() = %v, want %v", i, err, ErrHeader)
+		}
+	}
+
+	// Writing more than the data fragments fails.
+	tw := NewWriter(new(bytes.Buffer))
+	if err := tw.WriteSparseHeader(&Header{Name: "f", Typeflag: TypeReg, Size: 10}, []SparseEntry{{0, 2}}); err != nil {
+		t.Fatalf("WriteSparseHeader() = %v, want nil", err)
+	}
+	if _, err := io.WriteString(tw, "abc"); err != ErrWriteTooLong {
+		t.Errorf("WriteString() = %v, want %v", err, ErrWriteTooLong)
+	}
+}
+
+func TestWriteRawHeader(t *testing.T) {
+	// Create an archive with a vendor-specific entry that has
+	// non-standard data in the unused portion of its header.
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "vendor", Typeflag: 'Z', Size: 5}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "Kilts"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "文件", Typeflag: TypeReg, Size: 1}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "x"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	var blk block
+	copy(blk[:], b.Bytes())
+	copy(blk[500:], "vendor")
+	blk.SetFormat(formatUSTAR)
+	input := append(blk[:], b.Bytes()[blockSize:]...)
+
+	// Copy the vendor entry verbatim and re-encode the other entry.
+	var out bytes.Buffer
+	tr := NewReader(bytes.NewReader(input))
+	tw = NewWriter(&out)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if hdr.Typeflag == 'Z' {
+			err = tw.WriteRawHeader(tr.RawHeader())
+		} else {
+			err = tw.WriteHeader(hdr)
+		}
+		if err != nil {
+			t.Fatalf("write header for %q: %v", hdr.Name, err)
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			t.Fatalf("Copy() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if !bytes.Equal(out.Bytes(), input) {
+		t.Errorf("output differs from input")
+	}
+	if got := tr.RawHeader(); got != nil {
+		t.Errorf("RawHeader() = %q, want nil", got)
+	}
+
+	// Invalid raw headers.
+	tw = NewWriter(new(bytes.Buffer))
+	for _, raw := range [][]byte{nil, blk[:100], zeroBlock[:]} {
+		if err := tw.WriteRawHeader(raw); err != ErrHeader {
+			t.Errorf("WriteRawHeader() = %v, want %v", err, ErrHeader)
+		}
+	}
+}
+
+func TestWriterMultiVolume(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	hdr := &Header{Name: "disk.img", Typeflag: TypeGNUMultiVolume, Size: 5, VolumeOffset: 1 << 40, Mode: 0644}
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := io.WriteString(tw, "Kilts"); err != nil {
+		t.Fatalf("WriteString() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(&b)
+	got, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if got.Typeflag != hdr.Typeflag || got.Name != hdr.Name || got.Size != hdr.Size || got.VolumeOffset != hdr.VolumeOffset {
+		t.Errorf("Next() = %+v, want %+v", got, hdr)
+	}
+	if data, err := ioutil.ReadAll(tr); err != nil || string(data) != "Kilts" {
+		t.Errorf("ReadAll() = (%q, %v), want (%q, nil)", data, err, "Kilts")
+	}
+
+	// Only the GNU format can represent continuation entries.
+	tw = NewWriter(new(bytes.Buffer))
+	tw.NumericEncoding = NumericPAX
+	if err := tw.WriteHeader(hdr); err != ErrHeader {
+		t.Errorf("WriteHeader() = %v, want %v", err, ErrHeader)
+	}
+}
+
+// countWriter counts the number of calls to Write.
+type countWriter struct {
+	w io.Writer
+	n int
+}
+
+func (cw *countWriter) Write(b []byte) (int, error) {
+	cw.n++
+	return cw.w.Write(b)
+}
+
+func TestWriterBuffer(t *testing.T) {
+	write := func(bufSize int) ([]byte, int) {
+		var b bytes.Buffer
+		cw := &countWriter{w: &b}
+		tw := NewWriter(cw)
+		tw.WriteBufferSize = bufSize
+		for i := 0; i < 100; i++ {
+			if err := tw.WriteHeader(&Header{Name: "file" + strconv.Itoa(i), Typeflag: TypeReg, Size: 3}); err != nil {
+				t.Fatalf("WriteHeader() = %v", err)
+			}
+			if _, err := io.WriteString(tw, "abc"); err != nil {
+				t.Fatalf("WriteString() = %v", err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+		if got, want := tw.Written(), int64(b.Len()); got != want {
+			t.Errorf("Written() = %d, want %d", got, want)
+		}
+		return b.Bytes(), cw.n
+	}
+
+	want, unbuffered := write(0)
+	got, buffered := write(64 << 10)
+	if !bytes.Equal(got, want) {
+		t.Errorf("buffered output differs from unbuffered output")
+	}
+	if buffered >= unbuffered/10 {
+		t.Errorf("got %d writes with buffering, want far fewer than %d", buffered, unbuffered)
+	}
+}
+
+func TestWriterBinaryNames(t *testing.T) {
+	hdr := &Header{Name: "legacy/caf\xe9", Linkname: "target", Typeflag: TypeSymlink, ModTime: time.Unix(0, 0)}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(hdr); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if !bytes.Contains(b.Bytes(), []byte("hdrcharset=BINARY\n")) {
+		t.Errorf("archive does not contain a hdrcharset=BINARY record")
+	}
+
+	tr := NewReader(&b)
+	got, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if got.Name != hdr.Name {
+		t.Errorf("Name = %q, want %q", got.Name, hdr.Name)
+	}
+	if got.PAXRecords[paxHdrCharset] != "BINARY" {
+		t.Errorf("PAXRecords = %v, want hdrcharset record", got.PAXRecords)
+	}
+}
+
+func TestWriterLibarchiveXattrs(t *testing.T) {
+	xattrs := map[string]string{
+		"user.text":    "value",
+		"user.binary":  "\xff\xfe\x00\x01",
+		"user.a=b":     "equals",
+		"user.nul\x00": "nul",
+	}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Xattrs: xattrs}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	for _, rec := range []string{"LIBARCHIVE.xattr.user.a%3Db=ZXF1YWxz\n", "LIBARCHIVE.xattr.user.nul%00=bnVs\n", "SCHILY.xattr.user.binary=\xff\xfe\x00\x01\n"} {
+		if !bytes.Contains(b.Bytes(), []byte(rec)) {
+			t.Errorf("archive does not contain record %q", rec)
+		}
+	}
+	if bytes.Contains(b.Bytes(), []byte("LIBARCHIVE.xattr.user.text")) {
+		t.Errorf("archive contains LIBARCHIVE record for text attribute")
+	}
+
+	tr := NewReader(&b)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if !reflect.DeepEqual(hdr.Xattrs, xattrs) {
+		t.Errorf("Xattrs = %q, want %q", hdr.Xattrs, xattrs)
+	}
+
+	// Records written by bsdtar, which pads base64 values, take precedence.
+	hdr = &Header{Name: "file", Typeflag: TypeReg, PAXRecords: map[string]string{
+		"SCHILY.xattr.user.k":     "truncated",
+		"LIBARCHIVE.xattr.user.k": "dmFsdWU=",
+	}}
+	if err := mergePAX(hdr, hdr.PAXRecords); err != nil {
+		t.Fatalf("mergePAX() = %v", err)
+	}
+	if got := hdr.Xattrs["user.k"]; got != "value" {
+		t.Errorf("Xattrs[%q] = %q, want %q", "user.k", got, "value")
+	}
+}
+
+func TestWriterCopyEntry(t *testing.T) {
+	for _, file := range []string{
+		"testdata/sparse-formats.tar",
+		"testdata/gnu-multi-hdrs.tar",
+		"testdata/pax-multi-hdrs.tar",
+		"testdata/pax-path-hdr.tar",
+		"testdata/xattrs.tar",
+		"testdata/gnu-incremental.tar",
+	} {
+		input, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("ReadFile(%q) = %v", file, err)
+		}
+		tr := NewReader(bytes.NewReader(input))
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		for {
+			if _, err := tr.Next(); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Fatalf("%s: Next() = %v", file, err)
+			}
+			if err := tw.CopyEntry(tr); err != nil {
+				t.Fatalf("%s: CopyEntry() = %v", file, err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("%s: Close() = %v", file, err)
+		}
+		n := b.Len() - 2*blockSize
+		if n > len(input) || !bytes.Equal(b.Bytes()[:n], input[:n]) {
+			t.Errorf("%s: copied entries differ from input", file)
+		}
+	}
+
+	// Entries whose data has been read cannot be copied.
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.CopyEntry(NewReader(&b)); err == nil {
+		t.Errorf("CopyEntry() without entry succeeded")
+	}
+	tw.WriteHeader(&Header{Name: "file", Typeflag: TypeReg, Size: 4})
+	io.WriteString(tw, "data")
+	tw.Close()
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	tr.Read(make([]byte, 1))
+	if err := NewWriter(ioutil.Discard).CopyEntry(tr); err == nil {
+		t.Errorf("CopyEntry() after Read succeeded")
+	}
+}
+
+func TestWriterAlwaysPAX(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	hdrs := []*Header{
+		{Name: "file", Typeflag: TypeReg, Mode: 0644, Uid: 1000, Gid: 100, Uname: "gopher", ModTime: mtime},
+		{Name: "link", Typeflag: TypeSymlink, Linkname: "file", ModTime: mtime, AccessTime: mtime.Add(time.Second)},
+	}
+	want := []map[string]string{
+		{"path": "file", "uid": "1000", "gid": "100", "uname": "gopher", "mtime": "1500000000"},
+		{"path": "link", "uid": "0", "gid": "0", "linkpath": "file", "mtime": "1500000000", "atime": "1500000001"},
+	}
+
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.AlwaysPAX = true
+	for _, hdr := range hdrs {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(&b)
+	for i, hdr := range hdrs {
+		got, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if !reflect.DeepEqual(got.PAXRecords, want[i]) {
+			t.Errorf("%s: PAXRecords = %v, want %v", hdr.Name, got.PAXRecords, want[i])
+		}
+		if got.Name != hdr.Name || got.Linkname != hdr.Linkname || !got.ModTime.Equal(hdr.ModTime) {
+			t.Errorf("Next() = %+v, want %+v", got, hdr)
+		}
+	}
+}
+
+func TestWriterWriteFile(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteFile(&Header{Name: "dir/", Typeflag: TypeDir}, nil); err != nil {
+		t.Errorf("WriteFile(dir) = %v", err)
+	}
+	if err := tw.WriteFile(&Header{Name: "file", Typeflag: TypeReg, Size: 5}, strings.NewReader("Kilts")); err != nil {
+		t.Errorf("WriteFile(file) = %v", err)
+	}
+	err := tw.WriteFile(&Header{Name: "long", Typeflag: TypeReg, Size: 3}, strings.NewReader("Kilts"))
+	if want := `archive/tar: entry "long": data is longer than 3 bytes`; err == nil || err.Error() != want {
+		t.Errorf("WriteFile(long) = %v, want %s", err, want)
+	}
+	err = tw.WriteFile(&Header{Name: "short", Typeflag: TypeReg, Size: 10}, strings.NewReader("Kilts"))
+	if want := `archive/tar: entry "short": read 5 of 10 bytes`; err == nil || err.Error() != want {
+		t.Errorf("WriteFile(short) = %v, want %s", err, want)
+	}
+	tw.PadShortEntries = true
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	tr := NewReader(&b)
+	for _, want := range []string{"", "Kilts", "Kil", "Kilts\x00\x00\x00\x00\x00"} {
+		if _, err := tr.Next(); err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if got, err := ioutil.ReadAll(tr); err != nil || string(got) != want {
+			t.Errorf("ReadAll() = (%q, %v), want %q", got, err, want)
+		}
+	}
+}
+
+func TestWriterDeferredHeader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tar-spool")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	data := []string{"", "small", strings.Repeat("large", 100)}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.SpoolSize = 100
+	tw.SpoolDir = dir
+	for i, d := range data {
+		if err := tw.WriteDeferredHeader(&Header{Name: strconv.Itoa(i), Typeflag: TypeReg, Size: 1}); err != nil {
+			t.Fatalf("WriteDeferredHeader() = %v", err)
+		}
+		for j := 0; j < len(d); j += 7 {
+			end := j + 7
+			if end > len(d) {
+				end = len(d)
+			}
+			if _, err := io.WriteString(tw, d[j:end]); err != nil {
+				t.Fatalf("WriteString() = %v", err)
+			}
+		}
+		if spilled := tw.spl.f != nil; spilled != (len(d) > 100) {
+			t.Errorf("entry %d: spilled to a file = %v, want %v", i, spilled, !spilled)
+		}
+	}
+	if err := tw.WriteDeferredHeader(&Header{Name: "dir/", Typeflag: TypeDir}); err != ErrHeader {
+		t.Errorf("WriteDeferredHeader(dir) = %v, want %v", err, ErrHeader)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if names, _ := ioutil.ReadDir(dir); len(names) != 0 {
+		t.Errorf("%d temporary files remain", len(names))
+	}
+
+	tr := NewReader(&b)
+	for i, want := range data {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if hdr.Name != strconv.Itoa(i) || hdr.Size != int64(len(want)) {
+			t.Errorf("Next() = (%q, %d), want (%q, %d)", hdr.Name, hdr.Size, strconv.Itoa(i), len(want))
+		}
+		if got, err := ioutil.ReadAll(tr); err != nil || string(got) != want {
+			t.Errorf("ReadAll() = (%q, %v), want %q", got, err, want)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want io.EOF", err)
+	}
+}
+
+func TestWriterTypedEntries(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	if err := tw.WriteDir("dir", mtime); err != nil {
+		t.Fatalf("WriteDir() = %v", err)
+	}
+	if err := tw.WriteSymlink("dir/link", "../target", mtime); err != nil {
+		t.Fatalf("WriteSymlink() = %v", err)
+	}
+	if err := tw.WriteDevice("dev/null", TypeChar, 1, 3, mtime); err != nil {
+		t.Fatalf("WriteDevice() = %v", err)
+	}
+	if err := tw.WriteDevice("dev/bad", TypeReg, 1, 3, mtime); err != ErrHeader {
+		t.Errorf("WriteDevice(TypeReg) = %v, want %v", err, ErrHeader)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	want := []*Header{
+		{Name: "dir/", Typeflag: TypeDir, Mode: 0755},
+		{Name: "dir/link", Typeflag: TypeSymlink, Linkname: "../target", Mode: 0777},
+		{Name: "dev/null", Typeflag: TypeChar, Devmajor: 1, Devminor: 3, Mode: 0600},
+	}
+	tr := NewReader(&b)
+	for _, w := range want {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if hdr.Name != w.Name || hdr.Typeflag != w.Typeflag || hdr.Linkname != w.Linkname || hdr.Mode != w.Mode ||
+			hdr.Devmajor != w.Devmajor || hdr.Devminor != w.Devminor || hdr.Size != 0 || !hdr.ModTime.Equal(mtime) {
+			t.Errorf("Next() = %+v, want %+v", hdr, w)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want io.EOF", err)
+	}
+}
+
+func TestWriterContentTransform(t *testing.T) {
+	data := []string{"", "small", strings.Repeat("large", 100)}
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.ContentTransform = func(hdr *Header, w io.Writer) io.WriteCloser {
+		if hdr.Name == "plain" {
+			return nil
+		}
+		hdr.PAXRecords = map[string]string{"GO.test.encoding": "gzip"}
+		return gzip.NewWriter(w)
+	}
+	for i, d := range data {
+		if err := tw.WriteFile(&Header{Name: strconv.Itoa(i), Typeflag: TypeReg, Size: int64(len(d))}, strings.NewReader(d)); err != nil {
+			t.Fatalf("WriteFile() = %v", err)
+		}
+	}
+	if err := tw.WriteFile(&Header{Name: "plain", Typeflag: TypeReg, Size: 5}, strings.NewReader("plain")); err != nil {
+		t.Fatalf("WriteFile(plain) = %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "long", Typeflag: TypeReg, Size: 5}); err != nil {
+		t.Fatalf("WriteHeader(long) = %v", err)
+	}
+	if _, err := tw.Write([]byte("toolong")); err != ErrWriteTooLong {
+		t.Errorf("Write() = %v, want %v", err, ErrWriteTooLong)
+	}
+	tw.PadShortEntries = true
+	if err := tw.WriteHeader(&Header{Name: "padded", Typeflag: TypeReg, Size: 5}); err != nil {
+		t.Fatalf("WriteHeader(padded) = %v", err)
+	}
+	if err := tw.WriteHeader(&Header{Name: "dir/", Typeflag: TypeDir}); err != nil {
+		t.Fatalf("WriteHeader(dir) = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	want := append(data, "plain", "toolo", "\x00\x00\x00\x00\x00", "")
+	tr := NewReader(bytes.NewReader(b.Bytes()))
+	tr.ContentTransform = func(hdr *Header, r io.Reader) io.Reader {
+		if hdr.PAXRecords["GO.test.encoding"] != "gzip" {
+			return r
+		}
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			t.Errorf("entry %q: gzip.NewReader() = %v", hdr.Name, err)
+			return r
+		}
+		return zr
+	}
+	for _, w := range want {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if hdr.PAXRecords["GO.test.encoding"] == "gzip" && hdr.Size == int64(len(w)) {
+			t.Errorf("entry %q: Size = %d, want the size of the compressed data", hdr.Name, hdr.Size)
+		}
+		if got, err := ioutil.ReadAll(tr); err != nil || string(got) != w {
+			t.Errorf("entry %q: ReadAll() = (%q, %v), want %q", hdr.Name, got, err, w)
+		}
+	}
+	if _, err := tr.Next(); err != io.EOF {
+		t.Errorf("Next() = %v, want io.EOF", err)
+	}
+}
+
+type syncBuffer struct {
+	bytes.Buffer
+	syncs []int // lengths of the buffer when Sync was called
+}
+
+func (b *syncBuffer) Sync() error {
+	b.syncs = append(b.syncs, b.Len())
+	return nil
+}
+
+func TestWriterSync(t *testing.T) {
+	var b syncBuffer
+	tw := NewWriter(&b)
+	tw.WriteBufferSize = 4096
+	tw.SyncEntries = true
+	var marks []string
+	tw.EntryFlushed = func(name string, written int64) error {
+		marks = append(marks, name+"@"+strconv.FormatInt(written, 10))
+		if int64(b.Len()) != written {
+			t.Errorf("entry %q: %d bytes written through, want %d", name, b.Len(), written)
+		}
+		return nil
+	}
+	long := strings.Repeat("long", 30)
+	for _, hdr := range []*Header{
+		{Name: "file", Typeflag: TypeReg, Size: 1},
+		{Name: long, Typeflag: TypeReg, Size: 1},
+		{Name: "dir/", Typeflag: TypeDir},
+	} {
+		if err := tw.WriteFile(hdr, strings.NewReader(strings.Repeat("x", int(hdr.Size)))); err != nil {
+			t.Fatalf("WriteFile() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	wantMarks := []string{"file@1024", long + "@3072", "dir/@3584"}
+	if !reflect.DeepEqual(marks, wantMarks) {
+		t.Errorf("EntryFlushed calls = %q, want %q", marks, wantMarks)
+	}
+	if want := []int{1024, 3072, 3584, 4608}; !reflect.DeepEqual(b.syncs, want) {
+		t.Errorf("Sync calls at %v, want %v", b.syncs, want)
+	}
+
+	b = syncBuffer{}
+	tw = NewWriter(&b)
+	tw.SyncBytes = 2048
+	if err := tw.WriteFile(&Header{Name: "big", Typeflag: TypeReg, Size: 5000}, strings.NewReader(strings.Repeat("x", 5000))); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if want := []int{5512, 6656}; !reflect.DeepEqual(b.syncs, want) {
+		t.Errorf("Sync calls at %v, want %v", b.syncs, want)
+	}
+}
+
+func TestWriterGNUTimes(t *testing.T) {
+	atime, ctime := time.Unix(1500000001, 0), time.Unix(1500000002, 0)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.NumericEncoding = NumericBase256
+	for _, hdr := range []*Header{
+		{Name: "times", Typeflag: TypeReg, Uid: 1 << 30, AccessTime: atime, ChangeTime: ctime},
+		{Name: "none", Typeflag: TypeReg, Uid: 1 << 30},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader() = %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if got := b.Bytes()[257:265]; string(got) != magicGNU+versionGNU {
+		t.Fatalf("magic = %q, want the old GNU format", got)
+	}
+
+	tr := NewReader(&b)
+	for _, want := range [][2]time.Time{{atime, ctime}, {}} {
+		hdr, err := tr.Next()
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if !hdr.AccessTime.Equal(want[0]) || !hdr.ChangeTime.Equal(want[1]) {
+			t.Errorf("entry %q: times = (%v, %v), want (%v, %v)", hdr.Name, hdr.AccessTime, hdr.ChangeTime, want[0], want[1])
+		}
+	}
+}
+
+func TestWriterPreferUSTARPrefix(t *testing.T) {
+	long := strings.Repeat("dir", 40) + "/file"
+	for _, enc := range []NumericEncoding{NumericDefault, NumericBase256} {
+		for _, prefer := range []bool{false, true} {
+			var b bytes.Buffer
+			tw := NewWriter(&b)
+			tw.NumericEncoding = enc
+			tw.PreferUSTARPrefix = prefer
+			hdr := &Header{Name: long, Typeflag: TypeReg, Mode: 0644, Uid: 1 << 30}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatalf("WriteHeader() = %v", err)
+			}
+			if err := tw.Close(); err != nil {
+				t.Fatalf("Close() = %v", err)
+			}
+
+			tr := NewReader(&b)
+			got, err := tr.Next()
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			if got.Name != long || got.Uid != hdr.Uid {
+				t.Errorf("encoding %d, prefer %v: Next() = (%q, %d), want (%q, %d)", enc, prefer, got.Name, got.Uid, long, hdr.Uid)
+			}
+			_, hasPath := got.PAXRecords[paxPath]
+			var blk block
+			copy(blk[:], tr.RawHeader())
+			var p parser
+			name := p.parseString(blk.USTAR().Prefix()) + "/" + p.parseString(blk.V7().Name())
+			switch {
+			case prefer && (hasPath || got.PAXRecords[paxUid] == "" || name != long):
+				t.Errorf("encoding %d: got path record %v, uid record %q, and USTAR name %q; want PAX without path and split name", enc, hasPath, got.PAXRecords[paxUid], name)
+			case !prefer && name == long:
+				t.Errorf("encoding %d: name is split without the option", enc)
+			}
+		}
+	}
+}
+
+func TestWriterJournal(t *testing.T) {
+	f, err := ioutil.TempFile("", "tar-journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	var journal bytes.Buffer
+	tw := NewWriter(f)
+	tw.Journal = &journal
+	tw.WriteBufferSize = 4 * blockSize
+	for _, name := range []string{"a", "b", "c"} {
+		if err := tw.WriteFile(&Header{Name: name, Typeflag: TypeReg, Size: 3}, strings.NewReader(name+name+name)); err != nil {
+			t.Fatalf("WriteFile(%q) = %v", name, err)
+		}
+	}
+	if err := tw.Flush(); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	// Leave an entry and a journal record incomplete, as after a crash.
+	if err := tw.WriteHeader(&Header{Name: "d", Typeflag: TypeReg, Size: 3}); err != nil {
+		t.Fatalf("WriteHeader() = %v", err)
+	}
+	if _, err := tw.Write([]byte("dd")); err != nil {
+		t.Fatalf("Write() = %v", err)
+	}
+	if err := tw.bw.Flush(); err != nil {
+		t.Fatalf("Flush() = %v", err)
+	}
+	journal.WriteString("6144 \"d")
+
+	rec, err := RecoverArchive(f, &journal)
+	if want := (JournalRecord{Name: "c", Offset: 6 * blockSize}); err != nil || rec != want {
+		t.Fatalf("RecoverArchive() = (%v, %v), want %v", rec, err, want)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	tr := NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		names = append(names, hdr.Name)
+	}
+	if want := []string{"a", "b", "c"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("names = %q, want %q", names, want)
+	}
+	if fi, err := f.Stat(); err != nil || fi.Size() != 8*blockSize {
+		t.Errorf("Stat() = (%v, %v), want size %d", fi, err, 8*blockSize)
+	}
+
+	for _, s := range []string{"1024\n", "x \"a\"\n", "100 \"a\"\n"} {
+		if _, err := ReadJournal(strings.NewReader(s)); err == nil {
+			t.Errorf("ReadJournal(%q) succeeded, want error", s)
+		}
+	}
+	if rec, err := RecoverArchive(f, strings.NewReader("1048576 \"big\"\n")); err == nil {
+		t.Errorf("RecoverArchive() = %v, want error for a short archive", rec)
+	}
+}
+
+func TestWriterEntrySize(t *testing.T) {
+	long := strings.Repeat("long/", 30) + "name"
+	mtime := time.Unix(1500000000, 123456789)
+	hdrs := []*Header{
+		{Name: "dir/", Typeflag: TypeDir, Mode: 0755},
+		{Name: "small", Typeflag: TypeReg, Size: 5, ModTime: mtime},
+		{Name: "block", Typeflag: TypeReg, Size: 2 * blockSize},
+		{Name: long, Typeflag: TypeReg, Size: 1000, Uid: 1 << 30},
+		{Name: "link", Typeflag: TypeSymlink, Linkname: long},
+		{Name: "xattrs", Typeflag: TypeReg, Size: 1, Xattrs: map[string]string{"user.key": "value"}},
+		{Name: "hard", Typeflag: TypeLink, Linkname: "small"},
+	}
+	for _, opts := range []func(*Writer){
+		func(tw *Writer) {},
+		func(tw *Writer) { tw.AlwaysPAX = true },
+		func(tw *Writer) { tw.NumericEncoding = NumericBase256 },
+		func(tw *Writer) { tw.TimePrecision = TimePAX; tw.PreferUSTARPrefix = true },
+		func(tw *Writer) {
+			tw.HeaderHooks = []func(*Header) error{func(h *Header) error { h.Uname = "gopher"; return nil }}
+		},
+		func(tw *Writer) { tw.CheckLinks = true },
+	} {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		opts(tw)
+		for _, hdr := range hdrs {
+			want, err := tw.EntrySize(hdr)
+			if err != nil {
+				t.Fatalf("EntrySize(%q) = %v", hdr.Name, err)
+			}
+			off := tw.Written()
+			if err := tw.WriteFile(hdr, strings.NewReader(strings.Repeat("x", int(hdr.Size)))); err != nil {
+				t.Fatalf("WriteFile(%q) = %v", hdr.Name, err)
+			}
+			if err := tw.Flush(); err != nil {
+				t.Fatalf("Flush() = %v", err)
+			}
+			if got := tw.Written() - off; got != want {
+				t.Errorf("EntrySize(%q) = %d, want %d", hdr.Name, want, got)
+			}
+		}
+		if _, err := tw.EntrySize(&Header{Name: "bad", Typeflag: TypeReg, Size: -1}); err == nil {
+			t.Error("EntrySize with a negative size succeeded")
+		}
+
+		// EntrySize reports the errors of CheckLinks, without recording
+		// the names of the entries that it encodes.
+		if _, err := tw.EntrySize(&Header{Name: "unwritten", Typeflag: TypeReg}); err != nil {
+			t.Fatalf("EntrySize(%q) = %v", "unwritten", err)
+		}
+		_, err := tw.EntrySize(&Header{Name: "hard2", Typeflag: TypeLink, Linkname: "unwritten"})
+		if _, ok := err.(*LinkError); ok != tw.CheckLinks {
+			t.Errorf("EntrySize of a link to an unwritten file = %v, want a *LinkError: %v", err, tw.CheckLinks)
+		}
+	}
+}
+
+func TestWriterBackfillHeaders(t *testing.T) {
+	f, err := ioutil.TempFile("", "tar-backfill")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	const junk = "leading junk"
+	if _, err := f.WriteString(junk); err != nil {
+		t.Fatal(err)
+	}
+
+	data := []string{"", "small", strings.Repeat("large", 1000)}
+	write := func(w io.Writer) {
+		tw := NewWriter(w)
+		tw.BackfillHeaders = true
+		tw.WriteBufferSize = 2 * blockSize
+		for i, d := range data {
+			hdr := &Header{Name: strings.Repeat("long", 30) + strconv.Itoa(i), Typeflag: TypeReg, ModTime: time.Unix(0, 1)}
+			if err := tw.WriteDeferredHeader(hdr); err != nil {
+				t.Fatalf("WriteDeferredHeader() = %v", err)
+			}
+			if tw.spl != nil {
+				if _, ok := w.(io.WriteSeeker); ok {
+					t.Errorf("entry %d is spooled", i)
+				}
+			}
+			for j := 0; j < len(d); j += 300 {
+				end := j + 300
+				if end > len(d) {
+					end = len(d)
+				}
+				if _, err := io.WriteString(tw, d[j:end]); err != nil {
+					t.Fatalf("WriteString() = %v", err)
+				}
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+	}
+
+	// The archive must be the same as the one written with spooling.
+	var want bytes.Buffer
+	write(struct{ io.Writer }{&want})
+	write(f)
+	got, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(got), junk) || !bytes.Equal(got[len(junk):], want.Bytes()) {
+		t.Errorf("backfilled archive differs from spooled archive\n%s", bytediff(got[len(junk):], want.Bytes()))
+	}
+}
+
+// countLimiter is a Limiter that counts the bytes that it allows,
+// failing once more than max bytes have been allowed.
+type countLimiter struct {
+	n, max int
+}
+
+func (l *countLimiter) WaitN(n int) error {
+	if l.n += n; l.max > 0 && l.n > l.max {
+		return errors.New("limit exceeded")
+	}
+	return nil
+}
+
+func TestLimiter(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	wl := new(countLimiter)
+	tw.Limiter, tw.WriteBufferSize = wl, 4096
+	for _, name := range []string{"a", strings.Repeat("b", 200)} {
+		if err := tw.WriteFile(&Header{Name: name, Mode: 0644, Size: 1000}, bytes.NewReader(make([]byte, 1000))); err != nil {
+			t.Fatalf("WriteFile(%q) = %v", name, err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	if wl.n != b.Len() {
+		t.Errorf("Writer.Limiter allowed %d bytes, want %d", wl.n, b.Len())
+	}
+
+	// Data that is skipped over by seeking is not counted.
+	archive := b.Bytes()
+	for _, readData := range []bool{true, false} {
+		tr := NewReader(bytes.NewReader(archive))
+		rl := new(countLimiter)
+		tr.Limiter = rl
+		var skipped int
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("Next() = %v", err)
+			}
+			if readData {
+				if _, err := io.Copy(ioutil.Discard, tr); err != nil {
+					t.Fatalf("Copy() = %v", err)
+				}
+			} else {
+				skipped += int(hdr.Size) - 1 // The last byte is read
+			}
+		}
+		if want := len(archive) - skipped; rl.n != want {
+			t.Errorf("readData %v: Reader.Limiter allowed %d bytes, want %d", readData, rl.n, want)
+		}
+	}
+
+	// Errors from the Limiter are reported.
+	tw = NewWriter(ioutil.Discard)
+	tw.Limiter = &countLimiter{max: 1000}
+	if err := tw.WriteFile(&Header{Name: "a", Size: 1000}, bytes.NewReader(make([]byte, 1000))); err == nil {
+		t.Error("WriteFile() beyond the limit = nil, want error")
+	}
+	tr := NewReader(bytes.NewReader(archive))
+	tr.Limiter = &countLimiter{max: 1000}
+	if _, err := tr.Next(); err != nil {
+		t.Fatalf("Next() = %v", err)
+	}
+	if _, err := io.Copy(ioutil.Discard, tr); err == nil {
+		t.Error("Copy() beyond the limit = nil, want error")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	const rate = 1 << 20
+	l := NewRateLimiter(rate)
+	start := time.Now()
+	for i := 0; i < 5; i++ {
+		if err := l.WaitN(rate / 4); err != nil {
+			t.Fatalf("WaitN() = %v", err)
+		}
+	}
+	// The first second's worth is a burst, and the rest takes 0.25s.
+	if d := time.Since(start); d < 200*time.Millisecond {
+		t.Errorf("5/4 of the rate took %v, want at least 250ms", d)
+	}
+}
+
+func TestEditHeader(t *testing.T) {
+	f, err := ioutil.TempFile("", "TestEditHeader")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	long := strings.Repeat("long/", 30) + "file"
+	mtime := time.Unix(1500000000, 0)
+	tw := NewWriter(f)
+	for _, hdr := range []*Header{
+		{Name: "ustar", Mode: 0644, Size: 5, ModTime: mtime},
+		{Name: long, Mode: 0644, Size: 5, ModTime: mtime},
+		{Name: "gnu", Mode: 0644, Size: 5, ModTime: mtime, Uid: 1 << 30},
+	} {
+		tw.NumericEncoding = NumericBase256
+		if err := tw.WriteFile(hdr, strings.NewReader("hello")); err != nil {
+			t.Fatalf("WriteFile(%q) = %v", hdr.Name, err)
+		}
+	}
+	if err := tw.WriteGlobalHeader(map[string]string{"comment": "global"}); err != nil {
+		t.Fatalf("WriteGlobalHeader() = %v", err)
+	}
+	if err := tw.WriteFile(&Header{Name: "after", Mode: 0644, Size: 5, ModTime: mtime}, strings.NewReader("hello")); err != nil {
+		t.Fatalf("WriteFile() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	edits := map[int]func(*Header) error{
+		0: func(hdr *Header) error { hdr.ModTime, hdr.Uid = mtime.Add(time.Hour), 1000; return nil },
+		1: func(hdr *Header) error { hdr.Uname = "someone"; return nil },
+		2: func(hdr *Header) error { hdr.Uid++; return nil },
+		4: func(hdr *Header) error { hdr.Mode = 0600; return nil },
+	}
+	for i, edit := range edits {
+		if err := EditHeader(f, i, edit); err != nil {
+			t.Fatalf("EditHeader(%d) = %v", i, err)
+		}
+	}
+	if fi2, err := f.Stat(); err != nil || fi2.Size() != fi.Size() {
+		t.Fatalf("size after EditHeader = %d, want %d", fi2.Size(), fi.Size())
+	}
+
+	ix, err := NewIndex(f, fi.Size())
+	if err != nil {
+		t.Fatalf("NewIndex() = %v", err)
+	}
+	if ix.Len() != 5 {
+		t.Fatalf("Len() = %d, want 5", ix.Len())
+	}
+	for i := 0; i < ix.Len(); i++ {
+		hdr := ix.Header(i)
+		if hdr.Typeflag == TypeXGlobalHeader {
+			continue
+		}
+		if data, err := ioutil.ReadAll(ix.Open(i)); err != nil || string(data) != "hello" {
+			t.Errorf("%s: data = (%q, %v), want %q", hdr.Name, data, err, "hello")
+		}
+	}
+	for i, check := range map[int]func(*Header) bool{
+		0: func(hdr *Header) bool { return hdr.ModTime.Equal(mtime.Add(time.Hour)) && hdr.Uid == 1000 },
+		1: func(hdr *Header) bool { return hdr.Name == long && hdr.Uname == "someone" },
+		2: func(hdr *Header) bool { return hdr.Uid == 1<<30+1 },
+		4: func(hdr *Header) bool { return hdr.Mode == 0600 && hdr.PAXRecords["comment"] == "global" },
+	} {
+		if hdr := ix.Header(i); !check(hdr) {
+			t.Errorf("Header(%d) = %+v, edit not applied", i, hdr)
+		}
+	}
+
+	// Edits that move the data, and invalid edits, leave f as is.
+	before, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, v := range []struct {
+		i    int
+		edit func(*Header) error
+	}{
+		{0, func(hdr *Header) error { hdr.Name = strings.Repeat("x", 300); return nil }},
+		{0, func(hdr *Header) error { hdr.Size++; return nil }},
+		{0, func(hdr *Header) error { return errors.New("edit failed") }},
+		{3, func(hdr *Header) error { return nil }},
+		{5, func(hdr *Header) error { return nil }},
+	} {
+		if err := EditHeader(f, v.i, v.edit); err == nil {
+			t.Errorf("EditHeader(%d) = nil, want error", v.i)
+		}
+	}
+	if after, err := ioutil.ReadFile(f.Name()); err != nil || !bytes.Equal(after, before) {
+		t.Errorf("archive modified by failed edits")
+	}
+}
+
+func TestWriterDataAlignment(t *testing.T) {
+	for _, align := range []int64{blockSize, 4096, 3 * blockSize} {
+		var b bytes.Buffer
+		tw := NewWriter(&b)
+		tw.DataAlignment = align
+		files := []struct {
+			hdr  *Header
+			data string
+		}{
+			{&Header{Name: "small", Mode: 0644, Size: 5}, "hello"},
+			{&Header{Name: "dir/", Typeflag: TypeDir, Mode: 0755}, ""},
+			{&Header{Name: strings.Repeat("long/", 40), Mode: 0644, Size: 600}, strings.Repeat("x", 600)},
+			{&Header{Name: "records", Mode: 0644, Size: 3, PAXRecords: map[string]string{"comment": strings.Repeat("c", 1000)}}, "abc"},
+			{&Header{Name: "empty", Mode: 0644}, ""},
+			{&Header{Name: "last", Mode: 0644, Size: 1}, "z"},
+		}
+		for _, f := range files {
+			if err := tw.WriteFile(f.hdr, strings.NewReader(f.data)); err != nil {
+				t.Fatalf("WriteFile(%q) = %v", f.hdr.Name, err)
+			}
+		}
+		if err := tw.WriteSparseHeader(&Header{Name: "sparse", Size: 10}, []SparseEntry{{2, 3}}); err != nil {
+			t.Fatalf("WriteSparseHeader() = %v", err)
+		}
+		io.WriteString(tw, "xyz")
+		if err := tw.Close(); err != nil {
+			t.Fatalf("Close() = %v", err)
+		}
+
+		ix, err := NewIndexBytes(b.Bytes())
+		if err != nil {
+			t.Fatalf("NewIndexBytes() = %v", err)
+		}
+		for i := 0; i < ix.Len(); i++ {
+			hdr := ix.Header(i)
+			if off, n := ix.DataRange(i); n > 0 && off%align != 0 && ix.entries[i].sp == nil {
+				t.Errorf("DataAlignment %d: data of %q is at offset %d", align, hdr.Name, off)
+			}
+			if i < len(files) {
+				if hdr.Name != files[i].hdr.Name || hdr.PAXRecords["comment"] != files[i].hdr.PAXRecords["comment"] {
+					t.Errorf("DataAlignment %d: entry %d is %q, want %q", align, i, hdr.Name, files[i].hdr.Name)
+				}
+				if data, err := ioutil.ReadAll(ix.Open(i)); err != nil || string(data) != files[i].data {
+					t.Errorf("DataAlignment %d: data of %q = (%q, %v), want %q", align, hdr.Name, data, err, files[i].data)
+				}
+			}
+		}
+	}
+
+	tw := NewWriter(ioutil.Discard)
+	tw.DataAlignment = 1000
+	if err := tw.WriteHeader(&Header{Name: "file", Size: 1}); err == nil {
+		t.Error("WriteHeader() with a DataAlignment of 1000 = nil, want error")
+	}
+}
+
+func TestWriterParentDirs(t *testing.T) {
+	mtime := time.Unix(1500000000, 0)
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.ParentDirs = &Header{Name: "ignored", Mode: 0750, Uname: "root", Gname: "wheel"}
+	tw.ExplicitFlush = true
+	for _, hdr := range []*Header{
+		{Name: "a/b/c.txt", Typeflag: TypeReg, Mode: 0644, Size: 1, ModTime: mtime},
+		{Name: "a/b/d.txt", Typeflag: TypeReg, Mode: 0644, ModTime: mtime},
+		{Name: "x/", Typeflag: TypeDir, Mode: 0700, ModTime: mtime},
+		{Name: "x//y/", Typeflag: TypeDir, Mode: 0700, ModTime: mtime},
+		{Name: "./r/../s/t", Typeflag: TypeSymlink, Linkname: "u", ModTime: mtime},
+		{Name: "/abs//f", Typeflag: TypeReg, ModTime: mtime},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%q) = %v", hdr.Name, err)
+		}
+		if hdr.Size > 0 {
+			if _, err := tw.Write([]byte("c")); err != nil {
+				t.Fatalf("Write() = %v", err)
+			}
+		}
+		if err := tw.Flush(); err != nil {
+			t.Fatalf("Flush() = %v", err)
+		}
+	}
+	if err := tw.WriteDeferredHeader(&Header{Name: "x/y/z/deferred", Typeflag: TypeReg, ModTime: mtime}); err != nil {
+		t.Fatalf("WriteDeferredHeader() = %v", err)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	type entry struct {
+		name  string
+		mode  int64
+		uname string
+	}
+	want := []entry{
+		{"a/", 0750, "root"},
+		{"a/b/", 0750, "root"},
+		{"a/b/c.txt", 0644, ""},
+		{"a/b/d.txt", 0644, ""},
+		{"x/", 0700, ""},
+		{"x//y/", 0700, ""},
+		{"./r/", 0750, "root"},
+		{"./r/../s/t", 0, ""},
+		{"abs/", 0750, "root"},
+		{"/abs//f", 0, ""},
+		{"x/y/z/", 0750, "root"},
+		{"x/y/z/deferred", 0, ""},
+	}
+	var got []entry
+	tr := NewReader(&b)
+	tr.AllowInsecurePaths = true
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		if hdr.Typeflag == TypeDir && (!hdr.ModTime.Equal(mtime) || hdr.Uname == "root" && hdr.Gname != "wheel") {
+			t.Errorf("directory %q: ModTime = %v, Gname = %q", hdr.Name, hdr.ModTime, hdr.Gname)
+		}
+		got = append(got, entry{hdr.Name, hdr.Mode, hdr.Uname})
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %v, want %v", got, want)
+	}
+}
+
+func TestWriterParentDirsFinalNames(t *testing.T) {
+	var b bytes.Buffer
+	tw := NewWriter(&b)
+	tw.ParentDirs = &Header{}
+	tw.NormalizeNames = func(name string) string { return strings.TrimPrefix(name, "./") }
+	tw.HeaderHooks = []func(*Header) error{func(hdr *Header) error {
+		hdr.Name = "root/" + hdr.Name
+		return nil
+	}}
+	if err := tw.WriteSparseHeader(&Header{Name: "fail/", Typeflag: TypeDir}, []SparseEntry{{0, 1}}); err != ErrHeader {
+		t.Fatalf("WriteSparseHeader(%q) = %v, want %v", "fail/", err, ErrHeader)
+	}
+	for _, name := range []string{"./a/b", "fail/c"} {
+		hdr := &Header{Name: name, Typeflag: TypeReg}
+		size, err := tw.EntrySize(hdr)
+		if err != nil {
+			t.Fatalf("EntrySize(%q) = %v", name, err)
+		}
+		off := tw.Written()
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("WriteHeader(%q) = %v", name, err)
+		}
+		if err := tw.Flush(); err != nil {
+			t.Fatalf("Flush() = %v", err)
+		}
+		if got := tw.Written() - off; got != size {
+			t.Errorf("EntrySize(%q) = %d, but %d bytes were written", name, size, got)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("Close() = %v", err)
+	}
+
+	want := []string{"root/", "root/a/", "root/a/b", "root/fail/", "root/fail/c"}
+	var got []string
+	tr := NewReader(&b)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Next() = %v", err)
+		}
+		got = append(got, hdr.Name)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}